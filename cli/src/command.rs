@@ -0,0 +1,120 @@
+//! Parsing of the commands typed into the REPL
+use std::{path::PathBuf, str::FromStr};
+
+/// A command entered by the user
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Command {
+    /// Add a breakpoint at `path:line`
+    Break {
+        path: PathBuf,
+        line: usize,
+    },
+    /// Start the debugee, or resume it if it has already started
+    Continue,
+    /// Step over the current line
+    Step,
+    /// Evaluate an expression in the current stack frame
+    Print(String),
+    /// Show the stack of the paused thread
+    Backtrace,
+    Help,
+    Quit,
+}
+
+impl FromStr for Command {
+    type Err = eyre::Error;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let s = s.trim();
+        let (name, rest) = match s.split_once(char::is_whitespace) {
+            Some((name, rest)) => (name, rest.trim()),
+            None => (s, ""),
+        };
+
+        match name {
+            "break" | "b" => {
+                let Some((path, line)) = rest.rsplit_once(':') else {
+                    eyre::bail!("usage: break <file>:<line>");
+                };
+                let line = line
+                    .parse()
+                    .map_err(|_| eyre::eyre!("invalid line number {line}"))?;
+                Ok(Self::Break {
+                    path: PathBuf::from(path),
+                    line,
+                })
+            }
+            "continue" | "c" => Ok(Self::Continue),
+            "step" | "next" | "n" => Ok(Self::Step),
+            "print" | "p" => {
+                eyre::ensure!(!rest.is_empty(), "usage: print <expression>");
+                Ok(Self::Print(rest.to_string()))
+            }
+            "bt" | "backtrace" => Ok(Self::Backtrace),
+            "help" | "h" => Ok(Self::Help),
+            "quit" | "q" | "exit" => Ok(Self::Quit),
+            "" => eyre::bail!("no command given"),
+            other => eyre::bail!("unknown command {other}, try help"),
+        }
+    }
+}
+
+pub const HELP: &str = "\
+break <file>:<line>  add a breakpoint
+continue             start or resume the program
+step                 step over the current line
+print <expression>   evaluate an expression in the current frame
+bt                   show the stack of the paused thread
+quit                 stop debugging";
+
+#[cfg(test)]
+mod tests {
+    use std::path::PathBuf;
+
+    use super::Command;
+
+    #[test]
+    fn parse_commands() {
+        let cases = [
+            (
+                "break test.py:4",
+                Command::Break {
+                    path: PathBuf::from("test.py"),
+                    line: 4,
+                },
+            ),
+            (
+                "b /tmp/dir with spaces/main.py:12",
+                Command::Break {
+                    path: PathBuf::from("/tmp/dir with spaces/main.py"),
+                    line: 12,
+                },
+            ),
+            ("continue", Command::Continue),
+            ("c", Command::Continue),
+            ("step", Command::Step),
+            ("print a + b", Command::Print("a + b".to_string())),
+            ("  p   x  ", Command::Print("x".to_string())),
+            ("bt", Command::Backtrace),
+            ("quit", Command::Quit),
+        ];
+
+        for (input, expected) in cases {
+            let command: Command = input.parse().unwrap();
+            assert_eq!(command, expected, "parsing {input:?}");
+        }
+    }
+
+    #[test]
+    fn invalid_commands() {
+        for input in [
+            "",
+            "break test.py",
+            "break test.py:x",
+            "print",
+            "frobnicate",
+        ] {
+            assert!(input.parse::<Command>().is_err(), "parsing {input:?}");
+        }
+    }
+}
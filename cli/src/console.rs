@@ -0,0 +1,130 @@
+//! Showing the output of the debugee, coloured by its category
+use std::io::{self, IsTerminal, Write};
+
+use transport::events::OutputEventCategory;
+
+/// Terminal colours used for output
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Colour {
+    Red,
+    Yellow,
+    Cyan,
+}
+
+impl Colour {
+    fn ansi_code(self) -> u8 {
+        match self {
+            Colour::Red => 31,
+            Colour::Yellow => 33,
+            Colour::Cyan => 36,
+        }
+    }
+}
+
+/// How a piece of output is shown
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub struct Style {
+    pub colour: Option<Colour>,
+    /// Shown in bold, so it stands out from the surrounding output
+    pub emphasised: bool,
+}
+
+/// The style of output in `category`, or `None` if it should not be shown at all
+pub fn style(category: Option<&OutputEventCategory>) -> Option<Style> {
+    let style = match category {
+        // adapters which do not give a category are usually forwarding the debugee's output
+        None | Some(OutputEventCategory::Stdout) => Style::default(),
+        Some(OutputEventCategory::Stderr) => Style {
+            colour: Some(Colour::Red),
+            emphasised: false,
+        },
+        Some(OutputEventCategory::Console) => Style {
+            colour: Some(Colour::Cyan),
+            emphasised: false,
+        },
+        Some(OutputEventCategory::Important) => Style {
+            colour: Some(Colour::Yellow),
+            emphasised: true,
+        },
+        Some(OutputEventCategory::Telemetry) => return None,
+        Some(OutputEventCategory::Other(_)) => Style::default(),
+    };
+    Some(style)
+}
+
+/// Wrap `output` in the escape codes for `style`
+fn render(output: &str, style: Style) -> String {
+    let mut codes = Vec::new();
+    if style.emphasised {
+        codes.push(1);
+    }
+    codes.extend(style.colour.map(Colour::ansi_code));
+    if codes.is_empty() {
+        return output.to_string();
+    }
+
+    let codes: Vec<_> = codes.iter().map(u8::to_string).collect();
+    format!("\x1b[{}m{output}\x1b[0m", codes.join(";"))
+}
+
+/// Print output from the debugee, coloured if stdout is a terminal
+pub fn print(output: &str, category: Option<&OutputEventCategory>) -> io::Result<()> {
+    let Some(style) = style(category) else {
+        return Ok(());
+    };
+    let mut stdout = io::stdout().lock();
+    if stdout.is_terminal() {
+        write!(stdout, "{}", render(output, style))?;
+    } else {
+        write!(stdout, "{output}")?;
+    }
+    stdout.flush()
+}
+
+#[cfg(test)]
+mod tests {
+    use transport::events::OutputEventCategory;
+
+    use super::{render, style, Colour, Style};
+
+    #[test]
+    fn category_styles() {
+        let category = |name: &str| OutputEventCategory::from(name.to_string());
+
+        assert_eq!(style(None), Some(Style::default()));
+        assert_eq!(style(Some(&category("stdout"))), Some(Style::default()));
+        assert_eq!(
+            style(Some(&category("stderr"))).and_then(|style| style.colour),
+            Some(Colour::Red)
+        );
+        assert_eq!(
+            style(Some(&category("console"))).and_then(|style| style.colour),
+            Some(Colour::Cyan)
+        );
+        assert_eq!(
+            style(Some(&category("important"))),
+            Some(Style {
+                colour: Some(Colour::Yellow),
+                emphasised: true
+            })
+        );
+        assert_eq!(style(Some(&category("telemetry"))), None);
+        // categories defined by a particular adapter are shown plainly
+        assert_eq!(style(Some(&category("debugpyLog"))), Some(Style::default()));
+    }
+
+    #[test]
+    fn render_escape_codes() {
+        assert_eq!(render("plain\n", Style::default()), "plain\n");
+        assert_eq!(
+            render(
+                "warning",
+                Style {
+                    colour: Some(Colour::Yellow),
+                    emphasised: true
+                }
+            ),
+            "\x1b[1;33mwarning\x1b[0m"
+        );
+    }
+}
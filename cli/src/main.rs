@@ -0,0 +1,147 @@
+use std::io::{self, BufRead, Write};
+use std::path::PathBuf;
+
+use clap::Parser;
+use debugger::{Breakpoint, Debugger, Event, Language, LaunchArguments};
+use eyre::WrapErr;
+use tracing_subscriber::EnvFilter;
+use transport::types::StackFrame;
+
+use command::Command;
+
+mod command;
+mod console;
+
+/// Drive a debugging session from the terminal
+#[derive(Debug, Parser)]
+struct Args {
+    /// The program to debug
+    program: PathBuf,
+
+    #[clap(short, long, default_value_t = transport::DEFAULT_DAP_PORT)]
+    port: u16,
+
+    #[clap(short, long, default_value = "debugpy")]
+    language: Language,
+}
+
+fn main() -> eyre::Result<()> {
+    let _ = color_eyre::install();
+    tracing_subscriber::fmt()
+        .with_env_filter(EnvFilter::from_default_env())
+        .with_writer(io::stderr)
+        .init();
+
+    let args = Args::parse();
+    tracing::debug!(?args, "parsed command line arguments");
+
+    let debugger = Debugger::on_port(
+        args.port,
+        LaunchArguments::from_path(args.program, args.language),
+    )
+    .context("creating debugger")?;
+    debugger.wait_for_event(|e| matches!(e, Event::Initialised));
+    let events = debugger.events();
+
+    let mut launched = false;
+    // the stack of the paused thread, innermost frame first
+    let mut stack: Vec<StackFrame> = Vec::new();
+
+    let mut lines = io::stdin().lock().lines();
+    loop {
+        print!("(dap) ");
+        io::stdout().flush()?;
+        let Some(line) = lines.next() else {
+            break;
+        };
+
+        let command = match line?.parse::<Command>() {
+            Ok(command) => command,
+            Err(e) => {
+                eprintln!("{e}");
+                continue;
+            }
+        };
+        let resumes = matches!(command, Command::Continue | Command::Step);
+
+        let result = match command {
+            Command::Break { path, line } => debugger
+                .add_breakpoint(Breakpoint {
+                    path,
+                    line,
+                    ..Default::default()
+                })
+                .map(|id| println!("breakpoint {id} added")),
+            Command::Continue if !launched => {
+                launched = true;
+                debugger.launch()
+            }
+            Command::Continue => debugger.r#continue(),
+            Command::Step => debugger.step_over(),
+            Command::Print(expression) => match stack.first() {
+                Some(frame) => debugger
+                    .evaluate(frame.id, &expression)
+                    .map(|value| println!("{value}")),
+                None => Err(eyre::eyre!("the program is not paused")),
+            },
+            Command::Backtrace => {
+                for (i, frame) in stack.iter().enumerate() {
+                    println!("#{i} {}", describe(frame));
+                }
+                Ok(())
+            }
+            Command::Help => {
+                println!("{}", command::HELP);
+                Ok(())
+            }
+            Command::Quit => break,
+        };
+        if let Err(e) = result {
+            eprintln!("{e:#}");
+            continue;
+        }
+        if !resumes {
+            continue;
+        }
+
+        // wait for the program to stop again, showing its output in the meantime
+        let event = loop {
+            match events.recv().context("receiving debugger events")? {
+                Event::Output {
+                    category, output, ..
+                } => console::print(&output, category.as_ref())?,
+                event @ (Event::Paused { .. } | Event::Ended) => break event,
+                _ => {}
+            }
+        };
+        match event {
+            Event::Paused {
+                stack: new_stack,
+                description,
+                ..
+            } => {
+                stack = new_stack;
+                if let Some(description) = description {
+                    println!("{description}");
+                }
+                if let Some(frame) = stack.first() {
+                    println!("stopped at {}", describe(frame));
+                }
+            }
+            _ => {
+                println!("program ended");
+                break;
+            }
+        }
+    }
+
+    Ok(())
+}
+
+/// Describe the location of a stack frame, e.g. `main (test.py:4)`
+fn describe(frame: &StackFrame) -> String {
+    match frame.source.as_ref().and_then(|s| s.path.as_ref()) {
+        Some(path) => format!("{} ({}:{})", frame.name, path.display(), frame.line),
+        None => frame.name.clone(),
+    }
+}
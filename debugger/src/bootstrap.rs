@@ -0,0 +1,583 @@
+//! Ordering of the requests which bootstrap a debugging session
+//!
+//! The handshake `initialize` → `launch`/`attach` → (breakpoints once `initialized`) →
+//! `configurationDone` is order sensitive. Requests sent through [`Bootstrap`] wait until their
+//! phase of the handshake has been reached, and requests whose phase has already passed are
+//! rejected.
+//!
+//! The `initialized` event may arrive before or after the launch response (or even before the
+//! launch request is sent), so rather than tracking it here the session state of the client,
+//! see [`Client::state`], is consulted. Some minimal adapters never send it, so if it has not
+//! arrived a short time after the launch request was sent the adapter is assumed to accept
+//! configuration anyway.
+use std::{
+    sync::{Condvar, Mutex, MutexGuard},
+    time::{Duration, Instant},
+};
+
+use eyre::WrapErr;
+use transport::{
+    requests::RequestBody, responses::ResponseBody, Client, PendingResponse, SessionState,
+};
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord)]
+enum Phase {
+    Uninitialised,
+    /// The initialize request has been sent
+    Initialising,
+    /// The initialize response has been received
+    Initialised,
+    /// The launch or attach request has been sent
+    Launched,
+    /// The configuration done request has been sent
+    Configured,
+}
+
+struct State {
+    phase: Phase,
+    /// The initialized event never arrived, so the adapter was assumed to be initialized
+    initialized_assumed: bool,
+    /// Breakpoint requests waiting to be sent, which must be sent before configuration is done
+    pending_breakpoints: usize,
+    /// When the launch or attach request was sent
+    launched_at: Option<Instant>,
+    timeline: BootstrapTimeline,
+}
+
+/// When each milestone of the handshake was reached, measured from when the connection to the
+/// adapter was made, or `None` if it has not been reached yet
+///
+/// This shows which step is slow when an adapter takes a long time to start.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct BootstrapTimeline {
+    pub initialize_sent: Option<Duration>,
+    pub capabilities_received: Option<Duration>,
+    /// The launch or attach request was sent
+    pub launch_sent: Option<Duration>,
+    pub initialized_event: Option<Duration>,
+    /// The last breakpoints request before configuration was done was sent
+    pub breakpoints_set: Option<Duration>,
+    pub configuration_done: Option<Duration>,
+    /// The debuggee stopped for the first time
+    pub first_stop: Option<Duration>,
+}
+
+/// How long after the launch request to wait for the initialized event before assuming the
+/// adapter will never send it
+pub(crate) const INITIALIZED_FALLBACK: Duration = Duration::from_secs(2);
+
+/// The initialize request was sent more than once in a session, which confuses adapters
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct AlreadyInitialisedError;
+
+impl std::fmt::Display for AlreadyInitialisedError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str("initialize request sent more than once")
+    }
+}
+
+impl std::error::Error for AlreadyInitialisedError {}
+
+pub(crate) struct Bootstrap {
+    state: Mutex<State>,
+    changed: Condvar,
+    /// How long to wait for the initialized event after launching, or `None` to wait forever
+    initialized_fallback: Option<Duration>,
+    /// When the connection to the adapter was made, which the timeline is measured from
+    connected_at: Instant,
+}
+
+impl Default for Bootstrap {
+    fn default() -> Self {
+        Self::new(Some(INITIALIZED_FALLBACK))
+    }
+}
+
+impl Bootstrap {
+    pub(crate) fn new(initialized_fallback: Option<Duration>) -> Self {
+        Self {
+            state: Mutex::new(State {
+                phase: Phase::Uninitialised,
+                initialized_assumed: false,
+                pending_breakpoints: 0,
+                launched_at: None,
+                timeline: BootstrapTimeline::default(),
+            }),
+            changed: Condvar::new(),
+            initialized_fallback,
+            connected_at: Instant::now(),
+        }
+    }
+
+    /// When each milestone of the handshake was reached
+    pub(crate) fn timeline(&self) -> BootstrapTimeline {
+        self.state.lock().unwrap().timeline
+    }
+
+    /// Record that the debuggee has stopped, which completes the timeline the first time
+    pub(crate) fn on_stopped(&self) {
+        let mut state = self.state.lock().unwrap();
+        if state.timeline.first_stop.is_none() {
+            state.timeline.first_stop = Some(self.connected_at.elapsed());
+        }
+    }
+
+    /// Send a request once its phase of the handshake has been reached, and wait for the
+    /// response
+    pub(crate) fn send(
+        &self,
+        client: &Client,
+        body: RequestBody,
+    ) -> eyre::Result<Option<ResponseBody>> {
+        let is_initialize = matches!(body, RequestBody::Initialize(_));
+        let response = self
+            .send_in_order(client, body, |body| client.send_pending(body))?
+            .wait()?;
+        if is_initialize {
+            self.state.lock().unwrap().timeline.capabilities_received =
+                Some(self.connected_at.elapsed());
+            self.advance(Phase::Initialised);
+        }
+        Ok(response)
+    }
+
+    /// Send a request once its phase of the handshake has been reached, returning its response
+    /// to be waited for later, e.g. to send several requests before waiting for any of them
+    pub(crate) fn send_pending(
+        &self,
+        client: &Client,
+        body: RequestBody,
+    ) -> eyre::Result<PendingResponse> {
+        eyre::ensure!(
+            !matches!(body, RequestBody::Initialize(_)),
+            "the initialize request must wait for its response"
+        );
+        self.send_in_order(client, body, |body| client.send_pending(body))
+    }
+
+    /// Send a request once its phase of the handshake has been reached, without waiting for the
+    /// response
+    pub(crate) fn execute(&self, client: &Client, body: RequestBody) -> eyre::Result<()> {
+        eyre::ensure!(
+            !matches!(body, RequestBody::Initialize(_)),
+            "the initialize request must wait for its response"
+        );
+        self.send_in_order(client, body, |body| client.execute(body))
+    }
+
+    /// Record that the adapter has sent the initialized event, waking any requests waiting for
+    /// it
+    ///
+    /// The client has already seen the event by the time it is delivered, so its state says the
+    /// adapter is initialized.
+    pub(crate) fn on_initialized(&self) {
+        let mut state = self.state.lock().unwrap();
+        tracing::debug!(phase = ?state.phase, "received initialized event");
+        state
+            .timeline
+            .initialized_event
+            .get_or_insert(self.connected_at.elapsed());
+        self.changed.notify_all();
+    }
+
+    fn advance(&self, phase: Phase) {
+        let mut state = self.state.lock().unwrap();
+        if state.phase < phase {
+            tracing::debug!(from = ?state.phase, to = ?phase, "advancing bootstrap phase");
+            state.phase = phase;
+            self.changed.notify_all();
+        }
+    }
+
+    /// Wait until the adapter has sent the initialized event, or until the fallback period
+    /// after launching has passed without it
+    fn wait_for_initialized<'a>(
+        &self,
+        client: &Client,
+        mut state: MutexGuard<'a, State>,
+    ) -> MutexGuard<'a, State> {
+        while client.state() == SessionState::Uninitialized {
+            let (Some(fallback), Some(launched_at)) =
+                (self.initialized_fallback, state.launched_at)
+            else {
+                state = self.changed.wait(state).unwrap();
+                continue;
+            };
+
+            let remaining = fallback.saturating_sub(launched_at.elapsed());
+            if remaining.is_zero() {
+                tracing::warn!(
+                    ?fallback,
+                    "no initialized event from adapter, configuring without it"
+                );
+                client.assume_initialized();
+                state.initialized_assumed = true;
+                self.changed.notify_all();
+                return state;
+            }
+            state = self.changed.wait_timeout(state, remaining).unwrap().0;
+        }
+        // the event may not have been delivered yet
+        if !state.initialized_assumed {
+            state
+                .timeline
+                .initialized_event
+                .get_or_insert(self.connected_at.elapsed());
+        }
+        state
+    }
+
+    fn send_in_order<F, R>(&self, client: &Client, body: RequestBody, send: F) -> eyre::Result<R>
+    where
+        F: FnOnce(RequestBody) -> eyre::Result<R>,
+    {
+        let mut state = self.state.lock().unwrap();
+        match body {
+            RequestBody::Initialize(_) => {
+                if state.phase != Phase::Uninitialised {
+                    return Err(AlreadyInitialisedError.into());
+                }
+                let res = send(body).context("sending initialize request")?;
+                state.phase = Phase::Initialising;
+                state.timeline.initialize_sent = Some(self.connected_at.elapsed());
+                self.changed.notify_all();
+                Ok(res)
+            }
+            RequestBody::Launch(_) | RequestBody::Attach(_) => {
+                while state.phase < Phase::Initialised {
+                    state = self.changed.wait(state).unwrap();
+                }
+                eyre::ensure!(
+                    state.phase < Phase::Launched,
+                    "launch or attach request sent more than once"
+                );
+                let res = send(body).context("sending launch request")?;
+                state.phase = Phase::Launched;
+                state.launched_at = Some(Instant::now());
+                state.timeline.launch_sent = Some(self.connected_at.elapsed());
+                self.changed.notify_all();
+                Ok(res)
+            }
+            RequestBody::SetBreakpoints(_)
+            | RequestBody::SetFunctionBreakpoints(_)
+            | RequestBody::SetExceptionBreakpoints(_) => {
+                state.pending_breakpoints += 1;
+                state = self.wait_for_initialized(client, state);
+                state.pending_breakpoints -= 1;
+                self.changed.notify_all();
+                let res = send(body).context("sending breakpoints request")?;
+                if state.phase < Phase::Configured {
+                    state.timeline.breakpoints_set = Some(self.connected_at.elapsed());
+                }
+                Ok(res)
+            }
+            RequestBody::ConfigurationDone => {
+                loop {
+                    state = self.wait_for_initialized(client, state);
+                    if state.phase >= Phase::Launched && state.pending_breakpoints == 0 {
+                        break;
+                    }
+                    state = self.changed.wait(state).unwrap();
+                }
+                eyre::ensure!(
+                    state.phase < Phase::Configured,
+                    "configuration done request sent more than once"
+                );
+                let res = send(body).context("sending configuration done request")?;
+                state.phase = Phase::Configured;
+                state.timeline.configuration_done = Some(self.connected_at.elapsed());
+                self.changed.notify_all();
+                Ok(res)
+            }
+            body => send(body),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{path::PathBuf, sync::Arc, thread, time::Duration};
+
+    use transport::{
+        events,
+        requests::{self, Initialize, PathFormat, RequestBody},
+        types::Source,
+    };
+
+    use super::{AlreadyInitialisedError, Bootstrap, BootstrapTimeline};
+    use crate::fake_adapter;
+
+    fn initialize() -> RequestBody {
+        RequestBody::Initialize(Initialize {
+            adapter_id: "dap gui".to_string(),
+            lines_start_at_one: false,
+            path_format: PathFormat::Path,
+            supports_start_debugging_request: true,
+            supports_variable_type: true,
+            supports_variable_paging: true,
+            supports_progress_reporting: true,
+            supports_memory_event: true,
+        })
+    }
+
+    fn set_breakpoints() -> RequestBody {
+        RequestBody::SetBreakpoints(requests::SetBreakpoints {
+            source: Source {
+                path: Some(PathBuf::from("/test.py")),
+                ..Default::default()
+            },
+            lines: Some(vec![4]),
+            ..Default::default()
+        })
+    }
+
+    fn respond(request: &requests::Request) -> Vec<String> {
+        match request.body {
+            RequestBody::Initialize(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"initialize","body":{}"#,
+            )],
+            RequestBody::Launch(_) => {
+                // give the other bootstrap steps a chance to queue up
+                thread::sleep(Duration::from_millis(100));
+                vec![fake_adapter::event(r#""event":"initialized""#)]
+            }
+            RequestBody::SetBreakpoints(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"setBreakpoints","body":{"breakpoints":[]}"#,
+            )],
+            RequestBody::ConfigurationDone => vec![fake_adapter::response(
+                request,
+                r#""command":"configurationDone""#,
+            )],
+            _ => Vec::new(),
+        }
+    }
+
+    #[test]
+    fn concurrent_bootstrap_order() {
+        let (client, adapter) = fake_adapter::connect(respond);
+        let bootstrap = Arc::new(Bootstrap::default());
+
+        // forward the initialized event, as the debugger event loop does
+        let events_bootstrap = Arc::clone(&bootstrap);
+        thread::spawn(move || {
+            while let Ok(event) = adapter.events.recv() {
+                if matches!(event, events::Event::Initialized) {
+                    events_bootstrap.on_initialized();
+                }
+            }
+        });
+
+        // fire the steps in reverse order from separate threads
+        let handles: Vec<_> = [
+            RequestBody::ConfigurationDone,
+            set_breakpoints(),
+            RequestBody::Launch(requests::Launch::default()),
+            initialize(),
+        ]
+        .into_iter()
+        .map(|body| {
+            let bootstrap = Arc::clone(&bootstrap);
+            let client = client.clone();
+            thread::spawn(move || match body {
+                RequestBody::Launch(_) => bootstrap.execute(&client, body),
+                body => bootstrap.send(&client, body).map(drop),
+            })
+        })
+        .collect();
+
+        for handle in handles {
+            handle.join().unwrap().expect("sending bootstrap request");
+        }
+
+        let commands: Vec<_> = adapter.requests.try_iter().map(|r| command(&r)).collect();
+        assert_eq!(commands, EXPECTED_ORDER);
+    }
+
+    #[test]
+    fn rejects_repeated_initialize() {
+        let (client, _adapter) = fake_adapter::connect(respond);
+        let bootstrap = Bootstrap::default();
+
+        bootstrap
+            .send(&client, initialize())
+            .expect("sending initialize request");
+        let err = bootstrap.send(&client, initialize()).unwrap_err();
+        assert_eq!(
+            err.downcast_ref::<AlreadyInitialisedError>(),
+            Some(&AlreadyInitialisedError)
+        );
+    }
+
+    /// Run the bootstrap sequence from a single thread, where the adapter responds to the
+    /// launch request with `on_launch`
+    fn sequential_bootstrap<F>(on_launch: F) -> Vec<&'static str>
+    where
+        F: Fn(&requests::Request) -> Vec<String> + Send + 'static,
+    {
+        let (client, adapter) = fake_adapter::connect(move |request| match request.body {
+            RequestBody::Launch(_) => on_launch(request),
+            _ => respond(request),
+        });
+        let bootstrap = Arc::new(Bootstrap::default());
+
+        let events_bootstrap = Arc::clone(&bootstrap);
+        thread::spawn(move || {
+            while let Ok(event) = adapter.events.recv() {
+                if matches!(event, events::Event::Initialized) {
+                    events_bootstrap.on_initialized();
+                }
+            }
+        });
+
+        bootstrap.send(&client, initialize()).unwrap();
+        bootstrap
+            .send(&client, RequestBody::Launch(requests::Launch::default()))
+            .unwrap();
+        bootstrap.send(&client, set_breakpoints()).unwrap();
+        bootstrap
+            .send(&client, RequestBody::ConfigurationDone)
+            .unwrap();
+
+        adapter.requests.try_iter().map(|r| command(&r)).collect()
+    }
+
+    fn command(request: &requests::Request) -> &'static str {
+        match request.body {
+            RequestBody::Initialize(_) => "initialize",
+            RequestBody::Launch(_) => "launch",
+            RequestBody::SetBreakpoints(_) => "setBreakpoints",
+            RequestBody::ConfigurationDone => "configurationDone",
+            _ => "other",
+        }
+    }
+
+    const EXPECTED_ORDER: [&str; 4] = [
+        "initialize",
+        "launch",
+        "setBreakpoints",
+        "configurationDone",
+    ];
+
+    #[test]
+    fn initialized_before_launch_response() {
+        let order = sequential_bootstrap(|request| {
+            vec![
+                fake_adapter::event(r#""event":"initialized""#),
+                fake_adapter::response(request, r#""command":"launch""#),
+            ]
+        });
+        assert_eq!(order, EXPECTED_ORDER);
+    }
+
+    #[test]
+    fn initialized_after_launch_response() {
+        let order = sequential_bootstrap(|request| {
+            vec![
+                fake_adapter::response(request, r#""command":"launch""#),
+                fake_adapter::event(r#""event":"initialized""#),
+            ]
+        });
+        assert_eq!(order, EXPECTED_ORDER);
+    }
+
+    #[test]
+    fn missing_initialized_event() {
+        // the adapter answers the launch request but never sends the initialized event
+        let (client, adapter) = fake_adapter::connect(|request| match request.body {
+            RequestBody::Launch(_) => {
+                vec![fake_adapter::response(request, r#""command":"launch""#)]
+            }
+            _ => respond(request),
+        });
+        let bootstrap = Bootstrap::new(Some(Duration::from_millis(100)));
+
+        bootstrap.send(&client, initialize()).unwrap();
+        bootstrap
+            .send(&client, RequestBody::Launch(requests::Launch::default()))
+            .unwrap();
+        bootstrap.send(&client, set_breakpoints()).unwrap();
+        bootstrap
+            .send(&client, RequestBody::ConfigurationDone)
+            .unwrap();
+
+        let order: Vec<_> = adapter.requests.try_iter().map(|r| command(&r)).collect();
+        assert_eq!(order, EXPECTED_ORDER);
+    }
+
+    #[test]
+    fn timeline() {
+        let (client, adapter) = fake_adapter::connect(|request| match request.body {
+            RequestBody::Launch(_) => vec![
+                fake_adapter::response(request, r#""command":"launch""#),
+                fake_adapter::event(r#""event":"initialized""#),
+            ],
+            _ => respond(request),
+        });
+        let bootstrap = Arc::new(Bootstrap::default());
+        assert_eq!(bootstrap.timeline(), BootstrapTimeline::default());
+
+        let events_bootstrap = Arc::clone(&bootstrap);
+        thread::spawn(move || {
+            while let Ok(event) = adapter.events.recv() {
+                if matches!(event, events::Event::Initialized) {
+                    events_bootstrap.on_initialized();
+                }
+            }
+        });
+
+        bootstrap.send(&client, initialize()).unwrap();
+        bootstrap
+            .send(&client, RequestBody::Launch(requests::Launch::default()))
+            .unwrap();
+        bootstrap.send(&client, set_breakpoints()).unwrap();
+        bootstrap
+            .send(&client, RequestBody::ConfigurationDone)
+            .unwrap();
+        bootstrap.on_stopped();
+
+        let BootstrapTimeline {
+            initialize_sent,
+            capabilities_received,
+            launch_sent,
+            initialized_event,
+            breakpoints_set,
+            configuration_done,
+            first_stop,
+        } = bootstrap.timeline();
+        let milestones: Vec<_> = [
+            initialize_sent,
+            capabilities_received,
+            launch_sent,
+            initialized_event,
+            breakpoints_set,
+            configuration_done,
+            first_stop,
+        ]
+        .into_iter()
+        .map(|milestone| milestone.expect("milestone not reached"))
+        .collect();
+        assert!(
+            milestones.windows(2).all(|pair| pair[0] <= pair[1]),
+            "{milestones:?}"
+        );
+    }
+
+    #[test]
+    fn initialized_before_launch_request() {
+        let (client, adapter) = fake_adapter::connect(respond);
+        let bootstrap = Bootstrap::default();
+
+        bootstrap.send(&client, initialize()).unwrap();
+        client.assume_initialized();
+        bootstrap.on_initialized();
+        bootstrap
+            .execute(&client, RequestBody::Launch(requests::Launch::default()))
+            .expect("launch should not be rejected");
+        bootstrap.send(&client, set_breakpoints()).unwrap();
+
+        let order: Vec<_> = adapter.requests.try_iter().map(|r| command(&r)).collect();
+        assert_eq!(order, EXPECTED_ORDER[..3]);
+    }
+}
@@ -1,23 +1,25 @@
 use std::{
     io,
     net::{TcpStream, ToSocketAddrs},
-    sync::{Arc, Mutex},
+    path::{Path, PathBuf},
+    sync::{atomic::AtomicBool, Arc, Mutex},
     thread,
     time::Duration,
 };
 
 use eyre::WrapErr;
+use regex::Regex;
 use retry::{delay::Exponential, retry};
 use server::Implementation;
 use transport::{
-    requests::{self, Disconnect},
+    requests, responses,
+    types::{StackFrameId, ThreadId, VariablesReference},
     DEFAULT_DAP_PORT,
 };
 
 use crate::{
-    internals::{DebuggerInternals, FileSource},
-    state::{self, DebuggerState},
-    types, Event,
+    internals::{self, DebuggerInternals, FileSource},
+    state, types, variables, Event,
 };
 
 pub enum InitialiseArguments {
@@ -41,13 +43,20 @@ fn retry_scale() -> impl Iterator<Item = Duration> {
     Exponential::from_millis(200).take(5)
 }
 
+/// How long to wait for each connection attempt
+const CONNECT_TIMEOUT: Duration = Duration::from_secs(2);
+/// How long to wait for the adapter to answer a terminate request before disconnecting
+const SHUTDOWN_TIMEOUT: Duration = Duration::from_secs(2);
+/// How long to wait for the debugee to stop after stepping out of a function
+const STEP_OUT_TIMEOUT: Duration = Duration::from_secs(10);
+
 fn reliable_tcp_stream<A>(addr: A) -> Result<TcpStream, retry::Error<io::Error>>
 where
     A: ToSocketAddrs + Clone,
 {
     retry(retry_scale(), || {
         tracing::debug!("trying to make connection");
-        match TcpStream::connect(addr.clone()) {
+        match connect_with_timeout(addr.clone()) {
             Ok(stream) => {
                 tracing::debug!("connection made");
                 Ok(stream)
@@ -60,6 +69,28 @@ where
     })
 }
 
+fn connect_with_timeout(addr: impl ToSocketAddrs) -> io::Result<TcpStream> {
+    let mut last_error = io::Error::new(io::ErrorKind::InvalidInput, "no addresses to connect to");
+    for addr in addr.to_socket_addrs()? {
+        match TcpStream::connect_timeout(&addr, CONNECT_TIMEOUT) {
+            Ok(stream) => return Ok(stream),
+            Err(e) => last_error = e,
+        }
+    }
+    Err(last_error)
+}
+
+/// Describe a failure to connect to an attach target, distinguishing a missing target from
+/// later protocol errors
+fn attach_error(error: io::Error) -> eyre::Report {
+    let reason = match error.kind() {
+        io::ErrorKind::ConnectionRefused => "connection refused".to_string(),
+        io::ErrorKind::TimedOut | io::ErrorKind::WouldBlock => "timeout".to_string(),
+        _ => error.to_string(),
+    };
+    eyre::Report::new(error).wrap_err(format!("could not attach: {reason}"))
+}
+
 pub struct Debugger {
     internals: Arc<Mutex<DebuggerInternals>>,
     rx: crossbeam_channel::Receiver<Event>,
@@ -80,15 +111,20 @@ impl Debugger {
         let args: InitialiseArguments = initialise_arguments.into();
         let internals_rx = rx.clone();
         let (mut internals, events) = match &args {
-            InitialiseArguments::Launch(state::LaunchArguments { language, .. }) => {
+            InitialiseArguments::Launch(state::LaunchArguments {
+                language,
+                initialized_fallback,
+                ..
+            }) => {
                 // let implementation = language.into();
                 let implementation: Implementation = match language {
                     crate::Language::DebugPy => Implementation::Debugpy,
                     crate::Language::Delve => Implementation::Delve,
                 };
 
-                let s = server::for_implementation_on_port(implementation, port)
+                let mut s = server::for_implementation_on_port(implementation, port)
                     .context("creating background server process")?;
+                let stderr = s.take_stderr();
                 let stream = reliable_tcp_stream(format!("127.0.0.1:{port}"))
                     .context("connecting to server")?;
 
@@ -96,16 +132,31 @@ impl Debugger {
                 let client =
                     transport::Client::new(stream, ttx).context("creating transport client")?;
 
-                let internals = DebuggerInternals::new(client, tx, Some(s));
+                // interleave the adapter diagnostics with any recorded messages
+                if let Some(stderr) = stderr {
+                    let client = client.clone();
+                    thread::spawn(move || {
+                        for line in stderr {
+                            client.record_stderr(&line);
+                        }
+                    });
+                }
+
+                let internals = DebuggerInternals::new(client, tx, Some(s))
+                    .with_initialized_fallback(*initialized_fallback);
                 (internals, trx)
             }
-            InitialiseArguments::Attach(_) => {
+            InitialiseArguments::Attach(state::AttachArguments { inspect_only, .. }) => {
                 let stream = reliable_tcp_stream(format!("127.0.0.1:{port}"))
-                    .context("connecting to server")?;
+                    .map_err(|e| attach_error(e.error))?;
 
+                let mut options = transport::ClientOptions::default();
+                if *inspect_only {
+                    options = options.inspect_only();
+                }
                 let (ttx, trx) = crossbeam_channel::unbounded();
-                let client =
-                    transport::Client::new(stream, ttx).context("creating transport client")?;
+                let client = transport::Client::with_options(stream, ttx, options)
+                    .context("creating transport client")?;
 
                 let internals = DebuggerInternals::new(client, tx, None);
                 (internals, trx)
@@ -114,6 +165,7 @@ impl Debugger {
 
         internals.initialise(args).context("initialising")?;
 
+        let bootstrap = Arc::clone(&internals.bootstrap);
         let internals = Arc::new(Mutex::new(internals));
 
         // background thread reading transport events, and handling the event with our internal state
@@ -121,6 +173,10 @@ impl Debugger {
         let background_events = events.clone();
         thread::spawn(move || loop {
             let event = background_events.recv().unwrap();
+            // unblock any bootstrap requests without needing the internals lock
+            if matches!(event, transport::events::Event::Initialized) {
+                bootstrap.on_initialized();
+            }
             background_internals.lock().unwrap().on_event(event);
         });
 
@@ -138,6 +194,18 @@ impl Debugger {
         self.rx.clone()
     }
 
+    /// A stream of whether the debugee is running (`true`) or stopped (`false`), for interfaces
+    /// which do not need the full event stream
+    pub fn run_state_channel(&self) -> crossbeam_channel::Receiver<bool> {
+        self.internals.lock().unwrap().subscribe_run_state()
+    }
+
+    /// A stream of the output from the debugee split into lines, where any final partial line
+    /// is delivered once the debugee ends
+    pub fn output_lines_channel(&self) -> crossbeam_channel::Receiver<String> {
+        self.internals.lock().unwrap().subscribe_output_lines()
+    }
+
     pub fn add_breakpoint(
         &self,
         breakpoint: types::Breakpoint,
@@ -146,14 +214,100 @@ impl Debugger {
         internals.add_breakpoint(breakpoint)
     }
 
+    /// Add a breakpoint at `path:line` which stops when `expression` equals its current value
+    /// in the frame `frame_id`
+    pub fn break_when_equals(
+        &self,
+        frame_id: StackFrameId,
+        path: impl Into<PathBuf>,
+        line: usize,
+        expression: &str,
+    ) -> eyre::Result<types::BreakpointId> {
+        self.internals
+            .lock()
+            .unwrap()
+            .break_when_equals(frame_id, path.into(), line, expression)
+    }
+
+    /// The line breakpoint `id` was requested on, and the line the adapter placed it on, so
+    /// the marker can be drawn where the breakpoint actually is
+    pub fn breakpoint_lines(&self, id: types::BreakpointId) -> Option<types::BreakpointLines> {
+        self.internals.lock().unwrap().breakpoint_lines(id)
+    }
+
+    /// Replace the function breakpoints, which stop when a function named in `names` is called
+    ///
+    /// They can be set before the adapter is initialised, and are applied again if the session
+    /// restarts.
+    pub fn set_function_breakpoints(
+        &self,
+        names: impl IntoIterator<Item = impl Into<String>>,
+    ) -> eyre::Result<()> {
+        self.internals
+            .lock()
+            .unwrap()
+            .set_function_breakpoints(names.into_iter().map(Into::into).collect())
+    }
+
+    /// Add a watchpoint, which stops when the variable `name` in `variables_reference` is
+    /// changed
+    ///
+    /// [`Event::WatchpointExpired`] is published if the adapter later invalidates it.
+    pub fn add_watchpoint(
+        &self,
+        variables_reference: VariablesReference,
+        name: &str,
+    ) -> eyre::Result<types::Watchpoint> {
+        self.internals
+            .lock()
+            .unwrap()
+            .add_watchpoint(variables_reference, name)
+    }
+
+    /// When each milestone of starting the session was reached, e.g. to find out why an adapter
+    /// is slow to start
+    pub fn bootstrap_timeline(&self) -> crate::BootstrapTimeline {
+        self.internals.lock().unwrap().bootstrap.timeline()
+    }
+
+    /// Save the breakpoints to `path`, so they can be loaded in a later session
+    pub fn save_breakpoints(&self, path: impl AsRef<Path>) -> eyre::Result<()> {
+        self.internals
+            .lock()
+            .unwrap()
+            .save_breakpoints(path.as_ref())
+    }
+
+    /// Load breakpoints saved with [`Debugger::save_breakpoints`], which are applied once the
+    /// adapter is initialised
+    pub fn load_breakpoints(&self, path: impl AsRef<Path>) -> eyre::Result<()> {
+        self.internals
+            .lock()
+            .unwrap()
+            .load_breakpoints(path.as_ref())
+    }
+
+    /// Whether the debugee was launched without debugging
+    pub fn no_debug(&self) -> bool {
+        self.internals.lock().unwrap().no_debug
+    }
+
     pub fn launch(&self) -> eyre::Result<()> {
-        let mut internals = self.internals.lock().unwrap();
-        let _ = internals
-            .client
-            .send(requests::RequestBody::ConfigurationDone)
-            .context("completing configuration")?;
-        internals.set_state(DebuggerState::Running);
-        Ok(())
+        let (client, bootstrap) = {
+            let mut internals = self.internals.lock().unwrap();
+            internals.configuring = true;
+            (internals.client.clone(), Arc::clone(&internals.bootstrap))
+        };
+
+        // do not hold the internals lock while waiting, so events are still handled
+        let res = bootstrap
+            .send(&client, requests::RequestBody::ConfigurationDone)
+            .context("completing configuration");
+        self.internals
+            .lock()
+            .unwrap()
+            .finish_configuration(res.is_ok());
+        res.map(drop)
     }
 
     /// Resume execution of the debugee
@@ -174,6 +328,351 @@ impl Debugger {
         Ok(())
     }
 
+    /// Step over the current line of the debugee
+    pub fn step_over(&self) -> eyre::Result<()> {
+        let internals = self.internals.lock().unwrap();
+        match internals.current_thread_id {
+            Some(thread_id) => {
+                internals
+                    .client
+                    .execute(requests::RequestBody::Next(requests::Next {
+                        thread_id,
+                        granularity: None,
+                    }))
+                    .context("sending next request")?;
+            }
+            None => eyre::bail!("logic error: no current thread id"),
+        }
+        Ok(())
+    }
+
+    /// Evaluate an expression in the context of a stack frame, as if typed into a REPL
+    pub fn evaluate(&self, frame_id: StackFrameId, expression: &str) -> eyre::Result<String> {
+        let internals = self.internals.lock().unwrap();
+        let response = internals
+            .client
+            .send(requests::RequestBody::Evaluate(requests::Evaluate {
+                expression: expression.to_string(),
+                frame_id: Some(frame_id),
+                context: Some(requests::EvaluateContext::Repl),
+                source: None,
+                line: None,
+            }))
+            .context("sending evaluate request")?;
+        match response {
+            Some(responses::ResponseBody::Evaluate(responses::EvaluateResponse {
+                result, ..
+            })) => Ok(internals.pretty_print(&result)),
+            _ => eyre::bail!("could not evaluate {expression}"),
+        }
+    }
+
+    /// Resume only the thread `thread_id`, leaving the others paused where the adapter supports
+    /// it
+    pub fn continue_thread(&self, thread_id: ThreadId) -> eyre::Result<()> {
+        self.internals.lock().unwrap().continue_thread(thread_id)
+    }
+
+    /// Resume all threads
+    pub fn continue_all(&self, thread_id: ThreadId) -> eyre::Result<()> {
+        self.internals.lock().unwrap().continue_all(thread_id)
+    }
+
+    /// Step into a specific call on the current line, e.g. for a "step into specific" menu
+    pub fn step_in_target(&self, thread_id: ThreadId, target_id: i64) -> eyre::Result<()> {
+        self.internals
+            .lock()
+            .unwrap()
+            .step_in_target(thread_id, target_id)
+    }
+
+    /// Finish the current function of `thread_id` and inspect where it returned to, along with
+    /// the value it returned if the adapter reports one, e.g. debugpy with `showReturnValue`
+    pub fn step_out_and_inspect(
+        &self,
+        thread_id: ThreadId,
+    ) -> eyre::Result<(types::StoppedContext, Option<transport::types::Variable>)> {
+        let run_state = self.internals.lock().unwrap().step_out(thread_id)?;
+        loop {
+            let running = run_state
+                .recv_timeout(STEP_OUT_TIMEOUT)
+                .context("waiting for the debugee to stop after stepping out")?;
+            if !running {
+                break;
+            }
+        }
+        self.internals.lock().unwrap().inspect_return(thread_id)
+    }
+
+    /// Keep `thread_id` as the current thread when other threads stop, rather than following
+    /// whichever thread stopped most recently
+    pub fn pin_thread(&self, thread_id: ThreadId) {
+        self.internals.lock().unwrap().pin_thread(thread_id)
+    }
+
+    /// Follow whichever thread stopped most recently again, see [`Debugger::pin_thread`]
+    pub fn unpin_thread(&self) {
+        self.internals.lock().unwrap().unpin_thread()
+    }
+
+    /// Suspend the running debugee, e.g. to break into an infinite loop without a breakpoint
+    ///
+    /// The debugee is reported as paused with [`Event::Paused`] once it stops.
+    pub fn pause(&self) -> eyre::Result<()> {
+        self.internals.lock().unwrap().pause()
+    }
+
+    /// Focus a thread which stopped on an exception: select it and its innermost frame in user
+    /// code, skipping library frames, and fetch the details of the exception
+    pub fn focus_exception(&self, thread_id: ThreadId) -> eyre::Result<types::ExceptionFocus> {
+        self.internals.lock().unwrap().focus_exception(thread_id)
+    }
+
+    /// Pin a watch expression, which is re-evaluated and published as [`Event::Watches`]
+    /// whenever the program stops or a different frame is selected
+    pub fn pin_watch(&self, expression: impl Into<String>) {
+        self.internals.lock().unwrap().pin_watch(expression)
+    }
+
+    /// Set how long to wait for each pinned watch to be evaluated before reporting it as timed
+    /// out
+    pub fn set_watch_timeout(&self, timeout: Duration) {
+        self.internals.lock().unwrap().watch_timeout = timeout;
+    }
+
+    /// Select the stack frame that pinned watches are evaluated in
+    pub fn set_current_frame(&self, frame_id: StackFrameId) {
+        self.internals.lock().unwrap().set_current_frame(frame_id)
+    }
+
+    /// Whether the adapter supports editing variables, so the interface can offer inline editing
+    pub fn can_set_variable(&self) -> bool {
+        let internals = self.internals.lock().unwrap();
+        internals
+            .capabilities
+            .supports_set_variable
+            .unwrap_or(false)
+    }
+
+    /// Change the value of the variable `name` in `variables_reference`, returning its new value
+    pub fn set_variable(
+        &self,
+        variables_reference: transport::types::VariablesReference,
+        name: &str,
+        value: &str,
+    ) -> eyre::Result<String> {
+        self.internals
+            .lock()
+            .unwrap()
+            .set_variable(variables_reference, name, value)
+    }
+
+    /// Disassemble the `context` instructions either side of the current instruction of
+    /// `frame`, marking which instruction is current so it can be highlighted
+    pub fn disassemble_frame(
+        &self,
+        frame: &transport::types::StackFrame,
+        context: usize,
+    ) -> eyre::Result<Vec<types::Instruction>> {
+        self.internals
+            .lock()
+            .unwrap()
+            .disassemble_frame(frame, context)
+    }
+
+    /// Restart the debuggee, keeping the breakpoints
+    ///
+    /// Adapters which cannot restart the debuggee themselves have it terminated, launched and
+    /// configured again, see [`transport::Client::restart`].
+    pub fn restart(&self) -> eyre::Result<()> {
+        // do not hold the internals lock while waiting, so events are still handled
+        let client = self.internals.lock().unwrap().client.clone();
+        client.restart().context("restarting debuggee")
+    }
+
+    /// Restart execution of `frame` from its beginning, if the adapter allows it
+    ///
+    /// Whether a frame can be restarted is given by its `can_restart` flag.
+    pub fn restart_frame(&self, frame: &transport::types::StackFrame) -> eyre::Result<()> {
+        self.internals.lock().unwrap().restart_frame(frame)
+    }
+
+    /// Evaluate an expression to produce a copy-friendly full representation of its value
+    pub fn evaluate_for_clipboard(
+        &self,
+        frame_id: StackFrameId,
+        expression: &str,
+    ) -> eyre::Result<String> {
+        self.internals
+            .lock()
+            .unwrap()
+            .evaluate_for_clipboard(frame_id, expression)
+    }
+
+    /// Whether the adapter supports evaluating expressions for hovers, so the interface only
+    /// offers hover evaluation when it does
+    pub fn can_hover(&self) -> bool {
+        self.internals.lock().unwrap().can_hover()
+    }
+
+    /// Evaluate the expression under the cursor in a source view, giving an empty result if it
+    /// cannot be evaluated or the adapter does not support hovers
+    pub fn hover_at(
+        &self,
+        frame_id: StackFrameId,
+        expression: &str,
+        source: transport::types::Source,
+        line: usize,
+    ) -> eyre::Result<String> {
+        self.internals
+            .lock()
+            .unwrap()
+            .hover_at(frame_id, expression, source, line)
+    }
+
+    /// Fetch the scopes of a stack frame along with their variables.
+    ///
+    /// The variables requests for each scope are sent together rather than waiting for each
+    /// response in turn. Frames without scopes, e.g. `[External Code]` label frames, give an
+    /// empty list of scopes rather than an error.
+    pub fn frame_state(&self, frame_id: StackFrameId) -> eyre::Result<types::FrameState> {
+        self.internals.lock().unwrap().frame_state(frame_id)
+    }
+
+    /// Fetch the stack traces of every stopped thread, e.g. for a "parallel stacks" view
+    ///
+    /// Threads whose stack trace cannot be fetched, e.g. because they resumed in the meantime,
+    /// are reported as skipped rather than failing the whole call.
+    pub fn all_stacks(&self) -> eyre::Result<types::AllStacks> {
+        self.internals.lock().unwrap().all_stacks()
+    }
+
+    /// Fetch the variables below `variables_reference` breadth-first, calling `on_batch` as the
+    /// children of each variable arrive.
+    ///
+    /// Lazy variables are not expanded, pass their reference to expand them on request. Setting
+    /// `cancelled` stops the walk.
+    pub fn stream_variables<F>(
+        &self,
+        variables_reference: VariablesReference,
+        cancelled: &AtomicBool,
+        mut on_batch: F,
+    ) -> eyre::Result<()>
+    where
+        F: FnMut(&[String], &[transport::types::Variable]),
+    {
+        // do not hold the internals lock while walking, so events can still be handled
+        let (client, max_value_length) = {
+            let internals = self.internals.lock().unwrap();
+            (internals.client.clone(), internals.max_value_length)
+        };
+        variables::stream_variables(&client, variables_reference, cancelled, |path, batch| {
+            let batch: Vec<_> = batch
+                .iter()
+                .map(|variable| transport::types::Variable {
+                    value: variables::truncate_value(&variable.value, max_value_length),
+                    ..variable.clone()
+                })
+                .collect();
+            on_batch(path, &batch)
+        })
+    }
+
+    /// Fetch the tree of variables below `variables_reference`, up to `max_depth` levels deep
+    ///
+    /// Structures referring to themselves are only expanded once, and the tree is capped at
+    /// [`crate::MAX_EXPANDED_VARIABLES`] variables.
+    pub fn expand_variables(
+        &self,
+        variables_reference: VariablesReference,
+        max_depth: usize,
+    ) -> eyre::Result<Vec<variables::VariableNode>> {
+        let (client, max_value_length) = {
+            let internals = self.internals.lock().unwrap();
+            (internals.client.clone(), internals.max_value_length)
+        };
+        let mut nodes = variables::expand_variables(
+            &client,
+            variables_reference,
+            max_depth,
+            variables::MAX_EXPANDED_VARIABLES,
+        )?;
+        variables::truncate_values(&mut nodes, max_value_length);
+        Ok(nodes)
+    }
+
+    /// Re-fetch the variables below `variables_reference` with a new value format, optionally
+    /// keeping the variables in `previous` which were expanded
+    pub fn refresh_variables(
+        &self,
+        variables_reference: VariablesReference,
+        previous: &[variables::VariableNode],
+        preserve_expansion: bool,
+        format: requests::ValueFormat,
+    ) -> eyre::Result<Vec<variables::VariableNode>> {
+        let (client, max_value_length) = {
+            let internals = self.internals.lock().unwrap();
+            (internals.client.clone(), internals.max_value_length)
+        };
+        let mut nodes = variables::refresh_variables(
+            &client,
+            variables_reference,
+            previous,
+            preserve_expansion,
+            format,
+        )?;
+        variables::truncate_values(&mut nodes, max_value_length);
+        Ok(nodes)
+    }
+
+    /// Truncate variable values longer than `max_length` characters, e.g. to protect the
+    /// interface from values megabytes long, or show them in full with `None`
+    ///
+    /// The full value of a truncated variable can be fetched with [`Debugger::full_value`].
+    pub fn set_max_value_length(&self, max_length: Option<usize>) {
+        self.internals.lock().unwrap().max_value_length = max_length;
+    }
+
+    /// The full value of `variable` in the frame `frame_id`, evaluated again so it is not
+    /// truncated
+    pub fn full_value(
+        &self,
+        frame_id: StackFrameId,
+        variable: &transport::types::Variable,
+    ) -> eyre::Result<String> {
+        self.internals
+            .lock()
+            .unwrap()
+            .full_value(frame_id, variable)
+    }
+
+    /// Capabilities reported by the adapter, e.g. for [`crate::validate_launch_config`]
+    pub fn capabilities(&self) -> responses::Capabilities {
+        self.internals.lock().unwrap().capabilities.clone()
+    }
+
+    /// Extra columns the adapter wants shown in a modules view
+    pub fn additional_module_columns(&self) -> Vec<transport::types::ColumnDescriptor> {
+        self.internals.lock().unwrap().additional_module_columns()
+    }
+
+    /// The outcome of the session, e.g. to report once it has ended
+    pub fn session_result(&self) -> types::SessionResult {
+        self.internals.lock().unwrap().session_result()
+    }
+
+    /// End the session, falling back to disconnecting if the adapter does not answer the
+    /// terminate request in time
+    pub fn shutdown(&self) -> eyre::Result<()> {
+        self.internals.lock().unwrap().shutdown(SHUTDOWN_TIMEOUT)
+    }
+
+    /// Disconnect from the adapter while leaving the debuggee suspended, e.g. to hand the
+    /// process over to another debugger
+    pub fn detach_suspended(&self) -> eyre::Result<()> {
+        self.internals.lock().unwrap().disconnect(true)
+    }
+
     pub fn with_current_source<F>(&self, f: F)
     where
         F: Fn(Option<&FileSource>),
@@ -182,10 +681,19 @@ impl Debugger {
         f(internals.current_source.as_ref())
     }
 
-    fn execute(&self, body: requests::RequestBody) -> eyre::Result<()> {
-        self.internals.lock().unwrap().client.execute(body)
+    /// Wait for a line of output from the debugee matching `pattern`, e.g. to synchronise on a
+    /// log line before stepping
+    ///
+    /// Only output received after this is called is considered.
+    pub fn wait_for_output(&self, pattern: &Regex, timeout: Duration) -> eyre::Result<String> {
+        let output = self.internals.lock().unwrap().subscribe_output_lines();
+        internals::wait_for_output(&output, pattern, timeout)
     }
 
+    /// Wait for the next event matching `pred`, panicking if too many other events arrive first
+    ///
+    /// Output from the debugee is not counted, since a chatty program may print any number of
+    /// lines before the expected event.
     pub fn wait_for_event<F>(&self, pred: F) -> Event
     where
         F: Fn(&Event) -> bool,
@@ -203,7 +711,9 @@ impl Debugger {
             } else {
                 tracing::trace!(event = ?evt, "non-matching event");
             }
-            n += 1;
+            if !matches!(evt, Event::Output { .. }) {
+                n += 1;
+            }
         }
     }
 }
@@ -211,9 +721,131 @@ impl Debugger {
 impl Drop for Debugger {
     fn drop(&mut self) {
         tracing::debug!("dropping debugger");
-        self.execute(requests::RequestBody::Disconnect(Disconnect {
-            terminate_debugee: true,
-        }))
-        .unwrap();
+        let mut internals = self.internals.lock().unwrap();
+        if !internals.disconnected {
+            // the adapter may already have gone away
+            if let Err(e) = internals.disconnect(false) {
+                tracing::warn!(error = %e, "disconnecting from adapter");
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::sync::{Arc, Mutex};
+
+    use transport::requests::{self, RequestBody};
+
+    use super::Debugger;
+    use crate::{fake_adapter, internals::DebuggerInternals, Breakpoint, Event};
+
+    #[test]
+    fn restart_keeps_breakpoints() -> eyre::Result<()> {
+        // the adapter cannot restart by itself
+        let (client, adapter) = fake_adapter::connect(|request| match request.body {
+            RequestBody::Initialize(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"initialize","body":{}"#,
+            )],
+            RequestBody::Launch(_) => vec![
+                fake_adapter::response(request, r#""command":"launch""#),
+                fake_adapter::event(r#""event":"initialized""#),
+            ],
+            RequestBody::SetBreakpoints(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"setBreakpoints","body":{"breakpoints":[{"verified":true,"line":4}]}"#,
+            )],
+            RequestBody::ConfigurationDone => vec![fake_adapter::response(
+                request,
+                r#""command":"configurationDone""#,
+            )],
+            RequestBody::Terminate(_) => vec![
+                fake_adapter::response(request, r#""command":"terminate""#),
+                fake_adapter::event(r#""event":"terminated""#),
+            ],
+            _ => Vec::new(),
+        });
+        let (publisher, rx) = crossbeam_channel::unbounded();
+        let mut internals = DebuggerInternals::new(client, publisher, None);
+        let program = concat!(env!("CARGO_MANIFEST_DIR"), "/src/lib.rs");
+        internals.initialise(
+            crate::LaunchArguments::from_path(program, crate::Language::DebugPy).into(),
+        )?;
+        internals.on_event(adapter.events.recv()?);
+        internals.add_breakpoint(Breakpoint {
+            path: program.into(),
+            line: 4,
+            ..Default::default()
+        })?;
+        let debugger = Debugger {
+            internals: Arc::new(Mutex::new(internals)),
+            rx,
+        };
+        debugger.launch()?;
+
+        debugger.restart()?;
+
+        let requests: Vec<_> = adapter.requests.try_iter().collect();
+        let commands: Vec<_> = requests
+            .iter()
+            .map(|request| match &request.body {
+                RequestBody::Initialize(_) => "initialize",
+                RequestBody::Launch(_) => "launch",
+                RequestBody::SetBreakpoints(_) => "setBreakpoints",
+                RequestBody::ConfigurationDone => "configurationDone",
+                RequestBody::Terminate(requests::Terminate {
+                    restart: Some(true),
+                }) => "restart",
+                _ => "other",
+            })
+            .collect();
+        assert_eq!(
+            commands,
+            [
+                "initialize",
+                "launch",
+                "setBreakpoints",
+                "configurationDone",
+                "restart",
+                "launch",
+                "setBreakpoints",
+                "configurationDone",
+            ]
+        );
+        let (RequestBody::SetBreakpoints(before), RequestBody::SetBreakpoints(after)) =
+            (&requests[2].body, &requests[6].body)
+        else {
+            unreachable!();
+        };
+        assert_eq!(before.source.path, after.source.path);
+        assert_eq!(before.lines, after.lines);
+        Ok(())
+    }
+
+    #[test]
+    fn wait_for_event_skips_output() {
+        let (client, _adapter) = fake_adapter::connect(|_| Vec::new());
+        let (publisher, rx) = crossbeam_channel::unbounded();
+        let internals = DebuggerInternals::new(client, publisher.clone(), None);
+        let debugger = Debugger {
+            internals: Arc::new(Mutex::new(internals)),
+            rx,
+        };
+
+        for i in 0..500 {
+            publisher
+                .send(Event::Output {
+                    category: None,
+                    output: format!("line {i}\n"),
+                    group: None,
+                    depth: 0,
+                })
+                .unwrap();
+        }
+        publisher.send(Event::Ended).unwrap();
+
+        let event = debugger.wait_for_event(|event| matches!(event, Event::Ended));
+        assert!(matches!(event, Event::Ended));
     }
 }
@@ -0,0 +1,67 @@
+//! A fake debug adapter for tests, which computes its replies from each typed request
+use transport::{events, mock::MockAdapter, requests, Client, Message};
+
+/// Requests received by a fake adapter, and events received by the connected client
+pub(crate) struct FakeAdapter {
+    pub(crate) requests: crossbeam_channel::Receiver<requests::Request>,
+    pub(crate) events: crossbeam_channel::Receiver<events::Event>,
+    adapter: MockAdapter,
+}
+
+impl FakeAdapter {
+    /// Send an event which is not a reply to any request, with the event name and body given as
+    /// JSON fields
+    pub(crate) fn send_event(&self, fields: &str) {
+        let event: serde_json::Value = serde_json::from_str(&event(fields)).expect("parsing event");
+        self.adapter
+            .send_event(
+                event["event"].as_str().expect("event name"),
+                event["body"].clone(),
+            )
+            .expect("sending event");
+    }
+}
+
+/// Connect a client to a fake adapter, which replies to each request with the messages returned
+/// from `respond`
+pub(crate) fn connect<F>(respond: F) -> (Client, FakeAdapter)
+where
+    F: Fn(&requests::Request) -> Vec<String> + Send + 'static,
+{
+    let (requests_tx, requests_rx) = crossbeam_channel::unbounded();
+    let (events_tx, events_rx) = crossbeam_channel::unbounded();
+    let (client, adapter) = MockAdapter::connect_with_responder(events_tx, move |request| {
+        let Ok(Message::Request(request)) = serde_json::from_value(request.clone()) else {
+            panic!("unexpected message {request}");
+        };
+        // forward the request before replying so the order seen by tests is the wire order
+        let messages = respond(&request);
+        let _ = requests_tx.send(request);
+        messages
+            .iter()
+            .map(|message| serde_json::from_str(message).expect("parsing reply"))
+            .collect()
+    })
+    .expect("creating client");
+    (
+        client,
+        FakeAdapter {
+            requests: requests_rx,
+            events: events_rx,
+            adapter,
+        },
+    )
+}
+
+/// A successful response to `request`, with the command and body given as JSON fields
+pub(crate) fn response(request: &requests::Request, fields: &str) -> String {
+    format!(
+        "{{\"type\":\"response\",\"request_seq\":{},\"success\":true,{fields}}}",
+        request.seq
+    )
+}
+
+/// An event, with the event name and body given as JSON fields
+pub(crate) fn event(fields: &str) -> String {
+    format!("{{\"type\":\"event\",{fields}}}")
+}
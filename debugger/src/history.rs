@@ -0,0 +1,125 @@
+//! History of the expressions entered into the debug console, so they can be recalled
+use std::{fs::File, io::BufReader, path::Path};
+
+use eyre::WrapErr;
+
+/// Expressions entered into the debug console, oldest first, with a cursor for recalling them
+/// e.g. with the up and down arrow keys
+#[derive(Debug, Clone, Default)]
+pub struct History {
+    entries: Vec<String>,
+    /// The entry currently recalled, or `None` if the user is not navigating the history
+    position: Option<usize>,
+}
+
+impl History {
+    /// Add an entry, unless it repeats the most recent entry, and stop navigating
+    pub fn push(&mut self, entry: impl Into<String>) {
+        let entry = entry.into();
+        self.position = None;
+        if entry.trim().is_empty() || self.entries.last() == Some(&entry) {
+            return;
+        }
+        self.entries.push(entry);
+    }
+
+    /// Recall the entry before the current one, wrapping around to the most recent entry
+    pub fn older(&mut self) -> Option<&str> {
+        let last = self.entries.len().checked_sub(1)?;
+        let position = match self.position {
+            Some(0) | None => last,
+            Some(position) => position - 1,
+        };
+        self.position = Some(position);
+        Some(&self.entries[position])
+    }
+
+    /// Recall the entry after the current one, wrapping around to the oldest entry
+    pub fn newer(&mut self) -> Option<&str> {
+        let last = self.entries.len().checked_sub(1)?;
+        let position = match self.position {
+            Some(position) if position < last => position + 1,
+            _ => 0,
+        };
+        self.position = Some(position);
+        Some(&self.entries[position])
+    }
+
+    /// The entries, oldest first
+    pub fn entries(&self) -> &[String] {
+        &self.entries
+    }
+
+    /// Save the entries to `path`, so they can be recalled in a later session
+    pub fn save(&self, path: impl AsRef<Path>) -> eyre::Result<()> {
+        let path = path.as_ref();
+        let f = File::create(path).with_context(|| format!("creating {}", path.display()))?;
+        serde_json::to_writer_pretty(f, &self.entries).context("serializing history")
+    }
+
+    /// Load entries saved with [`History::save`]
+    pub fn load(path: impl AsRef<Path>) -> eyre::Result<Self> {
+        let path = path.as_ref();
+        let f = File::open(path).with_context(|| format!("opening {}", path.display()))?;
+        let entries =
+            serde_json::from_reader(BufReader::new(f)).context("deserializing history")?;
+        Ok(Self {
+            entries,
+            position: None,
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::History;
+
+    fn history(entries: &[&str]) -> History {
+        let mut history = History::default();
+        for entry in entries {
+            history.push(*entry);
+        }
+        history
+    }
+
+    #[test]
+    fn deduplicates_consecutive_entries() {
+        let history = history(&["a", "a", "b", "", "a", "a"]);
+        assert_eq!(history.entries(), ["a", "b", "a"]);
+    }
+
+    #[test]
+    fn navigation_wraps_around() {
+        let mut history = history(&["a", "b", "c"]);
+
+        assert_eq!(history.older(), Some("c"));
+        assert_eq!(history.older(), Some("b"));
+        assert_eq!(history.older(), Some("a"));
+        assert_eq!(history.older(), Some("c"));
+
+        assert_eq!(history.newer(), Some("a"));
+        assert_eq!(history.newer(), Some("b"));
+
+        // entering a new expression starts navigating from the most recent entry again
+        history.push("d");
+        assert_eq!(history.older(), Some("d"));
+
+        let mut empty = History::default();
+        assert_eq!(empty.older(), None);
+        assert_eq!(empty.newer(), None);
+    }
+
+    #[test]
+    fn round_trip() -> eyre::Result<()> {
+        let path = std::env::temp_dir().join(format!("history-{}.json", std::process::id()));
+        let history = history(&["x + 1", "items[0]"]);
+
+        history.save(&path)?;
+        let mut loaded = History::load(&path)?;
+        std::fs::remove_file(&path)?;
+
+        assert_eq!(loaded.entries(), history.entries());
+        assert_eq!(loaded.older(), Some("items[0]"));
+        Ok(())
+    }
+}
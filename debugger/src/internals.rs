@@ -1,20 +1,37 @@
 use eyre::WrapErr;
+use regex::Regex;
 use server::Server;
-use std::{collections::HashMap, path::PathBuf};
+use std::{
+    collections::HashMap,
+    path::{Path, PathBuf},
+    sync::Arc,
+    time::{Duration, Instant},
+};
 use transport::{
-    requests::{self, Initialize, PathFormat},
+    requests::{self, Initialize},
     responses,
-    types::{Source, SourceBreakpoint, ThreadId},
+    types::{Source, SourceBreakpoint, StackFrame, StackFrameId, ThreadId, VariablesReference},
     Client,
 };
 
 use crate::{
+    bootstrap::Bootstrap,
     debugger::InitialiseArguments,
+    path_mapping::PathMapper,
+    persistence,
+    pretty_print::{self, LanguagePrettyPrinter, PassThrough},
     state::DebuggerState,
-    types::{Breakpoint, BreakpointId},
-    Event,
+    types::{
+        AllStacks, Breakpoint, BreakpointId, BreakpointLines, ExceptionFocus, FrameState,
+        Instruction, ScopeState, SessionResult, StoppedContext, WatchValue, Watchpoint,
+    },
+    variables, Event,
 };
 
+/// How long to wait for each pinned watch to be evaluated, so a slow expression does not hold up
+/// the others
+const WATCH_TIMEOUT: Duration = Duration::from_secs(1);
+
 #[derive(Debug, PartialEq, Eq, Clone)]
 pub struct FileSource {
     pub line: usize,
@@ -24,13 +41,60 @@ pub struct FileSource {
 pub(crate) struct DebuggerInternals {
     pub(crate) client: Client,
     pub(crate) publisher: crossbeam_channel::Sender<Event>,
+    run_state_subscribers: Vec<crossbeam_channel::Sender<bool>>,
+    output_line_subscribers: Vec<crossbeam_channel::Sender<String>>,
+    /// Output received since the last newline, for the line-buffered output subscribers
+    partial_output_line: String,
+    pub(crate) bootstrap: Arc<Bootstrap>,
 
     // debugger specific details
     pub(crate) current_thread_id: Option<ThreadId>,
+    /// The thread the user selected, which stays current when other threads stop
+    pinned_thread_id: Option<ThreadId>,
     pub(crate) breakpoints: HashMap<BreakpointId, Breakpoint>,
+    /// Breakpoints as reported by the adapter, by local source path
+    pub(crate) adapter_breakpoints: HashMap<PathBuf, Vec<transport::types::Breakpoint>>,
+    /// The requested and verified lines of each breakpoint sent to the adapter
+    breakpoint_lines: HashMap<BreakpointId, BreakpointLines>,
+    /// The names of the functions to break on, applied again whenever the adapter is initialised
+    function_breakpoints: Vec<String>,
+    /// Data breakpoints, with the id the adapter reported for each
+    watchpoints: Vec<(Watchpoint, Option<transport::types::BreakpointId>)>,
 
     current_breakpoint_id: BreakpointId,
     pub(crate) current_source: Option<FileSource>,
+    /// The stack frame selected by the user, which watches are evaluated in
+    current_frame_id: Option<StackFrameId>,
+    /// Watch expressions re-evaluated whenever the selected frame changes
+    pinned_watches: Vec<String>,
+    /// How long to wait for each watch expression to be evaluated
+    pub(crate) watch_timeout: Duration,
+    /// Variable values longer than this are truncated, see [`variables::truncate_value`]
+    pub(crate) max_value_length: Option<usize>,
+
+    /// The debugee was launched without debugging
+    pub(crate) no_debug: bool,
+
+    pub(crate) path_mapper: PathMapper,
+    /// Renders evaluate and variable results for the language being debugged
+    pretty_printer: Box<dyn LanguagePrettyPrinter>,
+
+    /// Capabilities reported by the adapter in the initialize response
+    pub(crate) capabilities: responses::Capabilities,
+    /// A disconnect request has been sent
+    pub(crate) disconnected: bool,
+    /// The adapter has sent the initialized event
+    initialised: bool,
+    /// The configuration done request is in flight
+    pub(crate) configuring: bool,
+    /// Events received while configuring, delivered once configuration is done
+    buffered_events: Vec<transport::events::Event>,
+    /// How many output groups are currently open
+    output_depth: usize,
+    /// The exit code of the debugee, once it has exited
+    exit_code: Option<i64>,
+    /// The adapter has reported that the session terminated
+    terminated: bool,
 
     pub(crate) _server: Option<Box<dyn Server + Send>>,
 }
@@ -44,15 +108,76 @@ impl DebuggerInternals {
         Self::with_breakpoints(client, publisher, HashMap::new(), server)
     }
 
+    /// Wait `fallback` after launching for the initialized event, or forever if `None`
+    pub(crate) fn with_initialized_fallback(mut self, fallback: Option<Duration>) -> Self {
+        self.bootstrap = Arc::new(Bootstrap::new(fallback));
+        self
+    }
+
     pub(crate) fn emit(&mut self, event: Event) {
+        let running = match &event {
+            Event::Paused { .. } => Some(false),
+            Event::Running => Some(true),
+            _ => None,
+        };
+        if let Some(running) = running {
+            // drop subscribers which have gone away
+            self.run_state_subscribers
+                .retain(|subscriber| subscriber.send(running).is_ok());
+        }
         let _ = self.publisher.send(event);
     }
 
+    /// Subscribe to whether the debugee is running (`true`) or stopped (`false`)
+    pub(crate) fn subscribe_run_state(&mut self) -> crossbeam_channel::Receiver<bool> {
+        let (tx, rx) = crossbeam_channel::unbounded();
+        self.run_state_subscribers.push(tx);
+        rx
+    }
+
+    /// Subscribe to the output from the debugee, split into lines
+    ///
+    /// A trailing partial line is delivered once the debugee ends.
+    pub(crate) fn subscribe_output_lines(&mut self) -> crossbeam_channel::Receiver<String> {
+        let (tx, rx) = crossbeam_channel::unbounded();
+        self.output_line_subscribers.push(tx);
+        rx
+    }
+
+    fn buffer_output_lines(&mut self, output: &str) {
+        self.partial_output_line.push_str(output);
+        while let Some(end) = self.partial_output_line.find('\n') {
+            let line: String = self.partial_output_line.drain(..=end).collect();
+            let line = line.trim_end_matches(['\r', '\n']).to_string();
+            self.output_line_subscribers
+                .retain(|subscriber| subscriber.send(line.clone()).is_ok());
+        }
+    }
+
+    /// Deliver any output which was not terminated by a newline
+    fn flush_output_lines(&mut self) {
+        if self.partial_output_line.is_empty() {
+            return;
+        }
+        let line = std::mem::take(&mut self.partial_output_line);
+        self.output_line_subscribers
+            .retain(|subscriber| subscriber.send(line.clone()).is_ok());
+    }
+
     pub(crate) fn initialise(&mut self, arguments: InitialiseArguments) -> eyre::Result<()> {
+        let (path_format, language) = match &arguments {
+            InitialiseArguments::Launch(launch_arguments) => {
+                (launch_arguments.path_format, launch_arguments.language)
+            }
+            InitialiseArguments::Attach(attach_arguments) => {
+                (attach_arguments.path_format, attach_arguments.language)
+            }
+        };
+        self.pretty_printer = pretty_print::for_language(language);
         let req = requests::RequestBody::Initialize(Initialize {
             adapter_id: "dap gui".to_string(),
             lines_start_at_one: false,
-            path_format: PathFormat::Path,
+            path_format,
             supports_start_debugging_request: true,
             supports_variable_type: true,
             supports_variable_paging: true,
@@ -60,24 +185,77 @@ impl DebuggerInternals {
             supports_memory_event: true,
         });
 
-        // TODO: deal with capabilities from the response
-        let _ = self.client.send(req).context("sending initialize event")?;
+        let res = self
+            .bootstrap
+            .send(&self.client, req)
+            .context("sending initialize event")?;
+        if let Some(responses::ResponseBody::Initialize(capabilities)) = res {
+            self.capabilities = capabilities;
+        }
 
         match arguments {
             InitialiseArguments::Launch(launch_arguments) => {
+                self.no_debug = launch_arguments.no_debug;
+                let mut path_mapper = PathMapper::default().with_path_format(path_format);
+                if let Some(cwd) = launch_arguments.cwd() {
+                    path_mapper = path_mapper.with_cwd(cwd);
+                }
+                self.path_mapper = path_mapper;
+
                 // send launch event
                 let req = launch_arguments.to_request();
-                self.client.execute(req).context("sending launch request")?;
+                self.bootstrap
+                    .execute(&self.client, req)
+                    .context("sending launch request")?;
             }
             InitialiseArguments::Attach(attach_arguments) => {
+                self.path_mapper = PathMapper::new(attach_arguments.path_mappings.clone())
+                    .with_path_format(path_format);
+
                 let req = attach_arguments.to_request();
-                self.client.execute(req).context("sending attach request")?;
+                self.bootstrap
+                    .execute(&self.client, req)
+                    .context("sending attach request")?;
             }
         }
 
         Ok(())
     }
 
+    /// Disconnect from the adapter, either terminating the debuggee or leaving it suspended
+    ///
+    /// Leaving the debuggee suspended requires the adapter to support `suspendDebuggee`. An
+    /// inspect-only session never terminates the debuggee.
+    pub(crate) fn disconnect(&mut self, suspend_debuggee: bool) -> eyre::Result<()> {
+        if suspend_debuggee {
+            eyre::ensure!(
+                self.capabilities.support_suspend_debuggee.unwrap_or(false),
+                "adapter does not support suspending the debuggee on disconnect"
+            );
+        }
+
+        self.client
+            .execute(requests::RequestBody::Disconnect(requests::Disconnect {
+                terminate_debugee: !suspend_debuggee && !self.client.is_inspect_only(),
+                suspend_debuggee: suspend_debuggee.then_some(true),
+            }))
+            .context("sending disconnect request")?;
+        self.disconnected = true;
+        Ok(())
+    }
+
+    /// End the session through [`Client::shutdown`], asking the debuggee to terminate
+    /// gracefully if the adapter supports it
+    ///
+    /// Some adapters never answer the terminate request, so if the response does not arrive
+    /// within `timeout` the client falls back to disconnecting. The connection is closed either
+    /// way.
+    pub(crate) fn shutdown(&mut self, timeout: Duration) -> eyre::Result<()> {
+        let result = self.client.shutdown(timeout);
+        self.disconnected = true;
+        result
+    }
+
     pub(crate) fn with_breakpoints(
         client: Client,
         publisher: crossbeam_channel::Sender<Event>,
@@ -90,10 +268,34 @@ impl DebuggerInternals {
         Self {
             client,
             publisher,
+            run_state_subscribers: Vec::new(),
+            output_line_subscribers: Vec::new(),
+            partial_output_line: String::new(),
+            bootstrap: Arc::new(Bootstrap::default()),
             current_thread_id: None,
+            pinned_thread_id: None,
             breakpoints,
+            adapter_breakpoints: HashMap::new(),
+            breakpoint_lines: HashMap::new(),
+            function_breakpoints: Vec::new(),
+            watchpoints: Vec::new(),
             current_breakpoint_id,
             current_source: None,
+            current_frame_id: None,
+            pinned_watches: Vec::new(),
+            watch_timeout: WATCH_TIMEOUT,
+            max_value_length: None,
+            no_debug: false,
+            path_mapper: PathMapper::default(),
+            pretty_printer: Box::new(PassThrough),
+            capabilities: responses::Capabilities::default(),
+            disconnected: false,
+            initialised: false,
+            configuring: false,
+            buffered_events: Vec::new(),
+            output_depth: 0,
+            exit_code: None,
+            terminated: false,
             _server: server,
         }
     }
@@ -102,18 +304,81 @@ impl DebuggerInternals {
     pub(crate) fn on_event(&mut self, event: transport::events::Event) {
         tracing::debug!("handling event");
 
+        if self.configuring && matches!(event, transport::events::Event::Stopped(_)) {
+            // e.g. stopOnEntry, which should be delivered after the debugee is running
+            tracing::debug!("buffering stopped event until configuration is done");
+            self.buffered_events.push(event);
+            return;
+        }
+
         match event {
             transport::events::Event::Initialized => {
+                // also sent again when the debuggee is restarted, so forget how the last one
+                // ended
+                self.terminated = false;
+                self.exit_code = None;
+                self.initialised = true;
+                // apply breakpoints loaded before the adapter was ready, before telling our
+                // subscribers so they are set before configuration is done
+                if !self.breakpoints.is_empty() {
+                    if let Err(e) = self.broadcast_breakpoints() {
+                        tracing::warn!(error = %e, "applying loaded breakpoints");
+                    }
+                }
+                // the adapter forgets function breakpoints when the session restarts
+                if !self.function_breakpoints.is_empty() {
+                    if let Err(e) = self.broadcast_function_breakpoints() {
+                        tracing::warn!(error = %e, "applying function breakpoints");
+                    }
+                }
+
                 // broadcast our internal state change
                 self.set_state(DebuggerState::Initialised);
             }
-            // transport::events::Event::Output(_) => todo!(),
+            transport::events::Event::Output(transport::events::OutputEventBody {
+                category,
+                output,
+                group,
+                ..
+            }) => {
+                let depth = match group {
+                    Some(
+                        transport::events::OutputEventGroup::Start
+                        | transport::events::OutputEventGroup::StartCollapsed,
+                    ) => {
+                        self.output_depth += 1;
+                        self.output_depth - 1
+                    }
+                    Some(transport::events::OutputEventGroup::End) => {
+                        self.output_depth = self.output_depth.saturating_sub(1);
+                        self.output_depth
+                    }
+                    None => self.output_depth,
+                };
+                self.buffer_output_lines(&output);
+                self.emit(Event::Output {
+                    category,
+                    output,
+                    group,
+                    depth,
+                });
+            }
             // transport::events::Event::Process(_) => todo!(),
             transport::events::Event::Stopped(transport::events::StoppedEventBody {
                 thread_id,
+                description,
+                text,
                 ..
             }) => {
+                self.bootstrap.on_stopped();
+                // follow the thread which stopped, unless the user pinned a thread which is
+                // also stopped
+                let thread_id = self
+                    .pinned_thread_id
+                    .filter(|pinned| self.client.is_stopped(*pinned))
+                    .unwrap_or(thread_id);
                 self.current_thread_id = Some(thread_id);
+
                 // determine where we are in the source code
                 let Some(responses::ResponseBody::StackTrace(responses::StackTraceResponse {
                     stack_frames,
@@ -138,12 +403,12 @@ impl DebuggerInternals {
 
                 let current_source = FileSource {
                     line,
-                    file_path: source.path.clone(),
+                    file_path: source.path.as_deref().map(|p| self.path_mapper.to_local(p)),
                 };
                 self.current_source = Some(current_source.clone());
 
                 let Some(responses::ResponseBody::StackTrace(responses::StackTraceResponse {
-                    stack_frames,
+                    mut stack_frames,
                 })) = self
                     .client
                     .send(requests::RequestBody::StackTrace(requests::StackTrace {
@@ -155,20 +420,52 @@ impl DebuggerInternals {
                     unreachable!()
                 };
 
+                for frame in &mut stack_frames {
+                    if let Some(path) = frame.source.as_mut().and_then(|s| s.path.as_mut()) {
+                        *path = self.path_mapper.to_local(path);
+                    }
+                }
+                self.current_frame_id = stack_frames.first().map(|frame| frame.id);
                 self.set_state(DebuggerState::Paused {
                     stack: stack_frames,
                     source: current_source,
+                    description,
+                    text,
                 });
+                self.evaluate_watches();
             }
             transport::events::Event::Continued(_) => {
                 self.current_thread_id = None;
                 self.current_source = None;
+                self.current_frame_id = None;
                 self.set_state(DebuggerState::Running);
             }
-            // transport::events::Event::Thread(_) => todo!(),
-            transport::events::Event::Exited(_) | transport::events::Event::Terminated => {
+            transport::events::Event::Exited(transport::events::ExitedEventBody { exit_code }) => {
+                self.exit_code = Some(exit_code);
+                self.flush_output_lines();
+                self.set_state(DebuggerState::Ended);
+            }
+            transport::events::Event::Terminated => {
+                self.terminated = true;
+                self.flush_output_lines();
                 self.set_state(DebuggerState::Ended);
             }
+            transport::events::Event::Breakpoint(transport::events::BreakpointEventBody {
+                reason,
+                breakpoint,
+            }) => {
+                let expired = reason == "removed" || !breakpoint.verified;
+                let position = breakpoint.id.and_then(|id| {
+                    self.watchpoints
+                        .iter()
+                        .position(|(_, adapter_id)| *adapter_id == Some(id))
+                });
+                if let (true, Some(position)) = (expired, position) {
+                    let (watchpoint, _) = self.watchpoints.remove(position);
+                    tracing::debug!(?watchpoint, "watchpoint expired");
+                    self.emit(Event::WatchpointExpired(watchpoint));
+                }
+            }
             // transport::events::Event::DebugpyWaitingForServer { host, port } => todo!(),
             // transport::events::Event::Module(_) => todo!(),
             _ => {
@@ -180,6 +477,16 @@ impl DebuggerInternals {
     #[tracing::instrument(skip(self))]
     pub(crate) fn add_breakpoint(&mut self, breakpoint: Breakpoint) -> eyre::Result<BreakpointId> {
         tracing::debug!("adding breakpoint");
+        if let Some(mode) = &breakpoint.mode {
+            let supported = self
+                .capabilities
+                .breakpoint_modes
+                .iter()
+                .flatten()
+                .any(|m| m.mode == *mode && m.applies_to.iter().any(|kind| kind == "source"));
+            eyre::ensure!(supported, "breakpoint mode {mode} not supported by adapter");
+        }
+
         let id = self.next_id();
         self.breakpoints.insert(id, breakpoint.clone());
         self.broadcast_breakpoints()
@@ -187,60 +494,846 @@ impl DebuggerInternals {
         Ok(id)
     }
 
+    /// Add a breakpoint at `path:line` which stops when `expression` is equal to its value in
+    /// the frame `frame_id`
+    pub(crate) fn break_when_equals(
+        &mut self,
+        frame_id: StackFrameId,
+        path: PathBuf,
+        line: usize,
+        expression: &str,
+    ) -> eyre::Result<BreakpointId> {
+        eyre::ensure!(
+            self.capabilities
+                .supports_conditional_breakpoints
+                .unwrap_or(false),
+            "adapter does not support conditional breakpoints"
+        );
+
+        let responses::EvaluateResponse { result, .. } = self
+            .client
+            .send_typed(requests::Evaluate {
+                expression: expression.to_string(),
+                frame_id: Some(frame_id),
+                context: Some(requests::EvaluateContext::Watch),
+                source: None,
+                line: None,
+            })
+            .with_context(|| format!("evaluating {expression}"))?;
+
+        self.add_breakpoint(Breakpoint {
+            path,
+            line,
+            condition: Some(format!("{expression} == {result}")),
+            ..Default::default()
+        })
+    }
+
+    /// Add a watchpoint, which stops when the variable `name` in `variables_reference` is
+    /// changed
+    pub(crate) fn add_watchpoint(
+        &mut self,
+        variables_reference: VariablesReference,
+        name: &str,
+    ) -> eyre::Result<Watchpoint> {
+        eyre::ensure!(
+            self.capabilities.supports_data_breakpoints.unwrap_or(false),
+            "adapter does not support data breakpoints"
+        );
+
+        let responses::DataBreakpointInfoResponse {
+            data_id,
+            description,
+            ..
+        } = self
+            .client
+            .send_typed(requests::DataBreakpointInfo {
+                variables_reference: Some(variables_reference),
+                name: name.to_string(),
+                frame_id: None,
+            })
+            .with_context(|| format!("requesting data breakpoint info for {name}"))?;
+        let data_id = data_id.ok_or_else(|| eyre::eyre!("cannot watch {name}: {description}"))?;
+
+        let watchpoint = Watchpoint {
+            data_id,
+            description,
+        };
+        self.watchpoints.push((watchpoint.clone(), None));
+        self.broadcast_watchpoints()
+            .context("updating watchpoints with debugee")?;
+        Ok(watchpoint)
+    }
+
+    /// Send every watchpoint to the adapter, recording the id it reports for each
+    fn broadcast_watchpoints(&mut self) -> eyre::Result<()> {
+        let responses::SetBreakpoints { breakpoints } = self
+            .client
+            .send_typed(requests::SetDataBreakpoints {
+                breakpoints: self
+                    .watchpoints
+                    .iter()
+                    .map(|(watchpoint, _)| transport::types::DataBreakpoint {
+                        data_id: watchpoint.data_id.clone(),
+                        access_type: Some(transport::types::DataBreakpointAccessType::Write),
+                        condition: None,
+                        hit_condition: None,
+                    })
+                    .collect(),
+            })
+            .context("sending set data breakpoints request")?;
+
+        // the adapter reports the breakpoints in the order they were requested
+        for ((_, adapter_id), reported) in self.watchpoints.iter_mut().zip(breakpoints) {
+            *adapter_id = reported.id;
+        }
+        Ok(())
+    }
+
+    /// Save the breakpoints to `path`, so they can be loaded in a later session
+    pub(crate) fn save_breakpoints(&self, path: &Path) -> eyre::Result<()> {
+        let mut breakpoints: Vec<_> = self.breakpoints.iter().collect();
+        breakpoints.sort_by_key(|(id, _)| **id);
+        let breakpoints: Vec<_> = breakpoints.into_iter().map(|(_, b)| b.clone()).collect();
+        persistence::save_breakpoints(path, &breakpoints)
+    }
+
+    /// Load breakpoints saved with [`DebuggerInternals::save_breakpoints`]. They are applied once
+    /// the adapter is initialised.
+    pub(crate) fn load_breakpoints(&mut self, path: &Path) -> eyre::Result<()> {
+        for breakpoint in persistence::load_breakpoints(path)? {
+            let id = self.next_id();
+            self.breakpoints.insert(id, breakpoint);
+        }
+
+        if self.initialised {
+            self.broadcast_breakpoints()
+                .context("updating breakpoints with debugee")?;
+        }
+        Ok(())
+    }
+
+    /// Replace the function breakpoints, which stop when a function named in `names` is called
+    ///
+    /// The names are kept, so they can be set before the adapter is initialised, and are applied
+    /// again if it is initialised again, e.g. after the session restarts.
+    pub(crate) fn set_function_breakpoints(&mut self, names: Vec<String>) -> eyre::Result<()> {
+        self.function_breakpoints = names;
+        if self.initialised {
+            self.broadcast_function_breakpoints()
+                .context("updating function breakpoints with debugee")?;
+        }
+        Ok(())
+    }
+
+    fn broadcast_function_breakpoints(&mut self) -> eyre::Result<()> {
+        if self.no_debug {
+            tracing::warn!("debugee launched without debugging, not setting breakpoints");
+            return Ok(());
+        }
+        eyre::ensure!(
+            self.capabilities
+                .supports_function_breakpoints
+                .unwrap_or(false),
+            "adapter does not support function breakpoints"
+        );
+
+        let req = requests::RequestBody::SetFunctionBreakpoints(requests::SetFunctionBreakpoints {
+            breakpoints: self
+                .function_breakpoints
+                .iter()
+                .map(|name| requests::Breakpoint { name: name.clone() })
+                .collect(),
+        });
+        self.bootstrap
+            .send(&self.client, req)
+            .context("sending set function breakpoints request")?;
+        Ok(())
+    }
+
     #[tracing::instrument(skip(self))]
     pub(crate) fn remove_breakpoint(&mut self, id: BreakpointId) {
         tracing::debug!("removing breakpoint");
         self.breakpoints.remove(&id);
+        self.breakpoint_lines.remove(&id);
         self.broadcast_breakpoints()
             .expect("updating breakpoints with debugee");
     }
 
     fn broadcast_breakpoints(&mut self) -> eyre::Result<()> {
+        if self.no_debug {
+            tracing::warn!("debugee launched without debugging, not setting breakpoints");
+            return Ok(());
+        }
+
         // TODO: don't assume the breakpoints are for the same file
         if self.breakpoints.is_empty() {
             return Ok(());
         }
 
-        // group breakpoints by source file and send in multiple batches
-        let breakpoints_by_source = self.breakpoints_by_source();
+        // adapters may misinterpret hit conditions they do not support
+        let supports_hit_conditions = self
+            .capabilities
+            .supports_hit_conditional_breakpoints
+            .unwrap_or(false);
 
-        for (source, breakpoints) in &breakpoints_by_source {
-            let req = requests::RequestBody::SetBreakpoints(requests::SetBreakpoints {
-                source: Source {
-                    name: Some(source.display().to_string()),
-                    path: Some(source.clone()),
+        // group breakpoints by source file, sending a request for every file before waiting for
+        // any of the responses
+        let breakpoints_by_source = self.breakpoints_by_source();
+        let pending = breakpoints_by_source
+            .iter()
+            .map(|(source, breakpoints)| {
+                let remote_source = self.path_mapper.to_remote(source);
+                let req = requests::RequestBody::SetBreakpoints(requests::SetBreakpoints {
+                    source: Source {
+                        name: Some(remote_source.display().to_string()),
+                        path: Some(remote_source),
+                        ..Default::default()
+                    },
+                    lines: Some(breakpoints.iter().map(|(_, b)| b.line).collect()),
+                    breakpoints: Some(
+                        breakpoints
+                            .iter()
+                            .map(|(_, b)| SourceBreakpoint {
+                                line: b.line,
+                                mode: b.mode.clone(),
+                                condition: b.condition.clone(),
+                                hit_condition: b.hit_condition.clone().filter(|hit_condition| {
+                                    if !supports_hit_conditions {
+                                        tracing::warn!(
+                                            %hit_condition,
+                                            line = b.line,
+                                            "adapter does not support hit conditions, ignoring"
+                                        );
+                                    }
+                                    supports_hit_conditions
+                                }),
+                                ..Default::default()
+                            })
+                            .collect(),
+                    ),
                     ..Default::default()
-                },
-                lines: Some(breakpoints.iter().map(|b| b.line).collect()),
-                breakpoints: Some(
-                    breakpoints
-                        .iter()
-                        .map(|b| SourceBreakpoint {
-                            line: b.line,
-                            ..Default::default()
-                        })
-                        .collect(),
-                ),
-                ..Default::default()
-            });
+                });
+                self.bootstrap.send_pending(&self.client, req)
+            })
+            .collect::<eyre::Result<Vec<_>>>()
+            .context("broadcasting breakpoints to debugee")?;
 
-            let _ = self
-                .client
-                .send(req)
+        // only update what the adapter reported once every file has been set
+        let mut adapter_breakpoints = HashMap::new();
+        let mut breakpoint_lines = HashMap::new();
+        for ((source, breakpoints), pending) in breakpoints_by_source.iter().zip(pending) {
+            let response = pending
+                .wait()
                 .context("broadcasting breakpoints to debugee")?;
+            let Some(responses::ResponseBody::SetBreakpoints(responses::SetBreakpoints {
+                breakpoints: mut reported,
+            })) = response
+            else {
+                continue;
+            };
+
+            for breakpoint in &mut reported {
+                if let Some(path) = breakpoint.source.as_mut().and_then(|s| s.path.as_mut()) {
+                    *path = self.path_mapper.to_local(path);
+                }
+            }
+            // the adapter reports the breakpoints in the order they were requested
+            for ((id, requested), placed) in breakpoints.iter().zip(&reported) {
+                let verified = placed.verified.then(|| {
+                    placed
+                        .line
+                        .and_then(|line| usize::try_from(line).ok())
+                        .unwrap_or(requested.line)
+                });
+                breakpoint_lines.insert(
+                    *id,
+                    BreakpointLines {
+                        requested: requested.line,
+                        verified,
+                    },
+                );
+            }
+            adapter_breakpoints.insert(source.clone(), reported);
         }
+        self.adapter_breakpoints.extend(adapter_breakpoints);
+        self.breakpoint_lines.extend(breakpoint_lines);
         Ok(())
     }
 
-    fn breakpoints_by_source(&self) -> HashMap<PathBuf, Vec<Breakpoint>> {
+    /// Fetch the stack traces of every stopped thread.
+    ///
+    /// Threads which resume before their stack trace is fetched are skipped, along with the
+    /// reason the adapter gave.
+    pub(crate) fn all_stacks(&self) -> eyre::Result<AllStacks> {
+        let stopped_threads = self.client.stopped_threads();
+
+        // send every request before waiting for any response
+        let pending = stopped_threads
+            .iter()
+            .map(|thread_id| {
+                self.client
+                    .send_pending(requests::RequestBody::StackTrace(requests::StackTrace {
+                        thread_id: *thread_id,
+                        ..Default::default()
+                    }))
+            })
+            .collect::<eyre::Result<Vec<_>>>()
+            .context("fetching stack traces")?;
+
+        let mut all_stacks = AllStacks::default();
+        for (thread_id, pending) in stopped_threads.into_iter().zip(pending) {
+            let response = self
+                .client
+                .wait_response(pending)
+                .context("fetching stack traces")?;
+            match response {
+                responses::Response {
+                    success: true,
+                    body:
+                        Some(responses::ResponseBody::StackTrace(responses::StackTraceResponse {
+                            stack_frames,
+                        })),
+                    ..
+                } => {
+                    all_stacks.stacks.insert(thread_id, stack_frames);
+                }
+                responses::Response { message, .. } => {
+                    let reason = message.unwrap_or_else(|| "no stack trace".to_string());
+                    tracing::warn!(%thread_id, %reason, "no stack trace for thread, it may have resumed");
+                    all_stacks.skipped.insert(thread_id, reason);
+                }
+            }
+        }
+        Ok(all_stacks)
+    }
+
+    /// Finish configuring the debugee, delivering any events which arrived in the meantime
+    pub(crate) fn finish_configuration(&mut self, succeeded: bool) {
+        self.configuring = false;
+        if succeeded {
+            self.set_state(DebuggerState::Running);
+        }
+        for event in std::mem::take(&mut self.buffered_events) {
+            self.on_event(event);
+        }
+    }
+
+    /// Extra columns the adapter wants shown in a modules view
+    pub(crate) fn additional_module_columns(&self) -> Vec<transport::types::ColumnDescriptor> {
+        self.capabilities
+            .additional_module_columns
+            .clone()
+            .unwrap_or_default()
+    }
+
+    /// Evaluate an expression for copying to the clipboard, falling back to the repl context if
+    /// the adapter does not support the clipboard context
+    pub(crate) fn evaluate_for_clipboard(
+        &self,
+        frame_id: StackFrameId,
+        expression: &str,
+    ) -> eyre::Result<String> {
+        let context = if self
+            .capabilities
+            .supports_clipboard_context
+            .unwrap_or(false)
+        {
+            requests::EvaluateContext::Clipboard
+        } else {
+            requests::EvaluateContext::Repl
+        };
+
+        let responses::EvaluateResponse { result, .. } = self
+            .client
+            .send_typed(requests::Evaluate {
+                expression: expression.to_string(),
+                frame_id: Some(frame_id),
+                context: Some(context),
+                source: None,
+                line: None,
+            })
+            .context("sending evaluate request")?;
+        Ok(result)
+    }
+
+    /// Render an evaluate or variable result for the language being debugged
+    pub(crate) fn pretty_print(&self, value: &str) -> String {
+        self.pretty_printer.pretty_print(value)
+    }
+
+    /// The full value of `variable` in the frame `frame_id`, e.g. when its value was truncated
+    /// by the maximum value length
+    pub(crate) fn full_value(
+        &self,
+        frame_id: StackFrameId,
+        variable: &transport::types::Variable,
+    ) -> eyre::Result<String> {
+        let expression = variable.evaluate_name.as_deref().unwrap_or(&variable.name);
+        self.evaluate_for_clipboard(frame_id, expression)
+    }
+
+    /// Whether the adapter supports evaluating expressions for hovers
+    pub(crate) fn can_hover(&self) -> bool {
+        self.capabilities
+            .supports_evaluate_for_hovers
+            .unwrap_or(false)
+    }
+
+    /// Evaluate the expression under the cursor for a hover.
+    ///
+    /// Hovering over something which cannot be evaluated, e.g. an undefined name, gives an empty
+    /// result rather than an error, as does hovering when the adapter does not support it.
+    pub(crate) fn hover_at(
+        &self,
+        frame_id: StackFrameId,
+        expression: &str,
+        source: Source,
+        line: usize,
+    ) -> eyre::Result<String> {
+        if !self.can_hover() {
+            return Ok(String::new());
+        }
+
+        let response = self
+            .client
+            .send(requests::RequestBody::Evaluate(requests::Evaluate {
+                expression: expression.to_string(),
+                frame_id: Some(frame_id),
+                context: Some(requests::EvaluateContext::Hover),
+                source: Some(source),
+                line: Some(line),
+            }))
+            .context("sending evaluate request")?;
+
+        match response {
+            Some(responses::ResponseBody::Evaluate(responses::EvaluateResponse {
+                result, ..
+            })) => Ok(self.pretty_print(&result)),
+            _ => {
+                tracing::debug!(%expression, "could not evaluate expression for hover");
+                Ok(String::new())
+            }
+        }
+    }
+
+    pub(crate) fn frame_state(&self, frame_id: StackFrameId) -> eyre::Result<FrameState> {
+        let Some(responses::ResponseBody::Scopes(responses::ScopesResponse { scopes })) = self
+            .client
+            .send(requests::RequestBody::Scopes(requests::Scopes { frame_id }))
+            .context("sending scopes request")?
+        else {
+            eyre::bail!("invalid response to scopes request");
+        };
+
+        if scopes.is_empty() {
+            tracing::debug!(%frame_id, "frame has no scopes");
+            return Ok(FrameState { scopes: Vec::new() });
+        }
+
+        // a scope with a zero reference has no variables, and most adapters reject a variables
+        // request for it
+        let mut responses = self
+            .client
+            .send_many(
+                scopes
+                    .iter()
+                    .filter(|scope| scope.variables_reference > 0)
+                    .map(|scope| {
+                        requests::RequestBody::Variables(requests::Variables {
+                            variables_reference: scope.variables_reference,
+                            format: None,
+                        })
+                    }),
+            )
+            .context("sending variables requests")?
+            .into_iter();
+
+        let scopes = scopes
+            .into_iter()
+            .map(|scope| {
+                if scope.variables_reference == 0 {
+                    return Ok(ScopeState {
+                        scope,
+                        variables: Vec::new(),
+                    });
+                }
+                let Some(Some(responses::ResponseBody::Variables(responses::VariablesResponse {
+                    variables,
+                }))) = responses.next()
+                else {
+                    eyre::bail!("invalid response to variables request");
+                };
+                let variables = variables
+                    .into_iter()
+                    .map(|variable| transport::types::Variable {
+                        value: variables::truncate_value(
+                            &self.pretty_print(&variable.value),
+                            self.max_value_length,
+                        ),
+                        ..variable
+                    })
+                    .collect();
+                Ok(ScopeState { scope, variables })
+            })
+            .collect::<eyre::Result<Vec<_>>>()?;
+
+        Ok(FrameState { scopes })
+    }
+
+    pub(crate) fn session_result(&self) -> SessionResult {
+        SessionResult {
+            exit_code: self.exit_code,
+            terminated: self.terminated,
+            disconnected: self.disconnected,
+        }
+    }
+
+    fn breakpoints_by_source(&self) -> HashMap<PathBuf, Vec<(BreakpointId, Breakpoint)>> {
         let mut out = HashMap::new();
-        for breakpoint in self.breakpoints.values() {
+        for (id, breakpoint) in &self.breakpoints {
             let file_breakpoints = out.entry(breakpoint.path.clone()).or_insert(Vec::new());
-            file_breakpoints.push(breakpoint.clone());
+            file_breakpoints.push((*id, breakpoint.clone()));
         }
         out
     }
 
+    /// Where the breakpoint `id` was requested and where the adapter placed it, once it has
+    /// been sent to the adapter
+    pub(crate) fn breakpoint_lines(&self, id: BreakpointId) -> Option<BreakpointLines> {
+        self.breakpoint_lines.get(&id).copied()
+    }
+
+    /// Resume only the thread `thread_id`, if the adapter supports single thread execution
+    pub(crate) fn continue_thread(&mut self, thread_id: ThreadId) -> eyre::Result<()> {
+        self.resume(thread_id, true)
+    }
+
+    /// Resume all threads
+    pub(crate) fn continue_all(&mut self, thread_id: ThreadId) -> eyre::Result<()> {
+        self.resume(thread_id, false)
+    }
+
+    fn resume(&mut self, thread_id: ThreadId, single_thread: bool) -> eyre::Result<()> {
+        let supported = self
+            .capabilities
+            .supports_single_thread_execution_requests
+            .unwrap_or(false);
+        if single_thread && !supported {
+            tracing::warn!(
+                "adapter does not support single thread execution, resuming all threads"
+            );
+        }
+
+        // the client marks the resumed threads as running once the request is sent, and every
+        // thread once the response says they all continued, e.g. if the adapter ignored
+        // `singleThread`
+        self.client
+            .send_typed(requests::Continue {
+                thread_id,
+                single_thread: single_thread && supported,
+            })
+            .context("sending continue request")?;
+        Ok(())
+    }
+
+    /// Step into the call `target_id`, one of the targets returned by a `stepInTargets` request
+    pub(crate) fn step_in_target(&self, thread_id: ThreadId, target_id: i64) -> eyre::Result<()> {
+        eyre::ensure!(
+            self.capabilities
+                .supports_step_in_targets_request
+                .unwrap_or(false),
+            "adapter does not support stepping into specific targets"
+        );
+        self.client
+            .send(requests::RequestBody::StepIn(requests::StepIn {
+                thread_id,
+                target_id: Some(target_id),
+                granularity: None,
+            }))
+            .context("sending step in request")?;
+        Ok(())
+    }
+
+    /// Step out of the current function of `thread_id`, returning a channel which receives
+    /// `false` once the debugee stops again
+    pub(crate) fn step_out(
+        &mut self,
+        thread_id: ThreadId,
+    ) -> eyre::Result<crossbeam_channel::Receiver<bool>> {
+        // subscribe first so the stop cannot be missed
+        let run_state = self.subscribe_run_state();
+        self.client
+            .execute(requests::RequestBody::StepOut(requests::StepOut {
+                thread_id,
+                granularity: None,
+            }))
+            .context("sending step out request")?;
+        Ok(run_state)
+    }
+
+    /// Keep `thread_id` as the current thread when other threads stop, until
+    /// [`DebuggerInternals::unpin_thread`]
+    pub(crate) fn pin_thread(&mut self, thread_id: ThreadId) {
+        self.pinned_thread_id = Some(thread_id);
+        self.current_thread_id = Some(thread_id);
+    }
+
+    /// Go back to selecting whichever thread stopped most recently
+    pub(crate) fn unpin_thread(&mut self) {
+        self.pinned_thread_id = None;
+    }
+
+    /// Suspend the running debugee, e.g. when it is stuck in a loop without a breakpoint
+    ///
+    /// The current thread is paused, or the first thread the adapter reports if the debugee has
+    /// not stopped yet. The adapter reports the pause with a stopped event.
+    pub(crate) fn pause(&self) -> eyre::Result<()> {
+        let thread_id = match self.current_thread_id {
+            Some(thread_id) => thread_id,
+            None => {
+                let threads = self.client.threads().context("fetching threads")?;
+                let Some(thread) = threads.first() else {
+                    eyre::bail!("debugee has no threads to pause");
+                };
+                thread.id
+            }
+        };
+        self.client.pause(thread_id)
+    }
+
+    /// Where `thread_id` is stopped, and the value returned by the function it last stepped out
+    /// of if the adapter reports one
+    pub(crate) fn inspect_return(
+        &self,
+        thread_id: ThreadId,
+    ) -> eyre::Result<(StoppedContext, Option<transport::types::Variable>)> {
+        let Some(responses::ResponseBody::StackTrace(responses::StackTraceResponse {
+            stack_frames,
+        })) = self
+            .client
+            .send(requests::RequestBody::StackTrace(requests::StackTrace {
+                thread_id,
+                ..Default::default()
+            }))
+            .context("sending stack trace request")?
+        else {
+            eyre::bail!("invalid response to stack trace request");
+        };
+        let Some(caller) = stack_frames.first() else {
+            eyre::bail!("thread {thread_id} has no stack frames");
+        };
+
+        let frame = self.frame_state(caller.id)?;
+        let return_value = frame
+            .scopes
+            .iter()
+            .flat_map(|scope| &scope.variables)
+            .find(|variable| is_return_value(&variable.name))
+            .cloned();
+        Ok((
+            StoppedContext {
+                stack: stack_frames,
+                frame,
+            },
+            return_value,
+        ))
+    }
+
+    /// Pin a watch expression, which is re-evaluated whenever the selected frame changes
+    pub(crate) fn pin_watch(&mut self, expression: impl Into<String>) {
+        self.pinned_watches.push(expression.into());
+        self.evaluate_watches();
+    }
+
+    /// Select `thread_id`, which stopped on an exception, and focus its innermost frame in user
+    /// code, fetching the details of the exception if the adapter supports it
+    pub(crate) fn focus_exception(&mut self, thread_id: ThreadId) -> eyre::Result<ExceptionFocus> {
+        let responses::StackTraceResponse { stack_frames } = self
+            .client
+            .send_typed(requests::StackTrace {
+                thread_id,
+                ..Default::default()
+            })
+            .context("sending stack trace request")?;
+        let Some(frame) = stack_frames
+            .iter()
+            .find(|frame| is_user_frame(frame))
+            .or(stack_frames.first())
+            .cloned()
+        else {
+            eyre::bail!("thread {thread_id} has no stack frames");
+        };
+
+        self.current_thread_id = Some(thread_id);
+        self.set_current_frame(frame.id);
+
+        let exception = if self
+            .capabilities
+            .supports_exception_info_request
+            .unwrap_or(false)
+        {
+            let info = self
+                .client
+                .send_typed(requests::ExceptionInfo { thread_id })
+                .context("sending exception info request")?;
+            Some(info)
+        } else {
+            None
+        };
+
+        Ok(ExceptionFocus {
+            thread_id,
+            stack: stack_frames,
+            frame,
+            exception,
+        })
+    }
+
+    /// Select the stack frame that watches are evaluated in, e.g. when the user clicks on a
+    /// frame in the call stack
+    pub(crate) fn set_current_frame(&mut self, frame_id: StackFrameId) {
+        self.current_frame_id = Some(frame_id);
+        self.evaluate_watches();
+    }
+
+    /// Evaluate the pinned watches in the current frame, publishing their values
+    ///
+    /// The expressions are evaluated together, and any which take longer than the watch timeout
+    /// are reported as timed out rather than delaying the others.
+    fn evaluate_watches(&mut self) {
+        let Some(frame_id) = self.current_frame_id else {
+            return;
+        };
+        if self.pinned_watches.is_empty() {
+            return;
+        }
+
+        let sent_at = Instant::now();
+        let pending: Vec<_> = self
+            .pinned_watches
+            .iter()
+            .map(|expression| {
+                self.client
+                    .send_pending(requests::RequestBody::Evaluate(requests::Evaluate {
+                        expression: expression.clone(),
+                        frame_id: Some(frame_id),
+                        context: Some(requests::EvaluateContext::Watch),
+                        source: None,
+                        line: None,
+                    }))
+            })
+            .collect();
+
+        let values = self
+            .pinned_watches
+            .iter()
+            .zip(pending)
+            .map(|(expression, pending)| {
+                let remaining = self.watch_timeout.saturating_sub(sent_at.elapsed());
+                let response = pending.and_then(|pending| pending.wait_response(remaining));
+                let timed_out = response.is_err() && sent_at.elapsed() >= self.watch_timeout;
+                let value = match response {
+                    Ok(responses::Response {
+                        success: true,
+                        body:
+                            Some(responses::ResponseBody::Evaluate(responses::EvaluateResponse {
+                                result,
+                                ..
+                            })),
+                        ..
+                    }) => Some(result),
+                    _ => None,
+                };
+                WatchValue {
+                    expression: expression.clone(),
+                    value,
+                    timed_out,
+                }
+            })
+            .collect();
+        self.emit(Event::Watches(values));
+    }
+
+    /// Change the value of the variable `name` in `variables_reference`, returning its new value
+    ///
+    /// Fails without contacting the adapter if it does not support setting variables, see
+    /// [`transport::Client::set_variable`].
+    pub(crate) fn set_variable(
+        &self,
+        variables_reference: VariablesReference,
+        name: &str,
+        value: &str,
+    ) -> eyre::Result<String> {
+        let responses::SetVariableResponse { value, .. } = self
+            .client
+            .set_variable(variables_reference, name, value)
+            .with_context(|| format!("setting variable {name}"))?;
+        Ok(value)
+    }
+
+    /// Disassemble the `context` instructions either side of the current instruction of
+    /// `frame`, marking the current instruction
+    pub(crate) fn disassemble_frame(
+        &self,
+        frame: &StackFrame,
+        context: usize,
+    ) -> eyre::Result<Vec<Instruction>> {
+        eyre::ensure!(
+            self.capabilities
+                .supports_disassemble_request
+                .unwrap_or(false),
+            "adapter does not support disassembly"
+        );
+        let Some(pc) = &frame.instruction_pointer_reference else {
+            eyre::bail!("frame {} has no instruction pointer", frame.id);
+        };
+
+        let responses::DisassembleResponse { instructions } = self
+            .client
+            .send_typed(requests::Disassemble {
+                memory_reference: pc.clone(),
+                offset: None,
+                instruction_offset: Some(-(context as i64)),
+                instruction_count: 2 * context + 1,
+                resolve_symbols: Some(true),
+            })
+            .context("sending disassemble request")?;
+
+        Ok(instructions
+            .into_iter()
+            .map(|instruction| Instruction {
+                is_current: same_address(&instruction.address, pc),
+                instruction,
+            })
+            .collect())
+    }
+
+    /// Restart execution of `frame` from its beginning
+    ///
+    /// Frames which the adapter marks as not restartable are refused rather than sending a
+    /// request which would fail.
+    pub(crate) fn restart_frame(&self, frame: &StackFrame) -> eyre::Result<()> {
+        eyre::ensure!(
+            self.capabilities.supports_restart_frame.unwrap_or(false),
+            "adapter does not support restarting frames"
+        );
+        // frames are restartable unless the adapter says otherwise
+        eyre::ensure!(
+            frame.can_restart.unwrap_or(true),
+            "frame {} ({}) cannot be restarted",
+            frame.id,
+            frame.name
+        );
+
+        self.client
+            .send(requests::RequestBody::RestartFrame(
+                requests::RestartFrame { frame_id: frame.id },
+            ))
+            .context("sending restart frame request")?;
+        Ok(())
+    }
+
     fn next_id(&mut self) -> BreakpointId {
         self.current_breakpoint_id += 1;
         self.current_breakpoint_id
@@ -251,3 +1344,1623 @@ impl DebuggerInternals {
         self.emit(event);
     }
 }
+
+/// Compare memory addresses, which adapters may format with different amounts of padding
+fn same_address(a: &str, b: &str) -> bool {
+    fn parse(address: &str) -> Option<u64> {
+        let address = address.trim();
+        let hex = address
+            .strip_prefix("0x")
+            .or_else(|| address.strip_prefix("0X"))?;
+        u64::from_str_radix(hex, 16).ok()
+    }
+
+    match (parse(a), parse(b)) {
+        (Some(a), Some(b)) => a == b,
+        _ => a == b,
+    }
+}
+
+/// Whether `name` is the pseudo-variable adapters use for the value returned by the function
+/// just stepped out of, e.g. `(return) compute` for debugpy
+fn is_return_value(name: &str) -> bool {
+    name.starts_with("(return)") || name == "Return value"
+}
+
+/// Whether `frame` is in user code rather than a library or the runtime, going by the hints
+/// from the adapter and where its source lives
+fn is_user_frame(frame: &StackFrame) -> bool {
+    if matches!(frame.presentation_hint.as_deref(), Some("label" | "subtle")) {
+        return false;
+    }
+    let Some(source) = &frame.source else {
+        return false;
+    };
+    if source.presentation_hint.as_deref() == Some("deemphasize") {
+        return false;
+    }
+    source.path.as_ref().is_some_and(|path| {
+        !path.components().any(|component| {
+            matches!(
+                component.as_os_str().to_str(),
+                Some("site-packages" | "dist-packages")
+            )
+        })
+    })
+}
+
+/// Wait for a line of output matching `pattern`, returning the matching line
+///
+/// `output` must deliver whole lines, see [`DebuggerInternals::subscribe_output_lines`], so a
+/// line split across output events still matches.
+pub(crate) fn wait_for_output(
+    output: &crossbeam_channel::Receiver<String>,
+    pattern: &Regex,
+    timeout: Duration,
+) -> eyre::Result<String> {
+    let deadline = Instant::now() + timeout;
+    loop {
+        let remaining = deadline.saturating_duration_since(Instant::now());
+        let line = output
+            .recv_timeout(remaining)
+            .map_err(|_| eyre::eyre!("timed out waiting for output matching {pattern}"))?;
+        if pattern.is_match(&line) {
+            return Ok(line);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{
+        collections::HashMap,
+        path::PathBuf,
+        time::{Duration, Instant},
+    };
+
+    use regex::Regex;
+
+    use transport::{
+        events::{StoppedEventBody, StoppedReason},
+        requests::{self, PathFormat},
+        types::Source,
+    };
+
+    use super::DebuggerInternals;
+    use crate::{
+        fake_adapter::{self, FakeAdapter},
+        path_mapping::{PathMapper, PathMapping},
+        types::{AllStacks, Breakpoint, SessionResult, WatchValue},
+        Event,
+    };
+
+    /// Create debugger internals connected to a fake adapter, also returning the events
+    /// published by the debugger
+    fn internals<F>(
+        respond: F,
+    ) -> (
+        DebuggerInternals,
+        FakeAdapter,
+        crossbeam_channel::Receiver<Event>,
+    )
+    where
+        F: Fn(&requests::Request) -> Vec<String> + Send + 'static,
+    {
+        let (client, adapter) = fake_adapter::connect(respond);
+        let (publisher, published) = crossbeam_channel::unbounded();
+        (
+            DebuggerInternals::new(client, publisher, None),
+            adapter,
+            published,
+        )
+    }
+
+    #[test]
+    fn no_debug_skips_breakpoints() -> eyre::Result<()> {
+        let (mut internals, adapter, _) = internals(|_| Vec::new());
+        internals.no_debug = true;
+
+        internals.add_breakpoint(Breakpoint {
+            path: PathBuf::from("/test.py"),
+            line: 4,
+            ..Default::default()
+        })?;
+        assert_eq!(internals.breakpoints.len(), 1);
+
+        // the next request the adapter receives should not be the breakpoints
+        internals.client.execute(requests::RequestBody::Threads)?;
+        let request = adapter.requests.recv().unwrap();
+        assert!(matches!(request.body, requests::RequestBody::Threads));
+
+        Ok(())
+    }
+
+    fn respond_with_stack(request: &requests::Request) -> Vec<String> {
+        match request.body {
+            requests::RequestBody::StackTrace(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"stackTrace","body":{"stackFrames":[{"id":1,"name":"main","source":{"path":"/test.py"},"line":4,"column":0}]}"#,
+            )],
+            _ => Vec::new(),
+        }
+    }
+
+    /// Have the adapter report that `thread_id` stopped, returning the event once the client has
+    /// seen it
+    fn stop(
+        adapter: &FakeAdapter,
+        thread_id: i64,
+        all_threads_stopped: bool,
+    ) -> transport::events::Event {
+        adapter.send_event(&format!(
+            r#""event":"stopped","body":{{"reason":"breakpoint","threadId":{thread_id},"allThreadsStopped":{all_threads_stopped}}}"#
+        ));
+        adapter
+            .events
+            .recv_timeout(Duration::from_secs(1))
+            .expect("receiving stopped event")
+    }
+
+    #[test]
+    fn stopped_description() {
+        let (mut internals, _adapter, published) = internals(respond_with_stack);
+
+        internals.on_event(transport::events::Event::Stopped(StoppedEventBody {
+            reason: StoppedReason::Other("exception".to_string()),
+            thread_id: 1,
+            hit_breakpoint_ids: None,
+            description: Some("Paused on exception".to_string()),
+            text: Some("ValueError: bad value".to_string()),
+            all_threads_stopped: None,
+        }));
+
+        let Event::Paused {
+            description, text, ..
+        } = published.recv().unwrap()
+        else {
+            panic!("expected paused event");
+        };
+        assert_eq!(description.as_deref(), Some("Paused on exception"));
+        assert_eq!(text.as_deref(), Some("ValueError: bad value"));
+    }
+
+    #[test]
+    fn breakpoint_path_mapping() -> eyre::Result<()> {
+        let (mut internals, adapter, _) = internals(|request| match request.body {
+            requests::RequestBody::SetBreakpoints(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"setBreakpoints","body":{"breakpoints":[{"verified":true,"source":{"path":"/app/test.py"},"line":4}]}"#,
+            )],
+            _ => Vec::new(),
+        });
+        internals.path_mapper = PathMapper::new(vec![PathMapping {
+            local_root: "/home/user/project".to_string(),
+            remote_root: "/app".to_string(),
+        }]);
+        internals.client.assume_initialized();
+
+        let local_path = PathBuf::from("/home/user/project/test.py");
+        internals.add_breakpoint(Breakpoint {
+            path: local_path.clone(),
+            line: 4,
+            ..Default::default()
+        })?;
+
+        let request = adapter.requests.recv().unwrap();
+        let requests::RequestBody::SetBreakpoints(requests::SetBreakpoints { source, .. }) =
+            request.body
+        else {
+            panic!("expected set breakpoints request");
+        };
+        assert_eq!(source.path, Some(PathBuf::from("/app/test.py")));
+
+        let reported = &internals.adapter_breakpoints[&local_path];
+        assert_eq!(
+            reported[0].source.as_ref().and_then(|s| s.path.clone()),
+            Some(local_path)
+        );
+
+        Ok(())
+    }
+
+    #[test]
+    fn breakpoint_uri_path_format() -> eyre::Result<()> {
+        let (mut internals, adapter, _) = internals(|request| match request.body {
+            requests::RequestBody::SetBreakpoints(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"setBreakpoints","body":{"breakpoints":[{"verified":true,"source":{"path":"file:///home/user/my%20project/test.py"},"line":4}]}"#,
+            )],
+            _ => Vec::new(),
+        });
+        internals.path_mapper = PathMapper::default().with_path_format(PathFormat::Uri);
+        internals.client.assume_initialized();
+
+        let local_path = PathBuf::from("/home/user/my project/test.py");
+        internals.add_breakpoint(Breakpoint {
+            path: local_path.clone(),
+            line: 4,
+            ..Default::default()
+        })?;
+
+        let request = adapter.requests.recv().unwrap();
+        let requests::RequestBody::SetBreakpoints(requests::SetBreakpoints { source, .. }) =
+            request.body
+        else {
+            panic!("expected set breakpoints request");
+        };
+        assert_eq!(
+            source.path,
+            Some(PathBuf::from("file:///home/user/my%20project/test.py"))
+        );
+
+        let reported = &internals.adapter_breakpoints[&local_path];
+        assert_eq!(
+            reported[0].source.as_ref().and_then(|s| s.path.clone()),
+            Some(local_path)
+        );
+
+        Ok(())
+    }
+
+    #[test]
+    fn load_breakpoints_for_several_files() -> eyre::Result<()> {
+        // only lines in `a.py` have code
+        let (mut internals, adapter, _) = internals(|request| match &request.body {
+            requests::RequestBody::SetBreakpoints(requests::SetBreakpoints {
+                source,
+                lines: Some(lines),
+                ..
+            }) => {
+                let verified = source.path.as_deref() == Some(std::path::Path::new("/a.py"));
+                let breakpoints: Vec<_> = lines
+                    .iter()
+                    .map(|line| format!(r#"{{"verified":{verified},"line":{line}}}"#))
+                    .collect();
+                vec![fake_adapter::response(
+                    request,
+                    &format!(
+                        r#""command":"setBreakpoints","body":{{"breakpoints":[{}]}}"#,
+                        breakpoints.join(",")
+                    ),
+                )]
+            }
+            _ => Vec::new(),
+        });
+        internals.initialised = true;
+        internals.client.assume_initialized();
+
+        let path = std::env::temp_dir().join(format!("several-files-{}.json", std::process::id()));
+        let breakpoints: Vec<_> = [("/a.py", 1), ("/a.py", 2), ("/b.py", 3), ("/c.py", 4)]
+            .into_iter()
+            .map(|(path, line)| Breakpoint {
+                path: PathBuf::from(path),
+                line,
+                ..Default::default()
+            })
+            .collect();
+        crate::persistence::save_breakpoints(&path, &breakpoints)?;
+        internals.load_breakpoints(&path)?;
+        std::fs::remove_file(&path)?;
+
+        let requests = adapter.requests.try_iter().count();
+        assert_eq!(requests, 3);
+        for (file, count, verified) in
+            [("/a.py", 2, true), ("/b.py", 1, false), ("/c.py", 1, false)]
+        {
+            let reported = &internals.adapter_breakpoints[std::path::Path::new(file)];
+            assert_eq!(reported.len(), count, "{file}");
+            assert!(reported.iter().all(|b| b.verified == verified), "{file}");
+        }
+        Ok(())
+    }
+
+    #[test]
+    fn relocated_breakpoint_lines() -> eyre::Result<()> {
+        let (mut internals, _adapter, _) = internals(|request| match request.body {
+            // the breakpoint on a blank line is moved to the next line with code
+            requests::RequestBody::SetBreakpoints(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"setBreakpoints","body":{"breakpoints":[{"verified":true,"line":7}]}"#,
+            )],
+            _ => Vec::new(),
+        });
+        internals.client.assume_initialized();
+
+        let id = internals.add_breakpoint(Breakpoint {
+            path: PathBuf::from("/test.py"),
+            line: 5,
+            ..Default::default()
+        })?;
+
+        assert_eq!(
+            internals.breakpoint_lines(id),
+            Some(crate::BreakpointLines {
+                requested: 5,
+                verified: Some(7),
+            })
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn all_stacks() -> eyre::Result<()> {
+        let (internals, adapter, _) = internals(|request| match request.body {
+            requests::RequestBody::StackTrace(requests::StackTrace { thread_id: 3, .. }) => {
+                vec![format!(
+                    r#"{{"type":"response","request_seq":{},"success":false,"command":"stackTrace","message":"thread is running"}}"#,
+                    request.seq
+                )]
+            }
+            requests::RequestBody::StackTrace(requests::StackTrace { thread_id, .. }) => {
+                vec![fake_adapter::response(
+                    request,
+                    &format!(
+                        r#""command":"stackTrace","body":{{"stackFrames":[{{"id":{thread_id},"name":"thread{thread_id}","line":1,"column":0}}]}}"#
+                    ),
+                )]
+            }
+            _ => Vec::new(),
+        });
+        // thread 3 resumes while the stack traces are fetched, and thread 4 never stops
+        for thread_id in 1..=3 {
+            stop(&adapter, thread_id, false);
+        }
+
+        let AllStacks { stacks, skipped } = internals.all_stacks()?;
+
+        assert_eq!(stacks.len(), 2);
+        assert_eq!(stacks[&1][0].name, "thread1");
+        assert_eq!(stacks[&2][0].name, "thread2");
+        assert_eq!(
+            skipped,
+            HashMap::from([(3, "thread is running".to_string())])
+        );
+
+        Ok(())
+    }
+
+    #[test]
+    fn disconnect_suspend_debuggee() -> eyre::Result<()> {
+        let (mut internals, adapter, _) = internals(|_| Vec::new());
+
+        // not advertised by the adapter
+        assert!(internals.disconnect(true).is_err());
+        assert!(!internals.disconnected);
+
+        internals.capabilities.support_suspend_debuggee = Some(true);
+        internals.disconnect(true)?;
+        assert!(internals.disconnected);
+
+        let request = adapter.requests.recv().unwrap();
+        let requests::RequestBody::Disconnect(disconnect) = request.body else {
+            panic!("expected disconnect request");
+        };
+        assert_eq!(disconnect.suspend_debuggee, Some(true));
+        assert!(!disconnect.terminate_debugee);
+        assert!(adapter.requests.try_recv().is_err());
+
+        Ok(())
+    }
+
+    #[test]
+    fn session_result_normal_exit() {
+        let (mut internals, _adapter, published) = internals(|_| Vec::new());
+        assert_eq!(internals.session_result(), SessionResult::default());
+
+        internals.on_event(transport::events::Event::Exited(
+            transport::events::ExitedEventBody { exit_code: 0 },
+        ));
+        internals.on_event(transport::events::Event::Terminated);
+
+        let result = internals.session_result();
+        assert_eq!(result.exit_code, Some(0));
+        assert!(result.terminated);
+        assert!(!result.disconnected);
+        assert!(result.is_clean());
+        assert!(published
+            .try_iter()
+            .any(|event| matches!(event, Event::Ended)));
+    }
+
+    #[test]
+    fn stopped_during_configuration() -> eyre::Result<()> {
+        let (mut internals, adapter, published) = internals(|request| match request.body {
+            requests::RequestBody::ConfigurationDone => vec![
+                fake_adapter::event(r#""event":"stopped","body":{"reason":"entry","threadId":1}"#),
+                fake_adapter::response(request, r#""command":"configurationDone""#),
+            ],
+            requests::RequestBody::Launch(_) => {
+                vec![fake_adapter::event(r#""event":"initialized""#)]
+            }
+            _ => respond_with_stack(request),
+        });
+
+        internals.configuring = true;
+        internals
+            .client
+            .execute(requests::RequestBody::Launch(Default::default()))?;
+        assert!(matches!(
+            adapter.events.recv().unwrap(),
+            transport::events::Event::Initialized
+        ));
+        internals
+            .client
+            .send(requests::RequestBody::ConfigurationDone)?;
+        // handle the entry stop before configuration has finished
+        internals.on_event(adapter.events.recv().unwrap());
+        assert!(published.try_recv().is_err());
+
+        internals.finish_configuration(true);
+
+        assert!(matches!(published.recv().unwrap(), Event::Running));
+        assert!(matches!(published.recv().unwrap(), Event::Paused { .. }));
+        Ok(())
+    }
+
+    #[test]
+    fn evaluate_for_clipboard_fallback() -> eyre::Result<()> {
+        let (mut internals, adapter, _) = internals(|request| match request.body {
+            requests::RequestBody::Evaluate(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"evaluate","body":{"result":"'value'","variablesReference":0}"#,
+            )],
+            _ => Vec::new(),
+        });
+
+        let context = |adapter: &FakeAdapter| match adapter.requests.recv().unwrap().body {
+            requests::RequestBody::Evaluate(requests::Evaluate { context, .. }) => context,
+            other => panic!("unexpected request {other:?}"),
+        };
+
+        // capability not advertised
+        assert_eq!(internals.evaluate_for_clipboard(1, "value")?, "'value'");
+        assert!(matches!(
+            context(&adapter),
+            Some(requests::EvaluateContext::Repl)
+        ));
+
+        internals.capabilities.supports_clipboard_context = Some(true);
+        internals.evaluate_for_clipboard(1, "value")?;
+        assert!(matches!(
+            context(&adapter),
+            Some(requests::EvaluateContext::Clipboard)
+        ));
+
+        Ok(())
+    }
+
+    #[test]
+    fn run_state() {
+        let (mut internals, _adapter, _) = internals(respond_with_stack);
+        let run_state = internals.subscribe_run_state();
+
+        for _ in 0..2 {
+            internals.on_event(transport::events::Event::Stopped(StoppedEventBody {
+                reason: StoppedReason::Other("pause".to_string()),
+                thread_id: 1,
+                hit_breakpoint_ids: None,
+                description: None,
+                text: None,
+                all_threads_stopped: None,
+            }));
+            internals.on_event(transport::events::Event::Continued(
+                transport::events::ContinuedEventBody {
+                    thread_id: 1,
+                    all_threads_continued: None,
+                },
+            ));
+        }
+
+        let states: Vec<bool> = run_state.try_iter().collect();
+        assert_eq!(states, vec![false, true, false, true]);
+    }
+
+    #[test]
+    fn output_groups() {
+        use transport::events::{OutputEventBody, OutputEventGroup};
+
+        let (mut internals, _adapter, published) = internals(|_| Vec::new());
+
+        let outputs = [
+            ("g1", Some(OutputEventGroup::Start)),
+            ("a", None),
+            ("g2", Some(OutputEventGroup::StartCollapsed)),
+            ("b", None),
+            ("", Some(OutputEventGroup::End)),
+            ("", Some(OutputEventGroup::End)),
+            ("c", None),
+        ];
+        for (output, group) in outputs {
+            internals.on_event(transport::events::Event::Output(OutputEventBody {
+                category: None,
+                output: output.to_string(),
+                group,
+                variables_reference: None,
+                source: None,
+                line: None,
+                column: None,
+            }));
+        }
+
+        let depths: Vec<usize> = published
+            .try_iter()
+            .map(|event| match event {
+                Event::Output { depth, .. } => depth,
+                other => panic!("unexpected event {other:?}"),
+            })
+            .collect();
+        assert_eq!(depths, vec![0, 1, 1, 2, 1, 0, 0]);
+    }
+
+    #[test]
+    fn additional_module_columns() -> eyre::Result<()> {
+        let (mut internals, _adapter, _) = internals(|request| match request.body {
+            requests::RequestBody::Initialize(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"initialize","body":{"additionalModuleColumns":[{"attributeName":"symbolStatus","label":"Symbols","type":"string"}]}"#,
+            )],
+            _ => Vec::new(),
+        });
+        assert!(internals.additional_module_columns().is_empty());
+
+        internals.initialise(
+            crate::LaunchArguments::from_path(
+                concat!(env!("CARGO_MANIFEST_DIR"), "/src/lib.rs"),
+                crate::Language::DebugPy,
+            )
+            .into(),
+        )?;
+
+        let columns = internals.additional_module_columns();
+        assert_eq!(columns.len(), 1);
+        assert_eq!(columns[0].attribute_name, "symbolStatus");
+        assert_eq!(columns[0].label, "Symbols");
+        assert_eq!(
+            columns[0].r#type,
+            Some(transport::types::ColumnDescriptorType::String)
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn initialized_fallback() -> eyre::Result<()> {
+        // the adapter never sends the initialized event
+        let (internals, _adapter, _) = internals(|request| {
+            let command = match request.body {
+                requests::RequestBody::Initialize(_) => "initialize",
+                requests::RequestBody::Launch(_) => "launch",
+                requests::RequestBody::ConfigurationDone => "configurationDone",
+                _ => return Vec::new(),
+            };
+            vec![fake_adapter::response(
+                request,
+                &format!(r#""command":"{command}""#),
+            )]
+        });
+        let mut internals = internals.with_initialized_fallback(Some(Duration::from_millis(50)));
+        internals.initialise(
+            crate::LaunchArguments::from_path(
+                concat!(env!("CARGO_MANIFEST_DIR"), "/src/lib.rs"),
+                crate::Language::DebugPy,
+            )
+            .into(),
+        )?;
+
+        // configuring goes ahead once the fallback period has passed, well before the default
+        let started = Instant::now();
+        internals
+            .bootstrap
+            .send(&internals.client, requests::RequestBody::ConfigurationDone)?;
+        assert!(started.elapsed() < Duration::from_secs(1));
+        Ok(())
+    }
+
+    #[test]
+    fn repeated_initialise() -> eyre::Result<()> {
+        let (mut internals, adapter, _) = internals(|request| match request.body {
+            requests::RequestBody::Initialize(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"initialize","body":{}"#,
+            )],
+            _ => Vec::new(),
+        });
+        let arguments = || {
+            crate::LaunchArguments::from_path(
+                concat!(env!("CARGO_MANIFEST_DIR"), "/src/lib.rs"),
+                crate::Language::DebugPy,
+            )
+            .into()
+        };
+
+        internals.initialise(arguments())?;
+        let err = internals.initialise(arguments()).unwrap_err();
+        assert!(err
+            .downcast_ref::<crate::AlreadyInitialisedError>()
+            .is_some());
+
+        // the second initialize request never reached the adapter
+        let initialize_requests = adapter
+            .requests
+            .try_iter()
+            .filter(|r| matches!(r.body, requests::RequestBody::Initialize(_)))
+            .count();
+        assert_eq!(initialize_requests, 1);
+        Ok(())
+    }
+
+    #[test]
+    fn breakpoint_mode() -> eyre::Result<()> {
+        let (mut internals, adapter, _) = internals(|request| match request.body {
+            requests::RequestBody::SetBreakpoints(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"setBreakpoints","body":{"breakpoints":[{"verified":true,"line":4}]}"#,
+            )],
+            _ => Vec::new(),
+        });
+        internals.client.assume_initialized();
+
+        let breakpoint = Breakpoint {
+            path: PathBuf::from("/test.py"),
+            line: 4,
+            mode: Some("hardware".to_string()),
+            ..Default::default()
+        };
+
+        // not advertised by the adapter
+        assert!(internals.add_breakpoint(breakpoint.clone()).is_err());
+        assert!(internals.breakpoints.is_empty());
+
+        internals.capabilities.breakpoint_modes = Some(vec![transport::types::BreakpointMode {
+            mode: "hardware".to_string(),
+            label: "Hardware".to_string(),
+            description: None,
+            applies_to: vec!["source".to_string()],
+        }]);
+        internals.add_breakpoint(breakpoint)?;
+
+        let request = adapter.requests.recv().unwrap();
+        let requests::RequestBody::SetBreakpoints(requests::SetBreakpoints { breakpoints, .. }) =
+            request.body
+        else {
+            panic!("expected set breakpoints request");
+        };
+        assert_eq!(breakpoints.unwrap()[0].mode.as_deref(), Some("hardware"));
+
+        Ok(())
+    }
+
+    #[test]
+    fn wait_for_output_line() -> eyre::Result<()> {
+        let (mut internals, _adapter, _) = internals(|_| Vec::new());
+        let output = internals.subscribe_output_lines();
+
+        // the matching line is split across output events
+        for chunk in [
+            "starting\n",
+            "loaded config\nREA",
+            "DY port=8000\n",
+            "done\n",
+        ] {
+            internals.on_event(transport::events::Event::Output(
+                transport::events::OutputEventBody {
+                    category: None,
+                    output: chunk.to_string(),
+                    group: None,
+                    variables_reference: None,
+                    source: None,
+                    line: None,
+                    column: None,
+                },
+            ));
+        }
+
+        let pattern = Regex::new(r"^READY port=\d+$")?;
+        let line = super::wait_for_output(&output, &pattern, Duration::from_secs(1))?;
+        assert_eq!(line, "READY port=8000");
+
+        // no further matching output
+        assert!(super::wait_for_output(&output, &pattern, Duration::from_millis(50)).is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn single_thread_continue() -> eyre::Result<()> {
+        let (mut internals, adapter, _) = internals(|request| match &request.body {
+            requests::RequestBody::Continue(requests::Continue { single_thread, .. }) => {
+                vec![fake_adapter::response(
+                    request,
+                    &format!(
+                        r#""command":"continue","body":{{"allThreadsContinued":{}}}"#,
+                        !single_thread
+                    ),
+                )]
+            }
+            _ => Vec::new(),
+        });
+        stop(&adapter, 1, false);
+        stop(&adapter, 2, false);
+
+        // not supported, so all threads are resumed
+        internals.continue_thread(1)?;
+        let request = adapter.requests.recv().unwrap();
+        assert!(matches!(
+            request.body,
+            requests::RequestBody::Continue(requests::Continue {
+                single_thread: false,
+                ..
+            })
+        ));
+        assert!(internals.client.stopped_threads().is_empty());
+
+        stop(&adapter, 1, false);
+        stop(&adapter, 2, false);
+        internals
+            .capabilities
+            .supports_single_thread_execution_requests = Some(true);
+
+        internals.continue_thread(1)?;
+        assert_eq!(internals.client.stopped_threads(), [2]);
+
+        internals.continue_all(1)?;
+        assert!(internals.client.stopped_threads().is_empty());
+
+        Ok(())
+    }
+
+    #[test]
+    fn single_thread_continue_ignored() -> eyre::Result<()> {
+        // the adapter claims to support single thread execution, but resumes every thread
+        let (mut internals, adapter, _) = internals(|request| match &request.body {
+            requests::RequestBody::Continue(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"continue","body":{"allThreadsContinued":true}"#,
+            )],
+            _ => Vec::new(),
+        });
+        internals
+            .capabilities
+            .supports_single_thread_execution_requests = Some(true);
+        stop(&adapter, 1, false);
+        stop(&adapter, 2, false);
+
+        internals.continue_thread(1)?;
+        assert!(internals.client.stopped_threads().is_empty());
+
+        Ok(())
+    }
+
+    #[test]
+    fn loaded_breakpoints_applied_when_initialised() -> eyre::Result<()> {
+        let (mut internals, adapter, published) = internals(|request| match request.body {
+            requests::RequestBody::SetBreakpoints(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"setBreakpoints","body":{"breakpoints":[{"verified":true,"line":4}]}"#,
+            )],
+            _ => Vec::new(),
+        });
+
+        let path =
+            std::env::temp_dir().join(format!("load-breakpoints-{}.json", std::process::id()));
+        crate::persistence::save_breakpoints(
+            &path,
+            &[Breakpoint {
+                path: PathBuf::from("/test.py"),
+                line: 4,
+                ..Default::default()
+            }],
+        )?;
+        internals.load_breakpoints(&path)?;
+        std::fs::remove_file(&path)?;
+        assert_eq!(internals.breakpoints.len(), 1);
+        assert!(adapter.requests.try_recv().is_err());
+
+        internals.client.assume_initialized();
+        internals.on_event(transport::events::Event::Initialized);
+
+        let request = adapter.requests.recv().unwrap();
+        let requests::RequestBody::SetBreakpoints(requests::SetBreakpoints { breakpoints, .. }) =
+            request.body
+        else {
+            panic!("expected set breakpoints request");
+        };
+        assert_eq!(breakpoints.unwrap()[0].line, 4);
+        assert!(matches!(published.recv().unwrap(), Event::Initialised));
+        Ok(())
+    }
+
+    #[test]
+    fn step_in_target() -> eyre::Result<()> {
+        let (mut internals, adapter, _) = internals(|request| match request.body {
+            requests::RequestBody::StepIn(_) => {
+                vec![fake_adapter::response(request, r#""command":"stepIn""#)]
+            }
+            _ => Vec::new(),
+        });
+
+        // not advertised by the adapter
+        assert!(internals.step_in_target(1, 7).is_err());
+        assert!(adapter.requests.try_recv().is_err());
+
+        internals.capabilities.supports_step_in_targets_request = Some(true);
+        internals.step_in_target(1, 7)?;
+
+        let request = adapter.requests.recv().unwrap();
+        let requests::RequestBody::StepIn(requests::StepIn {
+            thread_id,
+            target_id,
+            ..
+        }) = request.body
+        else {
+            panic!("expected step in request");
+        };
+        assert_eq!(thread_id, 1);
+        assert_eq!(target_id, Some(7));
+        Ok(())
+    }
+
+    #[test]
+    fn hover_undefined_name() -> eyre::Result<()> {
+        let (mut internals, adapter, _) = internals(|request| match &request.body {
+            requests::RequestBody::Evaluate(requests::Evaluate { expression, .. })
+                if expression == "defined" =>
+            {
+                vec![fake_adapter::response(
+                    request,
+                    r#""command":"evaluate","body":{"result":"42","variablesReference":0}"#,
+                )]
+            }
+            _ => vec![format!(
+                r#"{{"type":"response","request_seq":{},"success":false,"command":"evaluate","message":"name 'undefined' is not defined"}}"#,
+                request.seq
+            )],
+        });
+        internals.capabilities.supports_evaluate_for_hovers = Some(true);
+        let source = Source {
+            path: Some(PathBuf::from("/test.py")),
+            ..Default::default()
+        };
+
+        assert_eq!(internals.hover_at(1, "defined", source.clone(), 4)?, "42");
+        let request = adapter.requests.recv().unwrap();
+        assert!(matches!(
+            request.body,
+            requests::RequestBody::Evaluate(requests::Evaluate {
+                context: Some(requests::EvaluateContext::Hover),
+                line: Some(4),
+                ..
+            })
+        ));
+
+        assert_eq!(internals.hover_at(1, "undefined", source, 4)?, "");
+        Ok(())
+    }
+
+    #[test]
+    fn hover_unsupported() -> eyre::Result<()> {
+        let (internals, adapter, _) = internals(|request| {
+            vec![fake_adapter::response(
+                request,
+                r#""command":"evaluate","body":{"result":"42","variablesReference":0}"#,
+            )]
+        });
+        let source = Source {
+            path: Some(PathBuf::from("/test.py")),
+            ..Default::default()
+        };
+
+        assert!(!internals.can_hover());
+        assert_eq!(internals.hover_at(1, "defined", source, 4)?, "");
+        // nothing is evaluated
+        assert!(adapter.requests.try_recv().is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn max_value_length() -> eyre::Result<()> {
+        let long_value = format!("'{}'", "x".repeat(1000));
+        let evaluated = long_value.clone();
+        let (mut internals, _adapter, _) = internals(move |request| match &request.body {
+            requests::RequestBody::Scopes(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"scopes","body":{"scopes":[{"name":"Locals","variablesReference":10,"expensive":false}]}"#,
+            )],
+            requests::RequestBody::Variables(_) => vec![fake_adapter::response(
+                request,
+                &format!(
+                    r#""command":"variables","body":{{"variables":[{{"name":"data","value":"{evaluated}","variablesReference":0,"evaluateName":"self.data"}},{{"name":"x","value":"1","variablesReference":0}}]}}"#
+                ),
+            )],
+            requests::RequestBody::Evaluate(requests::Evaluate { expression, .. }) => {
+                assert_eq!(expression, "self.data");
+                vec![fake_adapter::response(
+                    request,
+                    &format!(
+                        r#""command":"evaluate","body":{{"result":"{evaluated}","variablesReference":0}}"#
+                    ),
+                )]
+            }
+            _ => Vec::new(),
+        });
+        internals.max_value_length = Some(10);
+
+        let frame = internals.frame_state(1)?;
+        let variables = &frame.scopes[0].variables;
+        assert_eq!(variables[0].value, "'xxxxxxxxx…");
+        // short values are left alone
+        assert_eq!(variables[1].value, "1");
+
+        assert_eq!(internals.full_value(1, &variables[0])?, long_value);
+        Ok(())
+    }
+
+    #[test]
+    fn current_thread_follows_stops() {
+        let (mut internals, adapter, _) = internals(respond_with_stack);
+
+        internals.on_event(stop(&adapter, 1, false));
+        assert_eq!(internals.current_thread_id, Some(1));
+        internals.on_event(stop(&adapter, 2, false));
+        assert_eq!(internals.current_thread_id, Some(2));
+
+        internals.pin_thread(1);
+        internals.on_event(stop(&adapter, 3, true));
+        assert_eq!(internals.current_thread_id, Some(1));
+
+        internals.unpin_thread();
+        internals.on_event(stop(&adapter, 2, true));
+        assert_eq!(internals.current_thread_id, Some(2));
+    }
+
+    #[test]
+    fn pause_first_thread() -> eyre::Result<()> {
+        let (mut internals, adapter, published) = internals(|request| match request.body {
+            requests::RequestBody::Threads => vec![fake_adapter::response(
+                request,
+                r#""command":"threads","body":{"threads":[{"id":7,"name":"MainThread"}]}"#,
+            )],
+            requests::RequestBody::Pause(_) => vec![
+                fake_adapter::response(request, r#""command":"pause""#),
+                fake_adapter::event(r#""event":"stopped","body":{"reason":"pause","threadId":7}"#),
+            ],
+            _ => respond_with_stack(request),
+        });
+
+        internals.pause()?;
+        let stopped = adapter.events.recv_timeout(Duration::from_secs(1))?;
+        internals.on_event(stopped);
+
+        assert_eq!(internals.current_thread_id, Some(7));
+        assert!(matches!(published.recv()?, Event::Paused { .. }));
+        Ok(())
+    }
+
+    #[test]
+    fn focus_exception() -> eyre::Result<()> {
+        let (mut internals, _adapter, _) = internals(|request| match request.body {
+            requests::RequestBody::StackTrace(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"stackTrace","body":{"stackFrames":[
+                    {"id":1,"name":"raise_for_status","source":{"path":"/venv/lib/python3.12/site-packages/requests/models.py"},"line":1021,"column":0},
+                    {"id":2,"name":"fetch","source":{"path":"/app/main.py"},"line":12,"column":0},
+                    {"id":3,"name":"<module>","source":{"path":"/app/main.py"},"line":20,"column":0}
+                ]}"#,
+            )],
+            requests::RequestBody::ExceptionInfo(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"exceptionInfo","body":{"exceptionId":"HTTPError","description":"404 Not Found","breakMode":"unhandled","details":{"typeName":"HTTPError","message":"404 Not Found"}}"#,
+            )],
+            _ => Vec::new(),
+        });
+        internals.capabilities.supports_exception_info_request = Some(true);
+
+        let focus = internals.focus_exception(4)?;
+        assert_eq!(focus.stack.len(), 3);
+        // the library frame is skipped
+        assert_eq!(focus.frame.name, "fetch");
+        assert_eq!(internals.current_thread_id, Some(4));
+        assert_eq!(internals.current_frame_id, Some(2));
+
+        let exception = focus.exception.expect("exception info");
+        assert_eq!(exception.exception_id, "HTTPError");
+        assert_eq!(exception.break_mode, "unhandled");
+        assert_eq!(
+            exception
+                .details
+                .and_then(|details| details.message)
+                .as_deref(),
+            Some("404 Not Found")
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn step_out_return_value() -> eyre::Result<()> {
+        let (mut internals, adapter, _) = internals(|request| match request.body {
+            requests::RequestBody::StepOut(_) => vec![
+                fake_adapter::response(request, r#""command":"stepOut""#),
+                fake_adapter::event(r#""event":"stopped","body":{"reason":"step","threadId":1}"#),
+            ],
+            requests::RequestBody::Scopes(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"scopes","body":{"scopes":[{"name":"Locals","variablesReference":10,"expensive":false}]}"#,
+            )],
+            requests::RequestBody::Variables(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"variables","body":{"variables":[{"name":"(return) compute","value":"42","variablesReference":0},{"name":"x","value":"1","variablesReference":0}]}"#,
+            )],
+            _ => respond_with_stack(request),
+        });
+
+        let run_state = internals.step_out(1)?;
+        let stopped = adapter.events.recv_timeout(Duration::from_secs(1))?;
+        internals.on_event(stopped);
+        assert!(!run_state.recv_timeout(Duration::from_secs(1))?);
+
+        let (context, return_value) = internals.inspect_return(1)?;
+        assert_eq!(context.stack[0].name, "main");
+        assert_eq!(context.frame.scopes[0].variables.len(), 2);
+        let return_value = return_value.expect("return value");
+        assert_eq!(return_value.name, "(return) compute");
+        assert_eq!(return_value.value, "42");
+        Ok(())
+    }
+
+    #[test]
+    fn frame_state_variables_per_scope() -> eyre::Result<()> {
+        let (internals, adapter, _) = internals(|request| match &request.body {
+            requests::RequestBody::Scopes(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"scopes","body":{"scopes":[{"name":"Locals","variablesReference":10,"expensive":false},{"name":"Globals","variablesReference":20,"expensive":false}]}"#,
+            )],
+            requests::RequestBody::Variables(requests::Variables {
+                variables_reference: 10,
+                ..
+            }) => vec![fake_adapter::response(
+                request,
+                r#""command":"variables","body":{"variables":[{"name":"x","value":"1","variablesReference":0},{"name":"y","value":"2","variablesReference":0}]}"#,
+            )],
+            requests::RequestBody::Variables(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"variables","body":{"variables":[{"name":"__name__","value":"'__main__'","variablesReference":0}]}"#,
+            )],
+            _ => Vec::new(),
+        });
+
+        let frame_state = internals.frame_state(7)?;
+        let scopes: Vec<_> = frame_state
+            .scopes
+            .iter()
+            .map(|s| {
+                let names: Vec<_> = s.variables.iter().map(|v| v.name.as_str()).collect();
+                (s.scope.name.as_str(), names)
+            })
+            .collect();
+        assert_eq!(
+            scopes,
+            [("Locals", vec!["x", "y"]), ("Globals", vec!["__name__"])]
+        );
+
+        let request = adapter.requests.recv()?;
+        assert!(matches!(
+            request.body,
+            requests::RequestBody::Scopes(requests::Scopes { frame_id: 7 })
+        ));
+        Ok(())
+    }
+
+    #[test]
+    fn scope_without_variables() -> eyre::Result<()> {
+        let (internals, adapter, _) = internals(|request| match request.body {
+            requests::RequestBody::Scopes(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"scopes","body":{"scopes":[{"name":"Globals","variablesReference":0,"expensive":false},{"name":"Locals","variablesReference":10,"expensive":false}]}"#,
+            )],
+            requests::RequestBody::Variables(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"variables","body":{"variables":[{"name":"x","value":"1","variablesReference":0}]}"#,
+            )],
+            _ => Vec::new(),
+        });
+
+        let frame_state = internals.frame_state(7)?;
+        assert_eq!(frame_state.scopes.len(), 2);
+        assert!(frame_state.scopes[0].variables.is_empty());
+        assert_eq!(frame_state.scopes[1].variables[0].name, "x");
+
+        let references: Vec<_> = adapter
+            .requests
+            .try_iter()
+            .filter_map(|r| match r.body {
+                requests::RequestBody::Variables(requests::Variables {
+                    variables_reference,
+                    ..
+                }) => Some(variables_reference),
+                _ => None,
+            })
+            .collect();
+        assert_eq!(references, [10]);
+        Ok(())
+    }
+
+    #[test]
+    fn label_frame_without_scopes() -> eyre::Result<()> {
+        // synthetic `[External Code]` frames are presented as labels and have no scopes
+        let (internals, adapter, _) = internals(|request| match request.body {
+            requests::RequestBody::Scopes(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"scopes","body":{"scopes":[]}"#,
+            )],
+            _ => Vec::new(),
+        });
+
+        let frame_state = internals.frame_state(7)?;
+        assert!(frame_state.scopes.is_empty());
+
+        // no variables requests are needed for a frame without scopes
+        assert!(adapter
+            .requests
+            .try_iter()
+            .all(|r| !matches!(r.body, requests::RequestBody::Variables(_))));
+        Ok(())
+    }
+
+    /// Send an initialize request, so the client records the capabilities in the adapter's reply
+    fn initialize(internals: &DebuggerInternals, adapter: &FakeAdapter) -> eyre::Result<()> {
+        internals
+            .client
+            .send(requests::RequestBody::Initialize(requests::Initialize {
+                adapter_id: "dap gui".to_string(),
+                lines_start_at_one: false,
+                path_format: PathFormat::Path,
+                supports_start_debugging_request: true,
+                supports_variable_type: true,
+                supports_variable_paging: true,
+                supports_progress_reporting: true,
+                supports_memory_event: true,
+            }))?;
+        adapter.requests.recv()?;
+        Ok(())
+    }
+
+    #[test]
+    fn shutdown_falls_back_to_disconnect() -> eyre::Result<()> {
+        // the adapter never answers the terminate request
+        let (mut internals, adapter, _) = internals(|request| match request.body {
+            requests::RequestBody::Initialize(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"initialize","body":{"supportsTerminateRequest":true}"#,
+            )],
+            requests::RequestBody::Disconnect(_) => {
+                vec![fake_adapter::response(request, r#""command":"disconnect""#)]
+            }
+            _ => Vec::new(),
+        });
+        initialize(&internals, &adapter)?;
+
+        let timeout = Duration::from_millis(200);
+        let start = Instant::now();
+        internals.shutdown(timeout)?;
+        assert!(start.elapsed() < timeout * 5);
+        assert!(internals.disconnected);
+
+        let next_request = || {
+            adapter
+                .requests
+                .recv_timeout(Duration::from_secs(1))
+                .unwrap()
+        };
+        assert!(matches!(
+            next_request().body,
+            requests::RequestBody::Terminate(_)
+        ));
+        match next_request().body {
+            requests::RequestBody::Disconnect(disconnect) => {
+                assert!(disconnect.terminate_debugee)
+            }
+            other => panic!("expected disconnect request, got {other:?}"),
+        }
+        Ok(())
+    }
+
+    #[test]
+    fn output_lines_flushed_on_termination() {
+        use transport::events::OutputEventBody;
+
+        let (mut internals, _adapter, _) = internals(|_| Vec::new());
+        let lines = internals.subscribe_output_lines();
+
+        for output in ["first line\nsecond ", "line\r\nno trailing", " newline"] {
+            internals.on_event(transport::events::Event::Output(OutputEventBody {
+                category: None,
+                output: output.to_string(),
+                group: None,
+                variables_reference: None,
+                source: None,
+                line: None,
+                column: None,
+            }));
+        }
+        assert_eq!(
+            lines.try_iter().collect::<Vec<_>>(),
+            vec!["first line", "second line"]
+        );
+
+        internals.on_event(transport::events::Event::Terminated);
+        assert_eq!(
+            lines.try_iter().collect::<Vec<_>>(),
+            vec!["no trailing newline"]
+        );
+    }
+
+    #[test]
+    fn disassemble_marks_current_instruction() -> eyre::Result<()> {
+        let (mut internals, _adapter, _) = internals(|request| match request.body {
+            requests::RequestBody::Disassemble(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"disassemble","body":{"instructions":[{"address":"0x00001000","instruction":"push rbp"},{"address":"0x00001001","instruction":"mov rbp, rsp"},{"address":"0x00001004","instruction":"sub rsp, 16"}]}"#,
+            )],
+            _ => Vec::new(),
+        });
+
+        let frame: transport::types::StackFrame = serde_json::from_str(
+            r#"{"id":1,"name":"main","line":4,"column":0,"instructionPointerReference":"0x1001"}"#,
+        )?;
+
+        // not advertised by the adapter
+        assert!(internals.disassemble_frame(&frame, 1).is_err());
+
+        internals.capabilities.supports_disassemble_request = Some(true);
+        let instructions = internals.disassemble_frame(&frame, 1)?;
+        let current: Vec<_> = instructions
+            .iter()
+            .filter(|i| i.is_current)
+            .map(|i| i.instruction.instruction.as_str())
+            .collect();
+        assert_eq!(current, vec!["mov rbp, rsp"]);
+        Ok(())
+    }
+
+    #[test]
+    fn restart_frame_requires_restartable_frame() -> eyre::Result<()> {
+        let (mut internals, adapter, _) = internals(|request| match request.body {
+            requests::RequestBody::RestartFrame(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"restartFrame""#,
+            )],
+            _ => Vec::new(),
+        });
+        internals.capabilities.supports_restart_frame = Some(true);
+
+        let fixed: transport::types::StackFrame = serde_json::from_str(
+            r#"{"id":1,"name":"<module>","line":4,"column":0,"canRestart":false}"#,
+        )?;
+        let err = internals.restart_frame(&fixed).unwrap_err();
+        assert!(err.to_string().contains("cannot be restarted"), "{err}");
+        assert!(adapter.requests.try_iter().next().is_none());
+
+        let restartable: transport::types::StackFrame =
+            serde_json::from_str(r#"{"id":2,"name":"main","line":8,"column":0}"#)?;
+        internals.restart_frame(&restartable)?;
+        assert!(matches!(
+            adapter.requests.try_iter().next().map(|r| r.body),
+            Some(requests::RequestBody::RestartFrame(
+                requests::RestartFrame { frame_id: 2 }
+            ))
+        ));
+        Ok(())
+    }
+
+    #[test]
+    fn break_when_equals() -> eyre::Result<()> {
+        let (mut internals, adapter, _) = internals(|request| match request.body {
+            requests::RequestBody::Evaluate(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"evaluate","body":{"result":"'done'","variablesReference":0}"#,
+            )],
+            requests::RequestBody::SetBreakpoints(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"setBreakpoints","body":{"breakpoints":[]}"#,
+            )],
+            _ => Vec::new(),
+        });
+        internals.client.assume_initialized();
+        internals.capabilities.supports_conditional_breakpoints = Some(true);
+
+        internals.break_when_equals(1, PathBuf::from("/test.py"), 10, "state")?;
+
+        let requests: Vec<_> = adapter.requests.try_iter().collect();
+        let Some(requests::RequestBody::SetBreakpoints(requests::SetBreakpoints {
+            breakpoints: Some(breakpoints),
+            ..
+        })) = requests.last().map(|r| &r.body)
+        else {
+            panic!("expected set breakpoints request");
+        };
+        assert_eq!(breakpoints[0].line, 10);
+        assert_eq!(breakpoints[0].condition.as_deref(), Some("state == 'done'"));
+        Ok(())
+    }
+
+    #[test]
+    fn unsupported_hit_condition_is_dropped() -> eyre::Result<()> {
+        let (mut internals, adapter, _) = internals(|request| match request.body {
+            requests::RequestBody::SetBreakpoints(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"setBreakpoints","body":{"breakpoints":[{"verified":true}]}"#,
+            )],
+            _ => Vec::new(),
+        });
+        internals.client.assume_initialized();
+        let breakpoint = Breakpoint {
+            path: PathBuf::from("/test.py"),
+            line: 10,
+            hit_condition: Some(">= 3".to_string()),
+            ..Default::default()
+        };
+
+        let sent_hit_condition = |adapter: &fake_adapter::FakeAdapter| {
+            let requests: Vec<_> = adapter.requests.try_iter().collect();
+            let Some(requests::RequestBody::SetBreakpoints(requests::SetBreakpoints {
+                breakpoints: Some(breakpoints),
+                ..
+            })) = requests.last().map(|r| &r.body)
+            else {
+                panic!("expected set breakpoints request");
+            };
+            breakpoints[0].hit_condition.clone()
+        };
+
+        // not advertised by the adapter
+        let id = internals.add_breakpoint(breakpoint.clone())?;
+        assert_eq!(sent_hit_condition(&adapter), None);
+        internals.remove_breakpoint(id);
+        let _ = adapter.requests.try_iter().count();
+
+        internals.capabilities.supports_hit_conditional_breakpoints = Some(true);
+        internals.add_breakpoint(breakpoint.clone())?;
+        assert_eq!(sent_hit_condition(&adapter).as_deref(), Some(">= 3"));
+        Ok(())
+    }
+
+    #[test]
+    fn function_breakpoints_reapplied_after_restart() -> eyre::Result<()> {
+        let (mut internals, adapter, _) = internals(|request| match request.body {
+            requests::RequestBody::SetFunctionBreakpoints(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"setFunctionBreakpoints","body":{"breakpoints":[{"verified":true}]}"#,
+            )],
+            _ => Vec::new(),
+        });
+        internals.capabilities.supports_function_breakpoints = Some(true);
+        internals.initialised = true;
+        internals.client.assume_initialized();
+
+        let function_breakpoints = |adapter: &FakeAdapter| -> Vec<Vec<String>> {
+            adapter
+                .requests
+                .try_iter()
+                .filter_map(|request| match request.body {
+                    requests::RequestBody::SetFunctionBreakpoints(
+                        requests::SetFunctionBreakpoints { breakpoints },
+                    ) => Some(breakpoints.into_iter().map(|b| b.name).collect()),
+                    _ => None,
+                })
+                .collect()
+        };
+
+        internals.set_function_breakpoints(vec!["main".to_string()])?;
+        assert_eq!(function_breakpoints(&adapter), vec![vec!["main"]]);
+
+        // the adapter is initialised again when the session restarts
+        internals.on_event(transport::events::Event::Initialized);
+        assert_eq!(function_breakpoints(&adapter), vec![vec!["main"]]);
+        Ok(())
+    }
+
+    #[test]
+    fn function_breakpoints_before_initialize() -> eyre::Result<()> {
+        let (mut internals, adapter, _) = internals(|request| match request.body {
+            requests::RequestBody::SetFunctionBreakpoints(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"setFunctionBreakpoints","body":{"breakpoints":[{"verified":true}]}"#,
+            )],
+            _ => Vec::new(),
+        });
+
+        // the capabilities are not known until the adapter answers the initialize request
+        internals.set_function_breakpoints(vec!["main".to_string()])?;
+        assert!(adapter.requests.try_recv().is_err());
+
+        internals.capabilities.supports_function_breakpoints = Some(true);
+        internals.client.assume_initialized();
+        internals.on_event(transport::events::Event::Initialized);
+        let request = adapter.requests.recv_timeout(Duration::from_secs(1))?;
+        let requests::RequestBody::SetFunctionBreakpoints(requests::SetFunctionBreakpoints {
+            breakpoints,
+        }) = request.body
+        else {
+            panic!("expected set function breakpoints request");
+        };
+        let names: Vec<_> = breakpoints.into_iter().map(|b| b.name).collect();
+        assert_eq!(names, ["main"]);
+
+        // not advertised by the adapter
+        internals.capabilities.supports_function_breakpoints = None;
+        assert!(internals
+            .set_function_breakpoints(vec!["run".to_string()])
+            .is_err());
+        assert!(adapter.requests.try_recv().is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn watchpoint_expired() -> eyre::Result<()> {
+        let (mut internals, adapter, published) = internals(|request| match request.body {
+            requests::RequestBody::DataBreakpointInfo(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"dataBreakpointInfo","body":{"dataId":"x@1","description":"x"}"#,
+            )],
+            requests::RequestBody::SetDataBreakpoints(_) => vec![fake_adapter::response(
+                request,
+                r#""command":"setDataBreakpoints","body":{"breakpoints":[{"id":7,"verified":true}]}"#,
+            )],
+            _ => Vec::new(),
+        });
+
+        // not advertised by the adapter
+        assert!(internals.add_watchpoint(10, "x").is_err());
+        assert!(adapter.requests.try_recv().is_err());
+
+        internals.capabilities.supports_data_breakpoints = Some(true);
+        let watchpoint = internals.add_watchpoint(10, "x")?;
+        assert_eq!(watchpoint.data_id, "x@1");
+
+        let invalidated = |id| {
+            transport::events::Event::Breakpoint(transport::events::BreakpointEventBody {
+                reason: "changed".to_string(),
+                breakpoint: serde_json::from_value(serde_json::json!({
+                    "id": id,
+                    "verified": false,
+                }))
+                .unwrap(),
+            })
+        };
+        let expired = |published: &crossbeam_channel::Receiver<Event>| {
+            published
+                .try_iter()
+                .filter_map(|event| match event {
+                    Event::WatchpointExpired(watchpoint) => Some(watchpoint),
+                    _ => None,
+                })
+                .collect::<Vec<_>>()
+        };
+
+        // other breakpoints are ignored
+        internals.on_event(invalidated(3));
+        assert!(expired(&published).is_empty());
+
+        internals.on_event(invalidated(7));
+        assert_eq!(expired(&published), vec![watchpoint]);
+        assert!(internals.watchpoints.is_empty());
+        Ok(())
+    }
+
+    #[test]
+    fn set_variable_requires_capability() -> eyre::Result<()> {
+        let initialized = |capabilities: &'static str| -> eyre::Result<_> {
+            let (internals, adapter, _) = internals(move |request| match request.body {
+                requests::RequestBody::Initialize(_) => vec![fake_adapter::response(
+                    request,
+                    &format!(r#""command":"initialize","body":{capabilities}"#),
+                )],
+                requests::RequestBody::SetVariable(_) => vec![fake_adapter::response(
+                    request,
+                    r#""command":"setVariable","body":{"value":"42"}"#,
+                )],
+                _ => Vec::new(),
+            });
+            initialize(&internals, &adapter)?;
+            Ok((internals, adapter))
+        };
+
+        // not advertised by the adapter
+        let (internals, adapter) = initialized("{}")?;
+        let err = internals.set_variable(1, "x", "42").unwrap_err();
+        assert!(
+            err.downcast_ref::<transport::UnsupportedError>().is_some(),
+            "{err}"
+        );
+        assert!(adapter.requests.try_recv().is_err());
+
+        let (internals, _adapter) = initialized(r#"{"supportsSetVariable":true}"#)?;
+        assert_eq!(internals.set_variable(1, "x", "42")?, "42");
+        Ok(())
+    }
+
+    #[test]
+    fn pinned_watches_follow_current_frame() {
+        let (mut internals, _adapter, published) = internals(|request| match &request.body {
+            requests::RequestBody::Evaluate(requests::Evaluate {
+                expression,
+                frame_id: Some(frame_id),
+                ..
+            }) => vec![fake_adapter::response(
+                request,
+                &format!(
+                    r#""command":"evaluate","body":{{"result":"{expression} in frame {frame_id}","variablesReference":0}}"#
+                ),
+            )],
+            _ => Vec::new(),
+        });
+
+        // nothing to evaluate in until a frame is selected
+        internals.pin_watch("x");
+        internals.set_current_frame(1);
+        internals.set_current_frame(2);
+
+        let values: Vec<_> = published
+            .try_iter()
+            .filter_map(|event| match event {
+                Event::Watches(values) => Some(values),
+                _ => None,
+            })
+            .collect();
+        assert_eq!(
+            values,
+            vec![
+                vec![WatchValue {
+                    expression: "x".to_string(),
+                    value: Some("x in frame 1".to_string()),
+                    timed_out: false,
+                }],
+                vec![WatchValue {
+                    expression: "x".to_string(),
+                    value: Some("x in frame 2".to_string()),
+                    timed_out: false,
+                }],
+            ]
+        );
+    }
+
+    #[test]
+    fn slow_watch_times_out() {
+        // the adapter never answers for the slow expression
+        let (mut internals, _adapter, published) = internals(|request| match &request.body {
+            requests::RequestBody::Evaluate(requests::Evaluate { expression, .. })
+                if expression != "slow" =>
+            {
+                vec![fake_adapter::response(
+                    request,
+                    &format!(
+                        r#""command":"evaluate","body":{{"result":"{expression}!","variablesReference":0}}"#
+                    ),
+                )]
+            }
+            _ => Vec::new(),
+        });
+        internals.watch_timeout = Duration::from_millis(100);
+
+        internals.pin_watch("a");
+        internals.pin_watch("slow");
+        internals.pin_watch("b");
+        let started = Instant::now();
+        internals.set_current_frame(1);
+        assert!(started.elapsed() < Duration::from_secs(1));
+
+        let Some(Event::Watches(values)) = published.try_iter().last() else {
+            panic!("watches not published");
+        };
+        let summary: Vec<_> = values
+            .iter()
+            .map(|w| (w.expression.as_str(), w.value.as_deref(), w.timed_out))
+            .collect();
+        assert_eq!(
+            summary,
+            vec![
+                ("a", Some("a!"), false),
+                ("slow", None, true),
+                ("b", Some("b!"), false),
+            ]
+        );
+    }
+}
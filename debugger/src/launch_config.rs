@@ -0,0 +1,87 @@
+//! Checks for launch configurations which will not behave as expected
+use transport::responses::Capabilities;
+
+use crate::Language;
+
+/// A non-fatal problem with a launch configuration
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct LaunchWarning {
+    /// The launch option the warning relates to
+    pub option: String,
+    pub message: String,
+}
+
+/// Launch options which are only understood by some adapters
+const ADAPTER_OPTIONS: &[(&str, Language)] = &[
+    ("justMyCode", Language::DebugPy),
+    ("showReturnValue", Language::DebugPy),
+    ("redirectOutput", Language::DebugPy),
+    ("subProcess", Language::DebugPy),
+    ("buildFlags", Language::Delve),
+    ("dlvFlags", Language::Delve),
+    ("stackTraceDepth", Language::Delve),
+];
+
+/// Check the launch arguments `args` against what the adapter for `language` supports, as far
+/// as is known from its capabilities.
+pub fn validate_launch_config(
+    language: Language,
+    args: &serde_json::Value,
+    capabilities: &Capabilities,
+) -> Vec<LaunchWarning> {
+    let mut warnings = Vec::new();
+    let Some(args) = args.as_object() else {
+        return warnings;
+    };
+
+    for (option, supported_by) in ADAPTER_OPTIONS {
+        if args.contains_key(*option) && *supported_by != language {
+            warnings.push(LaunchWarning {
+                option: option.to_string(),
+                message: format!("{option} is ignored by the {language} adapter"),
+            });
+        }
+    }
+
+    if args.contains_key("__restart") && !capabilities.supports_restart_request.unwrap_or(false) {
+        warnings.push(LaunchWarning {
+            option: "__restart".to_string(),
+            message: "adapter does not support restarting, so restart data is ignored".to_string(),
+        });
+    }
+
+    warnings
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn unsupported_options() {
+        let args = serde_json::json!({
+            "program": "main.go",
+            "justMyCode": true,
+            "stopOnEntry": true,
+            "__restart": {},
+        });
+
+        let warnings = validate_launch_config(Language::Delve, &args, &Capabilities::default());
+
+        let options: Vec<_> = warnings.iter().map(|w| w.option.as_str()).collect();
+        assert_eq!(options, vec!["justMyCode", "__restart"]);
+    }
+
+    #[test]
+    fn supported_options() {
+        let args = serde_json::json!({
+            "program": "main.py",
+            "justMyCode": true,
+            "stopOnEntry": true,
+        });
+
+        assert!(
+            validate_launch_config(Language::DebugPy, &args, &Capabilities::default()).is_empty()
+        );
+    }
+}
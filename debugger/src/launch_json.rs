@@ -0,0 +1,266 @@
+//! Launch configurations from a VS Code `.vscode/launch.json` file, so existing project
+//! configurations can be reused
+use std::{collections::HashMap, io::Read, path::Path};
+
+use eyre::WrapErr;
+use serde::{Deserialize, Serialize};
+use serde_json::{Map, Value};
+
+/// Whether a configuration starts the debuggee or attaches to a running one
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub enum LaunchRequest {
+    Launch,
+    Attach,
+}
+
+/// A single entry of the `configurations` array
+///
+/// The fields understood by debugpy are parsed, and any other options are kept so they can be
+/// passed on to the adapter.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct LaunchConfiguration {
+    pub name: String,
+    /// The adapter the configuration is for, e.g. `debugpy`
+    #[serde(rename = "type")]
+    pub adapter: String,
+    pub request: LaunchRequest,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub program: Option<String>,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub args: Vec<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub cwd: Option<String>,
+    #[serde(default, skip_serializing_if = "HashMap::is_empty")]
+    pub env: HashMap<String, String>,
+    /// Adapter specific options, e.g. `justMyCode`
+    #[serde(flatten)]
+    pub options: Map<String, Value>,
+}
+
+impl LaunchConfiguration {
+    /// The arguments of the launch or attach request for this configuration
+    pub fn to_launch_arguments(&self) -> eyre::Result<Value> {
+        let mut arguments =
+            serde_json::to_value(self).context("serializing launch configuration")?;
+        if let Some(arguments) = arguments.as_object_mut() {
+            for key in ["name", "type", "request"] {
+                arguments.remove(key);
+            }
+        }
+        Ok(arguments)
+    }
+}
+
+#[derive(Deserialize)]
+struct LaunchJson {
+    configurations: Vec<Value>,
+}
+
+/// Parse the configurations of a `launch.json` file, substituting variables such as
+/// `${workspaceFolder}`
+///
+/// Like VS Code, comments and trailing commas are allowed.
+pub fn parse_launch_json(
+    mut reader: impl Read,
+    workspace_folder: &Path,
+) -> eyre::Result<Vec<LaunchConfiguration>> {
+    let mut contents = String::new();
+    reader
+        .read_to_string(&mut contents)
+        .context("reading launch configurations")?;
+    let launch_json: LaunchJson = serde_json::from_str(&strip_comments(&contents))
+        .context("deserializing launch configurations")?;
+
+    launch_json
+        .configurations
+        .into_iter()
+        .map(|mut configuration| {
+            substitute(&mut configuration, workspace_folder);
+            serde_json::from_value(configuration).context("deserializing launch configuration")
+        })
+        .collect()
+}
+
+/// Replace the variables in every string within `value`
+fn substitute(value: &mut Value, workspace_folder: &Path) {
+    match value {
+        Value::String(s) => *s = substitute_variables(s, workspace_folder),
+        Value::Array(values) => values
+            .iter_mut()
+            .for_each(|value| substitute(value, workspace_folder)),
+        Value::Object(values) => values
+            .values_mut()
+            .for_each(|value| substitute(value, workspace_folder)),
+        _ => {}
+    }
+}
+
+/// Replace `${...}` variables in `s`, leaving unknown variables unchanged
+fn substitute_variables(s: &str, workspace_folder: &Path) -> String {
+    let mut out = String::with_capacity(s.len());
+    let mut rest = s;
+    while let Some(start) = rest.find("${") {
+        // an unterminated variable is left as it is, along with the rest of the string
+        let Some(end) = rest[start..].find('}') else {
+            break;
+        };
+        out.push_str(&rest[..start]);
+        let variable = &rest[start + 2..start + end];
+        let value = match variable {
+            "workspaceFolder" | "workspaceRoot" => Some(workspace_folder.display().to_string()),
+            "workspaceFolderBasename" => workspace_folder
+                .file_name()
+                .map(|name| name.to_string_lossy().into_owned()),
+            "pathSeparator" => Some(std::path::MAIN_SEPARATOR.to_string()),
+            "userHome" => std::env::var("HOME").ok(),
+            _ => variable
+                .strip_prefix("env:")
+                .map(|name| std::env::var(name).unwrap_or_default()),
+        };
+        match value {
+            Some(value) => out.push_str(&value),
+            None => out.push_str(&rest[start..start + end + 1]),
+        }
+        rest = &rest[start + end + 1..];
+    }
+    out.push_str(rest);
+    out
+}
+
+/// Remove comments and trailing commas, which VS Code allows in its JSON files
+fn strip_comments(s: &str) -> String {
+    let mut out = String::with_capacity(s.len());
+    let mut chars = s.chars().peekable();
+    let mut in_string = false;
+    while let Some(c) = chars.next() {
+        if in_string {
+            out.push(c);
+            match c {
+                '\\' => out.extend(chars.next()),
+                '"' => in_string = false,
+                _ => {}
+            }
+            continue;
+        }
+
+        match (c, chars.peek()) {
+            ('"', _) => {
+                in_string = true;
+                out.push(c);
+            }
+            ('/', Some('/')) => {
+                for c in chars.by_ref() {
+                    if c == '\n' {
+                        out.push(c);
+                        break;
+                    }
+                }
+            }
+            ('/', Some('*')) => {
+                chars.next();
+                let mut previous = None;
+                for c in chars.by_ref() {
+                    if previous == Some('*') && c == '/' {
+                        break;
+                    }
+                    previous = Some(c);
+                }
+            }
+            (']' | '}', _) => {
+                // drop a trailing comma before the closing bracket
+                let trimmed = out.trim_end().len();
+                if out[..trimmed].ends_with(',') {
+                    out.truncate(trimmed - 1);
+                }
+                out.push(c);
+            }
+            _ => out.push(c),
+        }
+    }
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use std::path::Path;
+
+    use super::*;
+
+    const LAUNCH_JSON: &str = r#"{
+        // Use IntelliSense to learn about possible attributes.
+        "version": "0.2.0",
+        "configurations": [
+            {
+                "name": "Python: main",
+                "type": "debugpy",
+                "request": "launch",
+                "program": "${workspaceFolder}/main.py",
+                "args": ["--config", "${workspaceFolderBasename}.toml"],
+                "cwd": "${workspaceFolder}",
+                "env": { "URL": "http://localhost:8000" },
+                /* not one of the common fields */
+                "justMyCode": false,
+            },
+            {
+                "name": "Python: attach",
+                "type": "debugpy",
+                "request": "attach",
+                "connect": { "host": "localhost", "port": 5678 },
+            },
+        ],
+    }"#;
+
+    #[test]
+    fn parse() -> eyre::Result<()> {
+        let configurations =
+            parse_launch_json(LAUNCH_JSON.as_bytes(), Path::new("/home/user/project"))?;
+        assert_eq!(configurations.len(), 2);
+
+        let launch = &configurations[0];
+        assert_eq!(launch.request, LaunchRequest::Launch);
+        assert_eq!(
+            launch.program.as_deref(),
+            Some("/home/user/project/main.py")
+        );
+        assert_eq!(launch.args, ["--config", "project.toml"]);
+        assert_eq!(launch.cwd.as_deref(), Some("/home/user/project"));
+        // the url is not mistaken for a comment
+        assert_eq!(launch.env["URL"], "http://localhost:8000");
+
+        let attach = &configurations[1];
+        assert_eq!(attach.request, LaunchRequest::Attach);
+        assert_eq!(attach.options["connect"]["port"], 5678);
+        Ok(())
+    }
+
+    #[test]
+    fn launch_arguments() -> eyre::Result<()> {
+        let configurations =
+            parse_launch_json(LAUNCH_JSON.as_bytes(), Path::new("/home/user/project"))?;
+
+        let arguments = configurations[0].to_launch_arguments()?;
+        assert_eq!(arguments["program"], "/home/user/project/main.py");
+        assert_eq!(arguments["justMyCode"], false);
+        assert!(arguments.get("request").is_none());
+        Ok(())
+    }
+
+    #[test]
+    fn unknown_variables_are_unchanged() {
+        assert_eq!(
+            substitute_variables("${file} in ${workspaceFolder}", Path::new("/project")),
+            "${file} in /project"
+        );
+    }
+
+    #[test]
+    fn unterminated_variable_is_unchanged() {
+        let workspace_folder = Path::new("/project");
+        assert_eq!(substitute_variables("a${b", workspace_folder), "a${b");
+        assert_eq!(
+            substitute_variables("${workspaceFolder}/a${b", workspace_folder),
+            "/project/a${b"
+        );
+    }
+}
@@ -1,10 +1,31 @@
+mod bootstrap;
 mod debugger;
+#[cfg(test)]
+mod fake_adapter;
+mod history;
 mod internals;
+mod launch_config;
+mod launch_json;
+mod path_mapping;
 mod persistence;
+mod pretty_print;
 pub(crate) mod state;
 mod types;
+mod variables;
 
+pub use bootstrap::{AlreadyInitialisedError, BootstrapTimeline};
 pub use debugger::Debugger;
+pub use history::History;
 pub use internals::FileSource;
+pub use launch_config::{validate_launch_config, LaunchWarning};
+pub use launch_json::{parse_launch_json, LaunchConfiguration, LaunchRequest};
+pub use path_mapping::{PathMapper, PathMapping};
+pub use pretty_print::{LanguagePrettyPrinter, PassThrough, PythonPrettyPrinter};
 pub use state::{AttachArguments, Event, Language, LaunchArguments};
-pub use types::Breakpoint;
+pub use types::{
+    AllStacks, Breakpoint, BreakpointLines, ExceptionFocus, FrameState, Instruction, ScopeState,
+    SessionResult, StoppedContext, WatchValue, Watchpoint,
+};
+pub use variables::{
+    diff_variables, ChangeKind, VariableChange, VariableNode, MAX_EXPANDED_VARIABLES,
+};
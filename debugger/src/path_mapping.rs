@@ -0,0 +1,183 @@
+//! Translation between local paths and the paths the debug adapter sees, e.g. when debugging a
+//! process running in a container or on a remote machine
+use std::path::{Path, PathBuf};
+
+use transport::requests::PathFormat;
+pub use transport::requests::PathMapping;
+
+/// Maps paths between the local and remote sides using a list of [`PathMapping`]s
+#[derive(Debug, Clone, Default)]
+pub struct PathMapper {
+    mappings: Vec<PathMapping>,
+    /// The working directory of the debuggee, which relative paths from the adapter are
+    /// relative to
+    cwd: Option<PathBuf>,
+    /// Whether the adapter expects paths or `file://` URIs
+    path_format: PathFormat,
+}
+
+impl PathMapper {
+    pub fn new(mappings: Vec<PathMapping>) -> Self {
+        Self {
+            mappings,
+            cwd: None,
+            path_format: PathFormat::Path,
+        }
+    }
+
+    /// Send paths to the adapter in the format negotiated in the initialize request
+    pub fn with_path_format(mut self, path_format: PathFormat) -> Self {
+        self.path_format = path_format;
+        self
+    }
+
+    /// Resolve relative paths reported by the adapter against the working directory of the
+    /// debuggee
+    pub fn with_cwd(mut self, cwd: impl Into<PathBuf>) -> Self {
+        self.cwd = Some(cwd.into());
+        self
+    }
+
+    /// Translate a local path to the path the adapter expects
+    pub fn to_remote(&self, path: &Path) -> PathBuf {
+        let path = self
+            .mappings
+            .iter()
+            .find_map(|m| rebase(path, m.local_root.as_ref(), m.remote_root.as_ref()))
+            .unwrap_or_else(|| path.to_path_buf());
+        match self.path_format {
+            PathFormat::Path => path,
+            PathFormat::Uri => PathBuf::from(to_uri(&path)),
+        }
+    }
+
+    /// Translate a path reported by the adapter to the local path
+    ///
+    /// `file://` URIs are converted to paths, and relative paths are resolved against the
+    /// working directory of the debuggee, if known.
+    pub fn to_local(&self, path: &Path) -> PathBuf {
+        let path = from_uri(path).unwrap_or_else(|| path.to_path_buf());
+        let path = match &self.cwd {
+            Some(cwd) if path.is_relative() => cwd.join(path),
+            _ => path.to_path_buf(),
+        };
+        self.mappings
+            .iter()
+            .find_map(|m| rebase(&path, m.remote_root.as_ref(), m.local_root.as_ref()))
+            .unwrap_or(path)
+    }
+}
+
+fn rebase(path: &Path, from: &Path, to: &Path) -> Option<PathBuf> {
+    path.strip_prefix(from).ok().map(|rest| to.join(rest))
+}
+
+/// Convert an absolute path to a `file://` URI, percent encoding reserved characters
+fn to_uri(path: &Path) -> String {
+    let mut uri = String::from("file://");
+    for byte in path.to_string_lossy().bytes() {
+        if byte.is_ascii_alphanumeric() || b"/-._~".contains(&byte) {
+            uri.push(byte as char);
+        } else {
+            uri.push_str(&format!("%{byte:02X}"));
+        }
+    }
+    uri
+}
+
+/// Convert a `file://` URI to a path, or `None` if `uri` is not a file URI
+fn from_uri(uri: &Path) -> Option<PathBuf> {
+    let rest = uri.to_str()?.strip_prefix("file://")?;
+    let rest = rest.strip_prefix("localhost").unwrap_or(rest);
+
+    let mut bytes = Vec::with_capacity(rest.len());
+    let mut remaining = rest.as_bytes();
+    while let Some((&byte, tail)) = remaining.split_first() {
+        let escaped = tail
+            .get(..2)
+            .and_then(|hex| std::str::from_utf8(hex).ok())
+            .and_then(|hex| u8::from_str_radix(hex, 16).ok());
+        match escaped {
+            Some(decoded) if byte == b'%' => {
+                bytes.push(decoded);
+                remaining = &tail[2..];
+            }
+            _ => {
+                bytes.push(byte);
+                remaining = tail;
+            }
+        }
+    }
+    String::from_utf8(bytes).ok().map(PathBuf::from)
+}
+
+#[cfg(test)]
+mod tests {
+    use std::path::{Path, PathBuf};
+
+    use transport::requests::PathFormat;
+
+    use super::{PathMapper, PathMapping};
+
+    #[test]
+    fn round_trip() {
+        let mapper = PathMapper::new(vec![PathMapping {
+            local_root: "/home/user/project".to_string(),
+            remote_root: "/app".to_string(),
+        }]);
+
+        let remote = mapper.to_remote(Path::new("/home/user/project/src/main.py"));
+        assert_eq!(remote, PathBuf::from("/app/src/main.py"));
+        assert_eq!(
+            mapper.to_local(&remote),
+            PathBuf::from("/home/user/project/src/main.py")
+        );
+
+        // unmapped paths are unchanged
+        assert_eq!(
+            mapper.to_remote(Path::new("/usr/lib/python3/os.py")),
+            PathBuf::from("/usr/lib/python3/os.py")
+        );
+    }
+
+    #[test]
+    fn relative_to_cwd() {
+        let mapper = PathMapper::default().with_cwd("/home/user/project");
+
+        assert_eq!(
+            mapper.to_local(Path::new("src/main.py")),
+            PathBuf::from("/home/user/project/src/main.py")
+        );
+
+        // absolute paths are unchanged
+        assert_eq!(
+            mapper.to_local(Path::new("/usr/lib/python3/os.py")),
+            PathBuf::from("/usr/lib/python3/os.py")
+        );
+    }
+
+    #[test]
+    fn uri_round_trip() {
+        let mapper = PathMapper::new(vec![PathMapping {
+            local_root: "/home/user/my project".to_string(),
+            remote_root: "/app".to_string(),
+        }])
+        .with_path_format(PathFormat::Uri);
+
+        assert_eq!(
+            mapper.to_remote(Path::new("/home/user/my project/src/main.py")),
+            PathBuf::from("file:///app/src/main.py")
+        );
+        assert_eq!(
+            mapper.to_remote(Path::new("/home/user/other project/main.py")),
+            PathBuf::from("file:///home/user/other%20project/main.py")
+        );
+
+        let local = Path::new("/home/user/my project/src/café.py");
+        assert_eq!(mapper.to_local(&mapper.to_remote(local)), local);
+        assert_eq!(
+            mapper.to_local(Path::new("file://localhost/app/main.py")),
+            PathBuf::from("/home/user/my project/main.py")
+        );
+    }
+}
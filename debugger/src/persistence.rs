@@ -1 +1,53 @@
+//! Saving and loading breakpoints, so they persist between debugging sessions
+use std::{fs::File, io::BufReader, path::Path};
 
+use eyre::WrapErr;
+
+use crate::types::Breakpoint;
+
+pub(crate) fn save_breakpoints(path: &Path, breakpoints: &[Breakpoint]) -> eyre::Result<()> {
+    let f = File::create(path).with_context(|| format!("creating {}", path.display()))?;
+    serde_json::to_writer_pretty(f, breakpoints).context("serializing breakpoints")
+}
+
+pub(crate) fn load_breakpoints(path: &Path) -> eyre::Result<Vec<Breakpoint>> {
+    let f = File::open(path).with_context(|| format!("opening {}", path.display()))?;
+    serde_json::from_reader(BufReader::new(f)).context("deserializing breakpoints")
+}
+
+#[cfg(test)]
+mod tests {
+    use std::path::PathBuf;
+
+    use super::*;
+
+    #[test]
+    fn round_trip() -> eyre::Result<()> {
+        let path = std::env::temp_dir().join(format!("breakpoints-{}.json", std::process::id()));
+        let breakpoints = vec![
+            Breakpoint {
+                name: Some("entry".to_string()),
+                path: PathBuf::from("/test.py"),
+                line: 4,
+                mode: None,
+                condition: Some("x > 1".to_string()),
+                hit_condition: Some("3".to_string()),
+            },
+            Breakpoint {
+                name: None,
+                path: PathBuf::from("/other.py"),
+                line: 10,
+                mode: Some("hardware".to_string()),
+                condition: None,
+                hit_condition: None,
+            },
+        ];
+
+        save_breakpoints(&path, &breakpoints)?;
+        let loaded = load_breakpoints(&path)?;
+        std::fs::remove_file(&path)?;
+
+        assert_eq!(loaded, breakpoints);
+        Ok(())
+    }
+}
@@ -0,0 +1,91 @@
+//! Rendering values reported by the adapter the way the debugee's language would show them
+use crate::Language;
+
+/// Formats evaluate and variable results for display
+pub trait LanguagePrettyPrinter: Send {
+    /// Render `value`, as reported by the adapter, for display
+    fn pretty_print(&self, value: &str) -> String;
+}
+
+/// The printer for the adapter of `language`
+pub(crate) fn for_language(language: Language) -> Box<dyn LanguagePrettyPrinter> {
+    match language {
+        Language::DebugPy => Box::new(PythonPrettyPrinter),
+        Language::Delve => Box::new(PassThrough),
+    }
+}
+
+/// Shows values exactly as the adapter reported them
+#[derive(Debug, Clone, Copy, Default)]
+pub struct PassThrough;
+
+impl LanguagePrettyPrinter for PassThrough {
+    fn pretty_print(&self, value: &str) -> String {
+        value.to_string()
+    }
+}
+
+/// Collapses multi-line Python reprs onto a single line
+///
+/// Reprs spread over several lines, e.g. by `pprint`, are joined with their indentation
+/// removed, and a traceback is shortened to the exception it ends with.
+#[derive(Debug, Clone, Copy, Default)]
+pub struct PythonPrettyPrinter;
+
+impl LanguagePrettyPrinter for PythonPrettyPrinter {
+    fn pretty_print(&self, value: &str) -> String {
+        let mut lines = value.lines().map(str::trim).filter(|line| !line.is_empty());
+        let Some(first) = lines.next() else {
+            return value.to_string();
+        };
+
+        if first.starts_with("Traceback (most recent call last)") {
+            return lines.next_back().unwrap_or(first).to_string();
+        }
+
+        // newlines inside Python strings are escaped, so every line break is formatting
+        let mut out = first.to_string();
+        for line in lines {
+            let after_open = out.ends_with(['(', '[', '{']);
+            let before_close = line.starts_with([')', ']', '}']);
+            if !after_open && !before_close {
+                out.push(' ');
+            }
+            out.push_str(line);
+        }
+        out
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{for_language, LanguagePrettyPrinter, PythonPrettyPrinter};
+    use crate::Language;
+
+    #[test]
+    fn python_collapses_multiline_repr() {
+        let printer = PythonPrettyPrinter;
+
+        assert_eq!(
+            printer.pretty_print("{'a': 1,\n 'b': [1,\n       2]}"),
+            "{'a': 1, 'b': [1, 2]}"
+        );
+        assert_eq!(
+            printer.pretty_print("[\n    'first',\n    'second',\n]"),
+            "['first', 'second',]"
+        );
+        assert_eq!(
+            printer.pretty_print(
+                "Traceback (most recent call last):\n  File \"<string>\", line 1, in <module>\nNameError: name 'x' is not defined\n"
+            ),
+            "NameError: name 'x' is not defined"
+        );
+        assert_eq!(printer.pretty_print("'a\\nb'"), "'a\\nb'");
+    }
+
+    #[test]
+    fn other_languages_unchanged() {
+        let value = "main.Point {\n\tX: 1,\n\tY: 2,\n}";
+        assert_eq!(for_language(Language::Delve).pretty_print(value), value);
+    }
+}
@@ -1,4 +1,4 @@
-use std::{path::PathBuf, str::FromStr};
+use std::{path::PathBuf, str::FromStr, time::Duration};
 
 use transport::{
     requests::{self, DebugpyLaunchArguments},
@@ -12,6 +12,8 @@ pub(crate) enum DebuggerState {
     Paused {
         stack: Vec<types::StackFrame>,
         source: crate::FileSource,
+        description: Option<String>,
+        text: Option<String>,
     },
     Running,
     Ended,
@@ -24,18 +26,44 @@ pub enum Event {
     Paused {
         stack: Vec<types::StackFrame>,
         source: crate::FileSource,
+        /// Human readable reason for the stop, e.g. exception details
+        description: Option<String>,
+        /// Additional information about the stop, e.g. the exception message
+        text: Option<String>,
     },
     Running,
     Ended,
+    /// Output from the debugee or adapter
+    Output {
+        /// The kind of output, e.g. stderr, if the adapter gave one
+        category: Option<transport::events::OutputEventCategory>,
+        output: String,
+        /// Whether this output starts or ends a collapsible group
+        group: Option<transport::events::OutputEventGroup>,
+        /// How many groups this output is nested within
+        depth: usize,
+    },
+    /// The pinned watch expressions were evaluated in a newly selected stack frame
+    Watches(Vec<types::WatchValue>),
+    /// The adapter invalidated a watchpoint, e.g. because its variable went out of scope, so it
+    /// has been removed
+    WatchpointExpired(types::Watchpoint),
 }
 
 impl<'a> From<&'a DebuggerState> for Event {
     fn from(value: &'a DebuggerState) -> Self {
         match value {
             DebuggerState::Initialised => Event::Initialised,
-            DebuggerState::Paused { stack, source, .. } => Event::Paused {
+            DebuggerState::Paused {
+                stack,
+                source,
+                description,
+                text,
+            } => Event::Paused {
                 stack: stack.clone(),
                 source: source.clone(),
+                description: description.clone(),
+                text: text.clone(),
             },
             DebuggerState::Running => Event::Running,
             DebuggerState::Ended => Event::Ended,
@@ -43,12 +71,21 @@ impl<'a> From<&'a DebuggerState> for Event {
     }
 }
 
-#[derive(Clone, Copy)]
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
 pub enum Language {
     DebugPy,
     Delve,
 }
 
+impl std::fmt::Display for Language {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::DebugPy => f.write_str("debugpy"),
+            Self::Delve => f.write_str("delve"),
+        }
+    }
+}
+
 impl FromStr for Language {
     type Err = eyre::Error;
 
@@ -65,6 +102,13 @@ pub struct AttachArguments {
     pub working_directory: PathBuf,
     pub port: Option<u16>,
     pub language: Language,
+    /// Mappings between local paths and paths in the debugee
+    pub path_mappings: Vec<requests::PathMapping>,
+    /// Only observe the debuggee, rejecting requests such as continuing or stepping which would
+    /// change its state
+    pub inspect_only: bool,
+    /// Whether paths are exchanged with the adapter as paths or `file://` URIs
+    pub path_format: requests::PathFormat,
 }
 
 impl AttachArguments {
@@ -74,7 +118,7 @@ impl AttachArguments {
                 host: "localhost".to_string(),
                 port: self.port.unwrap_or(DEFAULT_DAP_PORT),
             },
-            path_mappings: Vec::new(),
+            path_mappings: self.path_mappings,
             just_my_code: false,
             workspace_folder: self.working_directory,
         })
@@ -85,6 +129,13 @@ pub struct LaunchArguments {
     pub program: PathBuf,
     pub working_directory: Option<PathBuf>,
     pub language: Language,
+    /// Run the program without debugging, so breakpoints are not set
+    pub no_debug: bool,
+    /// Whether paths are exchanged with the adapter as paths or `file://` URIs
+    pub path_format: requests::PathFormat,
+    /// How long after launching to wait for the initialized event before assuming the adapter
+    /// will never send it, or `None` to wait forever
+    pub initialized_fallback: Option<Duration>,
 }
 
 impl LaunchArguments {
@@ -96,8 +147,18 @@ impl LaunchArguments {
             program,
             working_directory: Some(working_directory),
             language,
+            no_debug: false,
+            path_format: requests::PathFormat::Path,
+            initialized_fallback: Some(crate::bootstrap::INITIALIZED_FALLBACK),
         }
     }
+
+    /// The working directory of the debuggee, defaulting to the directory of the program
+    pub fn cwd(&self) -> Option<PathBuf> {
+        self.working_directory
+            .clone()
+            .or_else(|| self.program.parent().map(|p| p.to_path_buf()))
+    }
 }
 
 impl LaunchArguments {
@@ -113,6 +174,7 @@ impl LaunchArguments {
         match self.language {
             Language::DebugPy => requests::RequestBody::Launch(requests::Launch {
                 program,
+                no_debug: self.no_debug.then_some(true),
                 launch_arguments: Some(transport::requests::LaunchArguments::Debugpy(
                     DebugpyLaunchArguments {
                         just_my_code: true,
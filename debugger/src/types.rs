@@ -1,12 +1,119 @@
-use std::path::PathBuf;
+use std::{collections::HashMap, path::PathBuf};
+
+use serde::{Deserialize, Serialize};
 
 pub type BreakpointId = u64;
 
-#[derive(Debug, Clone, Default)]
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
 pub struct Breakpoint {
     pub name: Option<String>,
     pub path: PathBuf,
     pub line: usize,
+    /// One of the breakpoint modes supported by the adapter, e.g. hardware breakpoints
+    pub mode: Option<String>,
+    /// Only stop when this expression is true
+    pub condition: Option<String>,
+    /// Only stop once the breakpoint has been hit the given number of times, interpreted by the
+    /// adapter, e.g. `>= 3`
+    pub hit_condition: Option<String>,
+}
+
+/// Where a breakpoint was requested, and where the adapter placed it, which may be a different
+/// line, e.g. the next line containing code
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct BreakpointLines {
+    pub requested: usize,
+    /// The line the breakpoint was placed on, or `None` if the adapter has not verified it
+    pub verified: Option<usize>,
+}
+
+/// A data breakpoint, which stops when a variable is changed
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Watchpoint {
+    /// The id the adapter gave the data
+    pub data_id: String,
+    /// A description of the data, e.g. the name of the variable
+    pub description: String,
+}
+
+/// The variables of a single scope
+#[derive(Debug, Clone)]
+pub struct ScopeState {
+    pub scope: transport::types::Scope,
+    pub variables: Vec<transport::types::Variable>,
+}
+
+/// The scopes, and their variables, of a stack frame
+#[derive(Debug, Clone)]
+pub struct FrameState {
+    pub scopes: Vec<ScopeState>,
+}
+
+/// Where a thread stopped, e.g. after stepping out of a function
+#[derive(Debug, Clone)]
+pub struct StoppedContext {
+    /// The stack of the thread, innermost frame first
+    pub stack: Vec<transport::types::StackFrame>,
+    /// The state of the innermost frame
+    pub frame: FrameState,
+}
+
+/// A thread which stopped on an exception, focused on the innermost frame in user code
+#[derive(Debug, Clone)]
+pub struct ExceptionFocus {
+    pub thread_id: transport::types::ThreadId,
+    /// The stack of the thread, innermost frame first
+    pub stack: Vec<transport::types::StackFrame>,
+    /// The innermost frame in user code, or the innermost frame if every frame is in library
+    /// code
+    pub frame: transport::types::StackFrame,
+    /// Details of the exception, if the adapter supports exception info requests
+    pub exception: Option<transport::responses::ExceptionInfoResponse>,
+}
+
+/// The stack traces of the stopped threads, e.g. for a "parallel stacks" view
+#[derive(Debug, Clone, Default)]
+pub struct AllStacks {
+    /// The stack of each thread, innermost frame first
+    pub stacks: HashMap<transport::types::ThreadId, Vec<transport::types::StackFrame>>,
+    /// Why the stack of a thread could not be fetched, e.g. because it resumed in the meantime
+    pub skipped: HashMap<transport::types::ThreadId, String>,
+}
+
+/// The value of a pinned watch expression in the current stack frame
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct WatchValue {
+    pub expression: String,
+    /// The value of the expression, or `None` if it could not be evaluated in this frame
+    pub value: Option<String>,
+    /// The adapter took too long to evaluate the expression
+    pub timed_out: bool,
+}
+
+/// The outcome of a debugging session
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub struct SessionResult {
+    /// The exit code of the debugee, if it has exited
+    pub exit_code: Option<i64>,
+    /// The adapter reported that the session terminated
+    pub terminated: bool,
+    /// The session was ended by disconnecting from the adapter
+    pub disconnected: bool,
+}
+
+impl SessionResult {
+    /// The debugee ran to completion and exited successfully
+    pub fn is_clean(&self) -> bool {
+        self.terminated && self.exit_code == Some(0)
+    }
+}
+
+/// A disassembled instruction, and whether it is the current instruction of the frame it was
+/// disassembled for
+#[derive(Debug, Clone)]
+pub struct Instruction {
+    pub instruction: transport::types::DisassembledInstruction,
+    pub is_current: bool,
 }
 
 pub(crate) use transport::types::StackFrame;
@@ -0,0 +1,663 @@
+//! Helpers for working with trees of variables
+use std::{
+    collections::{HashMap, HashSet, VecDeque},
+    sync::atomic::{AtomicBool, Ordering},
+};
+
+use eyre::WrapErr;
+use transport::{
+    requests, responses,
+    types::{Variable, VariablesReference},
+    Client,
+};
+
+/// A variable along with its children, if they have been fetched
+#[derive(Debug, Clone)]
+pub struct VariableNode {
+    pub variable: Variable,
+    pub children: Vec<VariableNode>,
+}
+
+impl VariableNode {
+    /// The reference to pass to a memory view to show the raw bytes of the variable, if the
+    /// adapter provides one
+    pub fn memory_reference(&self) -> Option<&str> {
+        self.variable.memory_reference.as_deref()
+    }
+
+    /// Whether the value is only evaluated on request, e.g. a property getter with side
+    /// effects, so the UI should offer to evaluate it rather than expanding it automatically
+    pub fn is_lazy(&self) -> bool {
+        is_lazy(&self.variable)
+    }
+}
+
+fn is_lazy(variable: &Variable) -> bool {
+    variable
+        .presentation_hint
+        .as_ref()
+        .and_then(|hint| hint.lazy)
+        .unwrap_or(false)
+}
+
+/// Shorten `value` to at most `max_length` characters followed by an ellipsis, so huge values
+/// do not swamp the interface
+pub(crate) fn truncate_value(value: &str, max_length: Option<usize>) -> String {
+    match max_length.and_then(|max_length| value.char_indices().nth(max_length)) {
+        Some((end, _)) => format!("{}…", &value[..end]),
+        None => value.to_string(),
+    }
+}
+
+/// Truncate the values of `nodes` and their children, see [`truncate_value`]
+pub(crate) fn truncate_values(nodes: &mut [VariableNode], max_length: Option<usize>) {
+    for node in nodes {
+        node.variable.value = truncate_value(&node.variable.value, max_length);
+        truncate_values(&mut node.children, max_length);
+    }
+}
+
+/// How a variable differs between two snapshots
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum ChangeKind {
+    Added { value: String },
+    Removed { value: String },
+    Changed { before: String, after: String },
+}
+
+/// A single difference between two snapshots of variables
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct VariableChange {
+    /// Names of the variable and its parents, outermost first
+    pub path: Vec<String>,
+    pub kind: ChangeKind,
+}
+
+/// Report the variables that were added, removed or changed between two snapshots, e.g. from
+/// consecutive stops.
+pub fn diff_variables(before: &[VariableNode], after: &[VariableNode]) -> Vec<VariableChange> {
+    let mut changes = Vec::new();
+    diff_level(&mut Vec::new(), before, after, &mut changes);
+    changes
+}
+
+fn diff_level(
+    path: &mut Vec<String>,
+    before: &[VariableNode],
+    after: &[VariableNode],
+    changes: &mut Vec<VariableChange>,
+) {
+    let before_by_name: HashMap<_, _> = before
+        .iter()
+        .map(|node| (node.variable.name.as_str(), node))
+        .collect();
+    let after_by_name: HashMap<_, _> = after
+        .iter()
+        .map(|node| (node.variable.name.as_str(), node))
+        .collect();
+
+    for node in before {
+        if !after_by_name.contains_key(node.variable.name.as_str()) {
+            changes.push(VariableChange {
+                path: child_path(path, &node.variable.name),
+                kind: ChangeKind::Removed {
+                    value: node.variable.value.clone(),
+                },
+            });
+        }
+    }
+
+    for node in after {
+        let name = &node.variable.name;
+        match before_by_name.get(name.as_str()) {
+            None => changes.push(VariableChange {
+                path: child_path(path, name),
+                kind: ChangeKind::Added {
+                    value: node.variable.value.clone(),
+                },
+            }),
+            Some(previous) => {
+                if node.children.is_empty() || previous.children.is_empty() {
+                    // compare the values for leaf nodes or when children are not known
+                    if previous.variable.value != node.variable.value {
+                        changes.push(VariableChange {
+                            path: child_path(path, name),
+                            kind: ChangeKind::Changed {
+                                before: previous.variable.value.clone(),
+                                after: node.variable.value.clone(),
+                            },
+                        });
+                    }
+                } else {
+                    path.push(name.clone());
+                    diff_level(path, &previous.children, &node.children, changes);
+                    path.pop();
+                }
+            }
+        }
+    }
+}
+
+fn child_path(path: &[String], name: &str) -> Vec<String> {
+    let mut out = path.to_vec();
+    out.push(name.to_string());
+    out
+}
+
+/// Walk the variables below `variables_reference` breadth-first, calling `on_batch` with the
+/// path of each parent and its children as they arrive, so they can be displayed incrementally.
+///
+/// Lazy variables are reported but not expanded; their children can be walked by streaming
+/// from their own reference. The walk stops with an error once `cancelled` is set.
+pub(crate) fn stream_variables<F>(
+    client: &Client,
+    variables_reference: VariablesReference,
+    cancelled: &AtomicBool,
+    mut on_batch: F,
+) -> eyre::Result<()>
+where
+    F: FnMut(&[String], &[Variable]),
+{
+    // a zero reference has no variables, and most adapters reject requests for it
+    if variables_reference == 0 {
+        return Ok(());
+    }
+    let mut queue = VecDeque::from([(Vec::new(), variables_reference)]);
+    // guard against self-referential structures
+    let mut seen = HashSet::from([variables_reference]);
+
+    while let Some((path, variables_reference)) = queue.pop_front() {
+        eyre::ensure!(
+            !cancelled.load(Ordering::SeqCst),
+            "streaming variables cancelled"
+        );
+
+        // stop waiting as soon as the walk is cancelled, discarding the response
+        let variables = match client
+            .send_pending(requests::RequestBody::Variables(requests::Variables {
+                variables_reference,
+                format: None,
+            }))
+            .context("sending variables request")?
+            .wait_cancellable(cancelled)
+            .context("streaming variables")?
+        {
+            Some(responses::ResponseBody::Variables(responses::VariablesResponse {
+                variables,
+            })) => variables,
+            _ => eyre::bail!("invalid response to variables request"),
+        };
+
+        on_batch(&path, &variables);
+
+        for variable in variables {
+            if variable.variables_reference > 0
+                && !is_lazy(&variable)
+                && seen.insert(variable.variables_reference)
+            {
+                queue.push_back((
+                    child_path(&path, &variable.name),
+                    variable.variables_reference,
+                ));
+            }
+        }
+    }
+    Ok(())
+}
+
+/// The most variables [`expand_variables`] fetches, so huge structures cannot hang the interface
+pub const MAX_EXPANDED_VARIABLES: usize = 1000;
+
+/// Fetch the tree of variables below `variables_reference`, expanding children up to `max_depth`
+/// levels down, e.g. to display a whole structure at once.
+///
+/// Each reference is only expanded once, so self-referential structures terminate, and lazy
+/// variables are not expanded. At most `max_nodes` variables are returned; once the cap is
+/// reached the remaining variables are left out.
+pub(crate) fn expand_variables(
+    client: &Client,
+    variables_reference: VariablesReference,
+    max_depth: usize,
+    max_nodes: usize,
+) -> eyre::Result<Vec<VariableNode>> {
+    let mut seen = HashSet::from([variables_reference]);
+    let mut remaining = max_nodes;
+    expand_level(
+        client,
+        variables_reference,
+        max_depth,
+        &mut seen,
+        &mut remaining,
+    )
+}
+
+fn expand_level(
+    client: &Client,
+    variables_reference: VariablesReference,
+    depth: usize,
+    seen: &mut HashSet<VariablesReference>,
+    remaining: &mut usize,
+) -> eyre::Result<Vec<VariableNode>> {
+    if depth == 0 || *remaining == 0 {
+        return Ok(Vec::new());
+    }
+    let mut variables = fetch_variables(client, variables_reference, None)?;
+    variables.truncate(*remaining);
+    *remaining -= variables.len();
+
+    variables
+        .into_iter()
+        .map(|variable| {
+            let children = if variable.variables_reference > 0
+                && !is_lazy(&variable)
+                && seen.insert(variable.variables_reference)
+            {
+                expand_level(
+                    client,
+                    variable.variables_reference,
+                    depth - 1,
+                    seen,
+                    remaining,
+                )?
+            } else {
+                Vec::new()
+            };
+            Ok(VariableNode { variable, children })
+        })
+        .collect()
+}
+
+/// Re-fetch the variables below `variables_reference` with a new value format, e.g. when
+/// toggling hex display.
+///
+/// If `preserve_expansion` is set, the children of variables which were expanded in `previous`
+/// are also re-fetched, so the tree keeps its shape.
+pub(crate) fn refresh_variables(
+    client: &Client,
+    variables_reference: VariablesReference,
+    previous: &[VariableNode],
+    preserve_expansion: bool,
+    format: requests::ValueFormat,
+) -> eyre::Result<Vec<VariableNode>> {
+    let previous_by_name: HashMap<_, _> = previous
+        .iter()
+        .map(|node| (node.variable.name.as_str(), node))
+        .collect();
+
+    fetch_variables(client, variables_reference, Some(format))?
+        .into_iter()
+        .map(|variable| {
+            let children = match previous_by_name.get(variable.name.as_str()) {
+                Some(node)
+                    if preserve_expansion
+                        && !node.children.is_empty()
+                        && variable.variables_reference > 0 =>
+                {
+                    refresh_variables(
+                        client,
+                        variable.variables_reference,
+                        &node.children,
+                        preserve_expansion,
+                        format,
+                    )?
+                }
+                _ => Vec::new(),
+            };
+            Ok(VariableNode { variable, children })
+        })
+        .collect()
+}
+
+fn fetch_variables(
+    client: &Client,
+    variables_reference: VariablesReference,
+    format: Option<requests::ValueFormat>,
+) -> eyre::Result<Vec<Variable>> {
+    if variables_reference == 0 {
+        return Ok(Vec::new());
+    }
+    let Some(responses::ResponseBody::Variables(responses::VariablesResponse { variables })) =
+        client
+            .send(requests::RequestBody::Variables(requests::Variables {
+                variables_reference,
+                format,
+            }))
+            .context("sending variables request")?
+    else {
+        eyre::bail!("invalid response to variables request");
+    };
+    Ok(variables)
+}
+
+#[cfg(test)]
+mod tests {
+    use transport::types::Variable;
+
+    use super::*;
+    use crate::fake_adapter;
+
+    fn node(name: &str, value: &str, children: Vec<VariableNode>) -> VariableNode {
+        VariableNode {
+            variable: Variable {
+                name: name.to_string(),
+                value: value.to_string(),
+                r#type: None,
+                variables_reference: 0,
+                presentation_hint: None,
+                evaluate_name: None,
+                memory_reference: None,
+            },
+            children,
+        }
+    }
+
+    #[test]
+    fn nested_change() {
+        let before = vec![
+            node("a", "1", vec![]),
+            node(
+                "b",
+                "{'c': 2}",
+                vec![node("c", "2", vec![]), node("d", "3", vec![])],
+            ),
+            node("e", "4", vec![]),
+        ];
+        let after = vec![
+            node("a", "1", vec![]),
+            node(
+                "b",
+                "{'c': 5}",
+                vec![node("c", "5", vec![]), node("d", "3", vec![])],
+            ),
+            node("f", "6", vec![]),
+        ];
+
+        let changes = diff_variables(&before, &after);
+
+        assert_eq!(
+            changes,
+            vec![
+                VariableChange {
+                    path: vec!["e".to_string()],
+                    kind: ChangeKind::Removed {
+                        value: "4".to_string()
+                    },
+                },
+                VariableChange {
+                    path: vec!["b".to_string(), "c".to_string()],
+                    kind: ChangeKind::Changed {
+                        before: "2".to_string(),
+                        after: "5".to_string()
+                    },
+                },
+                VariableChange {
+                    path: vec!["f".to_string()],
+                    kind: ChangeKind::Added {
+                        value: "6".to_string()
+                    },
+                },
+            ]
+        );
+    }
+
+    fn respond_with_tree(request: &requests::Request) -> Vec<String> {
+        let requests::RequestBody::Variables(requests::Variables {
+            variables_reference,
+            ..
+        }) = request.body
+        else {
+            return Vec::new();
+        };
+        let variables = match variables_reference {
+            1 => {
+                r#"[{"name":"a","value":"{}","variablesReference":2},{"name":"b","value":"[]","variablesReference":3}]"#
+            }
+            2 => r#"[{"name":"c","value":"{}","variablesReference":4}]"#,
+            3 => r#"[{"name":"d","value":"1","variablesReference":0}]"#,
+            4 => r#"[{"name":"e","value":"2","variablesReference":0}]"#,
+            _ => "[]",
+        };
+        vec![fake_adapter::response(
+            request,
+            &format!(r#""command":"variables","body":{{"variables":{variables}}}"#),
+        )]
+    }
+
+    #[test]
+    fn stream_breadth_first() -> eyre::Result<()> {
+        let (client, _adapter) = fake_adapter::connect(respond_with_tree);
+
+        let mut batches = Vec::new();
+        stream_variables(&client, 1, &AtomicBool::new(false), |path, children| {
+            let names: Vec<_> = children.iter().map(|v| v.name.clone()).collect();
+            batches.push((path.join("."), names));
+        })?;
+
+        assert_eq!(
+            batches,
+            vec![
+                ("".to_string(), vec!["a".to_string(), "b".to_string()]),
+                ("a".to_string(), vec!["c".to_string()]),
+                ("b".to_string(), vec!["d".to_string()]),
+                ("a.c".to_string(), vec!["e".to_string()]),
+            ]
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn stream_skips_lazy() -> eyre::Result<()> {
+        let (client, adapter) = fake_adapter::connect(|request| {
+            let requests::RequestBody::Variables(requests::Variables {
+                variables_reference,
+                ..
+            }) = request.body
+            else {
+                return Vec::new();
+            };
+            let variables = match variables_reference {
+                1 => {
+                    r#"[{"name":"getter","value":"...","variablesReference":2,"presentationHint":{"lazy":true}},{"name":"b","value":"[]","variablesReference":3}]"#
+                }
+                2 => r#"[{"name":"c","value":"1","variablesReference":0}]"#,
+                3 => r#"[{"name":"d","value":"2","variablesReference":0}]"#,
+                _ => "[]",
+            };
+            vec![fake_adapter::response(
+                request,
+                &format!(r#""command":"variables","body":{{"variables":{variables}}}"#),
+            )]
+        });
+
+        let mut paths = Vec::new();
+        stream_variables(&client, 1, &AtomicBool::new(false), |path, _| {
+            paths.push(path.join("."));
+        })?;
+        assert_eq!(paths, vec!["".to_string(), "b".to_string()]);
+
+        let requested: Vec<_> = adapter
+            .requests
+            .try_iter()
+            .filter_map(|r| match r.body {
+                requests::RequestBody::Variables(v) => Some(v.variables_reference),
+                _ => None,
+            })
+            .collect();
+        assert!(!requested.contains(&2), "lazy variable was expanded");
+
+        // expanding the lazy variable is still possible when asked for explicitly
+        let nodes = refresh_variables(&client, 1, &[], false, requests::ValueFormat::default())?;
+        assert!(nodes[0].is_lazy());
+        assert!(!nodes[1].is_lazy());
+        let mut children = Vec::new();
+        stream_variables(&client, 2, &AtomicBool::new(false), |_, batch| {
+            children.extend(batch.iter().map(|v| v.name.clone()));
+        })?;
+        assert_eq!(children, vec!["c".to_string()]);
+        Ok(())
+    }
+
+    #[test]
+    fn stream_cancelled() {
+        let (client, _adapter) = fake_adapter::connect(respond_with_tree);
+        let cancelled = AtomicBool::new(false);
+
+        let mut batches = 0;
+        let res = stream_variables(&client, 1, &cancelled, |_, _| {
+            batches += 1;
+            cancelled.store(true, Ordering::SeqCst);
+        });
+
+        assert!(res.is_err());
+        assert_eq!(batches, 1);
+    }
+
+    #[test]
+    fn stream_cancelled_while_waiting() {
+        // the adapter never answers for the children of `a`
+        let (client, adapter) = fake_adapter::connect(|request| match request.body {
+            requests::RequestBody::Variables(requests::Variables {
+                variables_reference: 2,
+                ..
+            }) => Vec::new(),
+            _ => respond_with_tree(request),
+        });
+        let cancelled = std::sync::Arc::new(AtomicBool::new(false));
+
+        let walk_cancelled = std::sync::Arc::clone(&cancelled);
+        let walk =
+            std::thread::spawn(move || stream_variables(&client, 1, &walk_cancelled, |_, _| {}));
+
+        // cancel while the request for the children of `a` is in flight
+        let requested = |request: requests::Request| match request.body {
+            requests::RequestBody::Variables(v) => v.variables_reference,
+            _ => 0,
+        };
+        assert_eq!(requested(adapter.requests.recv().unwrap()), 1);
+        assert_eq!(requested(adapter.requests.recv().unwrap()), 2);
+        cancelled.store(true, Ordering::SeqCst);
+
+        assert!(walk.join().unwrap().is_err());
+        assert!(
+            adapter
+                .requests
+                .recv_timeout(std::time::Duration::from_millis(100))
+                .is_err(),
+            "requests sent after cancelling"
+        );
+    }
+
+    fn names(nodes: &[VariableNode]) -> Vec<String> {
+        nodes
+            .iter()
+            .map(|node| match names(&node.children).as_slice() {
+                [] => node.variable.name.clone(),
+                children => format!("{}({})", node.variable.name, children.join(",")),
+            })
+            .collect()
+    }
+
+    #[test]
+    fn expand_tree() -> eyre::Result<()> {
+        let (client, _adapter) = fake_adapter::connect(respond_with_tree);
+
+        let nodes = expand_variables(&client, 1, 10, MAX_EXPANDED_VARIABLES)?;
+        assert_eq!(names(&nodes), ["a(c(e))", "b(d)"]);
+
+        let nodes = expand_variables(&client, 1, 2, MAX_EXPANDED_VARIABLES)?;
+        assert_eq!(names(&nodes), ["a(c)", "b(d)"]);
+
+        // the cap is reached after fetching `a`, `b` and `c`
+        let nodes = expand_variables(&client, 1, 10, 3)?;
+        assert_eq!(names(&nodes), ["a(c)", "b"]);
+        Ok(())
+    }
+
+    #[test]
+    fn expand_self_referential() -> eyre::Result<()> {
+        // `a` contains itself, and `b` refers back to the root
+        let (client, adapter) = fake_adapter::connect(|request| {
+            let requests::RequestBody::Variables(requests::Variables {
+                variables_reference,
+                ..
+            }) = request.body
+            else {
+                return Vec::new();
+            };
+            let variables = match variables_reference {
+                1 => r#"[{"name":"a","value":"{...}","variablesReference":2}]"#,
+                2 => {
+                    r#"[{"name":"self","value":"{...}","variablesReference":2},{"name":"b","value":"{...}","variablesReference":1}]"#
+                }
+                _ => "[]",
+            };
+            vec![fake_adapter::response(
+                request,
+                &format!(r#""command":"variables","body":{{"variables":{variables}}}"#),
+            )]
+        });
+
+        let nodes = expand_variables(&client, 1, 100, MAX_EXPANDED_VARIABLES)?;
+        assert_eq!(names(&nodes), ["a(self,b)"]);
+        assert_eq!(adapter.requests.try_iter().count(), 2);
+        Ok(())
+    }
+
+    #[test]
+    fn refresh_preserves_expansion() -> eyre::Result<()> {
+        let (client, _adapter) = fake_adapter::connect(|request| {
+            let requests::RequestBody::Variables(requests::Variables {
+                variables_reference,
+                format,
+            }) = &request.body
+            else {
+                return Vec::new();
+            };
+            let hex = format.and_then(|f| f.hex).unwrap_or(false);
+            let variables = match (variables_reference, hex) {
+                (1, false) => {
+                    r#"[{"name":"a","value":"[...]","variablesReference":2},{"name":"b","value":"10","variablesReference":0}]"#
+                }
+                (1, true) => {
+                    r#"[{"name":"a","value":"[...]","variablesReference":5},{"name":"b","value":"0xa","variablesReference":0}]"#
+                }
+                (5, true) => r#"[{"name":"c","value":"0xff","variablesReference":0}]"#,
+                _ => "[]",
+            };
+            vec![fake_adapter::response(
+                request,
+                &format!(r#""command":"variables","body":{{"variables":{variables}}}"#),
+            )]
+        });
+
+        let mut a = node("a", "[...]", vec![node("c", "255", vec![])]);
+        a.variable.variables_reference = 2;
+        let previous = vec![a, node("b", "10", vec![])];
+        let hex = requests::ValueFormat { hex: Some(true) };
+
+        let refreshed = refresh_variables(&client, 1, &previous, true, hex)?;
+        assert_eq!(refreshed.len(), 2);
+        assert_eq!(refreshed[0].children.len(), 1);
+        assert_eq!(refreshed[0].children[0].variable.value, "0xff");
+        assert_eq!(refreshed[1].variable.value, "0xa");
+
+        let collapsed = refresh_variables(&client, 1, &previous, false, hex)?;
+        assert!(collapsed[0].children.is_empty());
+        Ok(())
+    }
+
+    #[test]
+    fn memory_reference() -> eyre::Result<()> {
+        let (client, _adapter) = fake_adapter::connect(|request| {
+            vec![fake_adapter::response(
+                request,
+                r#""command":"variables","body":{"variables":[{"name":"buf","value":"[16]","variablesReference":0,"memoryReference":"0x7ffc0010"},{"name":"n","value":"16","variablesReference":0}]}"#,
+            )]
+        });
+
+        let nodes = refresh_variables(&client, 1, &[], false, requests::ValueFormat::default())?;
+        assert_eq!(nodes[0].memory_reference(), Some("0x7ffc0010"));
+        assert_eq!(nodes[1].memory_reference(), None);
+        Ok(())
+    }
+}
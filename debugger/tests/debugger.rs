@@ -27,6 +27,27 @@ fn init() {
     let _ = color_eyre::install();
 }
 
+#[test]
+fn test_attach_missing_target() -> eyre::Result<()> {
+    // nothing is listening on this port
+    let port = get_random_tcp_port().context("getting free port")?;
+
+    let attach_args = debugger::AttachArguments {
+        working_directory: std::env::current_dir().unwrap(),
+        port: Some(port),
+        language: debugger::Language::DebugPy,
+        path_mappings: Vec::new(),
+        inspect_only: false,
+        path_format: transport::requests::PathFormat::Path,
+    };
+
+    let Err(e) = Debugger::on_port(port, attach_args) else {
+        eyre::bail!("attaching to a closed port should fail");
+    };
+    assert_eq!(e.to_string(), "could not attach: connection refused");
+    Ok(())
+}
+
 #[test]
 fn test_remote_attach() -> eyre::Result<()> {
     let cwd = std::env::current_dir().unwrap();
@@ -52,6 +73,9 @@ fn test_remote_attach() -> eyre::Result<()> {
         working_directory: cwd.clone(),
         port: Some(port),
         language: debugger::Language::DebugPy,
+        path_mappings: Vec::new(),
+        inspect_only: false,
+        path_format: transport::requests::PathFormat::Path,
     };
 
     let debugger = Debugger::on_port(port, launch_args).context("creating debugger")?;
@@ -124,6 +148,9 @@ fn test_debugger() -> eyre::Result<()> {
         program: file_path.clone(),
         working_directory: None,
         language: debugger::Language::DebugPy,
+        no_debug: false,
+        path_format: transport::requests::PathFormat::Path,
+        initialized_fallback: Some(Duration::from_secs(2)),
     };
     let debugger = Debugger::on_port(port, launch_args).context("creating debugger")?;
     let drx = debugger.events();
@@ -9,8 +9,13 @@ use eyre::WrapErr;
 
 use crate::Server;
 
+/// How many lines of stderr output are kept for [`Server::take_stderr`] before further lines
+/// are dropped, so the output is not kept forever if nobody reads it
+const STDERR_BUFFER_LINES: usize = 1024;
+
 pub struct DebugpyServer {
     child: Child,
+    stderr: Option<mpsc::Receiver<String>>,
 }
 
 impl Server for DebugpyServer {
@@ -40,6 +45,7 @@ impl Server for DebugpyServer {
         let reader = BufReader::new(stderr);
 
         let (tx, rx) = mpsc::channel();
+        let (stderr_tx, stderr_rx) = mpsc::sync_channel(STDERR_BUFFER_LINES);
         thread::spawn(move || {
             let mut should_signal = true;
             for line in reader.lines() {
@@ -48,12 +54,21 @@ impl Server for DebugpyServer {
                     should_signal = false;
                     let _ = tx.send(());
                 }
+                // the lines are still read, so the server never blocks writing to stderr
+                let _ = stderr_tx.try_send(line);
             }
         });
         let _ = rx.recv();
 
         tracing::debug!("server ready");
-        Ok(Self { child })
+        Ok(Self {
+            child,
+            stderr: Some(stderr_rx),
+        })
+    }
+
+    fn take_stderr(&mut self) -> Option<mpsc::Receiver<String>> {
+        self.stderr.take()
     }
 }
 
@@ -1,3 +1,5 @@
+use std::sync::mpsc;
+
 use eyre::WrapErr;
 use transport::DEFAULT_DAP_PORT;
 
@@ -20,6 +22,11 @@ pub trait Server {
     {
         Self::on_port(DEFAULT_DAP_PORT)
     }
+
+    /// Take the lines the server process writes to stderr, if they are captured
+    fn take_stderr(&mut self) -> Option<mpsc::Receiver<String>> {
+        None
+    }
 }
 
 pub fn for_implementation(implementation: Implementation) -> eyre::Result<Box<dyn Server + Send>> {
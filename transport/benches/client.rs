@@ -0,0 +1,58 @@
+use criterion::{criterion_group, criterion_main, Criterion, Throughput};
+use serde_json::json;
+
+use transport::{mock::MockAdapter, requests};
+
+/// The number of messages exchanged in each benchmark iteration
+const MESSAGES: usize = 100;
+
+pub fn send_and_wait_benchmark(c: &mut Criterion) {
+    // an in-memory adapter answering every request immediately, so the benchmark measures the
+    // client rather than a socket
+    let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+    let (client, _adapter) = MockAdapter::connect_with_responder(events_tx, |request| {
+        vec![json!({
+            "type": "response",
+            "request_seq": request["seq"],
+            "success": true,
+            "command": "threads",
+            "body": { "threads": [] },
+        })]
+    })
+    .expect("creating client");
+
+    let mut group = c.benchmark_group("send and wait");
+    group.throughput(Throughput::Elements(MESSAGES as u64));
+    group.bench_function("threads", |b| {
+        b.iter(|| {
+            for _ in 0..MESSAGES {
+                client.send(requests::RequestBody::Threads).unwrap();
+            }
+        })
+    });
+    group.finish();
+}
+
+pub fn event_dispatch_benchmark(c: &mut Criterion) {
+    let (events_tx, events_rx) = crossbeam_channel::unbounded();
+    let (_client, adapter) = MockAdapter::connect(events_tx).expect("creating client");
+
+    let body = json!({ "output": "hello world\n" });
+
+    let mut group = c.benchmark_group("event dispatch");
+    group.throughput(Throughput::Elements(MESSAGES as u64));
+    group.bench_function("output", |b| {
+        b.iter(|| {
+            for _ in 0..MESSAGES {
+                adapter.send_event("output", body.clone()).unwrap();
+            }
+            for _ in 0..MESSAGES {
+                events_rx.recv().unwrap();
+            }
+        })
+    });
+    group.finish();
+}
+
+criterion_group!(benches, send_and_wait_benchmark, event_dispatch_benchmark);
+criterion_main!(benches);
@@ -1,4 +1,4 @@
-use criterion::{criterion_group, criterion_main, Criterion};
+use criterion::{criterion_group, criterion_main, BenchmarkId, Criterion, Throughput};
 use std::io::{BufReader, Cursor};
 
 use transport::Reader;
@@ -23,8 +23,53 @@ pub fn hand_written_parser_benchmark(c: &mut Criterion) {
     c.bench_function("hand written parser", |b| b.iter(|| reader.poll_message()));
 }
 
+/// Construct a single large output event, similar to a big variable dump
+fn large_message(size: usize) -> String {
+    let body = format!(
+        "{{\"type\":\"event\",\"event\":\"output\",\"body\":{{\"output\":\"{}\"}}}}",
+        "x".repeat(size)
+    );
+    format!("Content-Length: {}\r\n\r\n{}", body.len(), body)
+}
+
+pub fn reader_buffer_size_benchmark(c: &mut Criterion) {
+    let message = large_message(1024 * 1024);
+
+    let mut group = c.benchmark_group("reader buffer size");
+    group.throughput(Throughput::Bytes(message.len() as u64));
+    for buffer_size in [
+        4 * 1024,
+        transport::DEFAULT_READER_BUFFER_SIZE,
+        64 * 1024,
+        1024 * 1024,
+    ] {
+        group.bench_with_input(
+            BenchmarkId::from_parameter(buffer_size),
+            &buffer_size,
+            |b, &buffer_size| {
+                b.iter(|| {
+                    let input = BufReader::with_capacity(buffer_size, Cursor::new(&message));
+                    let mut reader =
+                        transport::reader::hand_written_reader::HandWrittenReader::new(input);
+                    reader.poll_message()
+                })
+            },
+        );
+    }
+    group.finish();
+}
+
 #[cfg(nom)]
-criterion_group!(benches, nom_parser_benchmark, hand_written_parser_benchmark);
+criterion_group!(
+    benches,
+    nom_parser_benchmark,
+    hand_written_parser_benchmark,
+    reader_buffer_size_benchmark
+);
 #[cfg(not(nom))]
-criterion_group!(benches, hand_written_parser_benchmark);
+criterion_group!(
+    benches,
+    hand_written_parser_benchmark,
+    reader_buffer_size_benchmark
+);
 criterion_main!(benches);
@@ -0,0 +1,91 @@
+//! Capturing the raw bytes of individual messages received from a DAP server
+use std::{sync::Mutex, time::Duration};
+
+/// A capture waiting for the message with the given name
+type Pending = (String, oneshot::Sender<Vec<u8>>);
+
+/// Captures waiting for a message to arrive
+pub(crate) struct Captures {
+    /// `None` once no more messages will be received
+    pending: Mutex<Option<Vec<Pending>>>,
+}
+
+impl Default for Captures {
+    fn default() -> Self {
+        Self {
+            pending: Mutex::new(Some(Vec::new())),
+        }
+    }
+}
+
+impl Captures {
+    /// Capture the next message for the command or event `name`
+    ///
+    /// Once closed, the capture fails straight away.
+    pub(crate) fn arm(&self, name: String) -> Capture {
+        let (tx, rx) = oneshot::channel();
+        if let Some(pending) = self.pending.lock().unwrap().as_mut() {
+            pending.push((name, tx));
+        }
+        Capture(rx)
+    }
+
+    /// Fail every waiting capture, and any created later, once no more messages will be
+    /// received
+    pub(crate) fn close(&self) {
+        self.pending.lock().unwrap().take();
+    }
+
+    /// Offer the JSON content of a received message to any matching captures
+    pub(crate) fn offer(&self, raw: &str) {
+        let mut pending = self.pending.lock().unwrap();
+        let Some(pending) = pending.as_mut().filter(|pending| !pending.is_empty()) else {
+            return;
+        };
+
+        let Ok(value) = serde_json::from_str::<serde_json::Value>(raw) else {
+            return;
+        };
+        let Some(name) = value
+            .get("command")
+            .or_else(|| value.get("event"))
+            .and_then(|name| name.as_str())
+        else {
+            return;
+        };
+
+        let (matching, rest) = std::mem::take(&mut *pending)
+            .into_iter()
+            .partition(|(wanted, _)| wanted == name);
+        *pending = rest;
+        for (_, tx) in matching {
+            let _ = tx.send(raw.as_bytes().to_vec());
+        }
+    }
+}
+
+/// A message capture, created with [`crate::Client::capture_next`]
+pub struct Capture(oneshot::Receiver<Vec<u8>>);
+
+impl Capture {
+    /// Wait for the message to arrive, returning its raw JSON
+    ///
+    /// Fails if the client stops reading from the adapter before the message arrives.
+    pub fn wait(self) -> eyre::Result<Vec<u8>> {
+        self.0
+            .recv()
+            .map_err(|_| eyre::eyre!("client shut down before message was captured"))
+    }
+
+    /// Wait up to `timeout` for the message to arrive, returning its raw JSON
+    pub fn wait_timeout(self, timeout: Duration) -> eyre::Result<Vec<u8>> {
+        self.0.recv_timeout(timeout).map_err(|e| match e {
+            oneshot::RecvTimeoutError::Timeout => {
+                eyre::eyre!("timed out waiting for captured message after {timeout:?}")
+            }
+            oneshot::RecvTimeoutError::Disconnected => {
+                eyre::eyre!("client shut down before message was captured")
+            }
+        })
+    }
+}
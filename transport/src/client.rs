@@ -1,19 +1,27 @@
-use std::io::{BufReader, Write};
+use std::collections::HashMap;
+use std::io::{self, BufRead, BufReader, Write};
 use std::net::TcpStream;
-use std::sync::atomic::{AtomicI64, Ordering};
+use std::process::{Child, ChildStderr, ChildStdin, Command, Stdio};
+use std::sync::atomic::{AtomicBool, AtomicI64, AtomicU64, Ordering};
 use std::thread;
-use std::time::Duration;
+use std::time::{Duration, Instant};
 
 use serde::{Deserialize, Serialize};
 use std::sync::{Arc, Mutex, MutexGuard};
 // TODO: use internal error type
-use eyre::Result;
+use eyre::{Result, WrapErr};
 
+use crate::capture::{Capture, Captures};
+use crate::configure::Replay;
 #[cfg(nom)]
 use crate::reader::nom_reader::NomReader;
-use crate::request_store::{RequestStore, WaitingRequest};
+use crate::reader::ProtocolError;
+use crate::recorder::Recorder;
+use crate::request_store::{self, InFlight, Permit, RequestStore, WaitingRequest};
 use crate::responses::ResponseBody;
-use crate::{events, reader, requests, responses, Reader};
+use crate::session::{SessionEnd, SessionState};
+use crate::threads::ThreadStates;
+use crate::{events, reader, requests, responses, types, Reader};
 
 #[derive(Debug)]
 pub struct Reply {
@@ -32,21 +40,384 @@ pub enum Message {
 
 pub struct ClientInternals {
     // writer
-    // TODO: trait implementor
-    output: TcpStream,
+    output: Box<dyn Output>,
 
     // common
     sequence_number: Arc<AtomicI64>,
     store: RequestStore,
+    /// Shared with the client, to free the space of a request which could not be sent
+    in_flight: Arc<InFlight>,
+    recorder: Option<Arc<Recorder>>,
+    captures: Arc<Captures>,
+    inspect_only: bool,
+    /// Whether the session attached to a running debuggee rather than launching one
+    attached: bool,
+    /// The requests which set up the session, to set it up again when restarting
+    replay: Replay,
+    state: Arc<Mutex<SessionState>>,
+    threads: Arc<Mutex<ThreadStates>>,
+    /// Shared with the poll thread, which decides when the session has ended
+    session_end: Arc<Mutex<SessionEnd>>,
+    command_overrides: HashMap<String, String>,
+    /// Span for the session the client belongs to, entered while sending
+    span: tracing::Span,
+    /// Where log output goes instead of the global subscriber, see [`ClientOptions::with_logger`]
+    logger: Option<tracing::Dispatch>,
 
     // Option because of drop and take
     exit: Option<oneshot::Sender<()>>,
 }
 
+/// How often a cancellable wait checks whether it has been cancelled
+const CANCEL_POLL_INTERVAL: Duration = Duration::from_millis(20);
+
+/// The default capacity of the buffer used to read messages from the server
+pub const DEFAULT_READER_BUFFER_SIZE: usize = 8 * 1024;
+
+/// Options to configure the behaviour of a [`Client`]
+#[derive(Debug, Clone)]
+pub struct ClientOptions {
+    reader_buffer_size: usize,
+    max_in_flight: Option<usize>,
+    record: bool,
+    inspect_only: bool,
+    command_overrides: HashMap<String, String>,
+    session: Option<String>,
+    logger: Option<tracing::Dispatch>,
+    request_timeout: Option<Duration>,
+    read_deadline: Option<Duration>,
+}
+
+impl Default for ClientOptions {
+    fn default() -> Self {
+        Self {
+            reader_buffer_size: DEFAULT_READER_BUFFER_SIZE,
+            max_in_flight: None,
+            record: false,
+            inspect_only: false,
+            command_overrides: HashMap::new(),
+            session: None,
+            logger: None,
+            request_timeout: None,
+            read_deadline: None,
+        }
+    }
+}
+
+impl ClientOptions {
+    /// Set the capacity of the buffer used when reading messages from the server.
+    ///
+    /// Adapters that emit large single messages (e.g. big variable dumps) benefit from a larger
+    /// buffer as fewer reads are required per message.
+    pub fn with_reader_buffer_size(mut self, n: usize) -> Self {
+        self.reader_buffer_size = n;
+        self
+    }
+
+    /// Limit the number of requests awaiting a response from the server.
+    ///
+    /// Sending a request blocks until the number of pending requests drops below this limit,
+    /// which prevents overwhelming fragile adapters, e.g. during a mass variable fetch. A limit
+    /// of zero is treated as one, as no request could ever be sent otherwise.
+    pub fn with_max_in_flight(mut self, n: usize) -> Self {
+        self.max_in_flight = Some(n.max(1));
+        self
+    }
+
+    /// Record every message exchanged with the server, so the session can be exported with
+    /// [`Client::export_fixture`].
+    pub fn with_recording(mut self) -> Self {
+        self.record = true;
+        self
+    }
+
+    /// Name the session this client belongs to, so its log output and recorded messages can be
+    /// told apart from other sessions.
+    ///
+    /// Log output is emitted within a `session` span carrying the name.
+    pub fn with_session(mut self, name: impl Into<String>) -> Self {
+        self.session = Some(name.into());
+        self
+    }
+
+    /// Send log output, including every message exchanged with the adapter at debug level, to
+    /// `logger` rather than the global subscriber, e.g. when embedding the client in a larger
+    /// application.
+    ///
+    /// The logger receives the output of every [`Client`] method, and of the thread reading
+    /// from the adapter. Without a logger the client logs to the global subscriber, so a library
+    /// user who has not installed one sees nothing by default, and `tracing::Dispatch::none()`
+    /// silences the client even when there is one.
+    pub fn with_logger(mut self, logger: tracing::Dispatch) -> Self {
+        self.logger = Some(logger);
+        self
+    }
+
+    /// Give up waiting for a response after `timeout` in the methods which wait for one, e.g.
+    /// [`Client::send`] and [`Client::initialize`], rather than waiting forever.
+    ///
+    /// A request which timed out no longer counts towards [`ClientOptions::with_max_in_flight`].
+    pub fn with_request_timeout(mut self, timeout: Duration) -> Self {
+        self.request_timeout = Some(timeout);
+        self
+    }
+
+    /// Treat the adapter as dead once a request has been waiting for `deadline` without anything
+    /// being received from the adapter, failing any requests waiting for a response, see
+    /// [`Client::adapter_exit`].
+    ///
+    /// The Debug Adapter Protocol has no heartbeat: an adapter sends nothing while the debuggee
+    /// runs, or sits paused, without anything to report. So the deadline only applies while a
+    /// request is waiting for its response, otherwise an idle session would be declared dead,
+    /// and e.g. a [`crate::ResilientClient`] would reconnect for no reason. Keep the deadline
+    /// longer than the slowest request the adapter answers, e.g. evaluating an expensive
+    /// expression.
+    ///
+    /// Only adapters connected over TCP are checked, as reading from the stdout of an adapter
+    /// subprocess cannot time out.
+    pub fn with_read_deadline(mut self, deadline: Duration) -> Self {
+        self.read_deadline = Some(deadline);
+        self
+    }
+
+    /// Send requests with the command `command` as `custom` instead, for adapters which use
+    /// non-standard command names, e.g. vendor forks using a different launch command.
+    pub fn with_command_override(
+        mut self,
+        command: impl Into<String>,
+        custom: impl Into<String>,
+    ) -> Self {
+        self.command_overrides.insert(command.into(), custom.into());
+        self
+    }
+
+    /// Only allow requests which observe the debuggee, e.g. when attaching to a production
+    /// process.
+    ///
+    /// Mutating requests (see [`requests::RequestBody::is_mutating`]) fail with a
+    /// [`ReadOnlyError`] without being sent.
+    pub fn inspect_only(mut self) -> Self {
+        self.inspect_only = true;
+        self
+    }
+}
+
+/// A mutating request was sent by a client in inspect-only mode
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct ReadOnlyError;
+
+impl std::fmt::Display for ReadOnlyError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str("request would modify the debuggee in inspect-only mode")
+    }
+}
+
+impl std::error::Error for ReadOnlyError {}
+
+/// A request was not sent because the adapter does not advertise the capability it needs
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct UnsupportedError {
+    /// What the adapter cannot do, e.g. `setting variables`
+    pub feature: &'static str,
+}
+
+impl std::fmt::Display for UnsupportedError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "adapter does not support {}", self.feature)
+    }
+}
+
+impl std::error::Error for UnsupportedError {}
+
+/// A callback registered with [`Client::on_event`]
+type EventHandler = Box<dyn Fn(&events::Event) + Send>;
+
+/// Event callbacks, by event name
+type EventHandlers = Arc<Mutex<HashMap<String, Vec<(HandlerId, EventHandler)>>>>;
+
+/// Identifies a handler registered with [`Client::on_event`], to remove it with
+/// [`Client::remove_event_handler`]
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub struct HandlerId(u64);
+
+impl HandlerId {
+    fn next() -> Self {
+        static NEXT: AtomicU64 = AtomicU64::new(0);
+        Self(NEXT.fetch_add(1, Ordering::Relaxed))
+    }
+}
+
+/// Receives the events with one name from when it is created, until it is dropped
+///
+/// Unlike the events channel, this does not take events from anyone else, so it can be used to
+/// wait for an event during a handshake.
+pub(crate) struct EventWaiter<'a> {
+    client: &'a Client,
+    handler: HandlerId,
+    events: crossbeam_channel::Receiver<events::Event>,
+}
+
+impl<'a> EventWaiter<'a> {
+    pub(crate) fn new(client: &'a Client, event: &str) -> Self {
+        let (tx, events) = crossbeam_channel::unbounded();
+        let handler = client.on_event(event, move |event| {
+            let _ = tx.send(event.clone());
+        });
+        Self {
+            client,
+            handler,
+            events,
+        }
+    }
+
+    /// Wait up to `timeout` for the next event
+    pub(crate) fn wait(&self, timeout: Duration) -> Result<events::Event> {
+        self.events
+            .recv_timeout(timeout)
+            .map_err(|_| eyre::eyre!("no event after {timeout:?}"))
+    }
+}
+
+impl Drop for EventWaiter<'_> {
+    fn drop(&mut self) {
+        self.client.remove_event_handler(self.handler);
+    }
+}
+
 /// DAP client
+///
+/// Each response is delivered only to the caller which sent its request, matched by the
+/// request sequence number, while events are sent to the channel given when creating the
+/// client.
 #[derive(Clone)]
 pub struct Client {
     internals: Arc<Mutex<ClientInternals>>,
+    // shared with the internals, so it can be inspected when the internals lock is held
+    store: RequestStore,
+    in_flight: Arc<InFlight>,
+    adapter_exit: Arc<Mutex<Option<AdapterExit>>>,
+    /// Why reading stopped, if the adapter sent a malformed message
+    protocol_error: Arc<Mutex<Option<ProtocolError>>>,
+    capabilities: Arc<Mutex<Option<responses::Capabilities>>>,
+    // shared with the internals and the poll thread, which update it as messages are exchanged
+    state: Arc<Mutex<SessionState>>,
+    threads: Arc<Mutex<ThreadStates>>,
+    /// The adapter subprocess, if the client communicates over its stdio
+    adapter_process: Option<Arc<Mutex<Child>>>,
+    event_handlers: EventHandlers,
+    /// How long to wait for each response, see [`ClientOptions::with_request_timeout`]
+    request_timeout: Option<Duration>,
+    /// Where log output goes instead of the global subscriber, see [`ClientOptions::with_logger`]
+    logger: Option<tracing::Dispatch>,
+}
+
+/// How the adapter ended the session, once it has closed its end of the connection
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum AdapterExit {
+    /// The adapter closed the network connection
+    Closed,
+    /// The adapter process exited, with its exit code if it was not killed by a signal
+    Exited(Option<i32>),
+    /// Reading from the adapter failed, e.g. because it crashed and reset the connection
+    ReadFailed(io::ErrorKind),
+    /// The adapter sent a malformed message, see [`Client::protocol_error`]
+    ProtocolError,
+}
+
+/// Input which fails with [`io::ErrorKind::TimedOut`] once a request has been waiting for
+/// `deadline` without anything being read, see [`ClientOptions::with_read_deadline`]
+///
+/// The deadline is only checked when a read times out, so the underlying reads must have a
+/// timeout.
+struct DeadlineInput<R> {
+    input: R,
+    deadline: Option<Duration>,
+    last_read: Instant,
+    /// The requests waiting for a response
+    store: RequestStore,
+}
+
+impl<R> DeadlineInput<R> {
+    fn new(input: R, deadline: Option<Duration>, store: RequestStore) -> Self {
+        Self {
+            input,
+            deadline,
+            last_read: Instant::now(),
+            store,
+        }
+    }
+
+    /// Whether a request has been waiting for the deadline since anything was read
+    fn expired(&self) -> bool {
+        let Some(deadline) = self.deadline else {
+            return false;
+        };
+        let oldest = with_lock("DeadlineInput.store", self.store.as_ref(), |store| {
+            store
+                .values()
+                .map(|WaitingRequest(_, _, sent_at)| *sent_at)
+                .min()
+        });
+        // an idle adapter is silent, so it is only dead if a request goes unanswered
+        oldest.is_some_and(|oldest| oldest.max(self.last_read).elapsed() >= deadline)
+    }
+}
+
+impl<R: io::Read> io::Read for DeadlineInput<R> {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        match self.input.read(buf) {
+            Ok(n) => {
+                self.last_read = Instant::now();
+                Ok(n)
+            }
+            Err(e)
+                if matches!(
+                    e.kind(),
+                    io::ErrorKind::WouldBlock | io::ErrorKind::TimedOut
+                ) && self.expired() =>
+            {
+                Err(io::ErrorKind::TimedOut.into())
+            }
+            Err(e) => Err(e),
+        }
+    }
+}
+
+/// The half of the connection requests are written to
+pub(crate) trait Output: Write + Send {
+    fn close(&mut self) -> io::Result<()>;
+}
+
+impl Output for TcpStream {
+    fn close(&mut self) -> io::Result<()> {
+        self.shutdown(std::net::Shutdown::Both)
+    }
+}
+
+/// The stdin of an adapter subprocess, which is closed by dropping it
+struct StdioOutput(Option<ChildStdin>);
+
+impl Write for StdioOutput {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        match &mut self.0 {
+            Some(stdin) => stdin.write(buf),
+            None => Err(io::ErrorKind::BrokenPipe.into()),
+        }
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        match &mut self.0 {
+            Some(stdin) => stdin.flush(),
+            None => Ok(()),
+        }
+    }
+}
+
+impl Output for StdioOutput {
+    fn close(&mut self) -> io::Result<()> {
+        self.0.take();
+        Ok(())
+    }
 }
 
 impl Client {
@@ -54,27 +425,226 @@ impl Client {
         stream: TcpStream,
         responses: crossbeam_channel::Sender<events::Event>,
     ) -> Result<Self> {
-        // internal state
-        let sequence_number = Arc::new(AtomicI64::new(0));
+        Self::with_options(stream, responses, ClientOptions::default())
+    }
 
-        // Background poller to send responses and events
+    pub fn with_options(
+        stream: TcpStream,
+        responses: crossbeam_channel::Sender<events::Event>,
+        options: ClientOptions,
+    ) -> Result<Self> {
         let input_stream = stream.try_clone().unwrap();
+        let read_timeout = Duration::from_secs(1);
         input_stream
-            .set_read_timeout(Some(Duration::from_secs(1)))
+            .set_read_timeout(Some(
+                options
+                    .read_deadline
+                    .map_or(read_timeout, |deadline| deadline.min(read_timeout)),
+            ))
             .unwrap();
+        Self::start(input_stream, Box::new(stream), responses, options, || {
+            AdapterExit::Closed
+        })
+    }
+
+    /// Communicate with an adapter subprocess over its stdin and stdout, which must both be
+    /// piped
+    ///
+    /// When the adapter closes its stdout the process is waited on to collect its exit code,
+    /// see [`Client::adapter_exit`]. If its stderr is piped too, each line is recorded, see
+    /// [`Client::record_stderr`].
+    pub fn from_child(
+        mut child: Child,
+        responses: crossbeam_channel::Sender<events::Event>,
+        options: ClientOptions,
+    ) -> Result<Self> {
+        let stdin = child
+            .stdin
+            .take()
+            .ok_or_else(|| eyre::eyre!("adapter stdin is not piped"))?;
+        let stdout = child
+            .stdout
+            .take()
+            .ok_or_else(|| eyre::eyre!("adapter stdout is not piped"))?;
+        let stderr = child.stderr.take();
+        let child = Arc::new(Mutex::new(child));
+        let exited_child = Arc::clone(&child);
+        let mut client = Self::start(
+            stdout,
+            Box::new(StdioOutput(Some(stdin))),
+            responses,
+            options,
+            // poll rather than block in `wait`, so the process can still be killed
+            move || loop {
+                match exited_child.lock().unwrap().try_wait() {
+                    Ok(Some(status)) => return AdapterExit::Exited(status.code()),
+                    Ok(None) => {}
+                    Err(e) => {
+                        tracing::warn!(error = %e, "waiting for adapter process");
+                        return AdapterExit::Exited(None);
+                    }
+                }
+                thread::sleep(Duration::from_millis(10));
+            },
+        )?;
+        client.adapter_process = Some(child);
+        if let Some(stderr) = stderr {
+            client.capture_stderr(stderr);
+        }
+        Ok(client)
+    }
+
+    /// Start an adapter which speaks DAP over its stdin and stdout, e.g. `dlv dap`
+    ///
+    /// The stdin, stdout and stderr of `command` are replaced with pipes. The process can be
+    /// killed with [`Client::kill_adapter`], and how it exited is given by
+    /// [`Client::adapter_exit`].
+    pub fn spawn(
+        command: &mut Command,
+        responses: crossbeam_channel::Sender<events::Event>,
+        options: ClientOptions,
+    ) -> Result<Self> {
+        let child = command
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::piped())
+            .spawn()
+            .with_context(|| format!("spawning adapter {:?}", command.get_program()))?;
+        Self::from_child(child, responses, options)
+    }
+
+    /// Log, and record if recording, each line the adapter process writes to stderr
+    ///
+    /// Every line is read even when not recording, so the adapter never blocks writing to a
+    /// full pipe.
+    fn capture_stderr(&self, stderr: ChildStderr) {
+        let recorder = with_lock("Client.internals", self.internals.as_ref(), |internals| {
+            internals.recorder.clone()
+        });
+        let logger = self.logger.clone();
+        thread::spawn(move || {
+            let _logger = logger.as_ref().map(tracing::dispatcher::set_default);
+            for line in BufReader::new(stderr).lines().map_while(io::Result::ok) {
+                tracing::debug!(%line, "adapter stderr");
+                if let Some(recorder) = &recorder {
+                    recorder.record_stderr(&line);
+                }
+            }
+        });
+    }
+
+    /// The process id of the adapter, if it is a subprocess communicating over stdio
+    pub fn adapter_process_id(&self) -> Option<u32> {
+        self.adapter_process
+            .as_ref()
+            .map(|child| child.lock().unwrap().id())
+    }
+
+    /// Kill the adapter subprocess
+    pub fn kill_adapter(&self) -> Result<()> {
+        let _logger = self.log_to_logger();
+        let child = self
+            .adapter_process
+            .as_ref()
+            .ok_or_else(|| eyre::eyre!("adapter is not a subprocess"))?;
+        child
+            .lock()
+            .unwrap()
+            .kill()
+            .context("killing adapter process")
+    }
+
+    pub(crate) fn start<R, F>(
+        input: R,
+        output: Box<dyn Output>,
+        responses: crossbeam_channel::Sender<events::Event>,
+        options: ClientOptions,
+        on_eof: F,
+    ) -> Result<Self>
+    where
+        R: io::Read + Send + 'static,
+        F: FnOnce() -> AdapterExit + Send + 'static,
+    {
+        let request_timeout = options.request_timeout;
+        let logger = options.logger.clone();
+
+        // so the session span belongs to the logger
+        let _logger = options
+            .logger
+            .as_ref()
+            .map(tracing::dispatcher::set_default);
+
+        // internal state
+        let sequence_number = Arc::new(AtomicI64::new(0));
+
+        // Background poller to send responses and events
         let store = RequestStore::default();
         let store_clone = Arc::clone(&store);
+        let in_flight = Arc::new(InFlight::new(options.max_in_flight));
+        let in_flight_clone = Arc::clone(&in_flight);
+        let span = match &options.session {
+            Some(session) => tracing::info_span!("session", %session),
+            None => tracing::Span::none(),
+        };
+        let poll_span = span.clone();
+        let poll_logger = options.logger.clone();
+        let recorder = options
+            .record
+            .then(|| Arc::new(Recorder::new(options.session.clone())));
+        let recorder_clone = recorder.clone();
+        let captures = Arc::new(Captures::default());
+        let captures_clone = Arc::clone(&captures);
+        let event_handlers = EventHandlers::default();
+        let event_handlers_clone = Arc::clone(&event_handlers);
+        let adapter_exit = Arc::new(Mutex::new(None));
+        let adapter_exit_clone = Arc::clone(&adapter_exit);
+        let protocol_error = Arc::new(Mutex::new(None));
+        let protocol_error_clone = Arc::clone(&protocol_error);
+        let state = Arc::new(Mutex::new(SessionState::default()));
+        let state_clone = Arc::clone(&state);
+        let capabilities = Arc::new(Mutex::new(None));
+        let capabilities_clone = Arc::clone(&capabilities);
+        let threads = Arc::new(Mutex::new(ThreadStates::default()));
+        let threads_clone = Arc::clone(&threads);
+        let session_end = Arc::new(Mutex::new(SessionEnd::default()));
+        let session_end_clone = Arc::clone(&session_end);
         let (shutdown_tx, shutdown_rx) = oneshot::channel();
 
         thread::spawn(move || {
-            let input = BufReader::new(input_stream);
+            let _logger = poll_logger.as_ref().map(tracing::dispatcher::set_default);
+            let _guard = poll_span.enter();
+            let input = DeadlineInput::new(input, options.read_deadline, Arc::clone(&store_clone));
+            let input = BufReader::with_capacity(options.reader_buffer_size, input);
             let mut reader = reader::get(input);
 
+            // fail the requests which will never be answered, and the captures of messages
+            // which will never arrive, rather than leaving their callers waiting forever
+            let fail_waiting = || {
+                with_lock("Reader.store", store_clone.as_ref(), |mut store| {
+                    store.clear()
+                });
+                captures_clone.close();
+            };
+            // call the handlers registered for the event, then send it to the events channel
+            let deliver = |evt: events::Event| {
+                let handlers = event_handlers_clone.lock().unwrap();
+                for (_, handler) in handlers.get(evt.name()).into_iter().flatten() {
+                    handler(&evt);
+                }
+                drop(handlers);
+                let _ = responses.send(evt);
+            };
+            let session_end = session_end_clone;
+
             // poll loop
             loop {
                 // check for shutdown
                 match shutdown_rx.try_recv() {
-                    Ok(_) => return,
+                    Ok(_) => {
+                        tracing::debug!("client stopped");
+                        fail_waiting();
+                        return;
+                    }
                     Err(oneshot::TryRecvError::Empty) => {}
                     Err(e) => {
                         tracing::error!(error = %e, "shutdown sender closed");
@@ -83,140 +653,2657 @@ impl Client {
                 }
 
                 match reader.poll_message() {
-                    Ok(Some(msg)) => match msg {
-                        Message::Event(evt) => {
-                            let _ = responses.send(evt);
+                    Ok(Some(msg)) => {
+                        tracing::debug!(message = ?msg, "received message");
+                        if let Some(recorder) = &recorder_clone {
+                            recorder.record(msg.clone());
                         }
-                        Message::Response(r) => {
-                            with_lock(
-                                "Reader.store",
-                                store_clone.as_ref(),
-                                |mut store| match store.remove(&r.request_seq) {
-                                    Some(WaitingRequest(_, tx)) => {
-                                        let _ = tx.send(r.body);
-                                    }
-                                    None => {
-                                        tracing::warn!(response = ?r, "no message in request store")
-                                    }
-                                },
-                            );
+                        captures_clone.offer(reader.raw_message());
+
+                        match msg {
+                            Message::Event(evt) => {
+                                // before the event is delivered, so the state is up to date
+                                // for anyone reacting to it
+                                {
+                                    let mut state = state_clone.lock().unwrap();
+                                    *state = state.on_event(&evt);
+                                }
+                                threads_clone.lock().unwrap().on_event(&evt);
+                                let ended = session_end.lock().unwrap().on_event(&evt);
+                                deliver(evt);
+                                if let Some(ended) = ended {
+                                    deliver(ended);
+                                }
+                            }
+                            Message::Response(r) => {
+                                in_flight_clone.release(r.request_seq);
+                                let ended = with_lock(
+                                    "Reader.store",
+                                    store_clone.as_ref(),
+                                    |mut store| match store.remove(&r.request_seq) {
+                                        Some(WaitingRequest(request, tx, _)) => {
+                                            let mut state = state_clone.lock().unwrap();
+                                            *state = state.on_response(&request, r.success);
+                                            drop(state);
+                                            if let Some(body) = &r.body {
+                                                threads_clone.lock().unwrap().on_response(body);
+                                            }
+                                            // however the request was sent, so the capability
+                                            // checks apply to every caller
+                                            if let Some(responses::ResponseBody::Initialize(
+                                                capabilities,
+                                            )) = &r.body
+                                            {
+                                                *capabilities_clone.lock().unwrap() =
+                                                    Some(capabilities.clone());
+                                            }
+                                            let _ = tx.send(r);
+                                            session_end.lock().unwrap().on_response(&request)
+                                        }
+                                        None => {
+                                            tracing::warn!(response = ?r, "no message in request store");
+                                            None
+                                        }
+                                    },
+                                );
+                                if let Some(ended) = ended {
+                                    deliver(ended);
+                                }
+                            }
+                            Message::Request(_) => {
+                                unreachable!("we should not be parsing requests")
+                            }
                         }
-                        Message::Request(_) => unreachable!("we should not be parsing requests"),
-                    },
+                    }
+                    Ok(None) if shutdown_rx.try_recv().is_ok() => {
+                        // we closed the connection in `Client::stop`
+                        tracing::debug!("client stopped");
+                        fail_waiting();
+                        return;
+                    }
                     Ok(None) => {
-                        tracing::debug!("ok none");
+                        // the adapter has closed its end of the connection
+                        let exit = on_eof();
+                        tracing::debug!(?exit, "adapter exited");
+                        *adapter_exit_clone.lock().unwrap() = Some(exit);
+                        fail_waiting();
+                        let ended = session_end.lock().unwrap().on_adapter_exit(exit);
+                        if let Some(ended) = ended {
+                            deliver(ended);
+                        }
+                        return;
+                    }
+                    Err(e) if e.is::<ProtocolError>() => {
+                        // the next message cannot be found, so nothing more can be read
+                        let exit = AdapterExit::ProtocolError;
+                        tracing::error!(error = %e, ?exit, "adapter sent a malformed message");
+                        *protocol_error_clone.lock().unwrap() = e.downcast().ok();
+                        *adapter_exit_clone.lock().unwrap() = Some(exit);
+                        fail_waiting();
+                        let ended = session_end.lock().unwrap().on_adapter_exit(exit);
+                        if let Some(ended) = ended {
+                            deliver(ended);
+                        }
                         return;
                     }
-                    Err(e) => eprintln!("reader error: {e}"),
+                    Err(e) => match e.downcast_ref::<io::Error>() {
+                        Some(_) if shutdown_rx.try_recv().is_ok() => {
+                            tracing::debug!("client stopped");
+                            fail_waiting();
+                            return;
+                        }
+                        Some(io_error) => {
+                            // the stream is dead
+                            let exit = AdapterExit::ReadFailed(io_error.kind());
+                            tracing::error!(error = %e, ?exit, "reading from adapter failed");
+                            *adapter_exit_clone.lock().unwrap() = Some(exit);
+                            fail_waiting();
+                            let ended = session_end.lock().unwrap().on_adapter_exit(exit);
+                            if let Some(ended) = ended {
+                                deliver(ended);
+                            }
+                            return;
+                        }
+                        // the message was consumed, so the stream is still usable
+                        None => tracing::warn!(error = %e, "skipping unreadable message"),
+                    },
                 }
             }
         });
 
         let internal = ClientInternals {
-            output: stream,
+            output,
             sequence_number,
-            store,
+            store: Arc::clone(&store),
+            in_flight: Arc::clone(&in_flight),
+            recorder,
+            captures,
+            inspect_only: options.inspect_only,
+            attached: false,
+            replay: Replay::default(),
+            state: Arc::clone(&state),
+            threads: Arc::clone(&threads),
+            session_end,
+            command_overrides: options.command_overrides,
+            span,
+            logger: options.logger,
             exit: Some(shutdown_tx),
         };
 
         Ok(Self {
             internals: Arc::new(Mutex::new(internal)),
+            store,
+            in_flight,
+            adapter_exit,
+            protocol_error,
+            capabilities,
+            state,
+            threads,
+            adapter_process: None,
+            event_handlers,
+            request_timeout,
+            logger,
         })
     }
 
-    #[tracing::instrument(skip(self, body))]
     pub fn send(&self, body: requests::RequestBody) -> Result<Option<ResponseBody>> {
-        with_lock(
-            "Client.internals",
-            self.internals.as_ref(),
-            |mut internals| internals.send(body),
-        )
+        let _logger = self.log_to_logger();
+        let _span = tracing::info_span!("send").entered();
+        let pending = self.send_pending(body)?;
+        self.wait(pending)
     }
 
-    #[tracing::instrument(skip(self, body))]
-    pub fn execute(&self, body: requests::RequestBody) -> Result<()> {
-        with_lock(
+    /// Wait for the response to `pending`, up to the request timeout if there is one
+    fn wait(&self, pending: PendingResponse) -> Result<Option<ResponseBody>> {
+        self.wait_response(pending).map(|response| response.body)
+    }
+
+    /// Wait for the full response to `pending`, including whether the request succeeded, up to
+    /// the request timeout if there is one, see [`ClientOptions::with_request_timeout`]
+    pub fn wait_response(&self, pending: PendingResponse) -> Result<responses::Response> {
+        let _logger = self.log_to_logger();
+        pending.recv(self.request_timeout)
+    }
+
+    /// Send a request and wait up to `timeout` for its response, failing if the adapter reports
+    /// that the request was unsuccessful
+    ///
+    /// Unlike [`Client::send`], a hung adapter cannot block the caller forever.
+    pub fn send_request(
+        &self,
+        body: requests::RequestBody,
+        timeout: Duration,
+    ) -> Result<Option<ResponseBody>> {
+        let _logger = self.log_to_logger();
+        let _span = tracing::info_span!("send_request", ?timeout).entered();
+        let response = self.send_pending(body)?.wait_response(timeout)?;
+        if !response.success {
+            eyre::bail!(
+                "request failed: {}",
+                response.message.as_deref().unwrap_or("no reason given")
+            );
+        }
+        Ok(response.body)
+    }
+
+    /// Send a request without waiting for the response, which can be waited for with the
+    /// returned [`PendingResponse`]
+    pub fn send_pending(&self, body: requests::RequestBody) -> Result<PendingResponse> {
+        let _logger = self.log_to_logger();
+        let _span = tracing::info_span!("send_pending").entered();
+        // wait for space before taking the lock, so the client is usable in the meantime
+        let permit = self.in_flight.acquire();
+        // only hold the lock while sending, so other requests can be sent while we wait
+        let (seq, response) = with_lock(
             "Client.internals",
             self.internals.as_ref(),
-            |mut internals| internals.execute(body),
-        )
+            |mut internals| internals.send(body, permit),
+        )?;
+        Ok(PendingResponse {
+            seq,
+            response,
+            store: Arc::clone(&self.store),
+            in_flight: Arc::clone(&self.in_flight),
+            logger: self.logger.clone(),
+        })
     }
-}
 
-fn with_lock<T, F, R>(name: &str, lock: &Mutex<T>, f: F) -> R
-where
-    F: FnOnce(MutexGuard<'_, T>) -> R,
-{
-    tracing::trace!(%name, "taking lock");
-    let inner = lock.lock().unwrap();
-    let res = f(inner);
-    tracing::trace!(%name, "releasing lock");
-    res
-}
+    /// Send multiple requests without waiting for each response, then collect the responses in
+    /// the order the requests were given.
+    pub fn send_many(
+        &self,
+        bodies: impl IntoIterator<Item = requests::RequestBody>,
+    ) -> Result<Vec<Option<ResponseBody>>> {
+        let _logger = self.log_to_logger();
+        let _span = tracing::info_span!("send_many").entered();
+        let pending = bodies
+            .into_iter()
+            .map(|body| self.send_pending(body))
+            .collect::<Result<Vec<_>>>()?;
 
-impl ClientInternals {
-    pub fn send(&mut self, body: requests::RequestBody) -> Result<Option<ResponseBody>> {
-        self.sequence_number.fetch_add(1, Ordering::SeqCst);
-        let message = requests::Request {
-            seq: self.sequence_number.load(Ordering::SeqCst),
-            r#type: "request".to_string(),
-            body: body.clone(),
-        };
-        let resp_json = serde_json::to_string(&message).unwrap();
-        tracing::debug!(request = ?message, "sending message");
-        write!(
-            self.output,
-            "Content-Length: {}\r\n\r\n{}",
-            resp_json.len(),
-            resp_json
-        )
-        .unwrap();
-        self.output.flush().unwrap();
+        pending
+            .into_iter()
+            .map(|pending| self.wait(pending))
+            .collect()
+    }
 
-        let (tx, rx) = oneshot::channel();
-        let waiting_request = WaitingRequest(body, tx);
+    /// Send a request and wait for its typed response, failing if the adapter replied with a
+    /// failed response or a response to a different request
+    pub fn send_typed<R>(&self, request: R) -> Result<R::Response>
+    where
+        R: requests::TypedRequest,
+    {
+        let _logger = self.log_to_logger();
+        let pending = self.send_pending(request.into_body())?;
+        let response = self.wait_response(pending)?;
+        if !response.success {
+            eyre::bail!(
+                "request failed: {}",
+                response.message.as_deref().unwrap_or("no reason given")
+            );
+        }
+        response
+            .body
+            .and_then(R::from_response)
+            .ok_or_else(|| eyre::eyre!("mismatched response from adapter"))
+    }
 
-        with_lock("ClientInternals.store", self.store.as_ref(), |mut store| {
-            store.insert(message.seq, waiting_request);
-        });
+    /// Call `handler` with every event named `event`, e.g. `stopped`, see
+    /// [`events::Event::name`]
+    ///
+    /// Any number of handlers can be registered for the same event, unlike the events channel
+    /// which delivers each event to only one receiver. Events are still sent to the channel.
+    /// Handlers are called from the thread reading from the adapter, so must not block or
+    /// register or remove handlers. The returned id removes the handler again, see
+    /// [`Client::remove_event_handler`].
+    pub fn on_event<F>(&self, event: impl Into<String>, handler: F) -> HandlerId
+    where
+        F: Fn(&events::Event) + Send + 'static,
+    {
+        let id = HandlerId::next();
+        self.event_handlers
+            .lock()
+            .unwrap()
+            .entry(event.into())
+            .or_default()
+            .push((id, Box::new(handler)));
+        id
+    }
 
-        let res = rx.recv().expect("sender dropped");
-        Ok(res)
+    /// Stop calling a handler registered with [`Client::on_event`]
+    pub fn remove_event_handler(&self, id: HandlerId) {
+        let mut handlers = self.event_handlers.lock().unwrap();
+        for registered in handlers.values_mut() {
+            registered.retain(|(handler, _)| *handler != id);
+        }
+        handlers.retain(|_, registered| !registered.is_empty());
     }
 
-    /// Execute a call on the client but do not wait for a response
-    pub fn execute(&mut self, body: requests::RequestBody) -> Result<()> {
-        self.sequence_number.fetch_add(1, Ordering::SeqCst);
-        let message = requests::Request {
-            seq: self.sequence_number.load(Ordering::SeqCst),
-            r#type: "request".to_string(),
-            body: body.clone(),
-        };
-        let resp_json = serde_json::to_string(&message).unwrap();
-        tracing::debug!(request = ?message, "sending message");
-        write!(
-            self.output,
-            "Content-Length: {}\r\n\r\n{}",
-            resp_json.len(),
-            resp_json
+    /// Perform the initialize handshake, returning the capabilities of the adapter
+    ///
+    /// The capabilities are also kept by the client, see [`Client::capabilities`].
+    pub fn initialize(&self, arguments: requests::Initialize) -> Result<responses::Capabilities> {
+        let _logger = self.log_to_logger();
+        self.send_typed(arguments)
+            .context("sending initialize request")
+    }
+
+    /// Replace the breakpoints in `source` with breakpoints on each of `lines`
+    ///
+    /// The response says which breakpoints the adapter verified, and the line each was actually
+    /// placed on.
+    pub fn set_breakpoints(
+        &self,
+        source: types::Source,
+        lines: &[usize],
+    ) -> Result<responses::SetBreakpoints> {
+        let _logger = self.log_to_logger();
+        self.send_typed(requests::SetBreakpoints {
+            source,
+            breakpoints: Some(
+                lines
+                    .iter()
+                    .map(|&line| types::SourceBreakpoint {
+                        line,
+                        ..Default::default()
+                    })
+                    .collect(),
+            ),
+            lines: Some(lines.to_vec()),
+            source_modified: None,
+        })
+        .context("sending set breakpoints request")
+    }
+
+    /// Break on the exceptions matched by `filters`, e.g. `uncaught`, replacing any filters
+    /// set before
+    ///
+    /// Once the adapter is initialized, only the filters it offers, see
+    /// [`Client::exception_breakpoint_filters`], are accepted.
+    pub fn set_exception_breakpoints(
+        &self,
+        filters: &[&str],
+    ) -> Result<responses::SetExceptionBreakpointsResponse> {
+        let _logger = self.log_to_logger();
+        self.check_exception_filters(filters)?;
+
+        let response = self
+            .send(requests::RequestBody::SetExceptionBreakpoints(
+                requests::SetExceptionBreakpoints {
+                    filters: filters.iter().map(|filter| filter.to_string()).collect(),
+                },
+            ))
+            .context("sending set exception breakpoints request")?;
+        // the body is optional
+        match response {
+            Some(ResponseBody::SetExceptionBreakpoints(response)) => Ok(response),
+            _ => Ok(Default::default()),
+        }
+    }
+
+    /// Fail if the adapter did not offer every one of `filters`
+    pub(crate) fn check_exception_filters<S: AsRef<str>>(&self, filters: &[S]) -> Result<()> {
+        if let Some(capabilities) = self.capabilities() {
+            let offered = capabilities
+                .exception_breakpoint_filters
+                .unwrap_or_default();
+            for filter in filters {
+                let filter = filter.as_ref();
+                eyre::ensure!(
+                    offered.iter().any(|offered| offered.filter == filter),
+                    "adapter does not support the exception filter {filter}"
+                );
+            }
+        }
+        Ok(())
+    }
+
+    /// The exceptions the adapter can break on, once [`Client::initialize`] has completed
+    pub fn exception_breakpoint_filters(&self) -> Vec<types::ExceptionBreakpointsFilter> {
+        self.capabilities()
+            .and_then(|capabilities| capabilities.exception_breakpoint_filters)
+            .unwrap_or_default()
+    }
+
+    /// Evaluate `expression` in the context of a stack frame, or globally if `frame_id` is
+    /// `None`
+    ///
+    /// Structured results have a non-zero `variables_reference`, which can be expanded with a
+    /// variables request.
+    pub fn evaluate(
+        &self,
+        expression: impl Into<String>,
+        frame_id: Option<types::StackFrameId>,
+        context: requests::EvaluateContext,
+    ) -> Result<responses::EvaluateResponse> {
+        let _logger = self.log_to_logger();
+        self.send_typed(requests::Evaluate {
+            expression: expression.into(),
+            frame_id,
+            context: Some(context),
+            source: None,
+            line: None,
+        })
+        .context("sending evaluate request")
+    }
+
+    /// Change the value of the variable `name` in `variables_reference`, e.g. to reproduce a
+    /// bug without restarting the debuggee
+    ///
+    /// The response contains the new value, as the adapter formats it. Once the adapter is
+    /// initialized, this fails with an [`UnsupportedError`] without sending anything if the
+    /// adapter does not support setting variables.
+    pub fn set_variable(
+        &self,
+        variables_reference: types::VariablesReference,
+        name: impl Into<String>,
+        value: impl Into<String>,
+    ) -> Result<responses::SetVariableResponse> {
+        let _logger = self.log_to_logger();
+        let unsupported = self
+            .capabilities()
+            .is_some_and(|capabilities| !capabilities.supports_set_variable.unwrap_or(false));
+        if unsupported {
+            return Err(UnsupportedError {
+                feature: "setting variables",
+            }
+            .into());
+        }
+        self.send_typed(requests::SetVariable {
+            variables_reference,
+            name: name.into(),
+            value: value.into(),
+            format: None,
+        })
+        .context("sending set variable request")
+    }
+
+    /// Attach to a running debuggee, with adapter specific `arguments`, e.g. the process id of
+    /// the debuggee or the host and port debugpy is listening on
+    ///
+    /// Adapters usually answer once configuration is done, so the response is returned to be
+    /// waited for later. Unlike a launched debuggee, an attached one is not guaranteed to end
+    /// with the session, and the adapter may not send a terminated event when it exits.
+    /// [`Client::shutdown`] disconnects without terminating it.
+    pub fn attach(&self, arguments: serde_json::Value) -> Result<PendingResponse> {
+        let _logger = self.log_to_logger();
+        self.send_pending(requests::RequestBody::RawAttach(arguments))
+            .context("sending attach request")
+    }
+
+    /// Step over the current line of `thread_id`
+    ///
+    /// The adapter reports the end of the step with a stopped event, so this does not wait for
+    /// the response.
+    pub fn next(
+        &self,
+        thread_id: types::ThreadId,
+        granularity: Option<requests::SteppingGranularity>,
+    ) -> Result<()> {
+        let _logger = self.log_to_logger();
+        self.check_granularity(granularity)?;
+        self.execute(requests::RequestBody::Next(requests::Next {
+            thread_id,
+            granularity,
+        }))
+        .context("sending next request")
+    }
+
+    /// Step into the function called on the current line of `thread_id`, see [`Client::next`]
+    pub fn step_in(
+        &self,
+        thread_id: types::ThreadId,
+        granularity: Option<requests::SteppingGranularity>,
+    ) -> Result<()> {
+        let _logger = self.log_to_logger();
+        self.check_granularity(granularity)?;
+        self.execute(requests::RequestBody::StepIn(requests::StepIn {
+            thread_id,
+            target_id: None,
+            granularity,
+        }))
+        .context("sending step in request")
+    }
+
+    /// Restart the debuggee, e.g. in an edit-debug loop
+    ///
+    /// If the adapter does not support restart requests, the debuggee is terminated, then once
+    /// the adapter reports it terminated it is launched again with the launch request which
+    /// started the session. The latest breakpoints are set again once the adapter is
+    /// initialized, before configuration is done, as for a new session.
+    pub fn restart(&self) -> Result<()> {
+        let _logger = self.log_to_logger();
+        let supports_restart = self
+            .capabilities()
+            .is_some_and(|capabilities| capabilities.supports_restart_request.unwrap_or(false));
+        if supports_restart {
+            self.send(requests::RequestBody::Restart(requests::Restart::default()))
+                .context("sending restart request")?;
+            return Ok(());
+        }
+
+        let replay = with_lock("Client.internals", self.internals.as_ref(), |internals| {
+            internals.replay.clone()
+        });
+        let config = replay
+            .config()
+            .filter(|config| matches!(config.launch, requests::RequestBody::Launch(_)))
+            .ok_or_else(|| eyre::eyre!("only launched sessions can be restarted"))?;
+
+        let terminated = EventWaiter::new(self, "terminated");
+        self.send_request(
+            requests::RequestBody::Terminate(requests::Terminate {
+                restart: Some(true),
+            }),
+            config.timeout,
         )
-        .unwrap();
-        self.output.flush().unwrap();
+        .context("sending terminate request")?;
+        terminated
+            .wait(config.timeout)
+            .context("waiting for the debuggee to terminate")?;
+
+        // registered before launching again, so the event cannot be missed
+        let initialized = EventWaiter::new(self, "initialized");
+        self.launch_configured(config, &initialized, replay.configuration_done)
+            .context("launching again")
+    }
+
+    /// Suspend `thread_id` while it is running, e.g. when it is stuck in a loop without a
+    /// breakpoint
+    ///
+    /// The adapter reports the thread stopping with a stopped event with the reason `pause`, so
+    /// this does not wait for the response.
+    pub fn pause(&self, thread_id: types::ThreadId) -> Result<()> {
+        let _logger = self.log_to_logger();
+        self.execute(requests::RequestBody::Pause(requests::Pause { thread_id }))
+            .context("sending pause request")
+    }
+
+    /// Step out of the current function of `thread_id`, see [`Client::next`]
+    pub fn step_out(
+        &self,
+        thread_id: types::ThreadId,
+        granularity: Option<requests::SteppingGranularity>,
+    ) -> Result<()> {
+        let _logger = self.log_to_logger();
+        self.check_granularity(granularity)?;
+        self.execute(requests::RequestBody::StepOut(requests::StepOut {
+            thread_id,
+            granularity,
+        }))
+        .context("sending step out request")
+    }
+
+    /// End the debug session, terminating the debuggee, and close the connection
+    ///
+    /// If the adapter supports it, the debuggee is first asked to terminate gracefully. Adapters
+    /// which do not, or which do not answer within `timeout`, are instead asked to terminate the
+    /// debuggee when disconnecting. In inspect only mode, or when attached to the debuggee, the
+    /// debuggee is left running.
+    pub fn shutdown(&self, timeout: Duration) -> Result<()> {
+        let _logger = self.log_to_logger();
+        let keep_running = self.is_inspect_only() || self.is_attached();
+        let supports_terminate = self
+            .capabilities()
+            .is_some_and(|capabilities| capabilities.supports_terminate_request.unwrap_or(false));
+
+        let mut terminated = false;
+        if supports_terminate && !keep_running {
+            match self.send_request(
+                requests::RequestBody::Terminate(requests::Terminate { restart: None }),
+                timeout,
+            ) {
+                Ok(_) => terminated = true,
+                Err(e) => tracing::warn!(
+                    error = %e,
+                    "terminate request failed, terminating debuggee when disconnecting"
+                ),
+            }
+        }
+
+        let disconnected = self
+            .send_request(
+                requests::RequestBody::Disconnect(requests::Disconnect {
+                    terminate_debugee: !terminated && !keep_running,
+                    suspend_debuggee: None,
+                }),
+                timeout,
+            )
+            .context("sending disconnect request");
+        self.stop()?;
+        disconnected.map(|_| ())
+    }
+
+    /// Send log output to the client's logger, if it has one, until the returned guard is
+    /// dropped, see [`ClientOptions::with_logger`]
+    fn log_to_logger(&self) -> Option<tracing::dispatcher::DefaultGuard> {
+        self.logger.as_ref().map(tracing::dispatcher::set_default)
+    }
 
+    /// Refuse a stepping granularity if the adapter is known not to support one
+    fn check_granularity(&self, granularity: Option<requests::SteppingGranularity>) -> Result<()> {
+        let unsupported = self.capabilities().is_some_and(|capabilities| {
+            !capabilities.supports_stepping_granularity.unwrap_or(false)
+        });
+        eyre::ensure!(
+            granularity.is_none() || !unsupported,
+            "adapter does not support stepping granularity"
+        );
         Ok(())
     }
-}
 
-impl Drop for ClientInternals {
-    fn drop(&mut self) {
-        tracing::debug!("shutting down client");
-        // Shutdown the background thread
-        let _ = self.exit.take().unwrap().send(());
+    /// The capabilities of the adapter, once it has answered the initialize request
+    pub fn capabilities(&self) -> Option<responses::Capabilities> {
+        self.capabilities.lock().unwrap().clone()
     }
-}
 
-#[derive(Clone, Debug)]
-pub enum Received {
-    Event(events::Event),
-    Response(requests::RequestBody, responses::Response),
+    /// How the adapter ended the session, or `None` if it is still connected
+    pub fn adapter_exit(&self) -> Option<AdapterExit> {
+        *self.adapter_exit.lock().unwrap()
+    }
+
+    /// The malformed message which ended the session, if
+    /// [`Client::adapter_exit`] is [`AdapterExit::ProtocolError`]
+    pub fn protocol_error(&self) -> Option<ProtocolError> {
+        self.protocol_error.lock().unwrap().clone()
+    }
+
+    /// Where the session is in its lifecycle, as observed from the messages exchanged with the
+    /// adapter
+    pub fn state(&self) -> SessionState {
+        *self.state.lock().unwrap()
+    }
+
+    /// The threads of the debuggee
+    ///
+    /// The threads are also remembered, so that if the adapter later reports that all threads
+    /// stopped, [`Client::is_stopped`] knows which threads that includes.
+    pub fn threads(&self) -> Result<Vec<types::Thread>> {
+        let _logger = self.log_to_logger();
+        let responses::ThreadsResponse { threads } = self
+            .send_typed(requests::Threads)
+            .context("sending threads request")?;
+        self.threads
+            .lock()
+            .unwrap()
+            .add_known(threads.iter().map(|thread| thread.id));
+        Ok(threads)
+    }
+
+    /// Whether the thread `thread_id` is stopped, so can be inspected, as reported by the stopped
+    /// and continued events
+    pub fn is_stopped(&self, thread_id: types::ThreadId) -> bool {
+        self.threads.lock().unwrap().is_stopped(thread_id)
+    }
+
+    /// The threads which are stopped, as reported by the stopped and continued events
+    pub fn stopped_threads(&self) -> Vec<types::ThreadId> {
+        self.threads.lock().unwrap().stopped()
+    }
+
+    /// Treat the adapter as initialized without having received the initialized event, for
+    /// minimal adapters which never send it
+    pub fn assume_initialized(&self) {
+        let mut state = self.state.lock().unwrap();
+        if *state == SessionState::Uninitialized {
+            *state = SessionState::Initialized;
+        }
+    }
+
+    /// Whether the session attached to a running debuggee, see [`Client::attach`]
+    pub fn is_attached(&self) -> bool {
+        let _logger = self.log_to_logger();
+        with_lock("Client.internals", self.internals.as_ref(), |internals| {
+            internals.attached
+        })
+    }
+
+    /// Whether mutating requests are rejected, see [`ClientOptions::inspect_only`]
+    pub fn is_inspect_only(&self) -> bool {
+        let _logger = self.log_to_logger();
+        with_lock("Client.internals", self.internals.as_ref(), |internals| {
+            internals.inspect_only
+        })
+    }
+
+    /// Close the connection to the adapter without waiting for any outstanding responses
+    pub fn close(&self) -> Result<()> {
+        let _logger = self.log_to_logger();
+        with_lock(
+            "Client.internals",
+            self.internals.as_ref(),
+            |mut internals| internals.output.close().context("closing connection"),
+        )
+    }
+
+    /// Stop polling for messages from the adapter, e.g. when the user stops debugging
+    ///
+    /// The blocking read from the adapter cannot be interrupted directly, so the connection is
+    /// closed to wake the poll thread. Requests still waiting for a response fail, and no
+    /// further events are sent.
+    pub fn stop(&self) -> Result<()> {
+        let _logger = self.log_to_logger();
+        with_lock(
+            "Client.internals",
+            self.internals.as_ref(),
+            |mut internals| {
+                if let Some(exit) = internals.exit.take() {
+                    let _ = exit.send(());
+                }
+                internals.output.close().context("closing connection")
+            },
+        )
+    }
+
+    pub fn execute(&self, body: requests::RequestBody) -> Result<()> {
+        let _logger = self.log_to_logger();
+        let _span = tracing::info_span!("execute").entered();
+        let permit = self.in_flight.acquire();
+        with_lock(
+            "Client.internals",
+            self.internals.as_ref(),
+            |mut internals| internals.execute(body, permit),
+        )
+    }
+
+    /// Describe the requests still awaiting a response, with their commands and how long they
+    /// have been waiting, e.g. to diagnose a stuck session.
+    ///
+    /// This does not need the client lock, so can be called while another request is blocked.
+    pub fn dump_state(&self) -> String {
+        let _logger = self.log_to_logger();
+        with_lock("Client.store", self.store.as_ref(), |store| {
+            request_store::dump(&store)
+        })
+    }
+
+    /// Capture the raw JSON of the next message received for the command or event `name`, e.g.
+    /// to debug a single problematic message.
+    ///
+    /// The capture must be created before the message arrives.
+    pub fn capture_next(&self, name: impl Into<String>) -> Capture {
+        let _logger = self.log_to_logger();
+        with_lock("Client.internals", self.internals.as_ref(), |internals| {
+            internals.captures.arm(name.into())
+        })
+    }
+
+    /// Record a line written to stderr by the server process, e.g. diagnostics from a debug
+    /// adapter, interleaved with the messages. Does nothing if the client is not recording.
+    pub fn record_stderr(&self, line: &str) {
+        let _logger = self.log_to_logger();
+        let recorder = with_lock("Client.internals", self.internals.as_ref(), |internals| {
+            internals.recorder.clone()
+        });
+        if let Some(recorder) = recorder {
+            recorder.record_stderr(line);
+        }
+    }
+
+    /// Export the recorded session as a fixture, which can be loaded with
+    /// [`crate::load_fixture`].
+    ///
+    /// The fixture is a transcript with one JSON object per line, each with a `timestamp` in
+    /// milliseconds since the unix epoch.
+    ///
+    /// Requires the client to have been created with [`ClientOptions::with_recording`].
+    pub fn export_fixture(&self, w: impl io::Write) -> Result<()> {
+        let _logger = self.log_to_logger();
+        let recorder = with_lock("Client.internals", self.internals.as_ref(), |internals| {
+            internals.recorder.clone()
+        });
+        match recorder {
+            Some(recorder) => recorder.export(w),
+            None => eyre::bail!("client is not recording messages"),
+        }
+    }
+}
+
+/// A request that has been sent, awaiting its response
+///
+/// Dropping it without waiting for the response, or after giving up waiting, forgets the
+/// request, so it no longer counts towards [`ClientOptions::with_max_in_flight`] and a late
+/// response is discarded.
+pub struct PendingResponse {
+    seq: types::Seq,
+    response: oneshot::Receiver<responses::Response>,
+    store: RequestStore,
+    in_flight: Arc<InFlight>,
+    /// The logger of the client which sent the request
+    logger: Option<tracing::Dispatch>,
+}
+
+impl PendingResponse {
+    /// Block until the response arrives
+    pub fn wait(self) -> Result<Option<ResponseBody>> {
+        self.recv(None).map(|response| response.body)
+    }
+
+    /// Block until the response arrives, failing if it does not arrive within `timeout`
+    pub fn wait_timeout(self, timeout: Duration) -> Result<Option<ResponseBody>> {
+        self.wait_response(timeout).map(|response| response.body)
+    }
+
+    /// Block until the response arrives, giving up once `cancelled` is set
+    ///
+    /// A response which arrives after giving up is discarded.
+    pub fn wait_cancellable(self, cancelled: &AtomicBool) -> Result<Option<ResponseBody>> {
+        loop {
+            eyre::ensure!(!cancelled.load(Ordering::SeqCst), "request cancelled");
+            match self.response.recv_timeout(CANCEL_POLL_INTERVAL) {
+                Ok(response) => return Ok(response.body),
+                Err(oneshot::RecvTimeoutError::Timeout) => {}
+                Err(oneshot::RecvTimeoutError::Disconnected) => {
+                    eyre::bail!("connection to adapter lost")
+                }
+            }
+        }
+    }
+
+    /// Block until the full response arrives, including whether the request succeeded
+    pub fn wait_response(self, timeout: Duration) -> Result<responses::Response> {
+        self.recv(Some(timeout))
+    }
+
+    /// Block until the full response arrives, for up to `timeout` if there is one
+    fn recv(&self, timeout: Option<Duration>) -> Result<responses::Response> {
+        let Some(timeout) = timeout else {
+            return self
+                .response
+                .recv_ref()
+                .map_err(|_| eyre::eyre!("connection to adapter lost"));
+        };
+        self.response.recv_timeout(timeout).map_err(|e| match e {
+            oneshot::RecvTimeoutError::Timeout => {
+                eyre::eyre!("timed out waiting for response after {timeout:?}")
+            }
+            oneshot::RecvTimeoutError::Disconnected => eyre::eyre!("connection to adapter lost"),
+        })
+    }
+}
+
+impl Drop for PendingResponse {
+    fn drop(&mut self) {
+        let _logger = self.logger.as_ref().map(tracing::dispatcher::set_default);
+        // nothing to do once the response has arrived, as the poll thread has already removed
+        // the request
+        let abandoned = with_lock("PendingResponse.store", self.store.as_ref(), |mut store| {
+            store.remove(&self.seq).is_some()
+        });
+        if abandoned {
+            tracing::debug!(seq = %self.seq, "abandoning request awaiting a response");
+            self.in_flight.release(self.seq);
+        }
+    }
+}
+
+fn with_lock<T, F, R>(name: &str, lock: &Mutex<T>, f: F) -> R
+where
+    F: FnOnce(MutexGuard<'_, T>) -> R,
+{
+    tracing::trace!(%name, "taking lock");
+    let inner = lock.lock().unwrap();
+    let res = f(inner);
+    tracing::trace!(%name, "releasing lock");
+    res
+}
+
+impl ClientInternals {
+    /// Send a request, returning its sequence number and a channel which receives the response
+    pub fn send(
+        &mut self,
+        body: requests::RequestBody,
+        permit: Permit,
+    ) -> Result<(types::Seq, oneshot::Receiver<responses::Response>)> {
+        let _logger = self.logger.as_ref().map(tracing::dispatcher::set_default);
+        let span = self.span.clone();
+        let _guard = span.enter();
+        self.check_allowed(&body)?;
+        self.check_state(&body)?;
+        self.track_launch(&body);
+        let message = requests::Request {
+            seq: self.next_seq(),
+            r#type: "request".to_string(),
+            body: body.clone(),
+        };
+        permit.send(message.seq);
+
+        // register the request before sending so the response cannot arrive first
+        let (tx, rx) = oneshot::channel();
+        let waiting_request = WaitingRequest(body, tx, Instant::now());
+
+        with_lock("ClientInternals.store", self.store.as_ref(), |mut store| {
+            store.insert(message.seq, waiting_request);
+        });
+
+        self.write_message(&message)?;
+        self.advance_state(&message.body);
+
+        Ok((message.seq, rx))
+    }
+
+    /// Execute a call on the client but do not wait for a response
+    pub fn execute(&mut self, body: requests::RequestBody, permit: Permit) -> Result<()> {
+        let _logger = self.logger.as_ref().map(tracing::dispatcher::set_default);
+        let span = self.span.clone();
+        let _guard = span.enter();
+        self.check_allowed(&body)?;
+        self.check_state(&body)?;
+        self.track_launch(&body);
+        let message = requests::Request {
+            seq: self.next_seq(),
+            r#type: "request".to_string(),
+            body: body.clone(),
+        };
+        permit.send(message.seq);
+
+        self.write_message(&message)?;
+        self.advance_state(&message.body);
+
+        Ok(())
+    }
+
+    /// Write `message` to the adapter
+    ///
+    /// The write fails once the connection is closed, e.g. after [`Client::stop`] or once the
+    /// adapter exits, in which case the request is forgotten again, so nothing waits for its
+    /// response and it no longer counts towards [`ClientOptions::with_max_in_flight`].
+    fn write_message(&mut self, message: &requests::Request) -> Result<()> {
+        let resp_json = self.serialize(message);
+        tracing::debug!(request = ?message, "sending message");
+        let written = write!(
+            self.output,
+            "Content-Length: {}\r\n\r\n{}",
+            resp_json.len(),
+            resp_json
+        )
+        .and_then(|_| self.output.flush());
+        if let Err(e) = written {
+            with_lock("ClientInternals.store", self.store.as_ref(), |mut store| {
+                store.remove(&message.seq)
+            });
+            self.in_flight.release(message.seq);
+            return Err(e).context("writing request to adapter");
+        }
+        self.record(message);
+        Ok(())
+    }
+
+    /// Allocate the sequence number of the next request
+    ///
+    /// The number is taken from the result of the increment rather than a separate load, so
+    /// concurrent callers can never be given the same number. Writes to the adapter are
+    /// serialised by the lock around [`ClientInternals`], so messages are never interleaved.
+    fn next_seq(&self) -> i64 {
+        self.sequence_number.fetch_add(1, Ordering::SeqCst) + 1
+    }
+
+    fn record(&self, message: &requests::Request) {
+        if let Some(recorder) = &self.recorder {
+            recorder.record(Message::Request(message.clone()));
+        }
+    }
+
+    /// Serialize a request, replacing its command if it has been overridden
+    fn serialize(&self, message: &requests::Request) -> String {
+        let mut value = serde_json::to_value(Message::Request(message.clone())).unwrap();
+        if let Some(command) = value.get_mut("command") {
+            let custom = command
+                .as_str()
+                .and_then(|name| self.command_overrides.get(name));
+            if let Some(custom) = custom {
+                *command = serde_json::Value::String(custom.clone());
+            }
+        }
+        value.to_string()
+    }
+
+    /// Record how the session was started and configured
+    fn track_launch(&mut self, body: &requests::RequestBody) {
+        if matches!(
+            body,
+            requests::RequestBody::Attach(_) | requests::RequestBody::RawAttach(_)
+        ) {
+            self.attached = true;
+        }
+        self.replay.record(body);
+    }
+
+    /// Reject requests sent out of order, see [`SessionState`]
+    fn check_state(&self, body: &requests::RequestBody) -> Result<()> {
+        self.state
+            .lock()
+            .unwrap()
+            .check_request(body)
+            .inspect_err(|e| tracing::warn!(error = %e, "rejecting out of order request"))?;
+        Ok(())
+    }
+
+    /// Advance the session once a request has been written, and record which threads it
+    /// resumes
+    fn advance_state(&self, body: &requests::RequestBody) {
+        let mut state = self.state.lock().unwrap();
+        *state = state.on_request(body);
+        self.threads.lock().unwrap().on_request(body);
+        self.session_end.lock().unwrap().on_request(body);
+    }
+
+    fn check_allowed(&self, body: &requests::RequestBody) -> Result<()> {
+        if self.inspect_only && body.is_mutating() {
+            tracing::warn!(request = ?body, "rejecting mutating request in inspect-only mode");
+            return Err(ReadOnlyError.into());
+        }
+        Ok(())
+    }
+}
+
+impl Drop for ClientInternals {
+    fn drop(&mut self) {
+        let _logger = self.logger.as_ref().map(tracing::dispatcher::set_default);
+        tracing::debug!("shutting down client");
+        // Shutdown the background thread
+        if let Some(exit) = self.exit.take() {
+            let _ = exit.send(());
+        }
+    }
+}
+
+#[derive(Clone, Debug)]
+pub enum Received {
+    Event(events::Event),
+    Response(requests::RequestBody, responses::Response),
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{
+        collections::HashMap,
+        net::{TcpListener, TcpStream},
+        sync::atomic::AtomicBool,
+        thread,
+        time::{Duration, Instant},
+    };
+
+    use crate::{
+        bindings::get_random_tcp_port,
+        events, load_fixture,
+        mock::{MockAdapter, Reply},
+        requests, responses, types, Message, OutOfOrderError, SessionState,
+    };
+
+    use super::{AdapterExit, Client, ClientOptions, EventWaiter, ReadOnlyError, UnsupportedError};
+
+    /// A log event recorded by [`RecordingLogger`]
+    #[derive(Debug, Clone)]
+    struct Logged {
+        message: String,
+        /// The fields of the spans the event was logged in, outermost first, e.g.
+        /// `session=first`
+        spans: Vec<String>,
+    }
+
+    /// A logger recording the message of each log event, along with the spans it was logged in
+    #[derive(Clone, Default)]
+    struct RecordingLogger {
+        logged: std::sync::Arc<std::sync::Mutex<Vec<Logged>>>,
+        /// The fields of each span, by id
+        spans: std::sync::Arc<std::sync::Mutex<Vec<String>>>,
+        /// The spans each thread is in
+        entered: std::sync::Arc<std::sync::Mutex<HashMap<thread::ThreadId, Vec<u64>>>>,
+    }
+
+    impl RecordingLogger {
+        fn logged(&self) -> Vec<Logged> {
+            self.logged.lock().unwrap().clone()
+        }
+    }
+
+    /// Collects the message and other fields of a span or event
+    #[derive(Default)]
+    struct Fields {
+        message: String,
+        fields: Vec<String>,
+    }
+
+    impl tracing::field::Visit for Fields {
+        fn record_debug(&mut self, field: &tracing::field::Field, value: &dyn std::fmt::Debug) {
+            match field.name() {
+                // the log message comes before any field also called `message`
+                "message" if self.message.is_empty() => self.message = format!("{value:?}"),
+                name => self.fields.push(format!("{name}={value:?}")),
+            }
+        }
+    }
+
+    impl tracing::Subscriber for RecordingLogger {
+        fn enabled(&self, _: &tracing::Metadata<'_>) -> bool {
+            true
+        }
+
+        fn new_span(&self, attributes: &tracing::span::Attributes<'_>) -> tracing::span::Id {
+            let mut fields = Fields::default();
+            attributes.record(&mut fields);
+            let mut spans = self.spans.lock().unwrap();
+            spans.push(fields.fields.join(" "));
+            tracing::span::Id::from_u64(spans.len() as u64)
+        }
+
+        fn record(&self, _: &tracing::span::Id, _: &tracing::span::Record<'_>) {}
+
+        fn record_follows_from(&self, _: &tracing::span::Id, _: &tracing::span::Id) {}
+
+        fn event(&self, event: &tracing::Event<'_>) {
+            let mut fields = Fields::default();
+            event.record(&mut fields);
+            let spans = self.spans.lock().unwrap();
+            let spans = self
+                .entered
+                .lock()
+                .unwrap()
+                .get(&thread::current().id())
+                .into_iter()
+                .flatten()
+                .map(|id| spans[*id as usize - 1].clone())
+                .collect();
+            self.logged.lock().unwrap().push(Logged {
+                message: fields.message,
+                spans,
+            });
+        }
+
+        fn enter(&self, span: &tracing::span::Id) {
+            self.entered
+                .lock()
+                .unwrap()
+                .entry(thread::current().id())
+                .or_default()
+                .push(span.into_u64());
+        }
+
+        fn exit(&self, _: &tracing::span::Id) {
+            if let Some(entered) = self
+                .entered
+                .lock()
+                .unwrap()
+                .get_mut(&thread::current().id())
+            {
+                entered.pop();
+            }
+        }
+    }
+
+    #[test]
+    fn custom_logger() -> eyre::Result<()> {
+        let logger = RecordingLogger::default();
+        let (events_tx, events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect_with_options(
+            events_tx,
+            ClientOptions::default().with_logger(tracing::Dispatch::new(logger.clone())),
+        )?;
+
+        client.execute(requests::RequestBody::Threads)?;
+        adapter.send_event("initialized", serde_json::Value::Null)?;
+        events_rx.recv_timeout(Duration::from_secs(1))?;
+
+        let messages: Vec<_> = logger
+            .logged()
+            .into_iter()
+            .map(|logged| logged.message)
+            .collect();
+        assert!(
+            messages.iter().any(|m| m == "sending message"),
+            "{messages:?}"
+        );
+        assert!(
+            messages.iter().any(|m| m == "received message"),
+            "{messages:?}"
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn custom_logger_entry_points() -> eyre::Result<()> {
+        let logger = RecordingLogger::default();
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect_with_options(
+            events_tx,
+            ClientOptions::default().with_logger(tracing::Dispatch::new(logger.clone())),
+        )?;
+        adapter.enqueue(
+            "initialize",
+            Reply::success(serde_json::json!({ "supportsTerminateRequest": true })),
+        );
+        adapter.enqueue("threads", Reply::no_response());
+        adapter.enqueue("terminate", Reply::failure("not now"));
+
+        client.initialize(initialize_arguments())?;
+        client.dump_state();
+        drop(client.send_pending(requests::RequestBody::Threads)?);
+        client.shutdown(Duration::from_secs(1))?;
+
+        let messages: Vec<_> = logger
+            .logged()
+            .into_iter()
+            .map(|logged| logged.message)
+            .collect();
+        for expected in [
+            "taking lock",
+            "abandoning request awaiting a response",
+            "terminate request failed, terminating debuggee when disconnecting",
+        ] {
+            assert!(messages.iter().any(|m| m == expected), "{messages:?}");
+        }
+        Ok(())
+    }
+
+    #[test]
+    fn max_in_flight() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect_with_options(
+            events_tx,
+            ClientOptions::default().with_max_in_flight(1),
+        )?;
+        adapter.enqueue("threads", Reply::no_response());
+
+        let handles: Vec<_> = (0..2)
+            .map(|_| {
+                let client = client.clone();
+                thread::spawn(move || client.send(requests::RequestBody::Threads))
+            })
+            .collect();
+
+        let first = adapter.requests().recv_timeout(Duration::from_secs(1))?;
+        thread::sleep(Duration::from_millis(200));
+        assert!(
+            adapter.requests().is_empty(),
+            "requests were not serialized"
+        );
+        adapter.reply(&first, Reply::success(serde_json::json!({ "threads": [] })))?;
+        adapter.requests().recv_timeout(Duration::from_secs(1))?;
+
+        for handle in handles {
+            handle.join().unwrap()?;
+        }
+
+        Ok(())
+    }
+
+    #[test]
+    fn max_in_flight_leaves_client_usable() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect_with_options(
+            events_tx,
+            ClientOptions::default().with_max_in_flight(1),
+        )?;
+        adapter.enqueue("threads", Reply::no_response());
+        let pending = client.send_pending(requests::RequestBody::Threads)?;
+        adapter.requests().recv_timeout(Duration::from_secs(1))?;
+
+        let waiting = {
+            let client = client.clone();
+            thread::spawn(move || client.send(requests::RequestBody::Threads))
+        };
+        thread::sleep(Duration::from_millis(100));
+        assert!(adapter.requests().is_empty(), "limit exceeded");
+
+        // the client is not locked while waiting for space
+        let (attached_tx, attached_rx) = crossbeam_channel::bounded(1);
+        {
+            let client = client.clone();
+            thread::spawn(move || attached_tx.send(client.is_attached()));
+        }
+        assert!(!attached_rx.recv_timeout(Duration::from_secs(1))?);
+
+        // giving up on the first request makes space for the second
+        drop(pending);
+        waiting.join().unwrap()?;
+        Ok(())
+    }
+
+    #[test]
+    fn max_in_flight_zero() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, _adapter) = MockAdapter::connect_with_options(
+            events_tx,
+            ClientOptions::default().with_max_in_flight(0),
+        )?;
+
+        let (sent_tx, sent_rx) = crossbeam_channel::bounded(1);
+        thread::spawn(move || sent_tx.send(client.send(requests::RequestBody::Threads)));
+        sent_rx.recv_timeout(Duration::from_secs(1))??;
+        Ok(())
+    }
+
+    #[test]
+    fn concurrent_sends_have_unique_seqs() -> eyre::Result<()> {
+        const SENDERS: usize = 50;
+
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+
+        let handles: Vec<_> = (0..SENDERS)
+            .map(|_| {
+                let client = client.clone();
+                thread::spawn(move || client.send(requests::RequestBody::Threads))
+            })
+            .collect();
+        for handle in handles {
+            handle.join().unwrap()?;
+        }
+
+        // every request must be parsed intact for the adapter to answer all of them
+        let seqs: std::collections::HashSet<_> = adapter
+            .requests()
+            .try_iter()
+            .map(|request| request["seq"].as_i64())
+            .collect();
+        assert_eq!(seqs.len(), SENDERS, "sequence numbers were reused");
+
+        Ok(())
+    }
+
+    #[test]
+    fn export_fixture() -> eyre::Result<()> {
+        let (events_tx, events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect_with_options(
+            events_tx,
+            ClientOptions::default().with_recording(),
+        )?;
+        adapter.enqueue(
+            "threads",
+            Reply::success(serde_json::json!({ "threads": [] }))
+                .event("terminated", serde_json::Value::Null),
+        );
+        client.send(requests::RequestBody::Threads)?;
+        let _ = events_rx.recv().unwrap();
+
+        let mut fixture = Vec::new();
+        client.export_fixture(&mut fixture)?;
+
+        let messages = load_fixture(fixture.as_slice())?;
+        assert_eq!(messages.len(), 3);
+        assert!(matches!(
+            messages[0],
+            Message::Request(requests::Request {
+                body: requests::RequestBody::Threads,
+                ..
+            })
+        ));
+        assert!(matches!(
+            messages[1],
+            Message::Response(responses::Response {
+                body: Some(responses::ResponseBody::Threads(_)),
+                ..
+            })
+        ));
+        assert!(matches!(
+            messages[2],
+            Message::Event(events::Event::Terminated)
+        ));
+
+        Ok(())
+    }
+
+    #[test]
+    fn export_fixture_without_recording() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, _adapter) = MockAdapter::connect(events_tx)?;
+
+        assert!(client.export_fixture(Vec::new()).is_err());
+        Ok(())
+    }
+
+    /// A variables response with a single variable named after the requested reference, e.g.
+    /// `v3`
+    fn variables_reply(request: &serde_json::Value) -> Reply {
+        let reference = &request["arguments"]["variablesReference"];
+        Reply::success(serde_json::json!({
+            "variables": [{ "name": format!("v{reference}"), "value": "", "variablesReference": 0 }],
+        }))
+    }
+
+    #[test]
+    fn send_many() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+
+        // only respond once every request has arrived, in reverse order
+        for _ in 0..3 {
+            adapter.enqueue("variables", Reply::no_response());
+        }
+        let responder = thread::spawn(move || -> eyre::Result<()> {
+            let requests = (0..3)
+                .map(|_| adapter.requests().recv_timeout(Duration::from_secs(1)))
+                .collect::<Result<Vec<_>, _>>()?;
+            for request in requests.iter().rev() {
+                adapter.reply(request, variables_reply(request))?;
+            }
+            Ok(())
+        });
+
+        let responses = client.send_many((1..=3).map(|variables_reference| {
+            requests::RequestBody::Variables(requests::Variables {
+                variables_reference,
+                format: None,
+            })
+        }))?;
+
+        let names: Vec<_> = responses
+            .into_iter()
+            .map(|response| match response {
+                Some(responses::ResponseBody::Variables(responses::VariablesResponse {
+                    variables,
+                })) => variables[0].name.clone(),
+                other => panic!("unexpected response {other:?}"),
+            })
+            .collect();
+        assert_eq!(names, vec!["v1", "v2", "v3"]);
+        responder.join().unwrap()?;
+
+        Ok(())
+    }
+
+    #[test]
+    fn responses_separate_from_events() -> eyre::Result<()> {
+        const SENDERS: i64 = 5;
+
+        let (events_tx, events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+
+        // respond in reverse order, with an event before each response
+        for _ in 0..SENDERS {
+            adapter.enqueue("variables", Reply::no_response());
+        }
+        let responder = thread::spawn(move || -> eyre::Result<()> {
+            let requests = (0..SENDERS)
+                .map(|_| adapter.requests().recv_timeout(Duration::from_secs(1)))
+                .collect::<Result<Vec<_>, _>>()?;
+            for request in requests.iter().rev() {
+                adapter.send_event("initialized", serde_json::Value::Null)?;
+                adapter.reply(request, variables_reply(request))?;
+            }
+            Ok(())
+        });
+
+        let handles: Vec<_> = (1..=SENDERS)
+            .map(|variables_reference| {
+                let client = client.clone();
+                thread::spawn(move || {
+                    client.send_typed(requests::Variables {
+                        variables_reference,
+                        format: None,
+                    })
+                })
+            })
+            .collect();
+        for (variables_reference, handle) in (1..=SENDERS).zip(handles) {
+            let responses::VariablesResponse { variables } = handle.join().unwrap()?;
+            assert_eq!(variables[0].name, format!("v{variables_reference}"));
+        }
+        responder.join().unwrap()?;
+
+        for _ in 0..SENDERS {
+            let event = events_rx.recv_timeout(Duration::from_secs(1))?;
+            assert!(matches!(event, events::Event::Initialized));
+        }
+        assert!(events_rx.is_empty(), "responses sent as events");
+
+        Ok(())
+    }
+
+    #[test]
+    fn event_waiter() -> eyre::Result<()> {
+        let (events_tx, events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+
+        {
+            let waiter = EventWaiter::new(&client, "initialized");
+            adapter.send_event("initialized", serde_json::Value::Null)?;
+            let event = waiter.wait(Duration::from_secs(1))?;
+            assert!(matches!(event, events::Event::Initialized), "{event:?}");
+            // the event is not taken from the events channel
+            events_rx.recv_timeout(Duration::from_secs(1))?;
+
+            let err = waiter.wait(Duration::from_millis(10)).unwrap_err();
+            assert!(err.to_string().contains("no event"), "{err}");
+        }
+
+        // the handler is removed once the waiter is dropped
+        assert!(client.event_handlers.lock().unwrap().is_empty());
+        Ok(())
+    }
+
+    #[test]
+    fn event_handlers() -> eyre::Result<()> {
+        let (events_tx, events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+
+        let (handled_tx, handled_rx) = crossbeam_channel::unbounded();
+        for panel in ["threads", "breakpoints"] {
+            let handled_tx = handled_tx.clone();
+            client.on_event("stopped", move |event| {
+                assert!(matches!(event, events::Event::Stopped(_)));
+                let _ = handled_tx.send(panel);
+            });
+        }
+        let removed_tx = handled_tx.clone();
+        let removed = client.on_event("stopped", move |_| {
+            let _ = removed_tx.send("removed");
+        });
+        client.remove_event_handler(removed);
+        client.on_event("terminated", move |_| {
+            let _ = handled_tx.send("terminated");
+        });
+
+        adapter.send_event(
+            "stopped",
+            serde_json::json!({ "reason": "step", "threadId": 1 }),
+        )?;
+        adapter.send_event("initialized", serde_json::Value::Null)?;
+
+        // the raw channel still receives every event
+        for _ in 0..2 {
+            events_rx.recv_timeout(Duration::from_secs(1))?;
+        }
+        let handled: Vec<_> = handled_rx.try_iter().collect();
+        assert_eq!(handled, vec!["threads", "breakpoints"]);
+
+        Ok(())
+    }
+
+    #[test]
+    fn send_typed() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+        adapter.enqueue(
+            "threads",
+            Reply::success(serde_json::json!({ "threads": [] })),
+        );
+        adapter.enqueue("scopes", Reply::failure("bad frame"));
+
+        let responses::ThreadsResponse { threads } = client.send_typed(requests::Threads)?;
+        assert!(threads.is_empty());
+
+        let err = client
+            .send_typed(requests::Scopes { frame_id: 1 })
+            .unwrap_err();
+        assert!(err.to_string().contains("bad frame"), "{err}");
+
+        Ok(())
+    }
+
+    #[test]
+    fn capture_next() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+        adapter.enqueue(
+            "threads",
+            Reply::success(serde_json::json!({ "threads": [] })),
+        );
+
+        let capture = client.capture_next("threads");
+        let _ = client.send(requests::RequestBody::Threads)?;
+
+        let raw: serde_json::Value = serde_json::from_slice(&capture.wait()?)?;
+        assert_eq!(raw["type"], "response");
+        assert_eq!(raw["request_seq"], 1);
+        assert_eq!(raw["body"], serde_json::json!({ "threads": [] }));
+
+        Ok(())
+    }
+
+    #[test]
+    fn capture_after_stop() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, _adapter) = MockAdapter::connect(events_tx)?;
+
+        // nothing arrives
+        let capture = client.capture_next("threads");
+        assert!(capture.wait_timeout(Duration::from_millis(50)).is_err());
+
+        // waiting when the client stops, or capturing afterwards
+        let capture = client.capture_next("threads");
+        client.stop()?;
+        for capture in [capture, client.capture_next("threads")] {
+            let err = capture.wait_timeout(Duration::from_secs(1)).unwrap_err();
+            assert!(err.to_string().contains("shut down"), "{err}");
+        }
+        Ok(())
+    }
+
+    #[test]
+    fn dump_state() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+        // the adapter never responds
+        adapter.enqueue("threads", Reply::no_response());
+        assert!(client.dump_state().is_empty());
+
+        let pending = client.send_pending(requests::RequestBody::Threads)?;
+        thread::sleep(Duration::from_millis(200));
+
+        let dump = client.dump_state();
+        let age: u128 = dump
+            .trim()
+            .strip_prefix("seq=1 command=threads age=")
+            .and_then(|rest| rest.strip_suffix("ms"))
+            .unwrap_or_else(|| panic!("unexpected dump {dump:?}"))
+            .parse()?;
+        assert!((200..5000).contains(&age), "implausible age {age}ms");
+
+        drop(pending);
+        Ok(())
+    }
+
+    #[test]
+    fn abandoned_requests_forgotten() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+        // the adapter never answers
+        adapter.enqueue("threads", Reply::no_response());
+        adapter.enqueue("threads", Reply::no_response());
+
+        let err = client
+            .send_request(requests::RequestBody::Threads, Duration::from_millis(50))
+            .unwrap_err();
+        assert!(err.to_string().contains("timed out"), "{err}");
+        assert_eq!(client.dump_state(), "");
+
+        let cancelled = AtomicBool::new(true);
+        assert!(client
+            .send_pending(requests::RequestBody::Threads)?
+            .wait_cancellable(&cancelled)
+            .is_err());
+        assert_eq!(client.dump_state(), "");
+        Ok(())
+    }
+
+    /// The entries of an exported transcript, one per line
+    fn transcript(fixture: &[u8]) -> eyre::Result<Vec<serde_json::Value>> {
+        let entries = std::str::from_utf8(fixture)?
+            .lines()
+            .map(serde_json::from_str)
+            .collect::<Result<_, _>>()?;
+        Ok(entries)
+    }
+
+    #[test]
+    fn record_stderr() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect_with_options(
+            events_tx,
+            ClientOptions::default().with_recording(),
+        )?;
+        adapter.enqueue(
+            "threads",
+            Reply::success(serde_json::json!({ "threads": [] })),
+        );
+        client.record_stderr("adapter starting");
+        client.send(requests::RequestBody::Threads)?;
+
+        let mut fixture = Vec::new();
+        client.export_fixture(&mut fixture)?;
+
+        let entries = transcript(&fixture)?;
+        assert_eq!(entries.len(), 3);
+        assert_eq!(entries[0]["stderr"], "adapter starting");
+        assert_eq!(entries[1]["type"], "request");
+        assert!(entries
+            .iter()
+            .all(|entry| entry["timestamp"].as_u64().unwrap() > 0));
+
+        // stderr output is not part of the replayable messages
+        assert_eq!(load_fixture(fixture.as_slice())?.len(), 2);
+
+        Ok(())
+    }
+
+    #[test]
+    fn inspect_only() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) =
+            MockAdapter::connect_with_options(events_tx, ClientOptions::default().inspect_only())?;
+        adapter.enqueue(
+            "stackTrace",
+            Reply::success(serde_json::json!({ "stackFrames": [] })),
+        );
+
+        let err = client
+            .send(requests::RequestBody::Next(requests::Next {
+                thread_id: 1,
+                granularity: None,
+            }))
+            .unwrap_err();
+        assert!(err.downcast_ref::<ReadOnlyError>().is_some());
+
+        let responses::StackTraceResponse { stack_frames } =
+            client.send_typed(requests::StackTrace {
+                thread_id: 1,
+                ..Default::default()
+            })?;
+        assert!(stack_frames.is_empty());
+
+        Ok(())
+    }
+
+    #[test]
+    fn command_override() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect_with_options(
+            events_tx,
+            ClientOptions::default().with_command_override("launch", "vendorLaunch"),
+        )?;
+
+        client.execute(requests::RequestBody::Launch(requests::Launch::default()))?;
+
+        let request = adapter.requests().recv_timeout(Duration::from_secs(1))?;
+        assert_eq!(request["command"], "vendorLaunch");
+        assert_eq!(request["type"], "request");
+
+        Ok(())
+    }
+
+    #[test]
+    fn stdio_adapter_exit() -> eyre::Result<()> {
+        // an adapter which announces the end of the session, then exits
+        let child = std::process::Command::new("sh")
+            .args([
+                "-c",
+                r#"printf 'Content-Length: 37\r\n\r\n{"type":"event","event":"terminated"}'; exit 3"#,
+            ])
+            .stdin(std::process::Stdio::piped())
+            .stdout(std::process::Stdio::piped())
+            .spawn()?;
+
+        let (events_tx, events_rx) = crossbeam_channel::unbounded();
+        let client = Client::from_child(child, events_tx, ClientOptions::default())?;
+
+        let event = events_rx.recv_timeout(Duration::from_secs(5))?;
+        assert!(matches!(event, events::Event::Terminated));
+
+        let start = Instant::now();
+        while client.adapter_exit().is_none() {
+            assert!(
+                start.elapsed() < Duration::from_secs(5),
+                "adapter exit not recorded"
+            );
+            thread::sleep(Duration::from_millis(10));
+        }
+        assert_eq!(client.adapter_exit(), Some(AdapterExit::Exited(Some(3))));
+
+        Ok(())
+    }
+
+    #[test]
+    fn read_failure() -> eyre::Result<()> {
+        let (events_tx, events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+
+        // an unknown message is skipped without ending the session
+        adapter.send_event("notARealEvent", serde_json::Value::Null)?;
+        adapter.send_event("initialized", serde_json::Value::Null)?;
+        let event = events_rx.recv_timeout(Duration::from_secs(1))?;
+        assert!(matches!(event, events::Event::Initialized));
+
+        // the adapter crashes while a request is waiting for its response
+        adapter.enqueue("threads", Reply::no_response());
+        let sender = client.clone();
+        let handle = thread::spawn(move || sender.send(requests::RequestBody::Threads));
+        adapter.requests().recv_timeout(Duration::from_secs(1))?;
+        adapter.fail(std::io::ErrorKind::ConnectionReset)?;
+
+        assert!(handle.join().unwrap().is_err());
+        assert_eq!(
+            client.adapter_exit(),
+            Some(AdapterExit::ReadFailed(std::io::ErrorKind::ConnectionReset))
+        );
+
+        Ok(())
+    }
+
+    #[test]
+    fn protocol_error() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+        adapter.enqueue("threads", Reply::no_response());
+
+        let sender = client.clone();
+        let handle = thread::spawn(move || sender.send(requests::RequestBody::Threads));
+        adapter.requests().recv_timeout(Duration::from_secs(1))?;
+        adapter.send_bytes(b"Content-Length: abc\r\n\r\n{}")?;
+
+        // the waiting request fails rather than waiting forever
+        assert!(handle.join().unwrap().is_err());
+        assert_eq!(client.adapter_exit(), Some(AdapterExit::ProtocolError));
+        let error = client.protocol_error().expect("protocol error");
+        assert_eq!(error.bytes, b"Content-Length: abc");
+
+        Ok(())
+    }
+
+    #[test]
+    fn request_timeout() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect_with_options(
+            events_tx,
+            ClientOptions::default().with_request_timeout(Duration::from_millis(100)),
+        )?;
+
+        // the adapter never responds
+        adapter.enqueue("threads", Reply::no_response());
+        let err = client.send(requests::RequestBody::Threads).unwrap_err();
+        assert!(err.to_string().contains("timed out"), "{err}");
+        Ok(())
+    }
+
+    #[test]
+    fn request_timeout_frees_in_flight_space() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect_with_options(
+            events_tx,
+            ClientOptions::default()
+                .with_request_timeout(Duration::from_millis(100))
+                .with_max_in_flight(1),
+        )?;
+        adapter.enqueue("threads", Reply::no_response());
+        adapter.enqueue("threads", Reply::no_response());
+
+        let (sent_tx, sent_rx) = crossbeam_channel::unbounded();
+        thread::spawn(move || {
+            for _ in 0..3 {
+                let _ = sent_tx.send(client.send(requests::RequestBody::Threads).is_ok());
+            }
+        });
+
+        // each timed out request makes space for the next
+        let answered: Vec<_> = (0..3)
+            .map(|_| sent_rx.recv_timeout(Duration::from_secs(1)))
+            .collect::<Result<_, _>>()?;
+        assert_eq!(answered, [false, false, true]);
+        Ok(())
+    }
+
+    #[test]
+    fn read_deadline() -> eyre::Result<()> {
+        // only connections over TCP have a deadline
+        let port = get_random_tcp_port()?;
+        let server = TcpListener::bind(format!("127.0.0.1:{port}"))?;
+        let stream = TcpStream::connect(format!("127.0.0.1:{port}"))?;
+        let _conn = server.accept()?;
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let client = Client::with_options(
+            stream,
+            events_tx,
+            ClientOptions::default().with_read_deadline(Duration::from_millis(100)),
+        )?;
+
+        // an idle adapter has nothing to send, e.g. while the debuggee runs
+        thread::sleep(Duration::from_millis(300));
+        assert_eq!(client.adapter_exit(), None);
+
+        // a request waiting on the silent adapter fails once the deadline passes
+        let sent_at = Instant::now();
+        let err = client.send(requests::RequestBody::Threads).unwrap_err();
+        assert!(sent_at.elapsed() >= Duration::from_millis(100));
+        assert!(
+            err.to_string().contains("connection to adapter lost"),
+            "{err}"
+        );
+        assert_eq!(
+            client.adapter_exit(),
+            Some(AdapterExit::ReadFailed(std::io::ErrorKind::TimedOut))
+        );
+        Ok(())
+    }
+
+    /// The session ended events sent while `adapter` sends messages
+    fn session_ended(
+        adapter: impl FnOnce(&MockAdapter) -> eyre::Result<()>,
+    ) -> eyre::Result<Vec<events::SessionEndedBody>> {
+        let (events_tx, events_rx) = crossbeam_channel::unbounded();
+        let (_client, mock) = MockAdapter::connect(events_tx)?;
+        adapter(&mock)?;
+
+        let mut ended = Vec::new();
+        while let Ok(event) = events_rx.recv_timeout(Duration::from_millis(200)) {
+            if let events::Event::SessionEnded(body) = event {
+                ended.push(body);
+            }
+        }
+        Ok(ended)
+    }
+
+    #[test]
+    fn session_ended_terminated() -> eyre::Result<()> {
+        let ended = session_ended(|adapter| {
+            adapter.send_event("terminated", serde_json::Value::Null)?;
+            adapter.send_event("terminated", serde_json::Value::Null)
+        })?;
+        assert_eq!(
+            ended,
+            [events::SessionEndedBody {
+                reason: events::SessionEndReason::Terminated,
+                exit_code: None,
+            }]
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn session_ended_debuggee_exited() -> eyre::Result<()> {
+        let ended = session_ended(|adapter| {
+            adapter.send_event("exited", serde_json::json!({ "exitCode": 3 }))?;
+            adapter.send_event("terminated", serde_json::Value::Null)
+        })?;
+        assert_eq!(
+            ended,
+            [events::SessionEndedBody {
+                reason: events::SessionEndReason::Exited,
+                exit_code: Some(3),
+            }]
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn session_ended_restart() -> eyre::Result<()> {
+        let restarts = [
+            (
+                "terminate",
+                requests::RequestBody::Terminate(requests::Terminate {
+                    restart: Some(true),
+                }),
+            ),
+            (
+                "restart",
+                requests::RequestBody::Restart(requests::Restart::default()),
+            ),
+        ];
+        for (command, restart) in restarts {
+            let (events_tx, events_rx) = crossbeam_channel::unbounded();
+            let (client, adapter) = MockAdapter::connect(events_tx)?;
+            // the old debuggee exits and terminates, then the new one is configured
+            adapter.enqueue(
+                command,
+                Reply::success(serde_json::Value::Null)
+                    .event("exited", serde_json::json!({ "exitCode": 0 }))
+                    .event("terminated", serde_json::Value::Null)
+                    .event("initialized", serde_json::Value::Null),
+            );
+            client.send_request(restart, Duration::from_secs(1))?;
+            let mut ended = Vec::new();
+            loop {
+                match events_rx.recv_timeout(Duration::from_secs(1))? {
+                    events::Event::SessionEnded(body) => ended.push(body),
+                    events::Event::Initialized => break,
+                    _ => {}
+                }
+            }
+            assert!(ended.is_empty(), "{ended:?}");
+
+            adapter.send_event("exited", serde_json::json!({ "exitCode": 3 }))?;
+            adapter.send_event("terminated", serde_json::Value::Null)?;
+            // only the restarted debuggee ending ends the session
+            while let Ok(event) = events_rx.recv_timeout(Duration::from_millis(200)) {
+                if let events::Event::SessionEnded(body) = event {
+                    ended.push(body);
+                }
+            }
+            assert_eq!(
+                ended,
+                [events::SessionEndedBody {
+                    reason: events::SessionEndReason::Exited,
+                    exit_code: Some(3),
+                }]
+            );
+        }
+        Ok(())
+    }
+
+    #[test]
+    fn session_ended_adapter_crashed() -> eyre::Result<()> {
+        let ended = session_ended(|adapter| {
+            adapter.send_event("initialized", serde_json::Value::Null)?;
+            adapter.fail(std::io::ErrorKind::ConnectionReset)
+        })?;
+        assert_eq!(
+            ended,
+            [events::SessionEndedBody {
+                reason: events::SessionEndReason::AdapterExited(AdapterExit::ReadFailed(
+                    std::io::ErrorKind::ConnectionReset
+                )),
+                exit_code: None,
+            }]
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn stop() -> eyre::Result<()> {
+        let (events_tx, events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+
+        // a request the adapter never answers
+        adapter.enqueue("threads", Reply::no_response());
+        let sender = client.clone();
+        let handle = thread::spawn(move || sender.send(requests::RequestBody::Threads));
+        adapter.requests().recv_timeout(Duration::from_secs(1))?;
+
+        client.stop()?;
+
+        assert!(handle.join().unwrap().is_err());
+        // the poll thread has exited, dropping the events sender
+        assert!(matches!(
+            events_rx.recv_timeout(Duration::from_secs(1)),
+            Err(crossbeam_channel::RecvTimeoutError::Disconnected)
+        ));
+        // stopping is not the adapter exiting
+        assert_eq!(client.adapter_exit(), None);
+
+        Ok(())
+    }
+
+    #[test]
+    fn send_after_stop() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, _adapter) = MockAdapter::connect_with_options(
+            events_tx,
+            ClientOptions::default().with_max_in_flight(1),
+        )?;
+        client.stop()?;
+
+        // the connection is closed, and each failed request frees its space for the next
+        for _ in 0..2 {
+            assert!(client.send(requests::RequestBody::Threads).is_err());
+            assert!(client.execute(requests::RequestBody::Threads).is_err());
+        }
+        assert_eq!(client.dump_state(), "");
+        Ok(())
+    }
+
+    #[test]
+    fn adapter_hangs_up() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+
+        // a request still waiting when the adapter closes the connection
+        adapter.enqueue("threads", Reply::no_response());
+        let (sent_tx, sent_rx) = crossbeam_channel::unbounded();
+        let sender = client.clone();
+        thread::spawn(move || {
+            let _ = sent_tx.send(sender.send(requests::RequestBody::Threads));
+        });
+        adapter.requests().recv_timeout(Duration::from_secs(1))?;
+
+        adapter.hang_up();
+
+        let err = sent_rx.recv_timeout(Duration::from_secs(1))?.unwrap_err();
+        assert!(
+            err.to_string().contains("connection to adapter lost"),
+            "{err}"
+        );
+        assert_eq!(client.adapter_exit(), Some(AdapterExit::Closed));
+        Ok(())
+    }
+
+    fn initialize_arguments() -> requests::Initialize {
+        requests::Initialize {
+            adapter_id: "dap gui".to_string(),
+            lines_start_at_one: false,
+            path_format: requests::PathFormat::Path,
+            supports_start_debugging_request: true,
+            supports_variable_type: true,
+            supports_variable_paging: true,
+            supports_progress_reporting: true,
+            supports_memory_event: true,
+        }
+    }
+
+    #[test]
+    fn stepping() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+        adapter.enqueue("initialize", Reply::success(serde_json::json!({})));
+        let requests = adapter.requests();
+        let instruction = Some(requests::SteppingGranularity::Instruction);
+
+        // capabilities are not known yet, so the granularity is sent
+        client.next(1, instruction)?;
+        let request = requests.recv_timeout(Duration::from_secs(1))?;
+        assert_eq!(request["command"], "next");
+        assert_eq!(request["arguments"]["granularity"], "instruction");
+
+        client.initialize(initialize_arguments())?;
+        requests.recv_timeout(Duration::from_secs(1))?;
+
+        let err = client.step_in(1, instruction).unwrap_err();
+        assert!(err.to_string().contains("stepping granularity"), "{err}");
+
+        client.step_out(2, None)?;
+        let request = requests.recv_timeout(Duration::from_secs(1))?;
+        assert_eq!(request["command"], "stepOut");
+        assert_eq!(request["arguments"]["threadId"], 2);
+        assert!(request["arguments"].get("granularity").is_none());
+
+        Ok(())
+    }
+
+    /// Run a session with an adapter which answers every request, attaching with `attach` if
+    /// given, then shut it down, returning the requests the adapter received after initialize
+    fn shutdown_session(
+        supports_terminate: bool,
+        attach: Option<serde_json::Value>,
+    ) -> eyre::Result<Vec<serde_json::Value>> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+        adapter.enqueue(
+            "initialize",
+            Reply::success(serde_json::json!({ "supportsTerminateRequest": supports_terminate })),
+        );
+
+        client.initialize(initialize_arguments())?;
+        if let Some(arguments) = attach {
+            client
+                .attach(arguments)?
+                .wait_timeout(Duration::from_secs(1))?;
+            assert!(client.is_attached());
+        }
+        client.shutdown(Duration::from_secs(1))?;
+        Ok(adapter.requests().try_iter().skip(1).collect())
+    }
+
+    #[test]
+    fn shutdown() -> eyre::Result<()> {
+        let requests = shutdown_session(true, None)?;
+        let commands: Vec<_> = requests.iter().map(|r| &r["command"]).collect();
+        assert_eq!(commands, ["terminate", "disconnect"]);
+        assert_eq!(requests[1]["arguments"]["terminateDebuggee"], false);
+
+        // without terminate, the debuggee is terminated when disconnecting
+        let requests = shutdown_session(false, None)?;
+        let commands: Vec<_> = requests.iter().map(|r| &r["command"]).collect();
+        assert_eq!(commands, ["disconnect"]);
+        assert_eq!(requests[0]["arguments"]["terminateDebuggee"], true);
+
+        Ok(())
+    }
+
+    #[test]
+    fn attach() -> eyre::Result<()> {
+        let arguments = serde_json::json!({ "processId": 1234, "justMyCode": false });
+        let requests = shutdown_session(true, Some(arguments.clone()))?;
+
+        assert_eq!(requests[0]["command"], "attach");
+        assert_eq!(requests[0]["arguments"], arguments);
+
+        // the attached debuggee is left running
+        let commands: Vec<_> = requests.iter().map(|r| &r["command"]).collect();
+        assert_eq!(commands, ["attach", "disconnect"]);
+        assert_eq!(requests[1]["arguments"]["terminateDebuggee"], false);
+
+        Ok(())
+    }
+
+    #[test]
+    fn exception_breakpoints() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+        adapter.enqueue(
+            "initialize",
+            Reply::success(serde_json::json!({
+                "exceptionBreakpointFilters": [
+                    { "filter": "raised", "label": "Raised Exceptions", "default": false },
+                    { "filter": "uncaught", "label": "Uncaught Exceptions", "default": true },
+                ],
+            })),
+        );
+
+        client.initialize(initialize_arguments())?;
+        let filters: Vec<_> = client
+            .exception_breakpoint_filters()
+            .into_iter()
+            .map(|filter| filter.filter)
+            .collect();
+        assert_eq!(filters, ["raised", "uncaught"]);
+
+        // debugpy does not send a body
+        client.set_exception_breakpoints(&["uncaught"])?;
+        let request = adapter.requests().try_iter().last().unwrap();
+        assert_eq!(request["command"], "setExceptionBreakpoints");
+        assert_eq!(
+            request["arguments"]["filters"],
+            serde_json::json!(["uncaught"])
+        );
+
+        let err = client
+            .set_exception_breakpoints(&["userUnhandled"])
+            .unwrap_err();
+        assert!(err.to_string().contains("userUnhandled"), "{err}");
+        Ok(())
+    }
+
+    #[test]
+    fn session_state() -> eyre::Result<()> {
+        let (events_tx, events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+        assert_eq!(client.state(), SessionState::Uninitialized);
+
+        // rejected without being sent
+        let err = client
+            .send(requests::RequestBody::ConfigurationDone)
+            .unwrap_err();
+        assert!(err.downcast_ref::<OutOfOrderError>().is_some(), "{err}");
+        assert!(adapter.requests().try_recv().is_err());
+
+        adapter.send_event("initialized", serde_json::Value::Null)?;
+        events_rx.recv_timeout(Duration::from_secs(1))?;
+        assert_eq!(client.state(), SessionState::Initialized);
+
+        client.send(requests::RequestBody::ConfigurationDone)?;
+        assert_eq!(client.state(), SessionState::Running);
+
+        adapter.send_event(
+            "stopped",
+            serde_json::json!({ "reason": "breakpoint", "threadId": 1 }),
+        )?;
+        events_rx.recv_timeout(Duration::from_secs(1))?;
+        assert_eq!(client.state(), SessionState::Stopped);
+
+        client.execute(requests::RequestBody::Continue(requests::Continue {
+            thread_id: 1,
+            single_thread: false,
+        }))?;
+        assert_eq!(client.state(), SessionState::Running);
+        Ok(())
+    }
+
+    #[test]
+    fn thread_stopped_state() -> eyre::Result<()> {
+        let (events_tx, events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+        adapter.enqueue(
+            "threads",
+            Reply::success(serde_json::json!({
+                "threads": [{ "id": 1, "name": "MainThread" }, { "id": 2, "name": "worker" }],
+            })),
+        );
+
+        let threads = client.threads()?;
+        assert_eq!(threads.len(), 2);
+        assert!(!client.is_stopped(1));
+
+        adapter.send_event(
+            "stopped",
+            serde_json::json!({ "reason": "breakpoint", "threadId": 2, "allThreadsStopped": true }),
+        )?;
+        events_rx.recv_timeout(Duration::from_secs(1))?;
+        assert!(client.is_stopped(1));
+        assert!(client.is_stopped(2));
+
+        adapter.send_event(
+            "continued",
+            serde_json::json!({ "threadId": 2, "allThreadsContinued": false }),
+        )?;
+        events_rx.recv_timeout(Duration::from_secs(1))?;
+        assert!(client.is_stopped(1));
+        assert!(!client.is_stopped(2));
+        Ok(())
+    }
+
+    #[test]
+    fn restart() -> eyre::Result<()> {
+        let launch = requests::RequestBody::Launch(requests::Launch {
+            program: "/app/main.py".into(),
+            ..Default::default()
+        });
+        let commands = |adapter: &MockAdapter| -> Vec<_> {
+            adapter
+                .requests()
+                .try_iter()
+                .map(|request| request["command"].clone())
+                .collect()
+        };
+
+        // native restart
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+        adapter.enqueue(
+            "initialize",
+            Reply::success(serde_json::json!({ "supportsRestartRequest": true })),
+        );
+        client.initialize(initialize_arguments())?;
+        client.execute(launch.clone())?;
+        client.restart()?;
+        assert_eq!(commands(&adapter), ["initialize", "launch", "restart"]);
+
+        // terminate, then launch and configure again
+        let (events_tx, events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+        adapter.enqueue("initialize", Reply::success(serde_json::json!({})));
+        for _ in 0..2 {
+            adapter.enqueue(
+                "launch",
+                Reply::success(serde_json::Value::Null)
+                    .event("initialized", serde_json::Value::Null),
+            );
+            adapter.enqueue(
+                "setBreakpoints",
+                Reply::success(serde_json::json!({ "breakpoints": [{ "verified": true }] })),
+            );
+        }
+        adapter.enqueue(
+            "terminate",
+            Reply::success(serde_json::Value::Null).event("terminated", serde_json::Value::Null),
+        );
+        client.initialize(initialize_arguments())?;
+        client.execute(launch)?;
+        while !matches!(
+            events_rx.recv_timeout(Duration::from_secs(1))?,
+            events::Event::Initialized
+        ) {}
+        client.set_breakpoints(
+            types::Source {
+                path: Some("/app/main.py".into()),
+                ..Default::default()
+            },
+            &[4],
+        )?;
+        client.send(requests::RequestBody::ConfigurationDone)?;
+        client.restart()?;
+
+        let requests: Vec<_> = adapter.requests().try_iter().collect();
+        let commands: Vec<_> = requests.iter().map(|r| r["command"].clone()).collect();
+        assert_eq!(
+            commands,
+            [
+                "initialize",
+                "launch",
+                "setBreakpoints",
+                "configurationDone",
+                "terminate",
+                "launch",
+                "setBreakpoints",
+                "configurationDone",
+            ]
+        );
+        assert_eq!(requests[4]["arguments"]["restart"], true);
+        assert_eq!(requests[5]["arguments"], requests[1]["arguments"]);
+        // the breakpoints survive the restart
+        assert_eq!(requests[6]["arguments"], requests[2]["arguments"]);
+        Ok(())
+    }
+
+    #[test]
+    fn restart_without_launch() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+        adapter.enqueue("initialize", Reply::success(serde_json::json!({})));
+        client.initialize(initialize_arguments())?;
+
+        let err = client.restart().unwrap_err();
+        assert!(err.to_string().contains("launched"), "{err}");
+        Ok(())
+    }
+
+    #[test]
+    fn pause() -> eyre::Result<()> {
+        let (events_tx, events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+        adapter.enqueue(
+            "pause",
+            Reply::success(serde_json::Value::Null).event(
+                "stopped",
+                serde_json::json!({ "reason": "pause", "threadId": 1 }),
+            ),
+        );
+
+        client.pause(1)?;
+        let request = adapter.requests().recv_timeout(Duration::from_secs(1))?;
+        assert_eq!(request["command"], "pause");
+        assert_eq!(request["arguments"], serde_json::json!({ "threadId": 1 }));
+
+        let event = events_rx.recv_timeout(Duration::from_secs(1))?;
+        let events::Event::Stopped(body) = event else {
+            panic!("expected stopped event, got {event:?}");
+        };
+        assert!(matches!(body.reason, events::StoppedReason::Other(reason) if reason == "pause"));
+        assert!(client.is_stopped(1));
+        Ok(())
+    }
+
+    #[test]
+    fn set_variable() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+        adapter.enqueue("initialize", Reply::success(serde_json::json!({})));
+        client.initialize(initialize_arguments())?;
+
+        // not advertised by the adapter
+        let err = client.set_variable(10, "counter", "1000").unwrap_err();
+        assert_eq!(
+            err.downcast_ref::<UnsupportedError>(),
+            Some(&UnsupportedError {
+                feature: "setting variables"
+            })
+        );
+        assert_eq!(adapter.requests().try_iter().count(), 1);
+
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+        adapter.enqueue(
+            "initialize",
+            Reply::success(serde_json::json!({ "supportsSetVariable": true })),
+        );
+        adapter.enqueue(
+            "setVariable",
+            Reply::success(serde_json::json!({ "value": "1000", "type": "int" })),
+        );
+        client.initialize(initialize_arguments())?;
+
+        let response = client.set_variable(10, "counter", "1000")?;
+        assert_eq!(response.value, "1000");
+        let request = adapter.requests().try_iter().last().unwrap();
+        assert_eq!(
+            request["arguments"],
+            serde_json::json!({ "variablesReference": 10, "name": "counter", "value": "1000" })
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn evaluate() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+        adapter.enqueue(
+            "evaluate",
+            Reply::success(serde_json::json!({
+                "result": "{...}",
+                "type": "dict",
+                "variablesReference": 12,
+            })),
+        );
+        adapter.enqueue(
+            "variables",
+            Reply::success(serde_json::json!({
+                "variables": [{ "name": "'a'", "value": "1", "variablesReference": 0 }],
+            })),
+        );
+
+        let response = client.evaluate("config", Some(3), requests::EvaluateContext::Watch)?;
+        assert_eq!(response.result, "{...}");
+        assert_eq!(response.r#type.as_deref(), Some("dict"));
+
+        let request = adapter.requests().recv_timeout(Duration::from_secs(1))?;
+        assert_eq!(request["command"], "evaluate");
+        assert_eq!(request["arguments"]["expression"], "config");
+        assert_eq!(request["arguments"]["frameId"], 3);
+        assert_eq!(request["arguments"]["context"], "watch");
+
+        // the structured result can be expanded
+        let responses::VariablesResponse { variables } =
+            client.send_typed(requests::Variables {
+                variables_reference: response.variables_reference,
+                format: None,
+            })?;
+        assert_eq!(variables[0].name, "'a'");
+
+        Ok(())
+    }
+
+    #[test]
+    fn initialize() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+        adapter.enqueue(
+            "initialize",
+            Reply::success(serde_json::json!({ "supportsConfigurationDoneRequest": true })),
+        );
+        assert!(client.capabilities().is_none());
+
+        let capabilities = client.initialize(initialize_arguments())?;
+        assert_eq!(capabilities.supports_configuration_done_request, Some(true));
+
+        // shared with clones of the client
+        let stored = client.clone().capabilities().expect("capabilities stored");
+        assert_eq!(stored.supports_configuration_done_request, Some(true));
+
+        Ok(())
+    }
+
+    #[test]
+    fn spawn_records_stderr() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let client = Client::spawn(
+            std::process::Command::new("sh")
+                .args(["-c", "echo adapter starting >&2; exec sleep 30"]),
+            events_tx,
+            ClientOptions::default().with_recording(),
+        )?;
+
+        let start = Instant::now();
+        loop {
+            let mut fixture = Vec::new();
+            client.export_fixture(&mut fixture)?;
+            if let Some(entry) = transcript(&fixture)?.first() {
+                assert_eq!(entry["stderr"], "adapter starting");
+                break;
+            }
+            assert!(
+                start.elapsed() < Duration::from_secs(5),
+                "stderr not recorded"
+            );
+            thread::sleep(Duration::from_millis(10));
+        }
+
+        client.kill_adapter()?;
+        Ok(())
+    }
+
+    #[test]
+    fn spawn_and_kill_adapter() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let client = Client::spawn(
+            std::process::Command::new("sh").args(["-c", "exec sleep 30"]),
+            events_tx,
+            ClientOptions::default(),
+        )?;
+        assert!(client.adapter_process_id().is_some());
+        assert_eq!(client.adapter_exit(), None);
+
+        client.kill_adapter()?;
+
+        let start = Instant::now();
+        while client.adapter_exit().is_none() {
+            assert!(
+                start.elapsed() < Duration::from_secs(5),
+                "adapter exit not recorded"
+            );
+            thread::sleep(Duration::from_millis(10));
+        }
+        // killed by a signal, so there is no exit code
+        assert_eq!(client.adapter_exit(), Some(AdapterExit::Exited(None)));
+
+        Ok(())
+    }
+
+    #[test]
+    fn set_breakpoints() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+        adapter.enqueue(
+            "setBreakpoints",
+            Reply::success(serde_json::json!({
+                "breakpoints": [
+                    { "verified": true, "line": 42 },
+                    { "verified": false, "message": "no code" },
+                ],
+            })),
+        );
+
+        let source = crate::types::Source {
+            path: Some("/main.py".into()),
+            ..Default::default()
+        };
+        let responses::SetBreakpoints { breakpoints } =
+            client.set_breakpoints(source, &[42, 50])?;
+        assert!(breakpoints[0].verified);
+        assert_eq!(breakpoints[0].line, Some(42));
+        assert!(!breakpoints[1].verified);
+
+        let request = adapter.requests().recv_timeout(Duration::from_secs(1))?;
+        assert_eq!(request["command"], "setBreakpoints");
+        let lines: Vec<_> = request["arguments"]["breakpoints"]
+            .as_array()
+            .unwrap()
+            .iter()
+            .map(|breakpoint| breakpoint["line"].clone())
+            .collect();
+        assert_eq!(lines, [42, 50]);
+
+        Ok(())
+    }
+
+    #[test]
+    fn session_tags() -> eyre::Result<()> {
+        let logger = RecordingLogger::default();
+        let start_session = |name: &str| {
+            let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+            MockAdapter::connect_with_options(
+                events_tx,
+                ClientOptions::default()
+                    .with_recording()
+                    .with_session(name)
+                    .with_logger(tracing::Dispatch::new(logger.clone())),
+            )
+        };
+
+        let (first, _first_adapter) = start_session("first")?;
+        let (second, _second_adapter) = start_session("second")?;
+        first.send(requests::RequestBody::Threads)?;
+        second.send(requests::RequestBody::Threads)?;
+        second.record_stderr("adapter log line");
+
+        for (client, name, count) in [(first, "first", 2), (second, "second", 3)] {
+            let mut fixture = Vec::new();
+            client.export_fixture(&mut fixture)?;
+
+            let entries = transcript(&fixture)?;
+            assert_eq!(entries.len(), count);
+            assert!(entries.iter().all(|entry| entry["session"] == name));
+
+            // the tags do not interfere with loading the messages
+            assert_eq!(load_fixture(fixture.as_slice())?.len(), 2);
+        }
+
+        // log output is tagged with the session, whether sending or receiving
+        let logged = logger.logged();
+        for name in ["first", "second"] {
+            let session = format!("session={name}");
+            for message in ["sending message", "received message"] {
+                assert!(
+                    logged
+                        .iter()
+                        .any(|logged| logged.message == message && logged.spans.contains(&session)),
+                    "no {message:?} in {session}: {logged:?}"
+                );
+            }
+        }
+
+        Ok(())
+    }
+
+    #[test]
+    fn send_request() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+        adapter.enqueue(
+            "threads",
+            Reply::success(serde_json::json!({ "threads": [] })),
+        );
+        adapter.enqueue("scopes", Reply::failure("bad frame"));
+        // never answered
+        adapter.enqueue("loadedSources", Reply::no_response());
+        let timeout = Duration::from_millis(200);
+
+        let response = client.send_request(requests::RequestBody::Threads, timeout)?;
+        assert!(matches!(
+            response,
+            Some(responses::ResponseBody::Threads(_))
+        ));
+
+        let err = client
+            .send_request(
+                requests::RequestBody::Scopes(requests::Scopes { frame_id: 1 }),
+                timeout,
+            )
+            .unwrap_err();
+        assert!(err.to_string().contains("bad frame"));
+
+        let err = client
+            .send_request(requests::RequestBody::LoadedSources, timeout)
+            .unwrap_err();
+        assert!(err.to_string().contains("timed out"));
+
+        Ok(())
+    }
 }
@@ -0,0 +1,351 @@
+//! Running the whole configuration handshake which starts every session
+//!
+//! `initialize` → `launch`/`attach` → (wait for the `initialized` event) → breakpoints →
+//! `configurationDone`
+use std::time::Duration;
+
+use eyre::{Result, WrapErr};
+
+use crate::{client::EventWaiter, requests, Client};
+
+/// How long to wait for each step of the handshake by default
+const DEFAULT_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// Everything needed to configure a session, see [`Client::configure`]
+#[derive(Debug, Clone)]
+pub struct SessionConfig {
+    pub initialize: requests::Initialize,
+    /// The launch or attach request
+    pub launch: requests::RequestBody,
+    /// Source breakpoints, one request per source
+    pub breakpoints: Vec<requests::SetBreakpoints>,
+    /// The names of functions to break on
+    pub function_breakpoints: Vec<String>,
+    /// The exception filters to break on, e.g. `uncaught`
+    pub exception_filters: Vec<String>,
+    /// How long to wait for the initialized event, and for each response
+    pub timeout: Duration,
+}
+
+impl SessionConfig {
+    /// A configuration which launches or attaches with `launch`, without any breakpoints
+    pub fn new(initialize: requests::Initialize, launch: requests::RequestBody) -> Self {
+        Self {
+            initialize,
+            launch,
+            breakpoints: Vec::new(),
+            function_breakpoints: Vec::new(),
+            exception_filters: Vec::new(),
+            timeout: DEFAULT_TIMEOUT,
+        }
+    }
+}
+
+/// The requests which set up the session, to set it up again in the same way, e.g. after
+/// reconnecting or when restarting
+#[derive(Debug, Clone, Default)]
+pub(crate) struct Replay {
+    initialize: Option<requests::RequestBody>,
+    /// The launch or attach request
+    launch: Option<requests::RequestBody>,
+    /// The latest breakpoints request of each kind, and for source breakpoints each source
+    breakpoints: Vec<(String, requests::RequestBody)>,
+    pub(crate) configuration_done: bool,
+}
+
+impl Replay {
+    pub(crate) fn record(&mut self, body: &requests::RequestBody) {
+        let key = match body {
+            requests::RequestBody::Initialize(_) => {
+                self.initialize = Some(body.clone());
+                return;
+            }
+            requests::RequestBody::Launch(_)
+            | requests::RequestBody::Attach(_)
+            | requests::RequestBody::RawAttach(_) => {
+                self.launch = Some(body.clone());
+                return;
+            }
+            requests::RequestBody::ConfigurationDone => {
+                self.configuration_done = true;
+                return;
+            }
+            requests::RequestBody::SetBreakpoints(request) => {
+                format!("source:{:?}", request.source.path)
+            }
+            requests::RequestBody::SetFunctionBreakpoints(_) => "function".to_string(),
+            requests::RequestBody::SetExceptionBreakpoints(_) => "exception".to_string(),
+            _ => return,
+        };
+        match self.breakpoints.iter_mut().find(|(k, _)| *k == key) {
+            Some((_, request)) => *request = body.clone(),
+            None => self.breakpoints.push((key, body.clone())),
+        }
+    }
+
+    /// The initialize request, if it has been sent
+    pub(crate) fn initialize(&self) -> Option<&requests::RequestBody> {
+        self.initialize.as_ref()
+    }
+
+    /// The configuration which sets up the session again, once it has been launched or
+    /// attached
+    pub(crate) fn config(&self) -> Option<SessionConfig> {
+        let (Some(requests::RequestBody::Initialize(initialize)), Some(launch)) =
+            (&self.initialize, &self.launch)
+        else {
+            return None;
+        };
+        let mut config = SessionConfig::new(initialize.clone(), launch.clone());
+        for (_, request) in &self.breakpoints {
+            match request {
+                requests::RequestBody::SetBreakpoints(request) => {
+                    config.breakpoints.push(request.clone())
+                }
+                requests::RequestBody::SetFunctionBreakpoints(request) => {
+                    config.function_breakpoints =
+                        request.breakpoints.iter().map(|b| b.name.clone()).collect();
+                }
+                requests::RequestBody::SetExceptionBreakpoints(request) => {
+                    config.exception_filters = request.filters.clone();
+                }
+                _ => {}
+            }
+        }
+        Some(config)
+    }
+}
+
+impl Client {
+    /// Run the configuration handshake, returning once the adapter is ready to run the
+    /// debuggee
+    ///
+    /// Breakpoints are only sent once the adapter has sent the initialized event, and
+    /// `configurationDone` is sent last. Many adapters, e.g. debugpy, only respond to the launch
+    /// request once configuration is done, so its response is waited for at the end.
+    pub fn configure(&self, config: SessionConfig) -> Result<()> {
+        self.configure_session(config, true)
+    }
+
+    /// Run the configuration handshake, only finishing with `configurationDone` if
+    /// `configuration_done`, e.g. when replaying a session which was still being configured
+    pub(crate) fn configure_session(
+        &self,
+        config: SessionConfig,
+        configuration_done: bool,
+    ) -> Result<()> {
+        eyre::ensure!(
+            matches!(
+                config.launch,
+                requests::RequestBody::Launch(_)
+                    | requests::RequestBody::Attach(_)
+                    | requests::RequestBody::RawAttach(_)
+            ),
+            "session must be configured with a launch or attach request"
+        );
+
+        // registered before anything is sent, so the event cannot be missed
+        let initialized = EventWaiter::new(self, "initialized");
+        // the client records the capabilities from the response
+        self.send_request(
+            requests::RequestBody::Initialize(config.initialize.clone()),
+            config.timeout,
+        )
+        .context("sending initialize request")?;
+        self.launch_configured(config, &initialized, configuration_done)
+    }
+
+    /// Send the launch or attach request, then once `initialized` has received the initialized
+    /// event set the breakpoints, and if `configuration_done` finish configuring
+    pub(crate) fn launch_configured(
+        &self,
+        config: SessionConfig,
+        initialized: &EventWaiter<'_>,
+        configuration_done: bool,
+    ) -> Result<()> {
+        let launch = self
+            .send_pending(config.launch)
+            .context("sending launch request")?;
+        initialized
+            .wait(config.timeout)
+            .context("waiting for initialized event")?;
+
+        for breakpoints in config.breakpoints {
+            self.send_request(
+                requests::RequestBody::SetBreakpoints(breakpoints),
+                config.timeout,
+            )
+            .context("sending set breakpoints request")?;
+        }
+        if !config.function_breakpoints.is_empty() {
+            let supported = self.capabilities().is_some_and(|capabilities| {
+                capabilities.supports_function_breakpoints.unwrap_or(false)
+            });
+            eyre::ensure!(supported, "adapter does not support function breakpoints");
+            self.send_request(
+                requests::RequestBody::SetFunctionBreakpoints(requests::SetFunctionBreakpoints {
+                    breakpoints: config
+                        .function_breakpoints
+                        .into_iter()
+                        .map(|name| requests::Breakpoint { name })
+                        .collect(),
+                }),
+                config.timeout,
+            )
+            .context("sending set function breakpoints request")?;
+        }
+        if !config.exception_filters.is_empty() {
+            self.check_exception_filters(&config.exception_filters)?;
+            self.send_request(
+                requests::RequestBody::SetExceptionBreakpoints(requests::SetExceptionBreakpoints {
+                    filters: config.exception_filters,
+                }),
+                config.timeout,
+            )
+            .context("sending set exception breakpoints request")?;
+        }
+        if !configuration_done {
+            return Ok(());
+        }
+
+        self.send_request(requests::RequestBody::ConfigurationDone, config.timeout)
+            .context("sending configuration done request")?;
+        let response = launch
+            .wait_response(config.timeout)
+            .context("waiting for launch response")?;
+        eyre::ensure!(
+            response.success,
+            "launch failed: {}",
+            response.message.as_deref().unwrap_or("no reason given")
+        );
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::Duration;
+
+    use serde_json::json;
+
+    use super::SessionConfig;
+    use crate::{
+        mock::{MockAdapter, Reply},
+        requests,
+        types::Source,
+    };
+
+    fn config() -> SessionConfig {
+        let mut config = SessionConfig::new(
+            requests::Initialize {
+                adapter_id: "dap gui".to_string(),
+                lines_start_at_one: false,
+                path_format: requests::PathFormat::Path,
+                supports_start_debugging_request: true,
+                supports_variable_type: true,
+                supports_variable_paging: true,
+                supports_progress_reporting: true,
+                supports_memory_event: true,
+            },
+            requests::RequestBody::Launch(requests::Launch::default()),
+        );
+        config.timeout = Duration::from_millis(500);
+        config
+    }
+
+    #[test]
+    fn configure() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+        adapter.enqueue(
+            "initialize",
+            Reply::success(json!({
+                "supportsFunctionBreakpoints": true,
+                "exceptionBreakpointFilters": [{ "filter": "uncaught", "label": "Uncaught" }],
+            })),
+        );
+        adapter.enqueue(
+            "launch",
+            Reply::success(serde_json::Value::Null).event("initialized", serde_json::Value::Null),
+        );
+
+        let mut config = config();
+        config.breakpoints = ["/a.py", "/b.py"]
+            .into_iter()
+            .map(|path| requests::SetBreakpoints {
+                source: Source {
+                    path: Some(path.into()),
+                    ..Default::default()
+                },
+                lines: Some(vec![4]),
+                ..Default::default()
+            })
+            .collect();
+        config.function_breakpoints = vec!["main".to_string()];
+        config.exception_filters = vec!["uncaught".to_string()];
+        client.configure(config)?;
+
+        let commands: Vec<_> = adapter
+            .requests()
+            .try_iter()
+            .map(|request| request["command"].clone())
+            .collect();
+        assert_eq!(
+            commands,
+            [
+                "initialize",
+                "launch",
+                "setBreakpoints",
+                "setBreakpoints",
+                "setFunctionBreakpoints",
+                "setExceptionBreakpoints",
+                "configurationDone",
+            ]
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn exception_breakpoints_timeout() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+        adapter.enqueue(
+            "initialize",
+            Reply::success(json!({
+                "exceptionBreakpointFilters": [{ "filter": "uncaught", "label": "Uncaught" }],
+            })),
+        );
+        adapter.enqueue(
+            "launch",
+            Reply::success(serde_json::Value::Null).event("initialized", serde_json::Value::Null),
+        );
+        adapter.enqueue("setExceptionBreakpoints", Reply::no_response());
+
+        let mut config = config();
+        config.exception_filters = vec!["uncaught".to_string()];
+        let err = client.configure(config).unwrap_err();
+        assert!(
+            format!("{err:#}").contains("set exception breakpoints"),
+            "{err:#}"
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn no_initialized_event() -> eyre::Result<()> {
+        let (events_tx, _events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+        adapter.enqueue("initialize", Reply::success(json!({})));
+
+        let err = client.configure(config()).unwrap_err();
+        assert!(err.to_string().contains("initialized"), "{err}");
+        // nothing is configured
+        let commands: Vec<_> = adapter
+            .requests()
+            .try_iter()
+            .map(|request| request["command"].clone())
+            .collect();
+        assert_eq!(commands, ["initialize", "launch"]);
+        Ok(())
+    }
+}
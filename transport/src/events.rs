@@ -1,7 +1,7 @@
 //! Events emitted by a DAP server
 use serde::{Deserialize, Serialize};
 
-use crate::types::{BreakpointId, Module, Source, ThreadId};
+use crate::types::{Breakpoint, BreakpointId, Module, Source, ThreadId};
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
 #[serde(tag = "event", content = "body", rename_all = "camelCase")]
@@ -17,15 +17,74 @@ pub enum Event {
     Terminated,
     // TODO: handle unknown event types
     // debugpy types
-    DebugpyWaitingForServer { host: String, port: u16 },
+    DebugpyWaitingForServer {
+        host: String,
+        port: u16,
+    },
     Module(ModuleEventBody),
+    Breakpoint(BreakpointEventBody),
+    // synthetic events, not sent by adapters
+    /// The connection to the adapter was lost, and reconnection attempt `attempt` is starting,
+    /// see [`crate::ResilientClient`]
+    #[serde(skip)]
+    Reconnecting {
+        attempt: u32,
+    },
+    /// The connection to the adapter was re-established and the session restored
+    #[serde(skip)]
+    Reconnected,
+    /// The session is over, sent exactly once however it ended
+    #[serde(skip)]
+    SessionEnded(SessionEndedBody),
+}
+
+impl Event {
+    /// The name of the event in the protocol, e.g. `stopped`
+    pub fn name(&self) -> &'static str {
+        match self {
+            Event::Initialized => "initialized",
+            Event::Output(_) => "output",
+            Event::Process(_) => "process",
+            Event::Stopped(_) => "stopped",
+            Event::Continued(_) => "continued",
+            Event::Thread(_) => "thread",
+            Event::Exited(_) => "exited",
+            Event::Terminated => "terminated",
+            Event::DebugpyWaitingForServer { .. } => "debugpyWaitingForServer",
+            Event::Module(_) => "module",
+            Event::Breakpoint(_) => "breakpoint",
+            Event::Reconnecting { .. } => "reconnecting",
+            Event::Reconnected => "reconnected",
+            Event::SessionEnded(_) => "sessionEnded",
+        }
+    }
+}
+
+/// Why a session ended, see [`Event::SessionEnded`]
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum SessionEndReason {
+    /// The adapter ended the session without the debuggee reporting its exit
+    Terminated,
+    /// The debuggee exited
+    Exited,
+    /// The client disconnected from the adapter
+    Disconnected,
+    /// The adapter went away without ending the session, e.g. because it crashed
+    AdapterExited(crate::AdapterExit),
+}
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct SessionEndedBody {
+    pub reason: SessionEndReason,
+    /// The exit code of the debuggee, if it reported one
+    pub exit_code: Option<i64>,
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct OutputEventBody {
-    // pub category: Option<OutputEventCategory>,
+    pub category: Option<OutputEventCategory>,
     pub output: String,
-    // pub group: Option<OutputEventGroup>,
+    pub group: Option<OutputEventGroup>,
     pub variables_reference: Option<i64>,
     pub source: Option<Source>,
     pub line: Option<i64>,
@@ -33,6 +92,59 @@ pub struct OutputEventBody {
     // pub data: Option<Value>,
 }
 
+/// The kind of output, e.g. whether it was written to stdout or stderr by the debugee
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(from = "String", into = "String")]
+pub enum OutputEventCategory {
+    /// Messages from the adapter, e.g. that the debugee has started
+    Console,
+    /// Messages which should stand out, e.g. a warning from the adapter
+    Important,
+    Stdout,
+    Stderr,
+    /// Usage data which should not be shown to the user
+    Telemetry,
+    Other(String),
+}
+
+impl From<String> for OutputEventCategory {
+    fn from(value: String) -> Self {
+        match value.as_str() {
+            "console" => Self::Console,
+            "important" => Self::Important,
+            "stdout" => Self::Stdout,
+            "stderr" => Self::Stderr,
+            "telemetry" => Self::Telemetry,
+            _ => Self::Other(value),
+        }
+    }
+}
+
+impl From<OutputEventCategory> for String {
+    fn from(value: OutputEventCategory) -> Self {
+        match value {
+            OutputEventCategory::Console => "console".to_string(),
+            OutputEventCategory::Important => "important".to_string(),
+            OutputEventCategory::Stdout => "stdout".to_string(),
+            OutputEventCategory::Stderr => "stderr".to_string(),
+            OutputEventCategory::Telemetry => "telemetry".to_string(),
+            OutputEventCategory::Other(other) => other,
+        }
+    }
+}
+
+/// Grouping of output events into collapsible sections
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub enum OutputEventGroup {
+    /// Start a new group, expanded by default
+    Start,
+    /// Start a new group, collapsed by default
+    StartCollapsed,
+    /// End the current group
+    End,
+}
+
 #[derive(Debug, Clone, Serialize, Deserialize)]
 #[serde(untagged)]
 pub enum StoppedReason {
@@ -51,6 +163,7 @@ pub struct StoppedEventBody {
     pub hit_breakpoint_ids: Option<Vec<BreakpointId>>,
     pub description: Option<String>,
     pub text: Option<String>,
+    pub all_threads_stopped: Option<bool>,
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
@@ -68,7 +181,10 @@ pub struct ProcessEventBody {
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
-pub struct ExitedEventBody {}
+#[serde(rename_all = "camelCase")]
+pub struct ExitedEventBody {
+    pub exit_code: i64,
+}
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
 #[serde(rename_all = "camelCase")]
@@ -77,6 +193,16 @@ pub struct ContinuedEventBody {
     pub all_threads_continued: Option<bool>,
 }
 
+/// A breakpoint was added, changed or removed by the adapter, e.g. a data breakpoint which
+/// became invalid when its variable went out of scope
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct BreakpointEventBody {
+    // TODO: enum
+    pub reason: String,
+    pub breakpoint: Breakpoint,
+}
+
 #[derive(Debug, Clone, Serialize, Deserialize)]
 #[serde(rename_all = "camelCase")]
 pub struct ModuleEventBody {
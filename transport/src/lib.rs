@@ -2,20 +2,43 @@
 //!
 //! This crate contains code to create a DAP client.
 pub mod bindings;
+mod capture;
 mod client;
+mod configure;
 pub mod events;
+pub mod mock;
+mod null;
 #[cfg(nom)]
 mod parse;
 pub mod reader;
+mod recorder;
 mod request_store;
 pub mod requests;
+mod resilient;
 pub mod responses;
+mod session;
+mod threads;
 pub mod types;
 
+pub use capture::Capture;
+pub use client::AdapterExit;
 pub use client::Client;
+pub use client::ClientOptions;
+pub use client::HandlerId;
 pub use client::Message;
+pub use client::PendingResponse;
+pub use client::ReadOnlyError;
 pub use client::Received;
+pub use client::UnsupportedError;
+pub use client::DEFAULT_READER_BUFFER_SIZE;
+pub use configure::SessionConfig;
+pub use reader::ProtocolError;
 pub use reader::Reader;
+pub use recorder::load_fixture;
+pub use resilient::ReconnectPolicy;
+pub use resilient::ResilientClient;
+pub use session::OutOfOrderError;
+pub use session::SessionState;
 
 /// The default port the DAP protocol listens on
 pub const DEFAULT_DAP_PORT: u16 = 5678;
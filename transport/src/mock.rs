@@ -0,0 +1,461 @@
+//! A scriptable in-memory adapter, so clients can be tested without running a real debug
+//! adapter such as debugpy
+//!
+//! Tests enqueue the replies to send for each command, or replay a recorded session, and can
+//! inspect every request the adapter received exactly as it was serialized.
+use std::{
+    collections::{HashMap, VecDeque},
+    io::{self, BufRead, BufReader},
+    sync::{
+        atomic::{AtomicI64, Ordering},
+        Arc, Mutex,
+    },
+    thread,
+};
+
+use serde_json::{json, Value};
+
+use crate::client::AdapterExit;
+use crate::null::{ChannelReader, ChannelWriter, Chunk};
+use crate::{events, types, Client, ClientOptions, Message};
+
+/// The messages an adapter sends in reply to a single request
+#[derive(Debug, Clone)]
+pub struct Reply {
+    /// The body of a successful response, or the message of a failed one, or `None` to never
+    /// respond
+    response: Option<Result<Value, String>>,
+    /// Events sent after the response
+    events: Vec<(String, Value)>,
+}
+
+impl Reply {
+    /// A successful response with `body`
+    pub fn success(body: Value) -> Self {
+        Self {
+            response: Some(Ok(body)),
+            events: Vec::new(),
+        }
+    }
+
+    /// An unsuccessful response, with the reason the request failed
+    pub fn failure(message: impl Into<String>) -> Self {
+        Self {
+            response: Some(Err(message.into())),
+            events: Vec::new(),
+        }
+    }
+
+    /// No response at all, like a hung adapter
+    pub fn no_response() -> Self {
+        Self {
+            response: None,
+            events: Vec::new(),
+        }
+    }
+
+    /// Also send the event `event`, after the response
+    pub fn event(mut self, event: impl Into<String>, body: Value) -> Self {
+        self.events.push((event.into(), body));
+        self
+    }
+}
+
+/// Replies waiting to be sent, by command
+type Script = Arc<Mutex<HashMap<String, VecDeque<Reply>>>>;
+
+/// Computes the messages sent in reply to a request, in place of the scripted replies
+type Responder = Box<dyn Fn(&Value) -> Vec<Value> + Send>;
+
+/// The adapter's half of the connection to the client
+struct Connection {
+    /// `None` once either side has hung up
+    output: Mutex<Option<crossbeam_channel::Sender<Chunk>>>,
+    seq: AtomicI64,
+}
+
+impl Connection {
+    /// Send a whole message at once, so messages from different threads are not interleaved
+    fn send(&self, message: &Value) -> eyre::Result<()> {
+        let body = message.to_string();
+        self.send_chunk(Ok(format!(
+            "Content-Length: {}\r\n\r\n{}",
+            body.len(),
+            body
+        )
+        .into_bytes()))
+    }
+
+    fn send_chunk(&self, chunk: Chunk) -> eyre::Result<()> {
+        self.output
+            .lock()
+            .unwrap()
+            .as_ref()
+            .and_then(|output| output.send(chunk).ok())
+            .ok_or_else(|| eyre::eyre!("client disconnected"))
+    }
+
+    fn next_seq(&self) -> i64 {
+        self.seq.fetch_add(1, Ordering::SeqCst) + 1
+    }
+
+    /// Send the messages of `reply` to `request`
+    fn reply(&self, request: &Value, reply: Reply) -> eyre::Result<()> {
+        if let Some(response) = reply.response {
+            let (success, body, message) = match response {
+                Ok(body) => (true, body, Value::Null),
+                Err(message) => (false, Value::Null, Value::String(message)),
+            };
+            self.send(&json!({
+                "seq": self.next_seq(),
+                "type": "response",
+                "request_seq": request["seq"],
+                "success": success,
+                "command": request["command"],
+                "message": message,
+                "body": body,
+            }))?;
+        }
+        for (event, body) in reply.events {
+            self.event(&event, body)?;
+        }
+        Ok(())
+    }
+
+    fn event(&self, event: &str, body: Value) -> eyre::Result<()> {
+        self.send(&json!({
+            "seq": self.next_seq(),
+            "type": "event",
+            "event": event,
+            "body": body,
+        }))
+    }
+}
+
+/// The adapter side of a client created with [`MockAdapter::connect`]
+///
+/// Replies enqueued for a command are used in order, one per request. Requests with no
+/// enqueued reply are answered with a successful response without a body. The adapter hangs
+/// up once the client closes the connection, e.g. with [`Client::stop`].
+pub struct MockAdapter {
+    script: Script,
+    requests: crossbeam_channel::Receiver<Value>,
+    connection: Arc<Connection>,
+}
+
+impl MockAdapter {
+    /// Create a client connected to a new mock adapter
+    pub fn connect(
+        events: crossbeam_channel::Sender<events::Event>,
+    ) -> eyre::Result<(Client, MockAdapter)> {
+        Self::connect_with_options(events, ClientOptions::default())
+    }
+
+    /// Create a client with `options` connected to a new mock adapter
+    pub fn connect_with_options(
+        events: crossbeam_channel::Sender<events::Event>,
+        options: ClientOptions,
+    ) -> eyre::Result<(Client, MockAdapter)> {
+        Self::start(events, options, None)
+    }
+
+    /// Create a client connected to a new mock adapter which sends the messages returned from
+    /// `respond` in reply to each request, e.g. to compute replies from the request arguments
+    pub fn connect_with_responder<F>(
+        events: crossbeam_channel::Sender<events::Event>,
+        respond: F,
+    ) -> eyre::Result<(Client, MockAdapter)>
+    where
+        F: Fn(&Value) -> Vec<Value> + Send + 'static,
+    {
+        Self::start(events, ClientOptions::default(), Some(Box::new(respond)))
+    }
+
+    fn start(
+        events: crossbeam_channel::Sender<events::Event>,
+        options: ClientOptions,
+        responder: Option<Responder>,
+    ) -> eyre::Result<(Client, MockAdapter)> {
+        let (requests_tx, requests_rx) = crossbeam_channel::unbounded();
+        let (messages_tx, messages_rx) = crossbeam_channel::unbounded();
+        let (received_tx, received_rx) = crossbeam_channel::unbounded();
+        let adapter = MockAdapter {
+            script: Script::default(),
+            requests: received_rx,
+            connection: Arc::new(Connection {
+                output: Mutex::new(Some(messages_tx)),
+                seq: AtomicI64::new(0),
+            }),
+        };
+
+        let script = Arc::clone(&adapter.script);
+        let connection = Arc::clone(&adapter.connection);
+        thread::spawn(move || {
+            let mut reader = BufReader::new(ChannelReader::new(requests_rx));
+            // stop when the client hangs up
+            while let Some(request) = read_message(&mut reader) {
+                if let Some(respond) = &responder {
+                    let messages = respond(&request);
+                    let _ = received_tx.send(request);
+                    if messages
+                        .iter()
+                        .any(|message| connection.send(message).is_err())
+                    {
+                        return;
+                    }
+                    continue;
+                }
+
+                let command = request["command"].as_str().unwrap_or_default().to_string();
+                let reply = script
+                    .lock()
+                    .unwrap()
+                    .get_mut(&command)
+                    .and_then(VecDeque::pop_front)
+                    .unwrap_or_else(|| Reply::success(Value::Null));
+
+                // record the request before replying so the order seen by tests is the wire
+                // order
+                let _ = received_tx.send(request.clone());
+                if connection.reply(&request, reply).is_err() {
+                    return;
+                }
+            }
+            connection.output.lock().unwrap().take();
+        });
+
+        let client = Client::start(
+            ChannelReader::new(messages_rx),
+            Box::new(ChannelWriter::new(requests_tx)),
+            events,
+            options,
+            || AdapterExit::Closed,
+        )?;
+        Ok((client, adapter))
+    }
+
+    /// Reply to the next request for `command` with `reply`
+    pub fn enqueue(&self, command: impl Into<String>, reply: Reply) {
+        self.script
+            .lock()
+            .unwrap()
+            .entry(command.into())
+            .or_default()
+            .push_back(reply);
+    }
+
+    /// Replay a recorded session, see [`crate::load_fixture`], by enqueueing the recorded reply
+    /// to each recorded request
+    ///
+    /// Each request is answered with its recorded response, if it had one, followed by the
+    /// events received after that response until the next one. Events received before any
+    /// response are sent straight away.
+    pub fn replay(&self, messages: &[Message]) -> eyre::Result<()> {
+        let mut replies: Vec<(String, Reply)> = Vec::new();
+        let mut by_seq: HashMap<types::Seq, usize> = HashMap::new();
+        let mut last_reply = None;
+        for message in messages {
+            let value = serde_json::to_value(message)?;
+            match message {
+                Message::Request(request) => {
+                    let command = value["command"].as_str().unwrap_or_default().to_string();
+                    by_seq.insert(request.seq, replies.len());
+                    replies.push((command, Reply::no_response()));
+                }
+                Message::Response(response) => {
+                    let Some(&index) = by_seq.get(&response.request_seq) else {
+                        eyre::bail!("response to unknown request {}", response.request_seq);
+                    };
+                    replies[index].1.response = Some(if response.success {
+                        Ok(value["body"].clone())
+                    } else {
+                        Err(response.message.clone().unwrap_or_default())
+                    });
+                    last_reply = Some(index);
+                }
+                Message::Event(_) => {
+                    let event = value["event"].as_str().unwrap_or_default();
+                    let body = value["body"].clone();
+                    match last_reply {
+                        Some(index) => replies[index].1.events.push((event.to_string(), body)),
+                        None => self.send_event(event, body)?,
+                    }
+                }
+            }
+        }
+
+        for (command, reply) in replies {
+            self.enqueue(command, reply);
+        }
+        Ok(())
+    }
+
+    /// Reply to `request`, one of the requests already received, e.g. to answer requests out
+    /// of order after enqueueing [`Reply::no_response`] for them
+    pub fn reply(&self, request: &Value, reply: Reply) -> eyre::Result<()> {
+        self.connection.reply(request, reply)
+    }
+
+    /// Send the event `event`, unprompted by any request
+    pub fn send_event(&self, event: &str, body: Value) -> eyre::Result<()> {
+        self.connection.event(event, body)
+    }
+
+    /// Send `bytes` exactly as given, e.g. a malformed message
+    pub fn send_bytes(&self, bytes: &[u8]) -> eyre::Result<()> {
+        self.connection.send_chunk(Ok(bytes.to_vec()))
+    }
+
+    /// Make the client's next read fail with `kind`, like a connection which drops, then hang
+    /// up
+    pub fn fail(&self, kind: io::ErrorKind) -> eyre::Result<()> {
+        self.connection.send_chunk(Err(kind.into()))?;
+        self.hang_up();
+        Ok(())
+    }
+
+    /// Close the connection, like an adapter which exits
+    pub fn hang_up(&self) {
+        self.connection.output.lock().unwrap().take();
+    }
+
+    /// The requests received so far, as JSON
+    pub fn requests(&self) -> &crossbeam_channel::Receiver<Value> {
+        &self.requests
+    }
+}
+
+/// Read a message as JSON, or `None` once the client hangs up
+pub(crate) fn read_message(reader: &mut impl BufRead) -> Option<Value> {
+    let mut header = String::new();
+    if reader.read_line(&mut header).ok()? == 0 {
+        return None;
+    }
+    let length: usize = header
+        .trim()
+        .strip_prefix("Content-Length: ")?
+        .parse()
+        .ok()?;
+    reader.read_line(&mut String::new()).ok()?;
+    let mut body = vec![0; length];
+    reader.read_exact(&mut body).ok()?;
+    serde_json::from_slice(&body).ok()
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::Duration;
+
+    use serde_json::json;
+
+    use super::{MockAdapter, Reply};
+    use crate::{events, load_fixture, requests, responses, ClientOptions};
+
+    #[test]
+    fn scripted_replies() -> eyre::Result<()> {
+        let (events_tx, events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+        adapter.enqueue(
+            "threads",
+            Reply::success(json!({ "threads": [{ "id": 1, "name": "MainThread" }] }))
+                .event("thread", json!({ "reason": "started", "threadId": 2 })),
+        );
+        adapter.enqueue("threads", Reply::failure("not stopped"));
+
+        let responses::ThreadsResponse { threads } = client.send_typed(requests::Threads)?;
+        assert_eq!(threads[0].name, "MainThread");
+        let event = events_rx.recv_timeout(Duration::from_secs(1))?;
+        assert!(matches!(event, events::Event::Thread(_)), "{event:?}");
+
+        // the replies are used in order
+        let err = client
+            .send_request(requests::RequestBody::Threads, Duration::from_secs(1))
+            .unwrap_err();
+        assert!(err.to_string().contains("not stopped"), "{err}");
+
+        let commands: Vec<_> = adapter
+            .requests()
+            .try_iter()
+            .map(|request| request["command"].clone())
+            .collect();
+        assert_eq!(commands, ["threads", "threads"]);
+        Ok(())
+    }
+
+    #[test]
+    fn unscripted_and_unanswered_requests() -> eyre::Result<()> {
+        let (events_tx, events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect(events_tx)?;
+        adapter.enqueue("threads", Reply::no_response());
+
+        client.send_request(
+            requests::RequestBody::Terminate(requests::Terminate { restart: None }),
+            Duration::from_secs(1),
+        )?;
+        assert!(client
+            .send_request(requests::RequestBody::Threads, Duration::from_millis(50))
+            .is_err());
+
+        adapter.send_event("terminated", serde_json::Value::Null)?;
+        let event = events_rx.recv_timeout(Duration::from_secs(1))?;
+        assert!(matches!(event, events::Event::Terminated), "{event:?}");
+        Ok(())
+    }
+
+    #[test]
+    fn replay_recorded_session() -> eyre::Result<()> {
+        // record a session against a scripted adapter
+        let (events_tx, events_rx) = crossbeam_channel::unbounded();
+        let (client, adapter) = MockAdapter::connect_with_options(
+            events_tx,
+            ClientOptions::default().with_recording(),
+        )?;
+        adapter.enqueue(
+            "threads",
+            Reply::success(json!({ "threads": [{ "id": 1, "name": "MainThread" }] })),
+        );
+        adapter.enqueue(
+            "continue",
+            Reply::success(json!({ "allThreadsContinued": true }))
+                .event("terminated", serde_json::Value::Null),
+        );
+        adapter.enqueue("pause", Reply::failure("not running"));
+        let session = |client: &crate::Client,
+                       events: &crossbeam_channel::Receiver<events::Event>|
+         -> eyre::Result<()> {
+            let responses::ThreadsResponse { threads } = client.send_typed(requests::Threads)?;
+            assert_eq!(threads[0].name, "MainThread");
+            client.send_typed(requests::Continue {
+                thread_id: 1,
+                single_thread: false,
+            })?;
+            let event = events.recv_timeout(Duration::from_secs(1))?;
+            assert!(matches!(event, events::Event::Terminated), "{event:?}");
+            let err = client
+                .send_request(
+                    requests::RequestBody::Pause(requests::Pause { thread_id: 1 }),
+                    Duration::from_secs(1),
+                )
+                .unwrap_err();
+            assert!(err.to_string().contains("not running"), "{err}");
+            Ok(())
+        };
+        session(&client, &events_rx)?;
+        let mut fixture = Vec::new();
+        client.export_fixture(&mut fixture)?;
+
+        // the same session against the recording
+        let (events_tx, events_rx) = crossbeam_channel::unbounded();
+        let (client, replayed) = MockAdapter::connect(events_tx)?;
+        replayed.replay(&load_fixture(fixture.as_slice())?)?;
+        session(&client, &events_rx)?;
+
+        let commands: Vec<_> = replayed
+            .requests()
+            .try_iter()
+            .map(|request| request["command"].clone())
+            .collect();
+        assert_eq!(commands, ["threads", "continue", "pause"]);
+        Ok(())
+    }
+}
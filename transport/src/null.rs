@@ -0,0 +1,300 @@
+//! A client connected to an in-process adapter which serves synthetic data
+//!
+//! This allows interfaces to be developed, and screenshotted, without running a real debug
+//! adapter. Unlike a replayed fixture, the data does not come from a real session.
+use std::io::{self, BufReader, Read, Write};
+use std::thread;
+
+use serde_json::{json, Value};
+
+use crate::client::{AdapterExit, Output};
+use crate::{events, reader, Client, ClientOptions, Reader};
+
+/// The thread which is stopped in the synthetic session
+const THREAD_ID: i64 = 1;
+/// The variables reference of the local scope of every frame
+const LOCALS_REFERENCE: i64 = 100;
+/// The variables reference of the children of the `items` variable
+const ITEMS_REFERENCE: i64 = 101;
+
+impl Client {
+    /// Create a client connected to an in-process adapter serving synthetic data
+    ///
+    /// Every request succeeds. Once configuration is done, and after every continue or step,
+    /// the adapter reports that the main thread stopped at a breakpoint, with a fake stack and
+    /// variables.
+    pub fn null(responses: crossbeam_channel::Sender<events::Event>) -> eyre::Result<Self> {
+        let (requests_tx, requests_rx) = crossbeam_channel::unbounded();
+        let (messages_tx, messages_rx) = crossbeam_channel::unbounded();
+
+        thread::spawn(move || {
+            let mut reader = reader::get(BufReader::new(ChannelReader::new(requests_rx)));
+            let mut output = ChannelWriter::new(messages_tx);
+            // stop when the client hangs up
+            while let Ok(Some(_)) = reader.poll_message() {
+                let Ok(request) = serde_json::from_str::<Value>(reader.raw_message()) else {
+                    continue;
+                };
+                for message in respond(&request) {
+                    let body = message.to_string();
+                    if write!(output, "Content-Length: {}\r\n\r\n{}", body.len(), body).is_err() {
+                        return;
+                    }
+                }
+            }
+        });
+
+        Self::start(
+            ChannelReader::new(messages_rx),
+            Box::new(ChannelWriter::new(requests_tx)),
+            responses,
+            ClientOptions::default(),
+            || AdapterExit::Closed,
+        )
+    }
+}
+
+/// The messages the synthetic adapter sends in reply to `request`
+fn respond(request: &Value) -> Vec<Value> {
+    let command = request["command"].as_str().unwrap_or_default();
+    let arguments = &request["arguments"];
+    let response = |body: Value| {
+        json!({
+            "seq": 0,
+            "type": "response",
+            "request_seq": request["seq"],
+            "success": true,
+            "command": command,
+            "body": body,
+        })
+    };
+    let event = |event: &str, body: Value| {
+        json!({
+            "seq": 0,
+            "type": "event",
+            "event": event,
+            "body": body,
+        })
+    };
+    let stopped = |reason: &str| {
+        event(
+            "stopped",
+            json!({
+                "reason": reason,
+                "threadId": THREAD_ID,
+                "allThreadsStopped": true,
+            }),
+        )
+    };
+
+    match command {
+        "initialize" => vec![
+            response(json!({
+                "supportsConfigurationDoneRequest": true,
+                "supportsEvaluateForHovers": true,
+            })),
+            event("initialized", Value::Null),
+        ],
+        "configurationDone" => vec![response(Value::Null), stopped("breakpoint")],
+        "continue" => vec![
+            response(json!({ "allThreadsContinued": true })),
+            stopped("breakpoint"),
+        ],
+        "next" | "stepIn" | "stepOut" => vec![response(Value::Null), stopped("breakpoint")],
+        "pause" => vec![response(Value::Null), stopped("pause")],
+        "threads" => vec![response(json!({
+            "threads": [{ "id": THREAD_ID, "name": "MainThread" }],
+        }))],
+        "stackTrace" => {
+            let frames = json!([
+                {
+                    "id": 1,
+                    "name": "process",
+                    "source": { "name": "example.py", "path": "/example.py" },
+                    "line": 4,
+                    "column": 0,
+                },
+                {
+                    "id": 2,
+                    "name": "main",
+                    "source": { "name": "example.py", "path": "/example.py" },
+                    "line": 12,
+                    "column": 0,
+                },
+            ]);
+            let levels = arguments["levels"].as_u64().unwrap_or(u64::MAX) as usize;
+            let frames: Vec<_> = frames.as_array().unwrap().iter().take(levels).collect();
+            vec![response(json!({ "stackFrames": frames }))]
+        }
+        "scopes" => vec![response(json!({
+            "scopes": [{
+                "name": "Locals",
+                "variablesReference": LOCALS_REFERENCE,
+                "expensive": false,
+            }],
+        }))],
+        "variables" => {
+            let variables = match arguments["variablesReference"].as_i64() {
+                Some(LOCALS_REFERENCE) => json!([
+                    { "name": "count", "value": "3", "type": "int", "variablesReference": 0 },
+                    { "name": "name", "value": "'example'", "type": "str", "variablesReference": 0 },
+                    {
+                        "name": "items",
+                        "value": "[1, 2]",
+                        "type": "list",
+                        "variablesReference": ITEMS_REFERENCE,
+                    },
+                ]),
+                Some(ITEMS_REFERENCE) => json!([
+                    { "name": "0", "value": "1", "type": "int", "variablesReference": 0 },
+                    { "name": "1", "value": "2", "type": "int", "variablesReference": 0 },
+                ]),
+                _ => json!([]),
+            };
+            vec![response(json!({ "variables": variables }))]
+        }
+        "evaluate" => vec![response(json!({
+            "result": arguments["expression"],
+            "variablesReference": 0,
+        }))],
+        "disconnect" | "terminate" => {
+            vec![response(Value::Null), event("terminated", Value::Null)]
+        }
+        _ => vec![response(Value::Null)],
+    }
+}
+
+/// The bytes, or the error, each read from one half of an in-memory connection returns
+pub(crate) type Chunk = io::Result<Vec<u8>>;
+
+/// Bytes written to a channel, as one half of an in-memory connection
+pub(crate) struct ChannelWriter(Option<crossbeam_channel::Sender<Chunk>>);
+
+impl ChannelWriter {
+    pub(crate) fn new(tx: crossbeam_channel::Sender<Chunk>) -> Self {
+        Self(Some(tx))
+    }
+}
+
+impl Write for ChannelWriter {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        self.0
+            .as_ref()
+            .ok_or(io::ErrorKind::BrokenPipe)?
+            .send(Ok(buf.to_vec()))
+            .map_err(|_| io::Error::from(io::ErrorKind::BrokenPipe))?;
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        Ok(())
+    }
+}
+
+impl Output for ChannelWriter {
+    fn close(&mut self) -> io::Result<()> {
+        // the reader reaches the end of the input once the sender is dropped
+        self.0.take();
+        Ok(())
+    }
+}
+
+/// Bytes read from a channel, reaching the end of the input once the writer is dropped
+pub(crate) struct ChannelReader {
+    rx: crossbeam_channel::Receiver<Chunk>,
+    buffer: Vec<u8>,
+    position: usize,
+}
+
+impl ChannelReader {
+    pub(crate) fn new(rx: crossbeam_channel::Receiver<Chunk>) -> Self {
+        Self {
+            rx,
+            buffer: Vec::new(),
+            position: 0,
+        }
+    }
+}
+
+impl Read for ChannelReader {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        if self.position == self.buffer.len() {
+            match self.rx.recv() {
+                Ok(Ok(bytes)) => {
+                    self.buffer = bytes;
+                    self.position = 0;
+                }
+                Ok(Err(e)) => return Err(e),
+                Err(_) => return Ok(0),
+            }
+        }
+
+        let n = buf.len().min(self.buffer.len() - self.position);
+        buf[..n].copy_from_slice(&self.buffer[self.position..self.position + n]);
+        self.position += n;
+        Ok(n)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::Duration;
+
+    use crate::{events, requests, responses, Client};
+
+    #[test]
+    fn synthetic_session() -> eyre::Result<()> {
+        let (events_tx, events_rx) = crossbeam_channel::unbounded();
+        let client = Client::null(events_tx)?;
+
+        client.initialize(requests::Initialize {
+            adapter_id: "dap gui".to_string(),
+            lines_start_at_one: false,
+            path_format: requests::PathFormat::Path,
+            supports_start_debugging_request: true,
+            supports_variable_type: true,
+            supports_variable_paging: true,
+            supports_progress_reporting: true,
+            supports_memory_event: true,
+        })?;
+        let event = events_rx.recv_timeout(Duration::from_secs(1))?;
+        assert!(matches!(event, events::Event::Initialized), "{event:?}");
+
+        client.send(requests::RequestBody::ConfigurationDone)?;
+        let event = events_rx.recv_timeout(Duration::from_secs(1))?;
+        let events::Event::Stopped(events::StoppedEventBody { thread_id, .. }) = event else {
+            panic!("expected stopped event, got {event:?}");
+        };
+
+        let responses::StackTraceResponse { stack_frames } =
+            client.send_typed(requests::StackTrace {
+                thread_id,
+                ..Default::default()
+            })?;
+        assert_eq!(stack_frames.len(), 2);
+
+        let responses::ScopesResponse { scopes } = client.send_typed(requests::Scopes {
+            frame_id: stack_frames[0].id,
+        })?;
+        let responses::VariablesResponse { variables } =
+            client.send_typed(requests::Variables {
+                variables_reference: scopes[0].variables_reference,
+                format: None,
+            })?;
+        assert!(!variables.is_empty());
+
+        // nested variables can be expanded
+        let items = variables
+            .iter()
+            .find(|v| v.variables_reference != 0)
+            .expect("a variable with children");
+        let responses::VariablesResponse { variables } =
+            client.send_typed(requests::Variables {
+                variables_reference: items.variables_reference,
+                format: None,
+            })?;
+        assert_eq!(variables.len(), 2);
+
+        Ok(())
+    }
+}
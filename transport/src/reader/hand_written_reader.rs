@@ -2,10 +2,12 @@ use std::io::{self, BufRead};
 
 use eyre::WrapErr;
 
+use super::ProtocolError;
 use crate::Reader;
 
 pub struct HandWrittenReader<R> {
     input: R,
+    raw: String,
 }
 
 enum ReaderState {
@@ -18,7 +20,10 @@ where
     R: BufRead,
 {
     fn new(input: R) -> Self {
-        Self { input }
+        Self {
+            input,
+            raw: String::new(),
+        }
     }
 
     fn poll_message(&mut self) -> eyre::Result<Option<crate::Message>> {
@@ -35,34 +40,40 @@ where
 
                     match state {
                         ReaderState::Header => {
-                            let parts: Vec<&str> = buffer.trim_end().split(':').collect();
-                            match parts[0] {
-                                "Content-Length" => {
-                                    content_length = match parts[1].trim().parse() {
-                                        Ok(val) => val,
-                                        Err(_) => {
-                                            eyre::bail!("failed to parse content length")
-                                        }
-                                    };
-                                    buffer.clear();
-                                    buffer.reserve(content_length);
-                                    state = ReaderState::Content;
+                            let header = buffer.trim_end();
+                            let Some(("Content-Length", value)) = header.split_once(':') else {
+                                return Err(ProtocolError {
+                                    reason: "expected a Content-Length header",
+                                    bytes: header.as_bytes().to_vec(),
                                 }
-                                other => {
-                                    eyre::bail!("header {} not implemented", other);
+                                .into());
+                            };
+                            content_length = match value.trim().parse() {
+                                Ok(val) => val,
+                                Err(_) => {
+                                    return Err(ProtocolError {
+                                        reason: "invalid Content-Length header",
+                                        bytes: header.as_bytes().to_vec(),
+                                    }
+                                    .into());
                                 }
-                            }
+                            };
+                            buffer.clear();
+                            buffer.reserve(content_length);
+                            state = ReaderState::Content;
                         }
                         ReaderState::Content => {
                             buffer.clear();
                             let mut content = vec![0; content_length];
                             self.input
                                 .read_exact(content.as_mut_slice())
-                                .map_err(|e| eyre::eyre!("failed to read: {:?}", e))?;
-                            let content =
-                                std::str::from_utf8(content.as_slice()).context("invalid utf8")?;
-                            let message = serde_json::from_str(content).with_context(|| {
-                                format!("could not construct message from: {content}")
+                                .context("failed to read")?;
+                            self.raw = String::from_utf8(content).map_err(|e| ProtocolError {
+                                reason: "message body is not valid UTF-8",
+                                bytes: e.into_bytes(),
+                            })?;
+                            let message = serde_json::from_str(&self.raw).with_context(|| {
+                                format!("could not construct message from: {}", self.raw)
                             })?;
                             return Ok(Some(message));
                         }
@@ -72,11 +83,15 @@ where
                     if e.kind() == io::ErrorKind::WouldBlock {
                         continue;
                     }
-                    return Err(eyre::eyre!("error reading from buffer: {e:?}"));
+                    return Err(e).context("error reading from buffer");
                 }
             }
         }
     }
+
+    fn raw_message(&self) -> &str {
+        &self.raw
+    }
 }
 
 #[cfg(test)]
@@ -88,7 +103,7 @@ mod tests {
 
     use crate::{bindings::get_random_tcp_port, events, Message, Reader};
 
-    use super::HandWrittenReader;
+    use super::{HandWrittenReader, ProtocolError};
 
     macro_rules! execute_test {
         // multiple bodies for single message
@@ -163,6 +178,17 @@ mod tests {
         Ok(())
     }
 
+    #[test]
+    fn malformed_content_length() {
+        let body = "Content-Length: 3x\r\n\r\n{}";
+        let mut reader = HandWrittenReader::new(body.as_bytes());
+
+        let err = reader.poll_message().unwrap_err();
+        let protocol_error = err.downcast_ref::<ProtocolError>().expect("protocol error");
+        assert_eq!(protocol_error.reason, "invalid Content-Length header");
+        assert_eq!(protocol_error.bytes, b"Content-Length: 3x");
+    }
+
     #[test]
     fn multiple_messages() -> eyre::Result<()> {
         let body = "Content-Length: 37\r\n\r\n{\"type\":\"event\",\"event\":\"terminated\"}Content-Length: 37\r\n\r\n{\"type\":\"event\",\"event\":\"terminated\"}";
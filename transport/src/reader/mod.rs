@@ -7,9 +7,36 @@ pub mod hand_written_reader;
 #[cfg(nom)]
 pub mod nom_reader;
 
+/// The adapter sent a message which is not framed correctly, e.g. with a malformed
+/// `Content-Length` header
+///
+/// Unlike a message with unexpected content, the following messages cannot be found, so this
+/// points to a bug in the adapter rather than a network problem.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ProtocolError {
+    pub reason: &'static str,
+    /// The offending bytes, e.g. the malformed header
+    pub bytes: Vec<u8>,
+}
+
+impl std::fmt::Display for ProtocolError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(
+            f,
+            "protocol error: {}: {:?}",
+            self.reason,
+            String::from_utf8_lossy(&self.bytes)
+        )
+    }
+}
+
+impl std::error::Error for ProtocolError {}
+
 pub trait Reader<R> {
     fn new(input: R) -> Self;
     fn poll_message(&mut self) -> eyre::Result<Option<Message>>;
+    /// The JSON content of the last message returned from [`Reader::poll_message`]
+    fn raw_message(&self) -> &str;
 }
 
 #[cfg(nom)]
@@ -1,10 +1,13 @@
 use std::io::{self, BufRead};
 
+use eyre::WrapErr;
+
 use crate::{parse::parse_message, Message, Reader};
 
 pub struct NomReader<R> {
     input: R,
     buffer: String,
+    raw: String,
 }
 
 impl<R> Reader<R> for NomReader<R>
@@ -15,6 +18,7 @@ where
         Self {
             input,
             buffer: String::new(),
+            raw: String::new(),
         }
     }
 
@@ -25,6 +29,13 @@ where
                 match parse_message(&self.buffer) {
                     Ok((input, message)) => {
                         tracing::trace!(rest = %input, "parsed message");
+                        // keep the JSON content, after the headers, of the parsed message
+                        let consumed = &self.buffer[..self.buffer.len() - input.len()];
+                        self.raw = consumed
+                            .split_once("\r\n\r\n")
+                            .map(|(_, content)| content)
+                            .unwrap_or(consumed)
+                            .to_owned();
                         // overwrite the buffer with the remaining input from parsing the message
                         self.buffer = input.to_owned();
                         return Ok(Some(message));
@@ -50,11 +61,15 @@ where
                     if e.kind() == io::ErrorKind::WouldBlock {
                         continue;
                     }
-                    return Err(eyre::eyre!("error reading from buffer: {e:?}"));
+                    return Err(e).context("error reading from buffer");
                 }
             }
         }
     }
+
+    fn raw_message(&self) -> &str {
+        &self.raw
+    }
 }
 
 #[cfg(test)]
@@ -0,0 +1,92 @@
+//! Recording of the messages exchanged with a DAP server, for later replay
+use std::{
+    io::{Read, Write},
+    sync::Mutex,
+    time::{SystemTime, UNIX_EPOCH},
+};
+
+use eyre::WrapErr;
+use serde::{Deserialize, Serialize};
+
+use crate::Message;
+
+/// An entry of the transcript, written as one JSON object per line
+#[derive(Debug, Serialize, Deserialize)]
+struct Entry {
+    /// Milliseconds since the unix epoch
+    timestamp: u64,
+    /// The session the entry belongs to, to tell recordings of concurrent sessions apart
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    session: Option<String>,
+    #[serde(flatten)]
+    record: Record,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+#[serde(untagged)]
+enum Record {
+    Message(Box<Message>),
+    /// A line written to stderr by the server process
+    Stderr {
+        stderr: String,
+    },
+}
+
+/// Records every message sent to, or received from, the server, interleaved with any stderr
+/// output from the server process
+pub(crate) struct Recorder {
+    entries: Mutex<Vec<Entry>>,
+    session: Option<String>,
+}
+
+impl Recorder {
+    pub(crate) fn new(session: Option<String>) -> Self {
+        Self {
+            entries: Mutex::default(),
+            session,
+        }
+    }
+
+    pub(crate) fn record(&self, message: Message) {
+        self.push(Record::Message(Box::new(message)));
+    }
+
+    pub(crate) fn record_stderr(&self, line: &str) {
+        self.push(Record::Stderr {
+            stderr: line.to_string(),
+        });
+    }
+
+    fn push(&self, record: Record) {
+        let timestamp = SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .map(|d| d.as_millis() as u64)
+            .unwrap_or_default();
+        self.entries.lock().unwrap().push(Entry {
+            timestamp,
+            session: self.session.clone(),
+            record,
+        });
+    }
+
+    /// Write the recorded transcript as newline delimited JSON, loadable by [`load_fixture`]
+    pub(crate) fn export(&self, mut w: impl Write) -> eyre::Result<()> {
+        for entry in self.entries.lock().unwrap().iter() {
+            serde_json::to_writer(&mut w, entry).context("serializing entry")?;
+            writeln!(w).context("writing entry")?;
+        }
+        Ok(())
+    }
+}
+
+/// Load the messages from a fixture written by [`crate::Client::export_fixture`], skipping any
+/// stderr output
+pub fn load_fixture(r: impl Read) -> eyre::Result<Vec<Message>> {
+    let mut messages = Vec::new();
+    for entry in serde_json::Deserializer::from_reader(r).into_iter::<Entry>() {
+        if let Record::Message(message) = entry.context("deserializing entry")?.record {
+            messages.push(*message);
+        }
+    }
+    Ok(messages)
+}
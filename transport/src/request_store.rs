@@ -1,15 +1,118 @@
 use std::{
-    collections::HashMap,
-    sync::{Arc, Mutex},
+    collections::{HashMap, HashSet},
+    fmt::Write,
+    sync::{Arc, Condvar, Mutex},
+    time::Instant,
 };
 
-use crate::{requests, responses::ResponseBody, types};
+use crate::{requests, responses, types};
 
-/// Wraps the incoming request with a channel to reply back on
+/// Wraps the incoming request with a channel to reply back on, and when it was sent
 pub(crate) struct WaitingRequest(
     pub(crate) requests::RequestBody,
-    pub(crate) oneshot::Sender<Option<ResponseBody>>,
+    pub(crate) oneshot::Sender<responses::Response>,
+    pub(crate) Instant,
 );
 
 /// A container for the requests awaiting responses
 pub(crate) type RequestStore = Arc<Mutex<HashMap<types::Seq, WaitingRequest>>>;
+
+/// Describe the requests awaiting responses, oldest first, one per line
+pub(crate) fn dump(store: &HashMap<types::Seq, WaitingRequest>) -> String {
+    let mut waiting: Vec<_> = store.iter().collect();
+    waiting.sort_by_key(|(seq, _)| **seq);
+
+    let mut out = String::new();
+    for (seq, WaitingRequest(body, _, sent_at)) in waiting {
+        let command = serde_json::to_value(body)
+            .ok()
+            .and_then(|value| value.get("command")?.as_str().map(str::to_string))
+            .unwrap_or_else(|| "unknown".to_string());
+        let _ = writeln!(
+            out,
+            "seq={seq} command={command} age={}ms",
+            sent_at.elapsed().as_millis()
+        );
+    }
+    out
+}
+
+/// Limits the number of requests that may be awaiting a response at any one time
+pub(crate) struct InFlight {
+    limit: Option<usize>,
+    slots: Mutex<Slots>,
+    released: Condvar,
+}
+
+#[derive(Default)]
+struct Slots {
+    /// Slots taken by requests which are about to be sent
+    reserved: usize,
+    /// Requests which have been sent and are awaiting a response
+    pending: HashSet<types::Seq>,
+}
+
+impl InFlight {
+    pub(crate) fn new(limit: Option<usize>) -> Self {
+        Self {
+            limit,
+            slots: Mutex::new(Slots::default()),
+            released: Condvar::new(),
+        }
+    }
+
+    /// Block until there is space for another request to be sent
+    ///
+    /// This must be called before taking the client lock, so other callers are not blocked
+    /// while waiting.
+    pub(crate) fn acquire(self: &Arc<Self>) -> Permit {
+        let Some(limit) = self.limit else {
+            return Permit(None);
+        };
+
+        let mut slots = self.slots.lock().unwrap();
+        while slots.reserved + slots.pending.len() >= limit {
+            tracing::trace!(in_flight = %slots.pending.len(), "waiting for in-flight requests");
+            slots = self.released.wait(slots).unwrap();
+        }
+        slots.reserved += 1;
+        Permit(Some(Arc::clone(self)))
+    }
+
+    /// Mark the request with sequence number `seq` as no longer in flight
+    pub(crate) fn release(&self, seq: types::Seq) {
+        if self.limit.is_none() {
+            return;
+        }
+
+        let mut slots = self.slots.lock().unwrap();
+        if slots.pending.remove(&seq) {
+            self.released.notify_all();
+        }
+    }
+}
+
+/// Space for a request to be sent, see [`InFlight::acquire`]
+///
+/// Dropping the permit without sending a request frees the space again.
+pub(crate) struct Permit(Option<Arc<InFlight>>);
+
+impl Permit {
+    /// Use the space for the request with sequence number `seq`, until it is released
+    pub(crate) fn send(mut self, seq: types::Seq) {
+        if let Some(in_flight) = self.0.take() {
+            let mut slots = in_flight.slots.lock().unwrap();
+            slots.reserved -= 1;
+            slots.pending.insert(seq);
+        }
+    }
+}
+
+impl Drop for Permit {
+    fn drop(&mut self) {
+        if let Some(in_flight) = self.0.take() {
+            in_flight.slots.lock().unwrap().reserved -= 1;
+            in_flight.released.notify_all();
+        }
+    }
+}
@@ -3,15 +3,18 @@ use std::path::PathBuf;
 
 use serde::{Deserialize, Serialize};
 
+use crate::responses::{self, ResponseBody};
 use crate::types::{
-    Seq, Source, SourceBreakpoint, StackFrameFormat, StackFrameId, ThreadId, VariablesReference,
+    DataBreakpoint, Seq, Source, SourceBreakpoint, StackFrameFormat, StackFrameId, ThreadId,
+    VariablesReference,
 };
 
 #[derive(Debug, Deserialize, Serialize, Clone)]
 #[serde(rename_all = "camelCase")]
 pub struct Request {
     pub seq: Seq,
-    #[serde(skip_deserializing)]
+    // the message type is written by the tag of [`crate::Message`]
+    #[serde(skip)]
     pub r#type: String,
     #[serde(flatten)]
     pub body: RequestBody,
@@ -28,7 +31,12 @@ pub enum RequestBody {
     SetFunctionBreakpoints(SetFunctionBreakpoints),
     SetBreakpoints(SetBreakpoints),
     SetExceptionBreakpoints(SetExceptionBreakpoints),
+    DataBreakpointInfo(DataBreakpointInfo),
+    SetDataBreakpoints(SetDataBreakpoints),
     Attach(Attach),
+    /// An attach request with adapter specific arguments, e.g. the process id of the debuggee
+    #[serde(rename = "attach", skip_deserializing)]
+    RawAttach(serde_json::Value),
     Launch(Launch),
     Scopes(Scopes),
     Variables(Variables),
@@ -37,12 +45,95 @@ pub enum RequestBody {
     Terminate(Terminate),
     Disconnect(Disconnect),
     Next(Next),
+    StepIn(StepIn),
+    StepOut(StepOut),
+    Evaluate(Evaluate),
+    Disassemble(Disassemble),
+    SetVariable(SetVariable),
+    RestartFrame(RestartFrame),
+    ExceptionInfo(ExceptionInfo),
+    Pause(Pause),
+    Restart(Restart),
+}
+
+impl RequestBody {
+    /// Whether the request changes the state of the debuggee, e.g. resuming or stepping it
+    ///
+    /// Evaluating in the REPL may run arbitrary code, so only evaluations in other contexts are
+    /// considered read only. Disconnecting is only mutating if it terminates the debuggee.
+    pub fn is_mutating(&self) -> bool {
+        match self {
+            RequestBody::Continue(_)
+            | RequestBody::Next(_)
+            | RequestBody::StepIn(_)
+            | RequestBody::StepOut(_)
+            | RequestBody::Pause(_)
+            | RequestBody::Restart(_)
+            | RequestBody::SetVariable(_)
+            | RequestBody::RestartFrame(_)
+            | RequestBody::Terminate(_) => true,
+            RequestBody::Disconnect(Disconnect {
+                terminate_debugee, ..
+            }) => *terminate_debugee,
+            RequestBody::Evaluate(Evaluate { context, .. }) => {
+                matches!(context, None | Some(EvaluateContext::Repl))
+            }
+            _ => false,
+        }
+    }
 }
 
 #[derive(Debug, Deserialize, Serialize, Default, Clone)]
 #[serde(rename_all = "camelCase")]
 pub struct Next {
     pub thread_id: ThreadId,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub granularity: Option<SteppingGranularity>,
+}
+
+#[derive(Debug, Deserialize, Serialize, Default, Clone)]
+#[serde(rename_all = "camelCase")]
+pub struct StepIn {
+    pub thread_id: ThreadId,
+    /// The target to step into, from the targets returned by a `stepInTargets` request
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub target_id: Option<i64>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub granularity: Option<SteppingGranularity>,
+}
+
+#[derive(Debug, Deserialize, Serialize, Default, Clone)]
+#[serde(rename_all = "camelCase")]
+pub struct StepOut {
+    pub thread_id: ThreadId,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub granularity: Option<SteppingGranularity>,
+}
+
+/// Suspend a running thread, e.g. to break into an infinite loop
+#[derive(Debug, Deserialize, Serialize, Default, Clone)]
+#[serde(rename_all = "camelCase")]
+pub struct Pause {
+    pub thread_id: ThreadId,
+}
+
+/// Restart the debuggee, if the adapter supports `supportsRestartRequest`
+#[derive(Debug, Deserialize, Serialize, Default, Clone)]
+#[serde(rename_all = "camelCase")]
+pub struct Restart {
+    /// The latest launch or attach arguments, or `None` to restart with the original ones
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub arguments: Option<serde_json::Value>,
+}
+
+/// How far a single step moves, if the adapter supports `supportsSteppingGranularity`
+#[derive(Debug, Deserialize, Serialize, Clone, Copy, PartialEq, Eq)]
+#[serde(rename_all = "camelCase")]
+pub enum SteppingGranularity {
+    Statement,
+    Line,
+    /// A single machine instruction, e.g. for stepping in a disassembly view
+    Instruction,
 }
 
 #[derive(Debug, Deserialize, Serialize, Default, Clone)]
@@ -54,7 +145,7 @@ pub struct StackTrace {
     pub format: Option<StackFrameFormat>,
 }
 
-#[derive(Default, Debug, Deserialize, Serialize, Clone)]
+#[derive(Default, Debug, Deserialize, Serialize, Clone, Copy, PartialEq, Eq)]
 #[serde(rename_all = "camelCase")]
 pub enum PathFormat {
     #[default]
@@ -96,6 +187,25 @@ pub struct SetFunctionBreakpoints {
     pub breakpoints: Vec<Breakpoint>,
 }
 
+/// Find out whether a data breakpoint can be set on a variable, and the id of its data
+#[derive(Debug, Deserialize, Serialize, Clone)]
+#[serde(rename_all = "camelCase")]
+pub struct DataBreakpointInfo {
+    /// The container of the variable, or `None` to look `name` up as an expression
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub variables_reference: Option<VariablesReference>,
+    pub name: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub frame_id: Option<StackFrameId>,
+}
+
+/// Replace all data breakpoints
+#[derive(Debug, Deserialize, Serialize, Clone)]
+#[serde(rename_all = "camelCase")]
+pub struct SetDataBreakpoints {
+    pub breakpoints: Vec<DataBreakpoint>,
+}
+
 #[derive(Debug, Default, Deserialize, Serialize, Clone)]
 #[serde(rename_all = "camelCase")]
 pub struct SetBreakpoints {
@@ -157,6 +267,10 @@ pub enum LaunchArguments {
 pub struct Launch {
     pub program: PathBuf,
 
+    /// Run the program without debugging
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub no_debug: Option<bool>,
+
     #[serde(flatten, skip_serializing_if = "Option::is_none")]
     pub launch_arguments: Option<LaunchArguments>,
 }
@@ -171,6 +285,17 @@ pub struct Scopes {
 #[serde(rename_all = "camelCase")]
 pub struct Variables {
     pub variables_reference: VariablesReference,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub format: Option<ValueFormat>,
+}
+
+/// How values should be formatted by the adapter
+#[derive(Debug, Default, Deserialize, Serialize, Clone, Copy, PartialEq, Eq)]
+#[serde(rename_all = "camelCase")]
+pub struct ValueFormat {
+    /// Display the value in hex
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub hex: Option<bool>,
 }
 
 #[derive(Default, Debug, Deserialize, Serialize, Clone)]
@@ -192,7 +317,156 @@ pub struct Terminate {
 #[derive(Debug, Deserialize, Serialize, Clone)]
 #[serde(rename_all = "camelCase")]
 pub struct Disconnect {
+    #[serde(rename = "terminateDebuggee")]
     pub terminate_debugee: bool,
+    /// Leave the debuggee suspended after disconnecting, if the adapter supports it
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub suspend_debuggee: Option<bool>,
+}
+
+/// The context in which an [`Evaluate`] request is run
+#[derive(Debug, Deserialize, Serialize, Clone)]
+#[serde(rename_all = "camelCase")]
+pub enum EvaluateContext {
+    Watch,
+    Repl,
+    Hover,
+    /// Produce a copy-friendly full representation of the value
+    Clipboard,
+    Variables,
+}
+
+/// Change the value of the variable `name` in the container `variables_reference`
+#[derive(Debug, Deserialize, Serialize, Clone)]
+#[serde(rename_all = "camelCase")]
+pub struct SetVariable {
+    pub variables_reference: VariablesReference,
+    pub name: String,
+    pub value: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub format: Option<ValueFormat>,
+}
+
+/// Restart execution of a stack frame, e.g. to re-run a function after changing a variable
+#[derive(Debug, Deserialize, Serialize, Clone)]
+#[serde(rename_all = "camelCase")]
+pub struct RestartFrame {
+    pub frame_id: StackFrameId,
+}
+
+/// Fetch details of the exception which stopped a thread
+#[derive(Debug, Deserialize, Serialize, Clone)]
+#[serde(rename_all = "camelCase")]
+pub struct ExceptionInfo {
+    pub thread_id: ThreadId,
+}
+
+/// Disassemble the instructions around a memory reference
+#[derive(Debug, Deserialize, Serialize, Default, Clone)]
+#[serde(rename_all = "camelCase")]
+pub struct Disassemble {
+    pub memory_reference: String,
+    /// Offset in bytes to apply to `memory_reference`
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub offset: Option<i64>,
+    /// Offset in instructions to apply after `offset`, negative to disassemble backwards
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub instruction_offset: Option<i64>,
+    pub instruction_count: usize,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub resolve_symbols: Option<bool>,
+}
+
+#[derive(Debug, Deserialize, Serialize, Clone)]
+#[serde(rename_all = "camelCase")]
+pub struct Evaluate {
+    pub expression: String,
+    pub frame_id: Option<StackFrameId>,
+    pub context: Option<EvaluateContext>,
+    /// The source containing the expression, e.g. when hovering
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub source: Option<Source>,
+    /// The line of the expression in `source`
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub line: Option<usize>,
+}
+
+/// The threads request, which has no arguments
+#[derive(Debug, Default, Clone, Copy)]
+pub struct Threads;
+
+/// A request whose response has a known type, for use with [`crate::Client::send_typed`]
+pub trait TypedRequest {
+    type Response;
+
+    fn into_body(self) -> RequestBody;
+
+    /// Extract the typed response, or `None` if the response is for a different request
+    fn from_response(body: ResponseBody) -> Option<Self::Response>;
+}
+
+macro_rules! typed_request {
+    ($request:ty, $variant:ident, $response:ty) => {
+        impl TypedRequest for $request {
+            type Response = $response;
+
+            fn into_body(self) -> RequestBody {
+                RequestBody::$variant(self)
+            }
+
+            fn from_response(body: ResponseBody) -> Option<Self::Response> {
+                match body {
+                    ResponseBody::$variant(response) => Some(response),
+                    _ => None,
+                }
+            }
+        }
+    };
+}
+
+typed_request!(Initialize, Initialize, responses::Capabilities);
+typed_request!(StackTrace, StackTrace, responses::StackTraceResponse);
+typed_request!(Continue, Continue, responses::ContinueResponse);
+typed_request!(
+    SetFunctionBreakpoints,
+    SetFunctionBreakpoints,
+    responses::SetFunctionBreakpointsResponse
+);
+typed_request!(SetBreakpoints, SetBreakpoints, responses::SetBreakpoints);
+typed_request!(
+    DataBreakpointInfo,
+    DataBreakpointInfo,
+    responses::DataBreakpointInfoResponse
+);
+typed_request!(
+    SetDataBreakpoints,
+    SetDataBreakpoints,
+    responses::SetBreakpoints
+);
+typed_request!(Scopes, Scopes, responses::ScopesResponse);
+typed_request!(Variables, Variables, responses::VariablesResponse);
+typed_request!(Evaluate, Evaluate, responses::EvaluateResponse);
+typed_request!(Disassemble, Disassemble, responses::DisassembleResponse);
+typed_request!(SetVariable, SetVariable, responses::SetVariableResponse);
+typed_request!(
+    ExceptionInfo,
+    ExceptionInfo,
+    responses::ExceptionInfoResponse
+);
+
+impl TypedRequest for Threads {
+    type Response = responses::ThreadsResponse;
+
+    fn into_body(self) -> RequestBody {
+        RequestBody::Threads
+    }
+
+    fn from_response(body: ResponseBody) -> Option<Self::Response> {
+        match body {
+            ResponseBody::Threads(response) => Some(response),
+            _ => None,
+        }
+    }
 }
 
 #[cfg(test)]
@@ -203,6 +477,7 @@ mod tests {
     fn launch_arguments() {
         let body = RequestBody::Launch(Launch {
             program: PathBuf::from("/"),
+            no_debug: None,
             launch_arguments: Some(LaunchArguments::Debugpy(DebugpyLaunchArguments {
                 just_my_code: true,
                 // console: "integratedTerminal".to_string(),
@@ -231,4 +506,36 @@ mod tests {
 
         assert!(just_my_code);
     }
+
+    #[test]
+    fn evaluate_context() {
+        let body = RequestBody::Evaluate(Evaluate {
+            expression: "a".to_string(),
+            frame_id: Some(1),
+            context: Some(EvaluateContext::Clipboard),
+            source: None,
+            line: None,
+        });
+
+        let s = serde_json::to_string(&body).unwrap();
+        let v: serde_json::Value = serde_json::from_str(&s).unwrap();
+
+        assert_eq!(v["command"], "evaluate");
+        assert_eq!(v["arguments"]["context"], "clipboard");
+        assert_eq!(v["arguments"]["frameId"], 1);
+    }
+
+    #[test]
+    fn disconnect_arguments() {
+        let body = RequestBody::Disconnect(Disconnect {
+            terminate_debugee: true,
+            suspend_debuggee: None,
+        });
+
+        let v = serde_json::to_value(&body).unwrap();
+
+        assert_eq!(v["command"], "disconnect");
+        assert_eq!(v["arguments"]["terminateDebuggee"], true);
+        assert!(v["arguments"].get("suspendDebuggee").is_none());
+    }
 }
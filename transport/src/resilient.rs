@@ -0,0 +1,405 @@
+//! A client which reconnects when the connection to the adapter drops, e.g. when debugging
+//! over a flaky network
+use std::{
+    io,
+    net::TcpStream,
+    sync::{Arc, Mutex},
+    thread,
+    time::Duration,
+};
+
+use eyre::WrapErr;
+
+use crate::{
+    configure::Replay, events, requests::RequestBody, responses::ResponseBody, AdapterExit, Client,
+    ClientOptions,
+};
+
+/// How often, and for how long, to try to reconnect
+#[derive(Debug, Clone, Copy)]
+pub struct ReconnectPolicy {
+    /// The delay before the first attempt, which doubles after each failed attempt
+    pub initial_delay: Duration,
+    pub max_attempts: u32,
+    /// How long to wait for the initialized event, and for each response, when replaying the
+    /// session after reconnecting, so an adapter which never answers fails the attempt
+    pub replay_timeout: Duration,
+}
+
+impl Default for ReconnectPolicy {
+    fn default() -> Self {
+        Self {
+            initial_delay: Duration::from_millis(200),
+            max_attempts: 5,
+            replay_timeout: Duration::from_secs(5),
+        }
+    }
+}
+
+/// Connects a new client to the adapter, sending its events to the given channel
+type Dial =
+    Box<dyn Fn(crossbeam_channel::Sender<events::Event>) -> eyre::Result<Client> + Send + Sync>;
+
+struct Shared {
+    client: Mutex<Client>,
+    dial: Dial,
+    policy: ReconnectPolicy,
+    replay: Mutex<Replay>,
+    events: crossbeam_channel::Sender<events::Event>,
+}
+
+/// A [`Client`] which, if reading from the adapter fails, connects again with exponential
+/// backoff and replays the requests which set up the session
+///
+/// The initialize, launch or attach, breakpoint and configuration done requests sent through
+/// [`ResilientClient::send`] or [`ResilientClient::execute`] are replayed, so breakpoints set
+/// before the connection dropped are set again. While reconnecting,
+/// [`events::Event::Reconnecting`] is sent for each attempt, then
+/// [`events::Event::Reconnected`] once the session has been restored.
+///
+/// A connection the adapter closes cleanly, e.g. at the end of the session, is not
+/// re-established.
+#[derive(Clone)]
+pub struct ResilientClient {
+    shared: Arc<Shared>,
+}
+
+impl ResilientClient {
+    /// Connect with `dial`, which is called again to reconnect
+    pub fn connect<F>(
+        dial: F,
+        events: crossbeam_channel::Sender<events::Event>,
+        policy: ReconnectPolicy,
+    ) -> eyre::Result<Self>
+    where
+        F: Fn() -> io::Result<TcpStream> + Send + Sync + 'static,
+    {
+        Self::connect_with_options(dial, events, policy, ClientOptions::default())
+    }
+
+    /// Connect with `dial`, which is called again to reconnect, creating each client with
+    /// `options`
+    pub fn connect_with_options<F>(
+        dial: F,
+        events: crossbeam_channel::Sender<events::Event>,
+        policy: ReconnectPolicy,
+        options: ClientOptions,
+    ) -> eyre::Result<Self>
+    where
+        F: Fn() -> io::Result<TcpStream> + Send + Sync + 'static,
+    {
+        Self::with_dial(
+            move |events| {
+                let stream = dial().context("connecting to adapter")?;
+                Client::with_options(stream, events, options.clone())
+            },
+            events,
+            policy,
+        )
+    }
+
+    /// Connect with a client created by `dial`, which is called again to reconnect
+    pub(crate) fn with_dial<F>(
+        dial: F,
+        events: crossbeam_channel::Sender<events::Event>,
+        policy: ReconnectPolicy,
+    ) -> eyre::Result<Self>
+    where
+        F: Fn(crossbeam_channel::Sender<events::Event>) -> eyre::Result<Client>
+            + Send
+            + Sync
+            + 'static,
+    {
+        let (tx, rx) = crossbeam_channel::unbounded();
+        let client = dial(tx)?;
+        let shared = Arc::new(Shared {
+            client: Mutex::new(client),
+            dial: Box::new(dial),
+            policy,
+            replay: Mutex::new(Replay::default()),
+            events,
+        });
+
+        let supervisor = Arc::clone(&shared);
+        thread::spawn(move || supervisor.supervise(rx));
+        Ok(Self { shared })
+    }
+
+    /// The client for the current connection, e.g. to send requests which are not replayed
+    pub fn client(&self) -> Client {
+        self.shared.client.lock().unwrap().clone()
+    }
+
+    /// Send a request and wait for the response, see [`Client::send`]
+    pub fn send(&self, body: RequestBody) -> eyre::Result<Option<ResponseBody>> {
+        self.shared.replay.lock().unwrap().record(&body);
+        self.client().send(body)
+    }
+
+    /// Send a request without waiting for the response, see [`Client::execute`]
+    pub fn execute(&self, body: RequestBody) -> eyre::Result<()> {
+        self.shared.replay.lock().unwrap().record(&body);
+        self.client().execute(body)
+    }
+
+    /// Stop the client, without reconnecting, see [`Client::stop`]
+    pub fn stop(&self) -> eyre::Result<()> {
+        self.client().stop()
+    }
+}
+
+impl Shared {
+    /// Forward the events of each connection, reconnecting whenever reading fails
+    fn supervise(&self, mut events: crossbeam_channel::Receiver<events::Event>) {
+        loop {
+            // ends once the client stops polling the connection
+            let mut ended = None;
+            for event in events.iter() {
+                // held back until it is known whether the session can be restored
+                if let events::Event::SessionEnded(events::SessionEndedBody {
+                    reason: events::SessionEndReason::AdapterExited(AdapterExit::ReadFailed(_)),
+                    ..
+                }) = event
+                {
+                    ended = Some(event);
+                    continue;
+                }
+                let _ = self.events.send(event);
+            }
+
+            let exit = self.client.lock().unwrap().adapter_exit();
+            let Some(AdapterExit::ReadFailed(kind)) = exit else {
+                tracing::debug!(?exit, "connection ended, not reconnecting");
+                return;
+            };
+            tracing::warn!(?kind, "connection to adapter lost, reconnecting");
+            match self.reconnect() {
+                Ok(rx) => events = rx,
+                Err(e) => {
+                    tracing::error!(error = %e, "could not reconnect to adapter");
+                    if let Some(ended) = ended {
+                        let _ = self.events.send(ended);
+                    }
+                    return;
+                }
+            }
+        }
+    }
+
+    fn reconnect(&self) -> eyre::Result<crossbeam_channel::Receiver<events::Event>> {
+        let mut delay = self.policy.initial_delay;
+        for attempt in 1..=self.policy.max_attempts {
+            let _ = self.events.send(events::Event::Reconnecting { attempt });
+            thread::sleep(delay);
+            delay *= 2;
+
+            // events received while replaying are for the new connection, so are left in the
+            // channel to be passed on once it has been restored
+            let (tx, rx) = crossbeam_channel::unbounded();
+            let client = match (self.dial)(tx) {
+                Ok(client) => client,
+                Err(e) => {
+                    tracing::debug!(error = %e, attempt, "reconnecting failed");
+                    continue;
+                }
+            };
+            match self.restore(client) {
+                Ok(()) => {
+                    let _ = self.events.send(events::Event::Reconnected);
+                    return Ok(rx);
+                }
+                Err(e) => tracing::debug!(error = %e, attempt, "restoring session failed"),
+            }
+        }
+        eyre::bail!(
+            "could not reconnect after {} attempts",
+            self.policy.max_attempts
+        )
+    }
+
+    /// Replay the session on a new connection, and make it the current connection
+    fn restore(&self, client: Client) -> eyre::Result<()> {
+        let replay = self.replay.lock().unwrap().clone();
+
+        match replay.config() {
+            Some(mut config) => {
+                config.timeout = self.policy.replay_timeout;
+                client
+                    .configure_session(config, replay.configuration_done)
+                    .context("replaying session")?
+            }
+            // the session had not been launched yet
+            None => {
+                if let Some(initialize) = replay.initialize() {
+                    client
+                        .send_request(initialize.clone(), self.policy.replay_timeout)
+                        .context("replaying initialize request")?;
+                }
+            }
+        }
+
+        *self.client.lock().unwrap() = client;
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{
+        sync::atomic::{AtomicUsize, Ordering},
+        time::Duration,
+    };
+
+    use serde_json::{json, Value};
+
+    use crate::{
+        events,
+        mock::{MockAdapter, Reply},
+        requests,
+        types::Source,
+    };
+
+    use super::{ReconnectPolicy, ResilientClient};
+
+    fn initialize() -> requests::Initialize {
+        requests::Initialize {
+            adapter_id: "dap gui".to_string(),
+            lines_start_at_one: false,
+            path_format: requests::PathFormat::Path,
+            supports_start_debugging_request: true,
+            supports_variable_type: true,
+            supports_variable_paging: true,
+            supports_progress_reporting: true,
+            supports_memory_event: true,
+        }
+    }
+
+    #[test]
+    fn reconnect_and_replay() -> eyre::Result<()> {
+        // every connection is to a new adapter
+        let (adapters_tx, adapters_rx) = crossbeam_channel::unbounded();
+        let (events_tx, events_rx) = crossbeam_channel::unbounded();
+        let client = ResilientClient::with_dial(
+            move |events| {
+                let (client, adapter) = MockAdapter::connect(events)?;
+                adapter.enqueue("initialize", Reply::success(json!({})));
+                adapter.enqueue(
+                    "launch",
+                    Reply::success(Value::Null).event("initialized", Value::Null),
+                );
+                adapter.enqueue(
+                    "setBreakpoints",
+                    Reply::success(json!({ "breakpoints": [{ "verified": true }] })),
+                );
+                let _ = adapters_tx.send(adapter);
+                Ok(client)
+            },
+            events_tx,
+            ReconnectPolicy {
+                initial_delay: Duration::from_millis(10),
+                max_attempts: 3,
+                ..Default::default()
+            },
+        )?;
+        let first = adapters_rx.recv_timeout(Duration::from_secs(1))?;
+
+        client.send(requests::RequestBody::Initialize(initialize()))?;
+        client.execute(requests::RequestBody::Launch(requests::Launch::default()))?;
+        let event = events_rx.recv_timeout(Duration::from_secs(1))?;
+        assert!(matches!(event, events::Event::Initialized), "{event:?}");
+        client.send(requests::RequestBody::SetBreakpoints(
+            requests::SetBreakpoints {
+                source: Source {
+                    path: Some("/test.py".into()),
+                    ..Default::default()
+                },
+                lines: Some(vec![4]),
+                ..Default::default()
+            },
+        ))?;
+        client.send(requests::RequestBody::ConfigurationDone)?;
+
+        // the connection drops before this request is answered
+        first.enqueue("threads", Reply::no_response());
+        client.execute(requests::RequestBody::Threads)?;
+        while first.requests().recv_timeout(Duration::from_secs(1))?["command"] != "threads" {}
+        first.fail(std::io::ErrorKind::ConnectionReset)?;
+
+        let event = events_rx.recv_timeout(Duration::from_secs(5))?;
+        assert!(
+            matches!(event, events::Event::Reconnecting { attempt: 1 }),
+            "{event:?}"
+        );
+        let event = events_rx.recv_timeout(Duration::from_secs(5))?;
+        assert!(matches!(event, events::Event::Reconnected), "{event:?}");
+
+        let second = adapters_rx.recv_timeout(Duration::from_secs(1))?;
+        let commands: Vec<_> = second
+            .requests()
+            .try_iter()
+            .map(|request| request["command"].clone())
+            .collect();
+        assert_eq!(
+            commands,
+            [
+                "initialize",
+                "launch",
+                "setBreakpoints",
+                "configurationDone"
+            ]
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn replay_timeout() -> eyre::Result<()> {
+        // the adapter of the first reconnection never answers the initialize request
+        let dialled = AtomicUsize::new(0);
+        let (adapters_tx, adapters_rx) = crossbeam_channel::unbounded();
+        let (events_tx, events_rx) = crossbeam_channel::unbounded();
+        let client = ResilientClient::with_dial(
+            move |events| {
+                let (client, adapter) = MockAdapter::connect(events)?;
+                if dialled.fetch_add(1, Ordering::SeqCst) == 1 {
+                    adapter.enqueue("initialize", Reply::no_response());
+                }
+                adapter.enqueue(
+                    "launch",
+                    Reply::success(Value::Null).event("initialized", Value::Null),
+                );
+                let _ = adapters_tx.send(adapter);
+                Ok(client)
+            },
+            events_tx,
+            ReconnectPolicy {
+                initial_delay: Duration::from_millis(10),
+                max_attempts: 3,
+                replay_timeout: Duration::from_millis(100),
+            },
+        )?;
+        let first = adapters_rx.recv_timeout(Duration::from_secs(1))?;
+
+        client.send(requests::RequestBody::Initialize(initialize()))?;
+        client.execute(requests::RequestBody::Launch(requests::Launch::default()))?;
+        let event = events_rx.recv_timeout(Duration::from_secs(1))?;
+        assert!(matches!(event, events::Event::Initialized), "{event:?}");
+        client.send(requests::RequestBody::ConfigurationDone)?;
+        first.fail(std::io::ErrorKind::ConnectionReset)?;
+
+        let events: Vec<_> = (0..3)
+            .map(|_| events_rx.recv_timeout(Duration::from_secs(5)))
+            .collect::<Result<_, _>>()?;
+        assert!(
+            matches!(
+                events[..],
+                [
+                    events::Event::Reconnecting { attempt: 1 },
+                    events::Event::Reconnecting { attempt: 2 },
+                    events::Event::Reconnected,
+                ]
+            ),
+            "{events:?}"
+        );
+        Ok(())
+    }
+}
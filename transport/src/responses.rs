@@ -1,5 +1,5 @@
 //! Responses in reply to [`crate::requests`] from a DAP server
-use crate::types::{self, Scope, StackFrame, Thread, Variable};
+use crate::types::{self, Scope, StackFrame, Thread, Variable, VariablesReference};
 use serde::{Deserialize, Serialize};
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
@@ -8,6 +8,8 @@ pub struct Response {
     #[serde(rename = "request_seq")]
     pub request_seq: i64,
     pub success: bool,
+    /// The reason the request failed, if it was not successful
+    pub message: Option<String>,
     #[serde(flatten)]
     pub body: Option<ResponseBody>,
 }
@@ -19,17 +21,30 @@ pub enum ResponseBody {
     Initialize(Capabilities),
     SetFunctionBreakpoints(SetFunctionBreakpointsResponse),
     SetBreakpoints(SetBreakpoints),
+    SetExceptionBreakpoints(SetExceptionBreakpointsResponse),
+    DataBreakpointInfo(DataBreakpointInfoResponse),
+    SetDataBreakpoints(SetBreakpoints),
     Continue(ContinueResponse),
     Threads(ThreadsResponse),
     StackTrace(StackTraceResponse),
     Scopes(ScopesResponse),
     Variables(VariablesResponse),
+    Evaluate(EvaluateResponse),
+    Disassemble(DisassembleResponse),
+    SetVariable(SetVariableResponse),
+    ExceptionInfo(ExceptionInfoResponse),
+    RestartFrame,
+    Next,
+    StepIn,
+    StepOut,
+    Pause,
+    Restart,
     ConfigurationDone,
     Terminate,
     Disconnect,
 }
 
-#[derive(Debug, Clone, Serialize, Deserialize)]
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
 #[serde(rename_all = "camelCase")]
 pub struct Capabilities {
     pub supports_configuration_done_request: Option<bool>,
@@ -37,7 +52,7 @@ pub struct Capabilities {
     pub supports_conditional_breakpoints: Option<bool>,
     pub supports_hit_conditional_breakpoints: Option<bool>,
     pub supports_evaluate_for_hovers: Option<bool>,
-    // pub exception_breakpoint_filters: Option<Vec<ExceptionBreakpointsFilter>>,
+    pub exception_breakpoint_filters: Option<Vec<types::ExceptionBreakpointsFilter>>,
     pub supports_step_back: Option<bool>,
     pub supports_set_variable: Option<bool>,
     pub supports_restart_frame: Option<bool>,
@@ -46,7 +61,7 @@ pub struct Capabilities {
     pub supports_completions_request: Option<bool>,
     pub completion_trigger_characters: Option<Vec<String>>,
     pub supports_modules_request: Option<bool>,
-    // pub additional_module_columns: Option<Vec<ColumnDescriptor>>,
+    pub additional_module_columns: Option<Vec<types::ColumnDescriptor>>,
     // pub supported_checksum_algorithms: Option<Vec<ChecksumAlgorithm>>,
     pub supports_restart_request: Option<bool>,
     pub supports_exception_options: Option<bool>,
@@ -71,6 +86,7 @@ pub struct Capabilities {
     pub supports_instruction_breakpoints: Option<bool>,
     pub supports_exception_filter_options: Option<bool>,
     pub supports_single_thread_execution_requests: Option<bool>,
+    pub breakpoint_modes: Option<Vec<types::BreakpointMode>>,
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
@@ -85,6 +101,13 @@ pub struct SetBreakpoints {
     pub breakpoints: Vec<types::Breakpoint>,
 }
 
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct SetExceptionBreakpointsResponse {
+    /// The state of each filter, if the adapter reports them
+    pub breakpoints: Option<Vec<types::Breakpoint>>,
+}
+
 #[derive(Debug, Clone, Serialize, Deserialize)]
 #[serde(rename_all = "camelCase")]
 pub struct ContinueResponse {
@@ -114,3 +137,49 @@ pub struct ScopesResponse {
 pub struct VariablesResponse {
     pub variables: Vec<Variable>,
 }
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct DataBreakpointInfoResponse {
+    /// The id to set a data breakpoint with, or `None` if one cannot be set
+    pub data_id: Option<String>,
+    /// A description of the data, or why a data breakpoint cannot be set
+    pub description: String,
+    pub access_types: Option<Vec<types::DataBreakpointAccessType>>,
+    /// Whether the breakpoint can be set again in a later session
+    pub can_persist: Option<bool>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct SetVariableResponse {
+    /// The new value of the variable
+    pub value: String,
+    pub r#type: Option<String>,
+    pub variables_reference: Option<VariablesReference>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct ExceptionInfoResponse {
+    /// The id of the exception, e.g. its type name
+    pub exception_id: String,
+    pub description: Option<String>,
+    /// When the adapter breaks on this exception, e.g. `always` or `unhandled`
+    pub break_mode: String,
+    pub details: Option<types::ExceptionDetails>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct DisassembleResponse {
+    pub instructions: Vec<types::DisassembledInstruction>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct EvaluateResponse {
+    pub result: String,
+    pub r#type: Option<String>,
+    pub variables_reference: VariablesReference,
+}
@@ -0,0 +1,241 @@
+//! The lifecycle of a debugging session, tracked from the messages exchanged with the adapter
+//!
+//! uninitialized → initialized → configured → running ⇄ stopped → terminated
+use crate::{
+    events,
+    requests::{self, RequestBody},
+    AdapterExit,
+};
+
+/// Where the session is in its lifecycle, see [`crate::Client::state`]
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub enum SessionState {
+    /// The adapter has not yet sent the initialized event
+    #[default]
+    Uninitialized,
+    /// The adapter has sent the initialized event, so breakpoints can be configured
+    Initialized,
+    /// The configuration done request has been sent, but not yet acknowledged
+    Configured,
+    Running,
+    Stopped,
+    /// The debuggee has exited, or the adapter has ended the session
+    Terminated,
+}
+
+impl SessionState {
+    /// The state after receiving `event`
+    pub(crate) fn on_event(self, event: &events::Event) -> Self {
+        match event {
+            // also sent again when the session restarts
+            events::Event::Initialized => SessionState::Initialized,
+            events::Event::Stopped(_) => SessionState::Stopped,
+            events::Event::Continued(_) => SessionState::Running,
+            events::Event::Exited(_) | events::Event::Terminated => SessionState::Terminated,
+            _ => self,
+        }
+    }
+
+    /// Check that `body` may be sent in this state
+    pub(crate) fn check_request(self, body: &RequestBody) -> Result<(), OutOfOrderError> {
+        if matches!(body, RequestBody::ConfigurationDone) && self != SessionState::Initialized {
+            return Err(OutOfOrderError {
+                command: "configurationDone",
+                state: self,
+            });
+        }
+        Ok(())
+    }
+
+    /// The state once `body` has been written to the adapter
+    pub(crate) fn on_request(self, body: &RequestBody) -> Self {
+        match body {
+            RequestBody::ConfigurationDone if self == SessionState::Initialized => {
+                SessionState::Configured
+            }
+            RequestBody::Continue(_)
+            | RequestBody::Next(_)
+            | RequestBody::StepIn(_)
+            | RequestBody::StepOut(_)
+                if self == SessionState::Stopped =>
+            {
+                SessionState::Running
+            }
+            _ => self,
+        }
+    }
+
+    /// The state once the adapter has responded to `request`
+    pub(crate) fn on_response(self, request: &RequestBody, success: bool) -> Self {
+        match request {
+            RequestBody::ConfigurationDone if success && self == SessionState::Configured => {
+                SessionState::Running
+            }
+            _ => self,
+        }
+    }
+}
+
+/// Decides when the session is over, so [`events::Event::SessionEnded`] is sent exactly once
+/// however it ends
+///
+/// Restarting the debuggee also terminates it, but does not end the session.
+#[derive(Debug, Default)]
+pub(crate) struct SessionEnd {
+    /// The exit code from the exited event, which usually comes just before the terminated
+    /// event
+    exit_code: Option<i64>,
+    /// A restart has been requested, so the debuggee exiting and terminating is expected
+    restarting: bool,
+    ended: bool,
+}
+
+impl SessionEnd {
+    /// Note a request once it has been sent, as restarting changes what the following events
+    /// mean
+    pub(crate) fn on_request(&mut self, body: &RequestBody) {
+        if matches!(
+            body,
+            RequestBody::Restart(_)
+                | RequestBody::Terminate(requests::Terminate {
+                    restart: Some(true)
+                })
+        ) {
+            self.restarting = true;
+        }
+    }
+
+    /// The session ended event to send after `event`, if it ends the session
+    pub(crate) fn on_event(&mut self, event: &events::Event) -> Option<events::Event> {
+        match event {
+            // the debuggee being restarted
+            events::Event::Exited(_) if self.restarting => None,
+            events::Event::Exited(events::ExitedEventBody { exit_code }) => {
+                self.exit_code = Some(*exit_code);
+                None
+            }
+            events::Event::Terminated if self.restarting => {
+                self.restarting = false;
+                None
+            }
+            events::Event::Terminated => self.end(events::SessionEndReason::Terminated),
+            // the restarted debuggee is being configured, whether or not the adapter sent a
+            // terminated event for the old one
+            events::Event::Initialized => {
+                self.restarting = false;
+                None
+            }
+            _ => None,
+        }
+    }
+
+    /// The session ended event to send once the adapter has responded to `request`
+    pub(crate) fn on_response(&mut self, request: &RequestBody) -> Option<events::Event> {
+        match request {
+            RequestBody::Disconnect(_) => self.end(events::SessionEndReason::Disconnected),
+            _ => None,
+        }
+    }
+
+    /// The session ended event to send once nothing more can be read from the adapter
+    pub(crate) fn on_adapter_exit(&mut self, exit: AdapterExit) -> Option<events::Event> {
+        self.end(events::SessionEndReason::AdapterExited(exit))
+    }
+
+    fn end(&mut self, reason: events::SessionEndReason) -> Option<events::Event> {
+        if std::mem::replace(&mut self.ended, true) {
+            return None;
+        }
+        // the debuggee exiting is what ended the session, even if the adapter went on to
+        // terminate or disconnect
+        let reason = match self.exit_code {
+            Some(_) => events::SessionEndReason::Exited,
+            None => reason,
+        };
+        Some(events::Event::SessionEnded(events::SessionEndedBody {
+            reason,
+            exit_code: self.exit_code,
+        }))
+    }
+}
+
+/// A request was sent at a point in the session where the adapter does not accept it, e.g.
+/// `configurationDone` before the initialized event
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct OutOfOrderError {
+    pub command: &'static str,
+    pub state: SessionState,
+}
+
+impl std::fmt::Display for OutOfOrderError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self.state {
+            SessionState::Uninitialized => write!(
+                f,
+                "{} request sent before the initialized event",
+                self.command
+            ),
+            state => write!(f, "{} request sent in state {state:?}", self.command),
+        }
+    }
+}
+
+impl std::error::Error for OutOfOrderError {}
+
+#[cfg(test)]
+mod tests {
+    use super::{OutOfOrderError, SessionState};
+    use crate::{events, requests};
+
+    #[test]
+    fn lifecycle() -> eyre::Result<()> {
+        let stopped = events::Event::Stopped(events::StoppedEventBody {
+            reason: events::StoppedReason::Step,
+            thread_id: 1,
+            hit_breakpoint_ids: None,
+            description: None,
+            text: None,
+            all_threads_stopped: None,
+        });
+        let next = requests::RequestBody::Next(requests::Next {
+            thread_id: 1,
+            granularity: None,
+        });
+
+        let state = SessionState::default().on_event(&events::Event::Initialized);
+        assert_eq!(state, SessionState::Initialized);
+        state.check_request(&requests::RequestBody::ConfigurationDone)?;
+        let state = state.on_request(&requests::RequestBody::ConfigurationDone);
+        assert_eq!(state, SessionState::Configured);
+        let state = state.on_response(&requests::RequestBody::ConfigurationDone, true);
+        assert_eq!(state, SessionState::Running);
+        let state = state.on_event(&stopped);
+        assert_eq!(state, SessionState::Stopped);
+        state.check_request(&next)?;
+        let state = state.on_request(&next);
+        assert_eq!(state, SessionState::Running);
+        let state = state.on_event(&events::Event::Terminated);
+        assert_eq!(state, SessionState::Terminated);
+        Ok(())
+    }
+
+    #[test]
+    fn configuration_done_out_of_order() {
+        let err = SessionState::Uninitialized
+            .check_request(&requests::RequestBody::ConfigurationDone)
+            .unwrap_err();
+        assert_eq!(
+            err.to_string(),
+            "configurationDone request sent before the initialized event"
+        );
+
+        // configuration is only done once
+        assert_eq!(
+            SessionState::Configured.check_request(&requests::RequestBody::ConfigurationDone),
+            Err(OutOfOrderError {
+                command: "configurationDone",
+                state: SessionState::Configured
+            })
+        );
+    }
+}
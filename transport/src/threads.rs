@@ -0,0 +1,180 @@
+//! Which threads of the debuggee are stopped, tracked from the messages exchanged with the
+//! adapter
+use std::collections::HashSet;
+
+use crate::{events, requests::RequestBody, responses, types::ThreadId};
+
+#[derive(Debug, Default)]
+pub(crate) struct ThreadStates {
+    /// Threads the adapter has told us about
+    known: HashSet<ThreadId>,
+    stopped: HashSet<ThreadId>,
+    /// The adapter reported that every thread stopped, including any we do not know about
+    all_stopped: bool,
+}
+
+impl ThreadStates {
+    pub(crate) fn is_stopped(&self, thread_id: ThreadId) -> bool {
+        self.all_stopped || self.stopped.contains(&thread_id)
+    }
+
+    /// The stopped threads, in order of their ids
+    pub(crate) fn stopped(&self) -> Vec<ThreadId> {
+        let mut stopped: Vec<_> = self.stopped.iter().copied().collect();
+        stopped.sort_unstable();
+        stopped
+    }
+
+    /// Record the threads listed in a threads response
+    pub(crate) fn add_known(&mut self, threads: impl IntoIterator<Item = ThreadId>) {
+        self.known.extend(threads);
+    }
+
+    pub(crate) fn on_event(&mut self, event: &events::Event) {
+        match event {
+            events::Event::Stopped(events::StoppedEventBody {
+                thread_id,
+                all_threads_stopped,
+                ..
+            }) => {
+                self.known.insert(*thread_id);
+                if *all_threads_stopped == Some(true) {
+                    self.stopped = self.known.clone();
+                    self.all_stopped = true;
+                } else {
+                    self.stopped.insert(*thread_id);
+                }
+            }
+            // all threads continued unless the adapter says otherwise
+            events::Event::Continued(events::ContinuedEventBody {
+                thread_id,
+                all_threads_continued,
+            }) => self.resume((*all_threads_continued == Some(false)).then_some(*thread_id)),
+            events::Event::Thread(events::ThreadEventBody { reason, thread_id }) => {
+                match reason.as_str() {
+                    "started" => {
+                        self.known.insert(*thread_id);
+                    }
+                    "exited" => {
+                        self.known.remove(thread_id);
+                        self.stopped.remove(thread_id);
+                    }
+                    _ => {}
+                }
+            }
+            events::Event::Exited(_) | events::Event::Terminated => {
+                *self = ThreadStates::default();
+            }
+            _ => {}
+        }
+    }
+
+    /// Record that `body` resumes threads, since not every adapter sends continued events
+    pub(crate) fn on_request(&mut self, body: &RequestBody) {
+        match body {
+            RequestBody::Continue(continue_) => {
+                self.resume(continue_.single_thread.then_some(continue_.thread_id))
+            }
+            // stepping resumes every thread while the step runs
+            RequestBody::Next(_) | RequestBody::StepIn(_) | RequestBody::StepOut(_) => {
+                self.resume(None)
+            }
+            _ => {}
+        }
+    }
+
+    /// Record the threads a response says were resumed, which may be more than were asked for,
+    /// e.g. when an adapter ignores `singleThread` in a continue request
+    pub(crate) fn on_response(&mut self, body: &responses::ResponseBody) {
+        // all threads continued unless the adapter says otherwise
+        if let responses::ResponseBody::Continue(responses::ContinueResponse {
+            all_threads_continued,
+        }) = body
+        {
+            if *all_threads_continued != Some(false) {
+                self.resume(None);
+            }
+        }
+    }
+
+    /// Mark `thread_id` as running, or every thread if `None`
+    fn resume(&mut self, thread_id: Option<ThreadId>) {
+        match thread_id {
+            Some(thread_id) => {
+                self.stopped.remove(&thread_id);
+            }
+            None => self.stopped.clear(),
+        }
+        self.all_stopped = false;
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::ThreadStates;
+    use crate::{events, requests, responses};
+
+    fn stopped(thread_id: i64, all_threads_stopped: bool) -> events::Event {
+        events::Event::Stopped(events::StoppedEventBody {
+            reason: events::StoppedReason::Other("breakpoint".to_string()),
+            thread_id,
+            hit_breakpoint_ids: None,
+            description: None,
+            text: None,
+            all_threads_stopped: Some(all_threads_stopped),
+        })
+    }
+
+    #[test]
+    fn individual_threads() {
+        let mut threads = ThreadStates::default();
+        threads.add_known([1, 2, 3]);
+
+        threads.on_event(&stopped(1, false));
+        threads.on_event(&stopped(3, false));
+        assert!(threads.is_stopped(1));
+        assert!(!threads.is_stopped(2));
+        assert!(threads.is_stopped(3));
+        assert_eq!(threads.stopped(), [1, 3]);
+
+        threads.on_event(&events::Event::Continued(events::ContinuedEventBody {
+            thread_id: 1,
+            all_threads_continued: Some(false),
+        }));
+        assert!(!threads.is_stopped(1));
+        assert!(threads.is_stopped(3));
+    }
+
+    #[test]
+    fn all_threads() {
+        let mut threads = ThreadStates::default();
+        threads.add_known([1, 2]);
+
+        threads.on_event(&stopped(1, true));
+        assert!(threads.is_stopped(2));
+        assert_eq!(threads.stopped(), [1, 2]);
+
+        // only the continued thread resumes
+        threads.on_request(&requests::RequestBody::Continue(requests::Continue {
+            thread_id: 1,
+            single_thread: true,
+        }));
+        assert!(!threads.is_stopped(1));
+        assert!(threads.is_stopped(2));
+
+        // an adapter which ignores `singleThread` resumes every thread
+        threads.on_response(&responses::ResponseBody::Continue(
+            responses::ContinueResponse {
+                all_threads_continued: Some(true),
+            },
+        ));
+        assert!(threads.stopped().is_empty());
+        threads.on_event(&stopped(2, false));
+
+        threads.on_request(&requests::RequestBody::Next(requests::Next {
+            thread_id: 2,
+            granularity: None,
+        }));
+        assert!(!threads.is_stopped(2));
+    }
+}
@@ -86,6 +86,29 @@ pub struct Breakpoint {
     pub offset: Option<i64>,
 }
 
+/// How a data breakpoint is triggered by accesses to its data
+#[derive(Serialize, Deserialize, Debug, Clone, Copy, PartialEq, Eq)]
+#[serde(rename_all = "camelCase")]
+pub enum DataBreakpointAccessType {
+    Read,
+    Write,
+    ReadWrite,
+}
+
+/// A breakpoint which stops when data is accessed, e.g. a watchpoint on a variable
+#[derive(Serialize, Deserialize, Debug, Clone)]
+#[serde(rename_all = "camelCase")]
+pub struct DataBreakpoint {
+    /// The id of the data, from a data breakpoint info request
+    pub data_id: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub access_type: Option<DataBreakpointAccessType>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub condition: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub hit_condition: Option<String>,
+}
+
 #[derive(Default, Serialize, Deserialize, Debug, Clone)]
 #[serde(rename_all = "camelCase")]
 pub struct SourceBreakpoint {
@@ -111,6 +134,8 @@ pub struct SourceBreakpoint {
     /// either `hitCondition` or `condition` is specified, then the message should only be logged
     /// if those conditions are met.
     pub log_message: Option<String>,
+    /// The mode of this breakpoint, one of the `breakpointModes` advertised by the adapter.
+    pub mode: Option<String>,
 }
 
 #[derive(Serialize, Deserialize, Debug, Clone)]
@@ -123,9 +148,32 @@ pub struct StackFrame {
     pub column: isize,
     pub end_line: Option<usize>,
     pub end_column: Option<usize>,
+    /// Whether the frame can be restarted with a `restartFrame` request, `true` if absent
     pub can_restart: Option<bool>,
     pub module_id: Option<ModuleId>,
     pub presentation_hint: Option<String>,
+    /// A memory reference for the current instruction pointer in this frame
+    pub instruction_pointer_reference: Option<String>,
+}
+
+/// A single instruction returned by a `disassemble` request
+#[derive(Serialize, Deserialize, Debug, Clone)]
+#[serde(rename_all = "camelCase")]
+pub struct DisassembledInstruction {
+    /// The address of the instruction, as a hex string
+    pub address: String,
+    pub instruction_bytes: Option<String>,
+    /// Text representing the instruction and its operands
+    pub instruction: String,
+    /// The name of the symbol corresponding to the address, e.g. the function name
+    pub symbol: Option<String>,
+    pub location: Option<Source>,
+    pub line: Option<usize>,
+    pub column: Option<usize>,
+    pub end_line: Option<usize>,
+    pub end_column: Option<usize>,
+    /// `invalid` if the adapter could not disassemble this address
+    pub presentation_hint: Option<String>,
 }
 
 #[derive(Serialize, Deserialize, Debug, Clone)]
@@ -145,6 +193,10 @@ pub struct Variable {
     pub r#type: Option<String>,
     pub variables_reference: VariablesReference,
     pub presentation_hint: Option<VariablePresentationHint>,
+    /// An expression which evaluates to the variable, e.g. `point.x`
+    pub evaluate_name: Option<String>,
+    /// A reference to the memory holding the variable, for viewing its raw bytes
+    pub memory_reference: Option<String>,
 }
 
 #[derive(Serialize, Deserialize, Debug, Clone)]
@@ -159,3 +211,69 @@ pub struct Module {
     pub name: String,
     pub path: Option<PathBuf>,
 }
+
+/// A kind of exception the adapter can break on, e.g. uncaught exceptions
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq, Eq)]
+#[serde(rename_all = "camelCase")]
+pub struct ExceptionBreakpointsFilter {
+    /// The id of the filter, sent in a set exception breakpoints request
+    pub filter: String,
+    /// The name of the filter, to show to the user
+    pub label: String,
+    pub description: Option<String>,
+    /// Whether the filter should be enabled by default
+    pub default: Option<bool>,
+    pub supports_condition: Option<bool>,
+    pub condition_description: Option<String>,
+}
+
+/// Details of an exception, from an exception info request
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq, Eq)]
+#[serde(rename_all = "camelCase")]
+pub struct ExceptionDetails {
+    pub message: Option<String>,
+    pub type_name: Option<String>,
+    pub full_type_name: Option<String>,
+    /// An expression which evaluates to the exception object
+    pub evaluate_name: Option<String>,
+    /// The stack trace at the time the exception was thrown, formatted by the adapter
+    pub stack_trace: Option<String>,
+    /// Exceptions which caused this one, e.g. a Python `__cause__`
+    pub inner_exception: Option<Vec<ExceptionDetails>>,
+}
+
+/// An extra column an adapter wants shown in a modules view
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq, Eq)]
+#[serde(rename_all = "camelCase")]
+pub struct ColumnDescriptor {
+    /// The name of the module attribute to show in the column
+    pub attribute_name: String,
+    pub label: String,
+    /// Format to use for the column values, e.g. `{0}%`
+    pub format: Option<String>,
+    pub r#type: Option<ColumnDescriptorType>,
+    /// Width of the column in characters
+    pub width: Option<i64>,
+}
+
+#[derive(Serialize, Deserialize, Debug, Clone, Copy, PartialEq, Eq)]
+#[serde(rename_all = "camelCase")]
+pub enum ColumnDescriptorType {
+    String,
+    Number,
+    Boolean,
+    #[serde(rename = "unixTimestampUTC")]
+    UnixTimestampUtc,
+}
+
+/// A mode breakpoints can be set with, e.g. hardware or software breakpoints
+#[derive(Serialize, Deserialize, Debug, Clone)]
+#[serde(rename_all = "camelCase")]
+pub struct BreakpointMode {
+    /// The identifier sent in the `mode` of a breakpoint
+    pub mode: String,
+    pub label: String,
+    pub description: Option<String>,
+    /// The kinds of breakpoint this mode applies to, e.g. `source` or `data`
+    pub applies_to: Vec<String>,
+}
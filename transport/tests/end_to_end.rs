@@ -69,6 +69,7 @@ fn test_loop() -> Result<()> {
     client
         .execute(requests::RequestBody::Launch(Launch {
             program: PathBuf::from("./test.py"),
+            no_debug: None,
             launch_arguments: Some(LaunchArguments::Debugpy(DebugpyLaunchArguments {
                 just_my_code: true,
                 // console: "integratedTerminal".to_string(),
@@ -144,10 +145,14 @@ fn test_loop() -> Result<()> {
             unreachable!()
         };
 
-        // variables
-        for scope in scopes {
+        // variables, skipping scopes without any
+        for scope in scopes
+            .into_iter()
+            .filter(|scope| scope.variables_reference > 0)
+        {
             let req = requests::RequestBody::Variables(requests::Variables {
                 variables_reference: scope.variables_reference,
+                format: None,
             });
 
             let _ = client.send(req).unwrap();
@@ -179,6 +184,7 @@ fn test_loop() -> Result<()> {
     // disconnect
     let req = requests::RequestBody::Disconnect(requests::Disconnect {
         terminate_debugee: true,
+        suspend_debuggee: None,
     });
     let _ = client.send(req).unwrap();
     Ok(())